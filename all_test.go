@@ -2,12 +2,24 @@ package ogdl
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 // path.go
@@ -29,6 +41,138 @@ func TestPath2(t *testing.T) {
 	}
 }
 
+func TestPath_QuotedKeys(t *testing.T) {
+
+	g := NilGraph()
+	c := g.Add("config")
+	keys := []string{"example.com", "my host", "a[0]", "x{1}", "f(x)", "1", `C:\dir\`, `say "hi"`}
+	for i, k := range keys {
+		c.Add(k).Add("port").Add(strconv.Itoa(8000 + i))
+	}
+	c.Add("list").Add("first")
+
+	tests := []struct{ path, want string }{
+		{`config."example.com".port`, "8000"},
+		{`config.'example.com'.port`, "8000"},
+		{`config["example.com"].port`, "8000"},
+		{`config[ 'example.com' ].port`, "8000"},
+		{`config."my host".port`, "8001"},
+		{`config["my host"].port`, "8001"},
+		{`config."a[0]".port`, "8002"},
+		{`config["a[0]"].port`, "8002"},
+		{`config."x{1}".port`, "8003"},
+		{`config."f(x)".port`, "8004"},
+		{`config["1"].port`, "8005"},
+		{"config.`C:\\dir\\`.port", "8006"},
+		{`config.'say "hi"'.port`, "8007"},
+		// Numbers in brackets are positions
+		{`config[1].port`, "8001"},
+	}
+	for _, test := range tests {
+		if n := g.Get(test.path); n == nil || n.String() != test.want {
+			t.Errorf("Get %s: %v", test.path, n)
+		}
+		if s := string(NewTemplate("${" + test.path + "}").Process(g)); s != test.want {
+			t.Errorf("template %s: %q", test.path, s)
+		}
+	}
+
+	// Canonical paths quote keys, and can be read back
+	for _, k := range keys {
+		n := c.Node(k).Node("port")
+		p, ok := g.PathFromRoot(n)
+		if !ok || g.Get(p).String() != n.GetAt(0).String() {
+			t.Errorf("%q: path %s", k, p)
+		}
+	}
+
+	// Set and Remove
+	g.Set(`config["example.com"].port`, 443)
+	if n, _ := g.GetInt64(`config."example.com".port`); n != 443 {
+		t.Error("Set:", g.Node("config").Text())
+	}
+	g.Set(`config["new.host"].port`, 1)
+	if c.Node("new.host") == nil {
+		t.Error("Set new key:", c.Text())
+	}
+	if err := g.Remove(`config["my host"]`); err != nil || c.Node("my host") != nil {
+		t.Error("Remove:", err)
+	}
+}
+
+func TestPath_Wildcard(t *testing.T) {
+
+	p := NewPath("servers.*.port")
+	if p.Len() != 3 || p.Out[1].String() != TypeAny || pathString(p) != "servers.*.port" {
+		t.Error("NewPath:", p.Text())
+	}
+	if p = NewPath("*[1]"); p.Len() != 2 || p.Out[0].String() != TypeAny || pathString(p) != "*[1]" {
+		t.Error("NewPath:", p.Text())
+	}
+	// A quoted * is a key
+	if p = NewPath(`a."*"`); p.Out[1].String() != "*" {
+		t.Error("quoted *:", p.Text())
+	}
+
+	g := ParseString(`servers
+  web
+    host a
+    port 80
+  db
+    host b
+  api
+    port 8080
+    port 9
+  "x y"
+    port 7`)
+
+	// All matches, in order
+	get := []struct{ path, want string }{
+		{"servers.*.port", "80\n8080\n7"},
+		{"servers.*.host", "a\nb"},
+		{"*.*.host", "a\nb"},
+		{"servers.*[0]", "host\n  a\nhost\n  b\nport\n  8080\nport\n  7"},
+		{"servers.*", "host\n  a\nport\n  80\nhost\n  b\nport\n  8080\nport\n  9\nport\n  7"},
+		// A single one is returned as is
+		{"servers.db.*", "b"},
+	}
+	for _, test := range get {
+		if s := g.Get(test.path).Text(); s != test.want {
+			t.Errorf("Get %s: %q", test.path, s)
+		}
+		v := g.EvalPath(NewPath(test.path))
+		if r, ok := v.(*Graph); !ok && _string(v) != test.want || ok && r.Text() != test.want {
+			t.Errorf("EvalPath %s: %v", test.path, v)
+		}
+	}
+
+	// The matches are the nodes of the graph
+	r := g.Get("servers.*.port")
+	if r.Len() != 3 || r.Out[1] != g.Get("servers.api.port") {
+		t.Error("Get returns copies:", r.Text())
+	}
+
+	if n := g.Get("servers.*.nope"); n != nil {
+		t.Error("Get of no match:", n.Text())
+	}
+	if _, err := NewTemplate("$servers.*.nope").ProcessE(g); !errors.Is(err, ErrNotFound) {
+		t.Error("no match is not ErrNotFound:", err)
+	}
+
+	tpl := NewTemplate("$for(p,servers.*.port)<$p>$end $servers.*.host")
+	if b, err := tpl.ProcessE(g); err != nil || string(b) != "<80><8080><7> a\nb" {
+		t.Errorf("template: %q %v", b, err)
+	}
+
+	// Paths that address a single node don't accept *
+	if g.Set("servers.*.port", 1) == nil || g.Remove("servers.*.port") == nil {
+		t.Error("Set or Remove with *")
+	}
+	if g.Get("servers.web.port").String() != "80" || g.Node("servers").Node("!*") != nil {
+		t.Error("Set with * changed the graph:", g.Text())
+	}
+}
+
 // binary.go
 
 func TestBinParser1(t *testing.T) {
@@ -170,6 +314,256 @@ func TestBinParser4(t *testing.T) {
 	}
 }
 
+func TestWriteBinary(t *testing.T) {
+
+	for _, s := range []string{"a", "a b, c, d", "a\n  b\n    c\n  'd e'", ""} {
+		g := ParseString(s)
+
+		buf := &bytes.Buffer{}
+		n, err := g.WriteBinary(buf)
+		if err != nil || n != buf.Len() {
+			t.Error("WriteBinary:", n, err)
+		}
+		if !bytes.Equal(buf.Bytes(), g.Binary()) {
+			t.Errorf("WriteBinary(%q) = %v, Binary() = %v", s, buf.Bytes(), g.Binary())
+		}
+	}
+
+	var g *Graph
+	if n, err := g.WriteBinary(&bytes.Buffer{}); n != 0 || err != nil {
+		t.Error("nil graph")
+	}
+}
+
+func TestBinParser_Skip(t *testing.T) {
+
+	g1 := ParseString("a b, c")
+	g2 := ParseString("x\n  y\n    z")
+
+	buf := &bytes.Buffer{}
+	buf.Write(g1.Binary())
+	buf.Write(g2.Binary())
+	buf.Write(g1.Binary())
+	b := buf.Bytes()
+
+	p := NewBytesBinParser(b)
+	var pos int64
+	for _, g := range []*Graph{g1, g2, g1} {
+		n, err := p.Skip()
+		if err != nil || n != int64(len(g.Binary())) {
+			t.Fatal("Skip:", n, err)
+		}
+		pos += n
+
+		// pos is a record boundary
+		if pos < int64(len(b)) && !BinParse(b[pos:]).Equal(g1) && !BinParse(b[pos:]).Equal(g2) {
+			t.Error("Skip didn't land at a record boundary:", pos)
+		}
+	}
+
+	if n, err := p.Skip(); n != 0 || err != io.EOF {
+		t.Error("Skip at end:", n, err)
+	}
+
+	// Truncated objects
+	for _, cut := range []int{1, 4, len(g2.Binary()) - 1} {
+		p = NewBytesBinParser(g2.Binary()[:cut])
+		if _, err := p.Skip(); err != io.ErrUnexpectedEOF {
+			t.Error("truncated object:", cut, err)
+		}
+	}
+
+	p = NewBytesBinParser([]byte("xyz"))
+	if _, err := p.Skip(); !errors.Is(err, ErrInvalidBinary) {
+		t.Error("expected header error:", err)
+	}
+}
+
+func TestBinParser_Invalid(t *testing.T) {
+
+	tests := []struct {
+		in  []byte
+		err error
+	}{
+		{[]byte{1, 'G', 0, 1, 'a', 0, 0}, nil},
+		{[]byte{}, io.EOF},
+		{[]byte{1, 'H', 0, 1, 'a', 0, 0}, ErrInvalidBinary},
+		{[]byte{1, 'G'}, io.ErrUnexpectedEOF},
+		{[]byte{1, 'G', 0, 1, 'a'}, io.ErrUnexpectedEOF},
+		// First level not 1, level jump
+		{[]byte{1, 'G', 0, 2, 'a', 0, 0}, ErrInvalidBinary},
+		{[]byte{1, 'G', 0, 1, 'a', 0, 3, 'b', 0, 0}, ErrInvalidBinary},
+		{[]byte{1, 'G', 0, 0xef, 0xff, 0xff, 0xff, 'a', 0, 0}, ErrInvalidBinary},
+		// Invalid varint
+		{[]byte{1, 'G', 0, 0xf0, 'a', 0, 0}, ErrInvalidBinary},
+		// Binary node longer than the input
+		{[]byte{1, 'G', 0, 1, 1, 0xef, 0xff, 0xff, 0xff, 'a', 0, 0}, ErrInvalidBinary},
+		{[]byte{1, 'G', 0, 1, 1, 5, 'a', 0, 0}, ErrInvalidBinary},
+		{[]byte{1, 'G', 0, 1, 1, 0xf8, 0}, ErrInvalidBinary},
+	}
+
+	for _, test := range tests {
+		_, err := NewBytesBinParser(test.in).ParseE()
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("ParseE(%v): %v, want %v", test.in, err, test.err)
+		}
+		_, err = NewBytesBinParser(test.in).Skip()
+		if !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("Skip(%v): %v, want %v", test.in, err, test.err)
+		}
+	}
+
+	// The same from a stream, whose length is unknown
+	_, err := NewBinParser(bytes.NewReader([]byte{1, 'G', 0, 1, 1, 5, 'a', 0, 0})).ParseE()
+	if err != io.ErrUnexpectedEOF {
+		t.Error("stream:", err)
+	}
+}
+
+func TestBinary_Typed(t *testing.T) {
+
+	now := time.Date(2014, 3, 1, 12, 30, 0, 500, time.FixedZone("X", 3600))
+
+	for _, c := range []struct {
+		in, out interface{}
+	}{
+		{int64(0), int64(0)},
+		{int64(-1), int64(-1)},
+		{int64(math.MaxInt64), int64(math.MaxInt64)},
+		{int64(math.MinInt64), int64(math.MinInt64)},
+		{42, int64(42)},
+		{int8(-5), int64(-5)},
+		{uint32(7), int64(7)},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+		{1.5, 1.5},
+		{float32(0.25), 0.25},
+		{math.Inf(-1), math.Inf(-1)},
+		{true, true},
+		{false, false},
+		{[]byte{0, 1, 2, 255}, []byte{0, 1, 2, 255}},
+		{"text", "text"},
+		{"\x02\x07 control", "\x02\x07 control"},
+	} {
+		g := NilGraph()
+		g.Add("v").Add(c.in).Add("below")
+
+		b := g.Binary()
+		var buf bytes.Buffer
+		g.WriteBinary(&buf)
+		if !bytes.Equal(b, buf.Bytes()) || len(b) != 4+g.binLen(1) {
+			t.Errorf("%T %v: Binary and WriteBinary differ", c.in, c.in)
+		}
+
+		r, err := NewBytesBinParser(b).ParseE()
+		if err != nil {
+			t.Errorf("%T %v: %v", c.in, c.in, err)
+			continue
+		}
+		v := r.Node("v").GetAt(0)
+		if !reflect.DeepEqual(v.This, c.out) || v.GetAt(0).String() != "below" {
+			t.Errorf("%T %v: decoded as %T %v", c.in, c.in, v.This, v.This)
+		}
+		if v.String() != _string(c.out) {
+			t.Errorf("%T %v: String() is %q", c.in, c.in, v.String())
+		}
+	}
+
+	// Times keep the instant and the zone offset
+	g := NilGraph()
+	g.Add("t").Add(now)
+	v := BinParse(g.Binary()).Node("t").GetAt(0)
+	if tm, ok := v.This.(time.Time); !ok || !tm.Equal(now) {
+		t.Error("time:", v.This)
+	} else if _, off := tm.Zone(); off != 3600 {
+		t.Error("time zone offset:", off)
+	}
+
+	// Typed nodes are smaller than text
+	g = NilGraph()
+	g.Add(int64(1234567890123))
+	if len(g.Binary()) >= len(ParseString("1234567890123").Binary()) {
+		t.Error("int64 not compact")
+	}
+
+	// Streams with only text decode as before
+	old := []byte{1, 'G', 0, 1, 'a', 0, 2, '1', '2', 0, 0}
+	if g := BinParse(old); g.Get("a").String() != "12" {
+		t.Error("text stream:", g.Text())
+	}
+
+	// Reserved tags and bad values are rejected
+	for _, b := range [][]byte{
+		{1, 'G', 0, 1, 0x07, 0, 0},
+		{1, 'G', 0, 1, 0x08, 'x', 0, 0},
+		{1, 'G', 0, 1, binBool, 2, 0},
+		{1, 'G', 0, 1, binTime, 1, 9, 0},
+	} {
+		if _, err := NewBytesBinParser(b).ParseE(); !errors.Is(err, ErrInvalidBinary) {
+			t.Errorf("% x: %v", b, err)
+		}
+	}
+	if _, err := NewBytesBinParser([]byte{1, 'G', 0, 1, binFloat, 1, 2}).ParseE(); err != io.ErrUnexpectedEOF {
+		t.Error("truncated float:", err)
+	}
+
+	// A Log record with values of all types
+	log, err := OpenLog(t.TempDir() + "/typed.gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	rec := NilGraph()
+	rec.Add("id").Add(int64(7))
+	rec.Add("price").Add(9.95)
+	rec.Add("paid").Add(true)
+	rec.Add("at").Add(now.UTC())
+	rec.Add("sig").Add([]byte{0xde, 0xad})
+	rec.Add("name").Add("box")
+	p := log.Add(rec)
+	log.Add(ParseString("next"))
+
+	r, next, err := log.Read(p)
+	if err != nil || r.Len() != rec.Len() {
+		t.Fatal("log record:", err)
+	}
+	for _, k := range []string{"id", "price", "paid", "at", "sig", "name"} {
+		if !reflect.DeepEqual(r.Node(k).GetAt(0).This, rec.Node(k).GetAt(0).This) {
+			t.Errorf("%s: %T %v", k, r.Node(k).GetAt(0).This, r.Node(k).GetAt(0).This)
+		}
+	}
+	if g, _, err := log.Read(next); err != nil || g.Node("next") == nil {
+		t.Error("next record:", err)
+	}
+	if n, err := log.Count(); n != 2 || err != nil {
+		t.Error("Count:", n, err)
+	}
+}
+
+func FuzzBinParser(f *testing.F) {
+
+	for _, s := range []string{"a", "a b, c, d", "a\n  b\n    c\n  'd e'"} {
+		f.Add(ParseString(s).Binary())
+	}
+	f.Add([]byte{1, 'G', 0, 1, 1, 1, 0x55, 0, 0})
+	f.Add(append(ParseString("a").Binary(), ParseString("b c").Binary()...))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p := NewBytesBinParser(b)
+		for i := 0; i <= len(b); i++ {
+			if _, err := p.ParseE(); err != nil {
+				break
+			}
+		}
+		p = NewBytesBinParser(b)
+		for i := 0; i <= len(b); i++ {
+			if _, err := p.Skip(); err != nil {
+				break
+			}
+		}
+	})
+}
+
 // parser.go
 
 func TestParser0(t *testing.T) {
@@ -280,1037 +674,7035 @@ func TestBlockPrint(t *testing.T) {
 	}
 }
 
-// Comments
-
-func TestComment(t *testing.T) {
+// Tab width
+
+func TestTabWidth(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		src   string
+		width int
+		want  string // "" if an error is expected
+	}{
+		{"spaces", "a\n  b\n    c\n  d\ne", 0, "a\n  b\n    c\n  d\ne\n"},
+		{"tabs", "a\n\tb\n\t\tc\n\td\ne", 0, "a\n  b\n    c\n  d\ne\n"},
+		{"tabs and block", "a\n\tb\n\t\tc\n\td\ne \\\n\tblock\nf", 0, "a\n  b\n    c\n  d\ne\n  block\nf\n"},
+		{"mixed", "a\n    b\n\tc\n\t    d\n  \t  e", 0, "a\n  b\n  c\n    d\n    e\n"},
+		{"mixed width 8", "a\n        b\n\tc\n\t\td", 8, "a\n  b\n  c\n    d\n"},
+		{"mixed width 1", "a\n  b\n\t\tc\n\t d", 1, "a\n  b\n  c\n  d\n"},
+		{"tab deeper", "a\n  b\n\tc", 0, "a\n  b\n    c\n"},
+		{"first line indented", "  a\nb", 0, "a\nb\n"},
+
+		// Going back to an indentation that no open level has
+		{"ambiguous", "a\n    b\n  c", 0, ""},
+		{"ambiguous tabs", "a\n\t\tb\n\tc", 0, ""},
+		{"ambiguous mixed", "a\n\tb\n\t\tc\n  d", 0, ""},
+		{"ambiguous inline", "a b\n    c\n  d", 0, ""},
+	}
+
+	for _, test := range tests {
+		p := NewStringParser(test.src)
+		if test.width != 0 {
+			p.TabWidth = test.width
+		}
+		err := p.Ogdl()
 
-	g := ParseString("#comment")
-	if g.Text() != "" {
-		t.Error("comment 1:", g.Text())
+		if test.want == "" {
+			if err == nil || !strings.Contains(err.Error(), "indentation") {
+				t.Errorf("%s: expected an indentation error, got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if s := p.Graph().Format(nil); s != test.want {
+			t.Errorf("%s:\n%s", test.name, s)
+		}
 	}
 
-	g = ParseString("#comment\nnot#acomment")
-	if g.Text() != "not#acomment" {
-		t.Error("comment 2:", g.Text())
+	// The error has the line number
+	p := NewStringParser("a\n    b\n    c\n  d\ne")
+	if err := p.Ogdl(); err == nil || err.Error() != "inconsistent indentation at line 4" {
+		t.Error("error line:", err)
 	}
 }
 
-// Other parser tests
+// Parser reuse
 
-func TestUnread(t *testing.T) {
+func TestFromReader(t *testing.T) {
 
-	p := NewStringParser("ab")
+	text := "\xef\xbb\xbfa\n  b 1\n  c 'x y'\nd\n"
+	want := ParseString(text[3:]).Text()
 
-	c := p.Read()
-	if c != 'a' {
-		t.Fatal("read failed: a")
-	}
-	p.Unread()
-	c = p.Read()
-	if c != 'a' {
-		t.Fatal("Unread failed: a")
-	}
-	c = p.Read()
-	if c != 'b' {
-		t.Fatal("read failed: b")
-	}
-	c = p.Read()
-	if c != 0 {
-		t.Fatal("read failed: EOS")
+	g, err := FromString(text)
+	if err != nil || g.Text() != want {
+		t.Error("FromString:", g.Text(), err)
 	}
 
-	p.Unread()
-	p.Unread()
-	c = p.Read()
-	if c != 'b' {
-		t.Fatal("Unread failed: b")
-	}
-	c = p.Read()
-	if c != 0 {
-		t.Fatal("read failed: EOS")
-	}
-	c = p.Read()
-	if c != 0 {
-		t.Fatal("read failed: EOS")
+	g, err = FromReader(bytes.NewReader([]byte(text)))
+	if err != nil || g.Text() != want {
+		t.Error("bytes.Reader:", g.Text(), err)
 	}
-}
 
-// chars.go
-// Character classes. Samples.
-
-func TestChars(t *testing.T) {
-	if !IsSpaceChar(' ') {
-		t.Error("Error in character class")
+	g, err = FromReader(iotest.OneByteReader(strings.NewReader(text)))
+	if err != nil || g.Text() != want {
+		t.Error("one byte per Read:", g.Text(), err)
 	}
 
-	if !IsBreakChar('\n') {
-		t.Error("Error in character class")
+	dir := t.TempDir()
+	os.WriteFile(dir+"/a.g", []byte(text), 0644)
+	g, err = FromFile(dir + "/a.g")
+	if err != nil || g.Text() != want {
+		t.Error("FromFile:", g.Text(), err)
 	}
 
-	if !IsBreakChar('\r') {
-		t.Error("Error in character class")
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write([]byte(text))
+	z.Close()
+	os.WriteFile(dir+"/a.g.gz", buf.Bytes(), 0644)
+	g, err = FromFile(dir + "/a.g.gz")
+	if err != nil || g.Text() != want {
+		t.Error("gzip file:", g.Text(), err)
 	}
 
-	if !IsSpaceChar('\t') {
-		t.Error("Error in character class")
+	if _, err = FromFile(dir + "/none.g"); !os.IsNotExist(err) {
+		t.Error("missing file:", err)
 	}
 
-	if IsSpaceChar('a') {
-		t.Error("Error in character class")
+	// Empty inputs are valid
+	for _, s := range []string{"", "\xef\xbb\xbf"} {
+		g, err = FromString(s)
+		if err != nil || g == nil || !g.IsNil() || g.Len() != 0 {
+			t.Errorf("empty input %q: %v %v", s, g, err)
+		}
 	}
 
-	if IsTextChar('(') {
-		t.Error("Error in character class")
+	// Read and syntax errors
+	bad := errors.New("bad disk")
+	if _, err = FromReader(io.MultiReader(strings.NewReader("a b\n"), iotest.ErrReader(bad))); err != bad {
+		t.Error("read error:", err)
 	}
-
-	if IsTextChar('\t') {
-		t.Error("Error in character class")
+	if _, err = FromString("a b c d e"); err != nil {
+		t.Error("valid input:", err)
 	}
-
-	if !IsTextChar('_') {
-		t.Error("Error in character class")
+	if _, err = FromString("a 'b"); err == nil {
+		t.Error("unterminated quote: no error")
 	}
+}
 
-	if !IsDigit('1') {
-		t.Error("Error in character class")
-	}
+func TestParser_Reset(t *testing.T) {
 
-	if IsDigit('x') {
-		t.Error("Error in character class")
+	inputs := []string{
+		"a\n  b\n    c\n  d",
+		"x 'quoted\n   string'",
+		"\n\n1 2\n3",
 	}
 
-	if IsDigit(-1) {
-		t.Error("Error in character class")
-	}
+	p := NewStringParser("")
+	p.TabWidth = 4
+	var graphs []*Graph
 
-	if IsLetter('1') {
-		t.Error("Error in character class")
+	for _, s := range inputs {
+		p.Reset(s)
+		if err := p.Ogdl(); err != nil {
+			t.Fatal(err)
+		}
+		graphs = append(graphs, p.Graph())
 	}
 
-	if IsLetter(-1) {
-		t.Error("Error in character class")
+	for i, s := range inputs {
+		if !graphs[i].Equal(ParseString(s)) {
+			t.Errorf("input %d:\n%s", i, graphs[i].Text())
+		}
 	}
 
-	if !IsEndChar(0) {
-		t.Error("Error in character class")
+	if p.TabWidth != 4 {
+		t.Error("Reset changed settings")
 	}
 
-	if IsEndChar('\t') {
-		t.Error("Error in character class")
+	// Errors and line numbers don't carry over
+	p.Reset("a\n(b")
+	if p.Ogdl() == nil {
+		t.Error("expected error")
 	}
-
-	if IsOperatorChar(-1) {
-		t.Error("Error in character class")
+	p.Reset("a")
+	if err := p.Ogdl(); err != nil || p.Graph().Text() != "a" {
+		t.Error("parse after error:", err)
 	}
+}
 
-	if !IsOperatorChar('>') {
-		t.Error("Error in character class")
+func TestParser_Intern(t *testing.T) {
+
+	src, err := os.ReadFile("testdata/catalog.ogdl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []string{
+		string(src),
+		"a 'b'\nb ''\n'' c\nd \\\n  block\n  text\ne \"a\\\"b\"",
+		"x (y, z) y",
 	}
 
-	if IsTemplateTextChar('$') {
-		t.Error("Error in character class")
+	p := NewStringParser("")
+	p.Intern = true
+	for i, s := range inputs {
+		p.Reset(s)
+		if err := p.Ogdl(); err != nil {
+			t.Fatal(err)
+		}
+		g := p.Graph()
+		if !g.Equal(ParseString(s)) {
+			t.Errorf("input %d:\n%s", i, g.Text())
+		}
+	}
+	if len(p.interned) == 0 || p.interned["product"] != "product" {
+		t.Error("scalars not interned:", len(p.interned))
 	}
 
-	if !IsTemplateTextChar(' ') {
-		t.Error("Error in character class")
+	// Graphs parsed before don't change when the buffer is reused
+	p = NewStringParser("a b c")
+	p.Ogdl()
+	g := p.Graph()
+	p.Reset("xxxxxx")
+	p.Ogdl()
+	if g.Text() != "a\n  b\n    c" {
+		t.Error("graph changed:", g.Text())
 	}
 
-	if IsTokenChar('$') {
-		t.Error("Error in character class")
+	// Recorded events are the same
+	p = NewStringParser(inputs[1])
+	p.Intern = true
+	p.RecordEvents()
+	p.Ogdl()
+	if !ReplayEvents(p.Events()).Equal(ParseString(inputs[1])) {
+		t.Error("replay with Intern:", ReplayEvents(p.Events()).Text())
 	}
 }
 
-// graph.go
-
-func TestCopyAndSubstitute(t *testing.T) {
-	g := ParseString("a b, c d, aa a")
+// Comments
 
-	g2 := NilGraph()
-	g2.Copy(g)
+func TestComment(t *testing.T) {
 
-	if !g.Equal(g2) {
-		t.Error("copy or equal failed")
+	g := ParseString("#comment")
+	if g.Text() != "" {
+		t.Error("comment 1:", g.Text())
 	}
 
-	g3 := ParseString("x b, c d, aa x")
-	g.Substitute("a", "x")
-	if !g.Equal(g3) {
-		t.Error("copy or equal failed")
+	g = ParseString("#comment\nnot#acomment")
+	if g.Text() != "not#acomment" {
+		t.Error("comment 2:", g.Text())
 	}
+
 }
 
-func TestGet1(t *testing.T) {
+func TestKeepComments(t *testing.T) {
 
-	g := ParseString("a b c")
+	src := "# header\na b # about b\n  # about c\n  c\nd"
 
-	v, _ := g.GetString("a")
-	s := _typeOf(v)
+	p := NewStringParser(src)
+	p.KeepComments = true
+	p.Ogdl()
+	g := p.Graph()
 
-	if v != "b" {
-		t.Error("GetString()")
+	if g.Len() != 3 || g.Out[0].String() != TypeComment || g.Out[0].Out[0].String() != " header" {
+		t.Fatal("top comment:", g.Text())
 	}
 
-	g2 := g.Get("a.b")
-	if g2.Len() != 0 || g2.String() != "c" {
-		t.Error("Get")
+	b := g.Node("a").Node("b")
+	if b.Len() != 3 || b.Out[0].String() != TypeComment || b.Out[0].Out[0].String() != " about b" {
+		t.Error("trailing comment:", g.Text())
+	}
+	if b.Out[1].String() != TypeComment || b.Out[1].Out[0].String() != " about c" {
+		t.Error("indented comment:", g.Text())
 	}
 
-	g.Add("n").Add(1)
-	g.Add("d").Add(1.0)
+	// c still belongs to b: a comment is never a parent
+	if g.Get("a.b.c") == nil || g.Node("d") == nil {
+		t.Error("structure changed by comments:", g.Text())
+	}
 
-	i := g.Get("n").Scalar()
-	s = _typeOf(i)
-	if s != "int64" || i != int64(1) {
-		t.Error("Scalar()")
+	// Default: comments are discarded
+	if !ParseString("# header\na b # about b\nd").Equal(ParseString("a b\nd")) {
+		t.Error("comments kept by default")
 	}
+}
 
-	f := g.Get("d").Scalar()
-	s = _typeOf(f)
-	if s != "float64" || f != 1.0 {
-		t.Error("Scalar()", f, s)
+func TestKeepComments_RoundTrip(t *testing.T) {
+
+	src := `# Server settings
+server
+  # where to listen
+  host localhost
+  port 8080 # not 80
+  #
+  tls
+    # both required
+    cert a.pem
+    key a.key
+# end
+`
+	parse := func(s string) *Graph {
+		p := NewStringParser(s)
+		p.KeepComments = true
+		p.Ogdl()
+		return p.Graph()
+	}
+
+	// Only the amount and kind of white space may change
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	}
+
+	g := parse(src)
+
+	for _, s := range []string{g.Text(), g.Format(nil), g.Format(&PrintOptions{MaxLineLen: 80})} {
+		if !parse(s).Equal(g) {
+			t.Errorf("comments not kept in:\n%s", s)
+		}
+		if !strings.Contains(s, "  # where to listen\n") || !strings.Contains(s, "# end") {
+			t.Errorf("comments not in place:\n%s", s)
+		}
+		if normalize(s) != normalize(src) {
+			t.Errorf("round trip differs:\n%s", s)
+		}
 	}
 }
 
-// A null or new graph should return size = 0
+// Backslashes
 
-func TestNilGraph(t *testing.T) {
+func TestWindowsPaths(t *testing.T) {
 
-	g := NilGraph()
+	// Unquoted: backslashes are always literal
+	g := ParseString("path C:\\Users\\x\\new\nshare \\\\server\\share")
+	if s, _ := g.GetString("path"); s != "C:\\Users\\x\\new" {
+		t.Error("unquoted windows path:", s)
+	}
+	if s, _ := g.GetString("share"); s != "\\\\server\\share" {
+		t.Error("unquoted UNC path:", s)
+	}
 
-	if g.Len() != 0 {
-		t.Error("nil node size not 0")
+	// Quoted: backslashes not followed by a quote are kept
+	g = ParseString("path \"C:\\Program Files\\tmp\"")
+	if s, _ := g.GetString("path"); s != "C:\\Program Files\\tmp" {
+		t.Error("quoted windows path:", s)
 	}
 
-	if !g.IsNil() {
-		t.Error("IsNil() incorrect")
+	g = ParseString("path 'C:\\new\\table'")
+	if s, _ := g.GetString("path"); s != "C:\\new\\table" {
+		t.Error("single quoted windows path:", s)
 	}
 
-	g = NewGraph(nil)
-
-	if g.Len() != 0 {
-		t.Error("nil node size not 0")
+	// Escaped quotes lose their backslash
+	g = ParseString("a 'it\\'s'")
+	if s, _ := g.GetString("a"); s != "it's" {
+		t.Error("escaped quote:", s)
 	}
 
-	if !g.IsNil() {
-		t.Error("IsNil() incorrect")
+	// And they survive Text()
+	g = ParseString("path 'C:\\new\\table'")
+	g = ParseString(g.Text())
+	if s, _ := g.GetString("path"); s != "C:\\new\\table" {
+		t.Error("windows path round trip:", s)
 	}
-
 }
 
-func TestNewGraph(t *testing.T) {
+// Escape sequences
 
-	g := NewGraph("a")
+func TestQuotedEscapes(t *testing.T) {
 
-	if g.Len() != 0 {
-		t.Error("new node size not 0")
-	}
+	in := [...]string{`"a\nb"`, `"a\tb"`, `"a\rb"`, `"a\\b"`, `"a\"b"`, `'a\'b'`, `"\u00e9t\u00E9"`, `"\x41\x7a"`, `"a\qb"`}
+	out := [...]string{"a\nb", "a\tb", "a\rb", "a\\b", "a\"b", "a'b", "\u00e9t\u00e9", "Az", "a\\qb"}
 
-	if g.IsNil() {
-		t.Error("false IsNil()")
+	for i, s := range in {
+		p := NewStringParser(s)
+		p.Escapes = true
+		r, ok := p.Quoted()
+		if !ok || r != out[i] {
+			t.Errorf("escape %s: got %q", s, r)
+		}
 	}
-}
-
-func TestDepth(t *testing.T) {
-	g := NewGraph("a")
 
-	if g.Depth() != 0 {
-		t.Error("g.Depth() != 0")
+	// Escapes are opt-in
+	g := ParseString(`a "x\ny"`)
+	if s, _ := g.GetString("a"); s != `x\ny` {
+		t.Error("escapes should be off by default:", s)
 	}
 
-	g.Add("b")
-
-	if g.Depth() != 1 {
-		t.Error("g.Depth() != 1")
+	// Multiline quoted strings keep their indentation handling
+	p := NewStringParser("a \"b\\t\n    c\"")
+	p.Escapes = true
+	p.Ogdl()
+	if s, _ := p.Graph().GetString("a"); s != "b\t\n c" {
+		t.Errorf("multiline with escapes: %q", s)
+	}
+
+	// Invalid \u sequence is a syntax error
+	p = NewStringParser(`a "\u12g4"`)
+	p.Escapes = true
+	if err := p.Ogdl(); err == nil {
+		t.Error("invalid \\u should fail")
+	}
+	p = NewStringParser(`a "\u12"`)
+	p.Escapes = true
+	if err := p.Ogdl(); err == nil || !strings.Contains(err.Error(), "invalid \\u escape") {
+		t.Error("short \\u should fail:", err)
+	}
+
+	// Surrogate pairs, and unpaired surrogates
+	for s, want := range map[string]string{
+		`"\ud83d\ude00!"`: "\U0001F600!",
+		`"\uD83D\uDE00"`:  "\U0001F600",
+		`"\ud83dx"`:       "\uFFFDx",
+		`"\ud83d\n"`:      "\uFFFD\n",
+		`"\ud83d\u0041"`:  "\uFFFDA",
+		`"\ude00"`:        "\uFFFD",
+		`"\ud83d"`:        "\uFFFD",
+	} {
+		p := NewStringParser(s)
+		p.Escapes = true
+		if r, ok := p.Quoted(); !ok || r != want {
+			t.Errorf("escape %s: got %q", s, r)
+		}
 	}
 
-	n := g.Add("c")
+	// A backslash at the end of the string must be escaped
+	for s, want := range map[string]bool{`"a\\"`: true, `"a\"`: false} {
+		p := NewStringParser(s)
+		p.Escapes = true
+		if r, ok := p.Quoted(); ok != want || ok && r != "a\\" {
+			t.Errorf("backslash at end %s: %q %v", s, r, ok)
+		}
+	}
 
-	if g.Depth() != 1 {
-		t.Error("g.Depth() != 1")
+	// Format writes escapes that read back losslessly
+	g = NilGraph()
+	g.Add("s").Add("tab\tnl\ncr\r bs\\ q\"' \x01 \u00e9 \U0001F600 \\")
+	p = NewStringParser(g.Format(&PrintOptions{Escapes: true}))
+	p.Escapes = true
+	if p.Ogdl() != nil || !p.Graph().Equal(g) {
+		t.Errorf("round trip: %q", g.Format(&PrintOptions{Escapes: true}))
 	}
+}
 
-	nn := n.Add("d")
+func TestQuotedUnterminated(t *testing.T) {
 
-	if g.Depth() != 2 {
-		t.Error("g.Depth() != 2")
+	p := NewStringParser(`"abc`)
+	if s, ok := p.Quoted(); ok || s != "" {
+		t.Error("unterminated quoted string accepted:", s)
 	}
 
-	nn.Add("e")
-
-	if g.Depth() != 3 {
-		t.Error("g.Depth() != 3")
+	p = NewStringParser("a \"abc")
+	err := p.Ogdl()
+	if err == nil || !strings.Contains(err.Error(), "unterminated quoted string") {
+		t.Error("unterminated quoted string not reported:", err)
 	}
-}
 
-func TestGraph_String(t *testing.T) {
-	g := NilGraph()
-	s := g.String()
-	if len(s) != 0 {
-		t.Error("g.String() returns something with a nil node")
+	// Escaped quote at the end of the input
+	p = NewStringParser(`a 'abc\'`)
+	if p.Ogdl() == nil {
+		t.Error("unterminated quoted string after escape")
 	}
 }
 
-func TestGraph_Delete(t *testing.T) {
-
-	g := NilGraph()
-
-	g.Add(1)
-	g.Add(2)
-	g.Add(3)
-	g.Add(4)
-	g.Add(5)
-
-	if g.Len() != 5 {
-		t.Fatal("g.Len()!=5")
+// Triple quotes
+
+func TestParser_TripleQuoted(t *testing.T) {
+
+	tests := []struct{ src, want string }{
+		// Quotes and backslashes are literal
+		{`a """say 'hi' and "bye" \n"""`, `say 'hi' and "bye" \n`},
+		{`a '''it's "x"'''`, `it's "x"`},
+		// Quotes before the closing ones belong to the text
+		{`a """say "hi""""`, `say "hi"`},
+		// Closing quotes in the middle of a line
+		{"a \"\"\"one\ntwo\"\"\" b", "one\ntwo"},
+		// Text starting on the next line is dedented
+		{"script \"\"\"\n    grep -E '^a|\"b\"$' x.txt\n      && echo \\done\n    \"\"\"", "grep -E '^a|\"b\"$' x.txt\n  && echo \\done"},
+		{"a\n  \"\"\"\n  x\n\n    y\n  \"\"\"", "x\n\n  y"},
+		// Empty strings
+		{`a ""`, ""},
+		{`a ''`, ""},
+	}
+
+	for _, tt := range tests {
+		g := ParseString(tt.src)
+		if s := g.GetAt(0).GetAt(0).String(); s != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.src, s, tt.want)
+		}
 	}
 
-	g.DeleteAt(2)
-
-	if g.Len() != 4 {
-		t.Fatal("g.Len()!=4")
+	// The node after the closing quotes
+	g := ParseString("a \"\"\"\n  x\n  \"\"\" b\nc")
+	if g.Text() != "a\n  x\n    b\nc" {
+		t.Error("after triple quotes:", g.Text())
 	}
 
-	g.DeleteAt(5)
-	if g.Len() != 4 {
-		t.Fatal("g.Len()!=4")
+	p := NewStringParser("a \"\"\"abc\"\"\nb")
+	err := p.Ogdl()
+	if err == nil || !strings.Contains(err.Error(), "unterminated quoted string") {
+		t.Error("unterminated triple quoted string not reported:", err)
 	}
 
-	g.DeleteAt(0)
-	if g.Len() != 3 {
-		t.Fatal("g.Len()!=3")
+	// Format writes what can be read back as it is
+	g = NilGraph()
+	g.Add("script").Add("grep \"a\" x\n  && echo '\\done'\n\nexit")
+	g.Add("sql").Add("select \"\"\"\nfrom t")
+	g.Add("raw").Add("  indented\n  lines")
+	g.Add("cr").Add("a\r\nb")
+	s := g.Format(&PrintOptions{TripleQuotes: true})
+	if !strings.Contains(s, "script\n  \"\"\"\n  grep \"a\" x\n    && echo '\\done'\n\n  exit\n  \"\"\"\n") {
+		t.Error("triple quotes not written:\n" + s)
 	}
-
-	// Delete element == 5 !
-	g.Delete(5)
-	if g.Len() != 2 {
-		t.Fatal("g.Len()!=2")
+	if !strings.Contains(s, "sql\n  '''\n") {
+		t.Error("single triple quotes not written:\n" + s)
 	}
-
-	if g.Node("5") != nil {
-		t.Error("5 not deleted")
+	if !ParseString(s).Equal(g) {
+		t.Error("no round trip:\n" + s)
 	}
 }
 
-// eval.go
-
-func TestEvalCalcMod(t *testing.T) {
+// Nesting limits
 
-	i := calc(11.0, 2.0, '%')
+func TestMaxDepth(t *testing.T) {
 
-	s := reflect.TypeOf(i).String()
+	deep := "a " + strings.Repeat("(", 5000) + "b" + strings.Repeat(")", 5000)
 
-	// % operates on ints!
-	if s != "int" || i != 1 {
-		t.Error("Calc %")
+	p := NewStringParser(deep)
+	err := p.Ogdl()
+	if err == nil || !strings.Contains(err.Error(), "depth exceeded") {
+		t.Error("group nesting not limited:", err)
 	}
-}
-
-func TestEvalCalcStr(t *testing.T) {
-
-	i := calc("11.0-", 2.0, '+')
-
-	s := reflect.TypeOf(i).String()
 
-	if s != "string" || i != "11.0-2" {
-		t.Error("string with numbers")
+	p = NewStringParser(strings.Repeat("(", 5000) + "1" + strings.Repeat(")", 5000))
+	p.Expression()
+	if p.err == nil {
+		t.Error("expression nesting not limited")
 	}
-}
-
-func TestCompare(t *testing.T) {
 
-	b := compare(1, 1, '=')
-	if !b {
-		t.Error("compare =")
+	// Unary operators nest too
+	p = NewStringParser(strings.Repeat("! ", 100000) + "a")
+	p.Expression()
+	if !errors.Is(p.err, ErrLimitExceeded) || !strings.Contains(p.err.Error(), "depth exceeded") {
+		t.Error("unary operator nesting not limited:", p.err)
 	}
-	b = compare(1, 1.0, '=')
-	if !b {
-		t.Error("compare =")
+	p = NewStringParser("! ! - a")
+	p.MaxDepth = 4
+	if !p.Expression() || p.err != nil {
+		t.Error("unary operators within limits:", p.err)
 	}
-	b = compare(1.0, 1.0, '=')
-	if !b {
-		t.Error("compare =")
+	p = NewStringParser("! ! - a")
+	p.MaxDepth = 3
+	if p.Expression(); p.err == nil {
+		t.Error("MaxDepth 3 not enforced for unary operators")
+	}
+	if g := NewExpression("!(-a)"); g == nil || g.Len() == 0 {
+		t.Error("unary expression not parsed")
 	}
 
-	b = compare(1, 2, '<')
-	if !b {
-		t.Error("compare 3")
+	// Within limits
+	p = NewStringParser("a ((b))")
+	p.MaxDepth = 2
+	if err := p.Ogdl(); err != nil {
+		t.Error(err)
 	}
-	b = compare(1.0, 2, '<')
-	if !b {
-		t.Error("compare 4")
+	p = NewStringParser("a (((b)))")
+	p.MaxDepth = 2
+	if err := p.Ogdl(); err == nil {
+		t.Error("MaxDepth 2 not enforced")
 	}
 
-	b = compare("a", "a", '=')
-	if !b {
-		t.Error("compare =")
-	}
-	b = compare("a", "a", '!')
-	if b {
-		t.Error("compare =")
+	// Unlimited
+	p = NewStringParser(deep)
+	p.MaxDepth = 0
+	if err := p.Ogdl(); err != nil {
+		t.Error(err)
 	}
+}
 
-	b = compare(2, 1, '>')
-	if !b {
-		t.Error("compare >")
+func TestParserLimits(t *testing.T) {
+
+	limited := func(err error) bool {
+		return errors.Is(err, ErrLimitExceeded)
 	}
-	b = compare(2.0, 1.0, '>')
-	if !b {
-		t.Error("compare >")
+
+	// Group bomb, with the default MaxDepth
+	p := NewStringParser("a " + strings.Repeat("(", 100000))
+	if err := p.Ogdl(); !limited(err) {
+		t.Error("group bomb:", err)
 	}
 
-	// <=
-	b = compare(1, 2, '-')
-	if !b {
-		t.Error("compare <=")
+	// Nesting by indentation and by scalars on a line
+	s := ""
+	for i := 0; i < 50; i++ {
+		s += strings.Repeat(" ", i) + "a\n"
 	}
-	b = compare(2, 2, '-')
-	if !b {
-		t.Error("compare <=")
+	p = NewStringParser(s)
+	p.MaxDepth = 40
+	if err := p.Ogdl(); !limited(err) {
+		t.Error("indentation depth:", err)
 	}
-	b = compare(2.0, 2.0, '-')
-	if !b {
-		t.Error("compare <=")
+	p = NewStringParser(strings.Repeat("a ", 50))
+	if err := p.Ogdl(); err != nil || p.Graph().Depth() != 50 {
+		t.Error("50 scalars on a line:", err)
 	}
-
-	// >=
-	b = compare(2, 1, '+')
-	if !b {
-		t.Error("compare >=")
+	p = NewStringParser(strings.Repeat("a ", 50))
+	p.MaxDepth = 40
+	if err := p.Ogdl(); !limited(err) {
+		t.Error("scalars on a line:", err)
 	}
-	b = compare(2, 2, '+')
-	if !b {
-		t.Error("compare >=")
+
+	// Never terminated quote
+	quote := "a '" + strings.Repeat("x", 100000)
+	p = NewStringParser(quote)
+	p.MaxScalarLen = 1000
+	if err := p.Ogdl(); !limited(err) || !strings.Contains(err.Error(), "scalar longer than 1000 bytes") {
+		t.Error("quote, MaxScalarLen:", err)
 	}
-	b = compare(2.0, 2.0, '+')
-	if !b {
-		t.Error("compare >=")
+	p = NewStringParser(quote)
+	p.MaxInputBytes = 1000
+	if err := p.Ogdl(); !limited(err) || !strings.Contains(err.Error(), "input longer than 1000 bytes") {
+		t.Error("quote, MaxInputBytes:", err)
 	}
 
-	// Cannot compare non numbers
-	b = compare("a", 1, '=')
-	if b {
-		t.Error("compare a string")
+	// Other scalars
+	for _, s := range []string{
+		"a " + strings.Repeat("x", 11),
+		"a '" + strings.Repeat("x", 11) + "'",
+		"a \\\n  " + strings.Repeat("x", 11),
+	} {
+		p = NewStringParser(s)
+		p.MaxScalarLen = 10
+		if err := p.Ogdl(); !limited(err) {
+			t.Errorf("%q: %v", s, err)
+		}
+		p = NewStringParser(s)
+		p.MaxScalarLen = 11
+		if err := p.Ogdl(); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
 	}
-	b = compare(1, "a", '=')
-	if b {
-		t.Error("compare a string")
+
+	// Input exactly at the limit
+	p = NewStringParser("a b")
+	p.MaxInputBytes = 3
+	if err := p.Ogdl(); err != nil {
+		t.Error(err)
 	}
 
-	// !
-	b = compare(1, 2, '!')
-	if !b {
-		t.Error("compare !=")
+	// Paths and expressions
+	p = NewStringParser("a." + strings.Repeat("b", 100))
+	p.MaxScalarLen = 10
+	p.Path()
+	if !limited(p.Err()) {
+		t.Error("path:", p.Err())
 	}
-	b = compare(1, 1, '!')
-	if b {
-		t.Error("compare !=")
+	p = NewStringParser("1 + '" + strings.Repeat("x", 100))
+	p.MaxInputBytes = 50
+	p.Expression()
+	if !limited(p.Err()) {
+		t.Error("expression:", p.Err())
 	}
-	b = compare(1.0, 2.0, '!')
-	if !b {
-		t.Error("compare !=")
+
+	// Reset keeps the limits
+	p.Reset("'" + strings.Repeat("x", 100) + "'")
+	if p.Ogdl(); !limited(p.Err()) {
+		t.Error("limits lost by Reset")
 	}
-	b = compare(1.0, 1.0, '!')
-	if b {
-		t.Error("compare !=")
+
+	// Binary
+	g := NilGraph()
+	n := g
+	for i := 0; i < 20; i++ {
+		n = n.Add("a")
+	}
+	g.Add(strings.Repeat("x", 100))
+	b := g.Binary()
+
+	// A binary node of 100 bytes
+	b = append(b[:len(b)-1], 1, 1, 100)
+	b = append(b, strings.Repeat("y", 100)...)
+	b = append(b, 0, 0)
+
+	for _, c := range []struct {
+		depth, scalar, input int
+		ok                   bool
+	}{
+		{0, 0, 0, true},
+		{20, 100, len(b), true},
+		{19, 0, 0, false},
+		{0, 99, 0, false},
+		{0, 0, len(b) - 1, false},
+		{0, 0, len(b) - 5, false},
+		{0, 0, 10, false},
+	} {
+		bp := NewBytesBinParser(b)
+		bp.MaxDepth = c.depth
+		bp.MaxScalarLen = c.scalar
+		bp.MaxInputBytes = c.input
+		_, err := bp.ParseE()
+		if c.ok && err != nil || !c.ok && !limited(err) {
+			t.Errorf("%+v: %v", c, err)
+		}
 	}
 }
 
-func TestEvalPath(t *testing.T) {
+// Compressed files
 
-	g := NilGraph()
-	g.Add("a").Add(1)
+func TestGzipFiles(t *testing.T) {
 
-	p := NewPath("a")
+	text := "eth0\n  ip 192.168.1.1\n  mask 255.255.255.0"
+	g := ParseString(text)
 
-	i := g.Eval(p)
-	s := reflect.TypeOf(i).String()
-	if i != 1 || s != "int" {
-		t.Error("EvalPath 1")
+	dir := t.TempDir()
+	plain := dir + "/conf.g"
+	zipped := dir + "/conf"
+
+	gzipFile := func(file string, b []byte) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(b)
+		w.Close()
+		os.WriteFile(file, buf.Bytes(), 0666)
 	}
 
-	// Creating a nil root or not should not make a difference
-	g = NewGraph("a")
-	g.Add(1)
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != 1 || s != "int" {
-		t.Error("EvalPath 2")
+	os.WriteFile(plain, []byte(text), 0666)
+	gzipFile(zipped, []byte(text))
+
+	g1 := ParseFile(plain)
+	g2 := ParseFile(zipped)
+	if g1 == nil || g2 == nil || !g.Equal(g1) || !g.Equal(g2) {
+		t.Error("gzip text file")
+	}
+
+	gzipFile(zipped+".gb", g.Binary())
+	g3 := NewFileBinParser(zipped + ".gb").Parse()
+	if g3 == nil || !g.Equal(g3) {
+		t.Error("gzip binary file")
 	}
 }
 
-func TestEvalPath_Index(t *testing.T) {
-	g := ParseString("a (b 1, b 2)")
+// Parse hooks
+
+func TestParserHook(t *testing.T) {
+
+	var evs []string
+	hook := func(ev ParseEvent) {
+		switch ev.Kind {
+		case ParseStart:
+			evs = append(evs, "start")
+		case ParseLine:
+			evs = append(evs, fmt.Sprintf("line %d:%d", ev.Line, ev.Level))
+		case ParseError:
+			evs = append(evs, "error")
+		case ParseEnd:
+			evs = append(evs, "end")
+		}
+	}
 
-	p := NewPath("a.b[0]")
+	p := NewStringParser("a\n  b\n  c\nd")
+	p.Hook = hook
+	p.Ogdl()
 
-	i := g.EvalPath(p)
+	if s := strings.Join(evs, ","); s != "start,line 1:0,line 2:1,line 3:1,line 4:0,end" {
+		t.Error("hook events:", s)
+	}
 
-	if _string(i) != "1" {
-		t.Error("EvalPath_Index")
+	evs = nil
+	p = NewStringParser("a (b")
+	p.Hook = hook
+	p.Ogdl()
+
+	if s := strings.Join(evs, ","); s != "start,line 1:0,error" {
+		t.Error("hook error events:", s)
 	}
+}
 
-	p = NewPath("a.b{1}")
+// Event recording
 
-	i = g.EvalPath(p)
+func TestReplayEvents(t *testing.T) {
 
-	if _string(i) != "2" {
-		t.Error("EvalPath_Selector")
+	src := "network\n  eth0 (ip 192.168.1.1, mask 255.255.255.0)\n  'gate way' 10.0.0.1 # comment\nname x"
+
+	p := NewStringParser(src)
+	p.RecordEvents()
+	p.Ogdl()
+	g := p.Graph()
+	ev := p.Events()
+
+	if ev.Len() == 0 {
+		t.Fatal("no events recorded")
+	}
+	if l, _ := ev.Out[ev.Len()-1].GetInt64("line"); l != 4 {
+		t.Error("last event line:", l)
 	}
 
-	p = NewPath("a.b{}")
+	if !ReplayEvents(ev).Equal(g) {
+		t.Error("replay differs from parse:", ReplayEvents(ev).Text())
+	}
 
-	i = g.EvalPath(p)
+	// The recording survives serialization
+	ev2 := BinParse(ev.Binary())
+	if !ReplayEvents(ev2).Equal(g) {
+		t.Error("replay of serialized events differs")
+	}
 
-	if _text(i) != "1\n2" {
-		t.Error("EvalPath_Selector", _text(i))
+	// Changing a recorded event changes the result
+	for _, e := range ev.Out {
+		if e.Node("value").Out[0].String() == "x" {
+			e.Set("value", "y")
+		}
+	}
+	if s, _ := ReplayEvents(ev).GetString("name"); s != "y" {
+		t.Error("mutated replay:", s)
 	}
 }
 
-func TestEvalScalar(t *testing.T) {
+// Incremental parsing
 
-	g := NilGraph()
-	p := NewGraph("1")
+func TestReparse(t *testing.T) {
 
-	// constants
-	i := g.Eval(p)
-	s := reflect.TypeOf(i).String()
-	if i != int64(1) || s != "int64" {
-		t.Error("Eval constant")
+	src := "config\n  name x\n  port 80\n# comment\nusers\n  alice\n  bob\nlast 1\n"
+
+	edit := func(text, old, new string) Edit {
+		i := strings.Index(text, old)
+		if i < 0 {
+			t.Fatalf("%q not in %q", old, text)
+		}
+		return Edit{Offset: i, Removed: len(old), Inserted: []byte(new)}
 	}
 
-	p = NewGraph("1.1")
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != float64(1.1) || s != "float64" {
-		t.Error("Eval constant int")
+	var edits = []struct{ old, new string }{
+		{"name x", "name y"},        // change a value
+		{"\nusers", "\n  users"},    // indent: joins the previous block
+		{"\n  users", "\nusers"},    // unindent: new block again
+		{"bob\n", "bob\nnew 2\n"},   // insert a top-level line
+		{"new 2\n", ""},             // delete it
+		{"users", "users'"},         // a quote inside a string
+		{"port 80", "port '80"},     // a quoted string spanning blocks
+		{"port '80", "port 80"},     // split again
+		{"users'", "users"},         // back to normal
+		{"last 1\n", "last 1\nend"}, // append at the end
+		{"config", "(a b) c"},       // group in the first line
 	}
 
-	p = NewGraph(1.1)
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != float64(1.1) || s != "float64" {
-		t.Error("Eval constant float")
+	p := NewBytesParser(nil)
+	r, err := p.ParseText([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Graph.Equal(ParseString(src)) {
+		t.Fatal("ParseText differs from Parse")
 	}
 
-	p = NewGraph('c')
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != int64('c') || s != "int64" {
-		t.Error("Eval constant char")
+	text := src
+	for _, e := range edits {
+		ed := edit(text, e.old, e.new)
+		text = text[:ed.Offset] + e.new + text[ed.Offset+ed.Removed:]
+
+		r, err = p.Reparse(r, ed)
+		full, err2 := p.ParseText([]byte(text))
+
+		if err != nil || err2 != nil {
+			t.Fatalf("%q: reparse error %v, parse error %v", e.new, err, err2)
+		}
+		if string(r.Text) != text {
+			t.Fatalf("%q: text %q", e.new, r.Text)
+		}
+		if !r.Graph.Equal(full.Graph) || !r.Graph.Equal(ParseString(text)) {
+			t.Fatalf("%q: reparse differs:\n%s\nexpected:\n%s", e.new, r.Graph.Text(), full.Graph.Text())
+		}
+		if !reflect.DeepEqual(r.blocks, full.blocks) {
+			t.Fatalf("%q: blocks %v, expected %v", e.new, r.blocks, full.blocks)
+		}
 	}
 
-	p = NewGraph("true")
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != true || s != "bool" {
-		t.Error("Eval constant bool")
+	if _, err := p.Reparse(r, edit(text, "alice", "'alice")); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+	if _, err := p.Reparse(r, Edit{Offset: len(r.Text), Removed: 1}); err == nil {
+		t.Error("edit out of range accepted")
+	}
+}
+
+// Lossless documents
+
+// fixtures returns the OGDL files in testdata, plus a copy of each one with
+// CR+LF line breaks.
+func fixtures(t *testing.T) map[string][]byte {
+
+	names, err := filepath.Glob("testdata/*.ogdl")
+	if err != nil || len(names) == 0 {
+		t.Fatal("no fixtures", err)
 	}
 
-	p = NewGraph(true)
-	i = g.Eval(p)
-	s = reflect.TypeOf(i).String()
-	if i != true || s != "bool" {
-		t.Error("Eval constant bool 2")
+	m := map[string][]byte{}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m[name] = b
+		m[name+" (crlf)"] = bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
 	}
+	return m
 }
 
-// TestEvalArgOfGraph tests the following situation:
-//
-//    $a(b)
-//
-// where a is a graph and b is a variable containing a path
-//
-func TestEvalArgOfGraph(t *testing.T) {
+// changed returns the offsets in a of the bytes that differ from b, after
+// removing the common prefix and suffix.
+func changed(a, b []byte) (int, int) {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	j := 0
+	for j < len(a)-i && j < len(b)-i && a[len(a)-1-j] == b[len(b)-1-j] {
+		j++
+	}
+	return i, len(a) - j
+}
 
-	g := NilGraph()
-	g.Add("a").Add("c").Add(int64(1))
-	g.Add("b").Add("c")
+func TestDocument_RoundTrip(t *testing.T) {
 
-	p := NewPath("a(b)")
-	r := g.Eval(p)
-	ty := _typeOf(r)
+	for name, src := range fixtures(t) {
+		d, err := ParseLossless(src)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(d.Source(), src) {
+			t.Errorf("%s: source differs", name)
+		}
+		if !d.Graph().Equal(Parse(src)) {
+			t.Errorf("%s: graph differs:\n%s", name, d.Graph().Text())
+		}
+	}
 
-	if ty != "int64" || r != int64(1) {
-		t.Errorf("a(b): %s %v", ty, r)
+	if _, err := ParseLossless([]byte("a\n  b 'c\n")); err == nil {
+		t.Error("unterminated quote accepted")
 	}
 }
 
-func TestEvalExpression(t *testing.T) {
+// TestDocument_Edit sets, adds to and removes every node of the fixtures,
+// checking that the result parses into the expected graph and that only the
+// lines of the node change.
+func TestDocument_Edit(t *testing.T) {
+
+	for name, src := range fixtures(t) {
+		d, err := ParseLossless(src)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		var nodes []*Graph
+		var walk func(g *Graph)
+		walk = func(g *Graph) {
+			for _, n := range g.Out {
+				nodes = append(nodes, n)
+				walk(n)
+			}
+		}
+		walk(d.Graph())
+
+		// Large fixtures are sampled
+		step := 1 + len(nodes)/50
+
+		for k := 0; k < len(nodes); k += step {
+			n := nodes[k]
+			path, _ := d.Graph().PathFromRoot(n)
+
+			// Region that the edit may touch: the line of the node and
+			// the lines below it, rewritten if needed.
+			pos := d.where[n]
+			l := d.lines[pos.line]
+			start, end := l.start, d.lines[d.lastLine(l.nodes[0])].end
+
+			check := func(op string, err error, d2 *Document, fn func(g *Graph)) {
+				if err == ErrNotEditable {
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s: %s %s: %v", name, op, path, err)
+				}
+				want := NilGraph()
+				want.Copy(d.Graph())
+				fn(want)
+				if got := Parse(d2.Source()); !got.Equal(want) {
+					t.Fatalf("%s: %s %s:\n%s", name, op, path, d2.Source())
+				}
+				if s := d2.Source(); len(s) < len(src)-end+start || !bytes.HasPrefix(s, src[:start]) || !bytes.HasSuffix(s, src[end:]) {
+					t.Errorf("%s: %s %s changed text outside bytes %d-%d", name, op, path, start, end)
+				}
+			}
+
+			// Set
+			d2, _ := ParseLossless(src)
+			err := d2.Set(path, "new value")
+			if n.Len() == 1 && n.Out[0].Len() == 0 {
+				// A single value: one line changes, unless the value
+				// itself has several
+				if err != nil {
+					t.Fatalf("%s: set %s: %v", name, path, err)
+				}
+				i, j := changed(src, d2.Source())
+				if bytes.Count(src[i:j], []byte("\n")) != 0 && strings.IndexByte(n.Out[0].String(), '\n') == -1 {
+					t.Errorf("%s: set %s changed several lines", name, path)
+				}
+			}
+			check("set", err, d2, func(g *Graph) {
+				p, k, _ := g.locate(path)
+				p.Out[k].Out = nil
+				p.Out[k].Add("new value")
+			})
+
+			// Add
+			d2, _ = ParseLossless(src)
+			err = d2.Add(path, "added")
+			check("add", err, d2, func(g *Graph) {
+				p, k, _ := g.locate(path)
+				p.Out[k].Add("added")
+			})
+
+			// Remove
+			d2, _ = ParseLossless(src)
+			err = d2.Remove(path)
+			if pos.i == 0 && l.roots == 1 {
+				// Whole lines: nothing else changes
+				if err != nil {
+					t.Fatalf("%s: remove %s: %v", name, path, err)
+				}
+				if i, j := changed(src, d2.Source()); len(src)-len(d2.Source()) != j-i {
+					t.Errorf("%s: remove %s changed other text", name, path)
+				}
+			}
+			check("remove", err, d2, func(g *Graph) {
+				p, k, _ := g.locate(path)
+				p.DeleteAt(k)
+			})
+		}
+	}
+}
+
+func TestDocument_Mutations(t *testing.T) {
+
+	src, err := os.ReadFile("testdata/service.ogdl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		op, path, value string
+		old, new        string
+	}{
+		{"set", "name", "billing", `name "billing api"   # display name`, `name billing   # display name`},
+		{"set", "listen.admin", "localhost:9090", `admin '127.0.0.1:9090'`, `admin localhost:9090`},
+		{"set", "limits.burst", "40", `burst 20)`, `burst 40)`},
+		{"set", "routes.route{1}.path", "/legacy", `path "/old invoices"`, `path /legacy`},
+		{"set", "notes", "none", "notes \\\n  Deployed with the standard pipeline.\n  Contact the owners before changing limits.", "notes none"},
+		{"set", "version", "two words", "version 2.4.1", `version "two words"`},
+		{"add", "listen", "https 0.0.0.0:8443", "  admin '127.0.0.1:9090'\n", "  admin '127.0.0.1:9090'\n  \"https 0.0.0.0:8443\"\n"},
+		{"add", "routes.route{1}.handler.legacy", "v2", "handler legacy", "handler legacy v2"},
+		{"add", "", "debug", "handler legacy\n", "handler legacy\ndebug\n"},
+		{"remove", "listen.admin", "", "  admin '127.0.0.1:9090'\n", ""},
+		{"remove", "routes.route{1}", "", "  route\n    path \"/old invoices\"\n    handler legacy\n", ""},
+		{"remove", "bob", "", "owners alice, bob", "owners alice"},
+		{"remove", "version.\"2.4.1\"", "", "version 2.4.1", "version"},
+	}
+
+	for _, test := range tests {
+		d, err := ParseLossless(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch test.op {
+		case "set":
+			err = d.Set(test.path, test.value)
+		case "add":
+			err = d.Add(test.path, test.value)
+		case "remove":
+			err = d.Remove(test.path)
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", test.op, test.path, err)
+			continue
+		}
+
+		want := strings.Replace(string(src), test.old, test.new, 1)
+		if string(d.Source()) != want {
+			t.Errorf("%s %s:\n%s", test.op, test.path, d.Source())
+		}
+		if !d.Graph().Equal(Parse(d.Source())) {
+			t.Errorf("%s %s: graph not updated", test.op, test.path)
+		}
+	}
+
+	// Nodes that don't take whole lines are rewritten with their line
+	d, _ := ParseLossless([]byte("a\n  x 1, y 2 # c\nb\n"))
+	if err := d.Remove("a.x"); err != nil || string(d.Source()) != "a\n  y 2 # c\nb\n" {
+		t.Errorf("remove first on line: %v %q", err, d.Source())
+	}
+	d, _ = ParseLossless([]byte("a b # c\nz\n"))
+	if err := d.Add("a", "c"); err != nil || string(d.Source()) != "a\n  b\n  c\nz\n" {
+		t.Errorf("add with inline value: %v %q", err, d.Source())
+	}
+	if err := d.Set("missing", 1); err == nil {
+		t.Error("set on a missing node")
+	}
+}
+
+// Partial parsing
+
+// readCounter counts the bytes read from r.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (c *readCounter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestExtractPath(t *testing.T) {
+
+	var b strings.Builder
+	b.WriteString("# settings\nfirst\n  a 1\n  b\n    c 2\n    d 3\n  e 'four'\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "item%d\n  value %d\n  tags (x, y)\n", i, i)
+	}
+	b.WriteString("last\n  z 26\n  y\n    x 24\n")
+	src := b.String()
+	all := ParseString(src)
+
+	var tests = []struct {
+		path  string
+		early bool
+	}{
+		{"first", true},
+		{"first.b", true},
+		{"first.b.c", true},
+		{"first.e", true},
+		{"item3.tags", true},
+		{"last", false},
+		{"last.y.x", false},
+	}
+
+	for _, test := range tests {
+		r := &readCounter{r: strings.NewReader(src)}
+		g, err := ExtractPath(r, test.path)
+		if err != nil {
+			t.Fatal(test.path, err)
+		}
+		if !g.Equal(all.Get(test.path)) {
+			t.Errorf("%s: got\n%s", test.path, g.Text())
+		}
+		if test.early && r.n > len(src)/10 {
+			t.Errorf("%s: read %d of %d bytes", test.path, r.n, len(src))
+		}
+	}
+
+	// Not found: as soon as first ends, or at the end
+	r := &readCounter{r: strings.NewReader(src)}
+	if _, err := ExtractPath(r, "first.x"); !errors.Is(err, ErrNotFound) || r.n > len(src)/10 {
+		t.Errorf("first.x: %v, read %d", err, r.n)
+	}
+	if _, err := ExtractPath(strings.NewReader(src), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("missing:", err)
+	}
+	if _, err := ExtractPath(strings.NewReader(src), "first[0]"); err == nil {
+		t.Error("index accepted")
+	}
+	if _, err := ExtractPath(strings.NewReader("a\n  b 'c\n"), "a.b"); err == nil {
+		t.Error("parse error not reported")
+	}
+}
+
+// Other parser tests
+
+func TestUnexpectedParen(t *testing.T) {
+	for _, s := range []string{"a)\n", "a, b)\r\nc\n", "a (b))\n"} {
+		if err := NewStringParser(s).Ogdl(); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestUnread(t *testing.T) {
+
+	p := NewStringParser("ab")
+
+	c := p.Read()
+	if c != 'a' {
+		t.Fatal("read failed: a")
+	}
+	p.Unread()
+	c = p.Read()
+	if c != 'a' {
+		t.Fatal("Unread failed: a")
+	}
+	c = p.Read()
+	if c != 'b' {
+		t.Fatal("read failed: b")
+	}
+	c = p.Read()
+	if c != 0 {
+		t.Fatal("read failed: EOS")
+	}
+
+	p.Unread()
+	p.Unread()
+	c = p.Read()
+	if c != 'b' {
+		t.Fatal("Unread failed: b")
+	}
+	c = p.Read()
+	if c != 0 {
+		t.Fatal("read failed: EOS")
+	}
+	c = p.Read()
+	if c != 0 {
+		t.Fatal("read failed: EOS")
+	}
+}
+
+func TestNumber(t *testing.T) {
+
+	var tests = []struct {
+		in, num, rest string
+	}{
+		{"0xdeadbeef", "0xdeadbeef", ""},
+		{"0XFF+1", "0XFF", "+1"},
+		{"-0x10", "-0x10", ""},
+		{"0x", "0", "x"},
+		{"0", "0", ""},
+		{"6.022e23", "6.022e23", ""},
+		{"-1e-10", "-1e-10", ""},
+		{"2E+3)", "2E+3", ")"},
+		{"1e", "1", "e"},
+		{"1e-", "1", "e-"},
+		{"1ex", "1", "ex"},
+	}
+
+	for _, test := range tests {
+		p := NewStringParser(test.in)
+		n, ok := p.Number()
+		if !ok || n != test.num {
+			t.Errorf("%q: got %q, expected %q", test.in, n, test.num)
+		}
+		rest := ""
+		for c := p.Read(); c != 0; c = p.Read() {
+			rest += string(rune(c))
+		}
+		if rest != test.rest {
+			t.Errorf("%q: rest %q, expected %q", test.in, rest, test.rest)
+		}
+	}
 
-	// The context
 	g := NewGraph("a")
-	g.Add("b")
+	var values = []struct {
+		expr string
+		val  interface{}
+	}{
+		{"0xff+1", int64(256)},
+		{"0x10*2", int64(32)},
+		{"6.022e23", 6.022e23},
+		{"-1e-10", -1e-10},
+		{"1e3+1", float64(1001)},
+		{"010+1", int64(11)},
+	}
+
+	for _, v := range values {
+		r := g.Eval(NewExpression(v.expr))
+		if r != v.val {
+			t.Errorf("%s: got %v (%T), expected %v", v.expr, r, r, v.val)
+		}
+	}
+}
+
+// chars.go
+// Character classes. Samples.
+
+func TestChars(t *testing.T) {
+	if !IsSpaceChar(' ') {
+		t.Error("Error in character class")
+	}
+
+	if !IsBreakChar('\n') {
+		t.Error("Error in character class")
+	}
+
+	if !IsBreakChar('\r') {
+		t.Error("Error in character class")
+	}
+
+	if !IsSpaceChar('\t') {
+		t.Error("Error in character class")
+	}
+
+	if IsSpaceChar('a') {
+		t.Error("Error in character class")
+	}
+
+	if IsTextChar('(') {
+		t.Error("Error in character class")
+	}
+
+	if IsTextChar('\t') {
+		t.Error("Error in character class")
+	}
+
+	if !IsTextChar('_') {
+		t.Error("Error in character class")
+	}
+
+	if !IsDigit('1') {
+		t.Error("Error in character class")
+	}
+
+	if IsDigit('x') {
+		t.Error("Error in character class")
+	}
+
+	if IsDigit(-1) {
+		t.Error("Error in character class")
+	}
+
+	if IsLetter('1') {
+		t.Error("Error in character class")
+	}
+
+	if IsLetter(-1) {
+		t.Error("Error in character class")
+	}
+
+	if !IsEndChar(0) {
+		t.Error("Error in character class")
+	}
+
+	if IsEndChar('\t') {
+		t.Error("Error in character class")
+	}
+
+	if IsOperatorChar(-1) {
+		t.Error("Error in character class")
+	}
+
+	if !IsOperatorChar('>') {
+		t.Error("Error in character class")
+	}
+
+	if IsTemplateTextChar('$') {
+		t.Error("Error in character class")
+	}
+
+	if !IsTemplateTextChar(' ') {
+		t.Error("Error in character class")
+	}
+
+	if IsTokenChar('$') {
+		t.Error("Error in character class")
+	}
+}
+
+// graph.go
+
+func TestCopyAndSubstitute(t *testing.T) {
+	g := ParseString("a b, c d, aa a")
+
+	g2 := NilGraph()
+	g2.Copy(g)
+
+	if !g.Equal(g2) {
+		t.Error("copy or equal failed")
+	}
+
+	g3 := ParseString("x b, c d, aa x")
+	g.Substitute("a", "x")
+	if !g.Equal(g3) {
+		t.Error("copy or equal failed")
+	}
+}
+
+func TestGet1(t *testing.T) {
+
+	g := ParseString("a b c")
+
+	v, _ := g.GetString("a")
+	s := _typeOf(v)
+
+	if v != "b" {
+		t.Error("GetString()")
+	}
+
+	g2 := g.Get("a.b")
+	if g2.Len() != 0 || g2.String() != "c" {
+		t.Error("Get")
+	}
+
+	g.Add("n").Add(1)
+	g.Add("d").Add(1.0)
+
+	i := g.Get("n").Scalar()
+	s = _typeOf(i)
+	if s != "int64" || i != int64(1) {
+		t.Error("Scalar()")
+	}
+
+	f := g.Get("d").Scalar()
+	s = _typeOf(f)
+	if s != "float64" || f != 1.0 {
+		t.Error("Scalar()", f, s)
+	}
+}
+
+// A null or new graph should return size = 0
+
+func TestNilGraph(t *testing.T) {
+
+	g := NilGraph()
+
+	if g.Len() != 0 {
+		t.Error("nil node size not 0")
+	}
+
+	if !g.IsNil() {
+		t.Error("IsNil() incorrect")
+	}
+
+	g = NewGraph(nil)
+
+	if g.Len() != 0 {
+		t.Error("nil node size not 0")
+	}
+
+	if !g.IsNil() {
+		t.Error("IsNil() incorrect")
+	}
+
+}
+
+func TestNewGraph(t *testing.T) {
+
+	g := NewGraph("a")
+
+	if g.Len() != 0 {
+		t.Error("new node size not 0")
+	}
+
+	if g.IsNil() {
+		t.Error("false IsNil()")
+	}
+}
+
+func TestDepth(t *testing.T) {
+	g := NewGraph("a")
+
+	if g.Depth() != 0 {
+		t.Error("g.Depth() != 0")
+	}
+
+	g.Add("b")
+
+	if g.Depth() != 1 {
+		t.Error("g.Depth() != 1")
+	}
+
+	n := g.Add("c")
+
+	if g.Depth() != 1 {
+		t.Error("g.Depth() != 1")
+	}
+
+	nn := n.Add("d")
+
+	if g.Depth() != 2 {
+		t.Error("g.Depth() != 2")
+	}
+
+	nn.Add("e")
+
+	if g.Depth() != 3 {
+		t.Error("g.Depth() != 3")
+	}
+}
+
+func TestRepeatedNames(t *testing.T) {
+
+	g := ParseString("server\n  host a\nport 80\nserver\n  host b\nserver\n  host c")
+
+	l := g.Nodes("server")
+	if len(l) != 3 || l[1].Get("host").String() != "b" || l[2].Get("host").String() != "c" {
+		t.Error("Nodes:", len(l))
+	}
+	if g.Nodes("none") != nil || (*Graph)(nil).Nodes("server") != nil {
+		t.Error("Nodes of nothing")
+	}
+	if g.Count("server") != 3 || g.Count("port") != 1 || g.Count("none") != 0 {
+		t.Error("Count")
+	}
+
+	// Paths
+	if g.Get("server.host").String() != "a" || g.Get("server{1}.host").String() != "b" || g.Get("server{2}.host").String() != "c" {
+		t.Error("server{N} paths")
+	}
+	if g.Get("server{3}") != nil {
+		t.Error("server{3} found")
+	}
+
+	// NodeOrAdd reuses the first one, Add always adds
+	if g.NodeOrAdd("server") != l[0] || g.Count("server") != 3 {
+		t.Error("NodeOrAdd existing")
+	}
+	n := g.NodeOrAdd("client")
+	if n == nil || g.Node("client") != n || g.NodeOrAdd("client") != n || g.Count("client") != 1 {
+		t.Error("NodeOrAdd new")
+	}
+	g.Add("server")
+	if g.Count("server") != 4 {
+		t.Error("Add")
+	}
+}
+
+func TestWalk(t *testing.T) {
+
+	g := ParseString("db\n  user admin\n  password secret\nservers\n  a\n    password x\n  b\n    port 80")
+
+	// Redact passwords
+	g.Walk(func(path []string, n *Graph) bool {
+		if n.String() == "password" {
+			for _, v := range n.Out {
+				v.This = "***"
+			}
+			return false
+		}
+		return true
+	})
+	if g.Get("db.password").String() != "***" || g.Get("servers.a.password").String() != "***" {
+		t.Error("not redacted:", g.Text())
+	}
+
+	// Collect paths, in order
+	var paths []string
+	g.Walk(func(path []string, n *Graph) bool {
+		paths = append(paths, strings.Join(append(path, n.String()), "."))
+		return true
+	})
+	want := "db db.user db.user.admin db.password db.password.*** servers servers.a servers.a.password servers.a.password.*** servers.b servers.b.port servers.b.port.80"
+	if s := strings.Join(paths, " "); s != want {
+		t.Error("paths:", s)
+	}
+
+	// Pruning
+	paths = nil
+	g.Walk(func(path []string, n *Graph) bool {
+		paths = append(paths, n.String())
+		return len(path) == 0
+	})
+	if s := strings.Join(paths, " "); s != "db user password servers a b" {
+		t.Error("pruned walk:", s)
+	}
+
+	// Depths, pruning the subtree of servers.a
+	paths = nil
+	g.Walk(func(path []string, n *Graph) bool {
+		paths = append(paths, n.String()+":"+strconv.Itoa(len(path)))
+		return n.String() != "a"
+	})
+	if s := strings.Join(paths, " "); s != "db:0 user:1 admin:2 password:1 ***:2 servers:0 a:1 b:1 port:2 80:3" {
+		t.Error("depths:", s)
+	}
+
+	// Subnodes added during the walk are visited
+	n := 0
+	g.Walk(func(path []string, node *Graph) bool {
+		if node.String() == "b" {
+			node.Add("host").Add("h")
+		}
+		n++
+		return true
+	})
+	if n != 14 || g.Get("servers.b.host").String() != "h" {
+		t.Error("walk with additions:", n)
+	}
+
+	// Cycles
+	c := NewGraph("c")
+	c.Add("d").Add(c)
+	n = 0
+	c.Walk(func(path []string, node *Graph) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Error("cycle visited:", n)
+	}
+
+	// FindAll
+	l := g.FindAll(func(n *Graph) bool {
+		return n.String() == "password" || n.String() == "port"
+	})
+	if len(l) != 3 || l[2].String() != "port" {
+		t.Error("FindAll:", len(l))
+	}
+}
+
+func TestWalkDepth(t *testing.T) {
+
+	g := ParseString("root\n  a\n    b\n      c\n  d\n    e\n  f").Node("root")
+
+	// Pre-order, including the receiver
+	var l []string
+	g.WalkDepth(func(n *Graph, depth int) bool {
+		l = append(l, n.String()+":"+strconv.Itoa(depth))
+		return true
+	})
+	if s := strings.Join(l, " "); s != "root:0 a:1 b:2 c:3 d:1 e:2 f:1" {
+		t.Error("pre-order:", s)
+	}
+
+	// Pruning the subtree of a
+	l = nil
+	g.WalkDepth(func(n *Graph, depth int) bool {
+		l = append(l, n.String())
+		return n.String() != "a"
+	})
+	if s := strings.Join(l, " "); s != "root a d e f" {
+		t.Error("pruned:", s)
+	}
+
+	// Pruning at the receiver
+	n := 0
+	g.WalkDepth(func(*Graph, int) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Error("pruned at the receiver:", n)
+	}
+
+	var nilg *Graph
+	nilg.WalkDepth(func(*Graph, int) bool {
+		t.Error("nil graph visited")
+		return true
+	})
+}
+
+func TestSharedNodes(t *testing.T) {
+
+	g := ParseString("a\nb")
+	s := NewGraph("s")
+	s.Add("1")
+
+	// Sharing: one node, two parents
+	g.Node("a").Add(s)
+	g.Node("b").Add(s)
+
+	if g.IsTree() || len(g.SharedNodes()) != 1 || g.SharedNodes()[0] != s {
+		t.Error("shared node not found:", g.SharedNodes())
+	}
+	if g.Text() != "a\n  s\n    1\nb\n  s\n    1" {
+		t.Errorf("Text: %q", g.Text())
+	}
+	if !ParseString(g.Text()).IsTree() || !BinParse(g.Binary()).IsTree() {
+		t.Error("serializations should be trees")
+	}
+
+	s.Add("2")
+	if g.Get("b.s").Len() != 2 {
+		t.Error("change not seen from the other parent")
+	}
+
+	g.Node("a").Delete("s")
+	if g.Node("a").Len() != 0 || g.Node("b").Node("s") != s || !g.IsTree() {
+		t.Error("delete from one parent")
+	}
+
+	// Copying: changes are not seen from the other parent
+	g.Node("a").Add(s.Clone())
+	s.Add("3")
+	if !g.IsTree() || g.Get("a.s").Len() != 2 || g.Get("b.s").Len() != 3 {
+		t.Error("clone:", g.Text())
+	}
+
+	// A node twice under the same parent
+	c := NewGraph("c")
+	g.Node("a").Add(c)
+	g.Node("a").Add(c)
+	if g.IsTree() || len(g.SharedNodes()) != 1 {
+		t.Error("node twice in the same parent")
+	}
+
+	// Cycles
+	cy := NewGraph("x")
+	cy.Add("y").Add(cy)
+	if cy.IsTree() || len(cy.SharedNodes()) != 1 || cy.Depth() != -1 {
+		t.Error("cycle:", cy.SharedNodes(), cy.Depth())
+	}
+
+	if !ParseString("a b c\nd").IsTree() {
+		t.Error("tree")
+	}
+}
+
+func TestGraph_String(t *testing.T) {
+	g := NilGraph()
+	s := g.String()
+	if len(s) != 0 {
+		t.Error("g.String() returns something with a nil node")
+	}
+}
+
+func TestGraph_Delete(t *testing.T) {
+
+	g := NilGraph()
+
+	g.Add(1)
+	g.Add(2)
+	g.Add(3)
+	g.Add(4)
+	g.Add(5)
+
+	if g.Len() != 5 {
+		t.Fatal("g.Len()!=5")
+	}
+
+	g.DeleteAt(2)
+
+	if g.Len() != 4 {
+		t.Fatal("g.Len()!=4")
+	}
+
+	g.DeleteAt(5)
+	if g.Len() != 4 {
+		t.Fatal("g.Len()!=4")
+	}
+
+	g.DeleteAt(0)
+	if g.Len() != 3 {
+		t.Fatal("g.Len()!=3")
+	}
+
+	// Delete element == 5 !
+	g.Delete(5)
+	if g.Len() != 2 {
+		t.Fatal("g.Len()!=2")
+	}
+
+	if g.Node("5") != nil {
+		t.Error("5 not deleted")
+	}
+}
+
+func TestGraph_Equal(t *testing.T) {
+
+	src := "a\n  b 1\n  c\n    d (x, y)\ne 'f g'"
+
+	if !ParseString(src).Equal(ParseString(src)) {
+		t.Error("identical graphs")
+	}
+
+	for _, s := range []string{
+		"a\n  c\n    d (x, y)\n  b 1\ne 'f g'", // order of subnodes
+		"a\n  b 1\n  c\n    d (y, x)\ne 'f g'", // order of leaves
+		"a\n  b 1\n  c\n    d (x, z)\ne 'f g'", // deep leaf
+		"a\n  b 1\n  c\n    d (x, y)",          // missing node
+		"a\n  b 1\n  c\n    d (x, y, z)\ne 'f g'",
+	} {
+		if ParseString(src).Equal(ParseString(s)) || ParseString(s).Equal(ParseString(src)) {
+			t.Errorf("different graphs equal:\n%s", s)
+		}
+	}
+
+	// Values are compared with their type
+	a := NilGraph()
+	a.Add("n").Add(int64(5))
+	if a.Equal(ParseString("n 5")) {
+		t.Error("number equal to string")
+	}
+
+	// Values that are not comparable
+	a = NilGraph()
+	a.Add([]byte("raw"))
+	a.Add(map[string]int{"x": 1})
+	b := NilGraph()
+	b.Add([]byte("raw"))
+	b.Add(map[string]int{"x": 1})
+	if !a.Equal(b) {
+		t.Error("equal content")
+	}
+	b.Out[0].This = []byte("Raw")
+	if a.Equal(b) {
+		t.Error("different bytes")
+	}
+
+	// Nil and empty
+	if !(&Graph{This: "x", Out: []*Graph{}}).Equal(NewGraph("x")) {
+		t.Error("empty list of subnodes")
+	}
+	if NilGraph().Equal(nil) || (*Graph)(nil).Equal(NilGraph()) || !(*Graph)(nil).Equal(nil) {
+		t.Error("nil graphs")
+	}
+	if NilGraph().Equal(NewGraph("")) {
+		t.Error("transparent node equal to empty string")
+	}
+}
+
+func TestGraph_EqualApprox(t *testing.T) {
+
+	a := NilGraph()
+	a.Add("x").Add(0.1 + 0.2)
+	a.Add("y").Add(int64(3))
+	a.Add("name").Add("z")
+
+	b := NilGraph()
+	b.Add("x").Add(0.3)
+	b.Add("y").Add(3.0000001)
+	b.Add("name").Add("z")
+
+	if a.Equal(b) {
+		t.Error("exact equality expected to fail")
+	}
+	if !a.EqualApprox(b, 1e-6) {
+		t.Error("below epsilon:\n" + a.Text() + "\n" + b.Text())
+	}
+	if a.EqualApprox(b, 1e-9) {
+		t.Error("above epsilon")
+	}
+
+	// Numbers in text compare as numbers, other strings exactly
+	c := ParseString("x 0.3000000001\ny 3\nname z")
+	if !a.EqualApprox(c, 1e-6) || !c.EqualApprox(a, 1e-6) {
+		t.Error("numeric strings")
+	}
+	if a.EqualApprox(ParseString("x 0.3\ny 3\nname Z"), 1e-6) {
+		t.Error("strings must be equal")
+	}
+	if a.EqualApprox(ParseString("x 0.3x\ny 3\nname z"), 1) {
+		t.Error("non numeric string compared as number")
+	}
+	if ParseString("a\n  b").EqualApprox(ParseString("a"), 1) {
+		t.Error("different structure")
+	}
+
+	// nil graphs
+	var n *Graph
+	if NilGraph().EqualApprox(nil, 0.1) || n.EqualApprox(NilGraph(), 0.1) || !n.EqualApprox(nil, 0.1) {
+		t.Error("nil graphs")
+	}
+	if ParseString("a\n  b").EqualApprox(&Graph{This: "a", Out: []*Graph{nil}}, 1) {
+		t.Error("nil subnode")
+	}
+}
+
+func TestGraph_Clone(t *testing.T) {
+
+	type point struct{ x, y int }
+	p := &point{1, 2}
+
+	g := NilGraph()
+	a := g.Add("a")
+	a.Add(int64(1))
+	a.Add(2.5)
+	a.Add([]byte("raw"))
+	g.Add("b").Add(p)
+	g.Add(true)
+
+	c := g.Clone()
+	if !c.TextEqual(g) || c == g {
+		t.Fatal("clone differs:", c.Text())
+	}
+	if c.Get("b").This != p {
+		t.Error("values are not copied as they are")
+	}
+
+	// No node is shared
+	c.Get("a").Out[0].This = int64(5)
+	c.Add("c")
+	if a.Out[0].This != int64(1) || g.Len() != 3 {
+		t.Error("clone shares nodes")
+	}
+
+	text := g.Text()
+	c = g.Clone()
+	c.Node("a").DeleteAt(0)
+	c.DeleteAt(1)
+	c.Set("a[0]", "x")
+	NewTemplate("$set(a, 'y')").ProcessTo(c, io.Discard, &TemplateOptions{ModifyContext: true})
+	if g.Text() != text || a.Len() != 3 {
+		t.Error("original modified:", g.Text())
+	}
+
+	g.Freeze()
+	if g.Clone().IsFrozen() {
+		t.Error("clone is frozen")
+	}
+	if (*Graph)(nil).Clone() != nil {
+		t.Error("nil clone")
+	}
+}
+
+func TestGraph_CloneCOW(t *testing.T) {
+
+	g := ParseString("a\n  b 1\n  c\n    d 2\ne\n  f 3")
+	orig := g.Text()
+
+	c := g.CloneCOW()
+	if !c.TextEqual(g) || c == g {
+		t.Fatal("clone differs:", c.Text())
+	}
+	if c.Out[0] != g.Out[0] {
+		t.Error("subnodes are not shared")
+	}
+
+	// Edits in the clone copy only the path to the change
+	if c.Set("a.c.d", 4) != nil {
+		t.Fatal("Set failed")
+	}
+	if c.Get("a.c.d").String() != "4" || g.Text() != orig {
+		t.Error("Set not isolated:", g.Text())
+	}
+	if c.Out[0] == g.Out[0] || c.Out[1] != g.Out[1] || c.Out[0].Out[0] != g.Out[0].Out[0] {
+		t.Error("wrong nodes copied")
+	}
+
+	if err := c.Remove("e.f"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Get("e").Len() != 0 || g.Get("e.f").String() != "3" {
+		t.Error("Remove not isolated:", g.Text())
+	}
+
+	c.Add("x")
+	c.DeleteAt(0)
+	if g.Text() != orig {
+		t.Error("root edits not isolated:", g.Text())
+	}
+
+	// The original is not frozen: shared nodes can be modified directly,
+	// in both graphs at once, or in one after Unshare
+	if g.Get("a.c").IsFrozen() || g.Out[1].IsFrozen() {
+		t.Fatal("original frozen")
+	}
+	n := g.Unshare("a.c")
+	if n == nil || n.IsFrozen() {
+		t.Fatal("Unshare failed")
+	}
+	n.Add("y")
+	n.DeleteAt(0)
+	if g.Get("a.c").Text() != "y" || c.Len() != 2 || c.Get("e").Len() != 0 {
+		t.Error("direct edits not isolated:", g.Text(), c.Text())
+	}
+
+	// The original keeps working
+	g.Set("e.f", 5)
+	if g.Get("e.f").String() != "5" || c.Get("e.f") != nil {
+		t.Error("edits of the original not isolated")
+	}
+
+	if g.Unshare("nothing") != nil || g.Unshare("") != g || (*Graph)(nil).CloneCOW() != nil {
+		t.Error("edge cases")
+	}
+
+	// Holders of subnodes of the original can still modify them
+	g = ParseString("a\n  b 1\nc 2")
+	a := g.Node("a")
+	c = g.CloneCOW()
+	if a.IsFrozen() || a.Add("x") == nil || a.Len() != 2 {
+		t.Fatal("subnode of the original not modifiable")
+	}
+	a.DeleteAt(1)
+	if g.Merge(ParseString("a\n  d 4")) != nil || g.Get("a.d").String() != "4" || c.Get("a.d") != nil {
+		t.Error("Merge into the original not isolated:", c.Text())
+	}
+	if g.DeletePath("a.b") != 1 || c.Get("a.b").String() != "1" {
+		t.Error("DeletePath in the original not isolated:", c.Text())
+	}
+
+	// Clones of clones
+	c2 := c.CloneCOW()
+	c2.Set("a.b", 7)
+	c.Set("c", 3)
+	if c2.Get("a.b").String() != "7" || c.Get("a.b").String() != "1" || c2.Get("c").String() != "2" {
+		t.Error("clone of a clone:", c.Text(), c2.Text())
+	}
+	if g.Text() != "a\n  d\n    4\nc\n  2" {
+		t.Error("original:", g.Text())
+	}
+}
+
+func TestGraph_TextEqual(t *testing.T) {
+
+	g := NilGraph()
+	a := g.Add("a")
+	a.Add(int64(5))
+	a.Add([]byte("raw"))
+	g.Add(true)
+
+	if !g.TextEqual(ParseString("a (5, raw)\ntrue")) {
+		t.Error("equal by string values")
+	}
+	if g.TextEqual(ParseString("a (5, raw)\nfalse")) || g.TextEqual(ParseString("a (5)\ntrue")) {
+		t.Error("different graphs found equal")
+	}
+	if g.TextEqual(nil) || !(*Graph)(nil).TextEqual(nil) {
+		t.Error("nil graphs")
+	}
+	if NilGraph().TextEqual(NewGraph("")) {
+		t.Error("nil node equal to empty string")
+	}
+}
+
+func TestGraph_Merge(t *testing.T) {
+
+	defaults := ParseString(`server
+  host localhost
+  port 8080
+  tls
+    enabled false
+    cert default.crt
+log
+  level info
+  outputs (stdout)
+route
+  path /
+route
+  path /api`)
+
+	overrides := ParseString(`server
+  port 9090
+  tls
+    enabled true
+log
+  outputs (file)
+route
+  path /home
+route
+  path /api
+  auth token
+route
+  path /admin
+metrics
+  port 9100`)
+
+	want := ParseString(`server
+  host localhost
+  port 9090
+  tls
+    enabled true
+    cert default.crt
+log
+  level info
+  outputs (file)
+route
+  path /home
+route
+  path /api
+  auth token
+route
+  path /admin
+metrics
+  port 9100`)
+
+	g := defaults.Clone()
+	if err := g.Merge(overrides); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Equal(want) {
+		t.Errorf("merge:\n%s", g.Text())
+	}
+
+	// Values accumulate with MergeAppend
+	a := defaults.Clone()
+	if err := a.MergeWith(overrides, MergeAppend); err != nil {
+		t.Fatal(err)
+	}
+	appended := ParseString(`server
+  host localhost
+  port (8080, 9090)
+  tls
+    enabled (false, true)
+    cert default.crt
+log
+  level info
+  outputs (stdout, file)
+route
+  path (/, /home)
+route
+  path /api
+  auth token
+route
+  path /admin
+metrics
+  port 9100`)
+	if !a.Equal(appended) {
+		t.Errorf("merge append:\n%s", a.Text())
+	}
+	a = ParseString("a\n  b 1")
+	a.MergeWith(ParseString("a\n  b 1\n  c 2"), MergeAppend)
+	if !a.Equal(ParseString("a\n  b 1\n  c 2")) {
+		t.Error("merge append of the same value:", a.Text())
+	}
+
+	// Nothing is shared with the overrides
+	overrides.Get("metrics.port").This = "1"
+	if g.Get("metrics.port").String() != "9100" {
+		t.Error("merge shares nodes")
+	}
+
+	// Lists of values are merged, not replaced
+	g = ParseString("tags (a, b)")
+	g.Merge(ParseString("tags (b, c)"))
+	if !g.Equal(ParseString("tags (a, b, c)")) {
+		t.Error("list merge:", g.Text())
+	}
+
+	// Frozen graphs are not modified
+	defaults.Freeze()
+	if err := defaults.Merge(overrides); err != ErrFrozen {
+		t.Error("merge into frozen graph:", err)
+	}
+
+	// An overlay of a frozen graph can be merged into
+	o := defaults.overlay()
+	if err := o.Merge(ParseString("server\n  port 1")); err != nil || o.Get("server.port").String() != "1" || defaults.Get("server.port").String() != "8080" {
+		t.Error("merge into overlay:", err, o.Text())
+	}
+}
+
+func TestGraph_Set(t *testing.T) {
+
+	// Creation of intermediate nodes
+	g := NilGraph()
+	g.Set("a.b.c", "1")
+	if s, _ := g.GetString("a.b.c"); s != "1" {
+		t.Error("Set create", g.Text())
+	}
+
+	// Replacement of a scalar
+	g.Set("a.b.c", "2")
+	if g.Text() != "a\n  b\n    c\n      2" {
+		t.Error("Set replace", g.Text())
+	}
+
+	// Replacement of a subtree
+	g.Set("a.b", ParseString("x y"))
+	if g.Text() != "a\n  b\n    x\n      y" {
+		t.Error("Set subtree", g.Text())
+	}
+
+	// Index addressing: replace, append, out of range
+	g = ParseString("a (b, c, d)")
+	if g.Set("a[1]", "x") != nil || g.Text() != "a\n  b\n  x\n  d" {
+		t.Error("Set index", g.Text())
+	}
+	if g.Set("a[3]", "e") != nil || g.Text() != "a\n  b\n  x\n  d\n  e" {
+		t.Error("Set index append", g.Text())
+	}
+	if g.Set("a[9]", "e") == nil {
+		t.Error("Set index out of range")
+	}
+	g.Set("a[0].z", "1")
+	if s, _ := g.GetString("a.b.z"); s != "1" {
+		t.Error("Set through index", g.Text())
+	}
+
+	// Quoted elements with dots
+	g = NilGraph()
+	g.Set("hosts.'example.com'.port", "80")
+	if g.Node("hosts").Node("example.com") == nil {
+		t.Error("Set quoted", g.Text())
+	}
+}
+
+func TestGraph_Remove(t *testing.T) {
+
+	g := ParseString("a (b (c 1), d 2, e 3)")
+
+	if err := g.Remove("a.b"); err != nil {
+		t.Error(err)
+	}
+	if g.Text() != "a\n  d\n    2\n  e\n    3" {
+		t.Error("Remove", g.Text())
+	}
+
+	if err := g.Remove("a[1]"); err != nil {
+		t.Error(err)
+	}
+	if g.Text() != "a\n  d\n    2" {
+		t.Error("Remove index", g.Text())
+	}
+
+	if g.Remove("a.x") == nil || g.Remove("a[5]") == nil {
+		t.Error("Remove should fail on unresolved paths")
+	}
+}
+
+func TestGraph_DeletePath(t *testing.T) {
+
+	src := `servers
+  web
+    host a
+    port 80
+    port 8080
+  db
+    host b
+    port 5432
+  web
+    host c
+    port 81`
+
+	for _, c := range []struct {
+		path string
+		n    int
+		want string
+	}{
+		// A leaf
+		{"servers.db.port.5432", 1, "servers\n  web\n    host a\n    port 80\n    port 8080\n  db\n    host b\n    port\n  web\n    host c\n    port 81"},
+		// Interior nodes with their subtree, under sibling keys
+		{"servers.web.port", 3, "servers\n  web\n    host a\n  db\n    host b\n    port 5432\n  web\n    host c"},
+		{"servers.web", 2, "servers\n  db\n    host b\n    port 5432"},
+		// Single nodes
+		{"servers.web{1}.port", 1, "servers\n  web\n    host a\n    port 80\n    port 8080\n  db\n    host b\n    port 5432\n  web\n    host c"},
+		{"servers.web.port{1}", 1, "servers\n  web\n    host a\n    port 80\n  db\n    host b\n    port 5432\n  web\n    host c\n    port 81"},
+		{"servers[1]", 1, "servers\n  web\n    host a\n    port 80\n    port 8080\n  web\n    host c\n    port 81"},
+		// No match
+		{"servers.mail.port", 0, src},
+		{"servers.web.user", 0, src},
+		{"servers[9]", 0, src},
+		{"servers.db{1}", 0, src},
+	} {
+		g := ParseString(src)
+		if n := g.DeletePath(c.path); n != c.n || !g.Equal(ParseString(c.want)) {
+			t.Errorf("DeletePath(%s) = %d:\n%s", c.path, n, g.Text())
+		}
+	}
+
+	// A node shared by two parents is deleted from it once
+	g := ParseString("a\n  x 1\n  x 2")
+	shared := g.Node("a")
+	g.Add("b").Add(shared)
+	if n := g.DeletePath("*.x"); n != 0 {
+		t.Error("wildcards are keys here:", n)
+	}
+	if n := g.DeletePath("a.x"); n != 2 || shared.Len() != 0 {
+		t.Error("shared:", n, g.Text())
+	}
+
+	// Copy-on-write clones are modified without changing the original,
+	// and frozen graphs are not modified
+	g = ParseString(src)
+	c := g.CloneCOW()
+	if n := c.DeletePath("servers.web.host"); n != 2 || len(c.Find("**.host")) != 1 {
+		t.Error("clone:", n, c.Text())
+	}
+	if len(g.Find("**.host")) != 3 {
+		t.Error("original modified:", g.Text())
+	}
+	g.Freeze()
+	if n := g.DeletePath("servers.web.host"); n != 0 || len(g.Find("**.host")) != 3 {
+		t.Error("frozen graph modified:", n)
+	}
+}
+
+func TestPathFromRoot(t *testing.T) {
+
+	g := ParseString("a\n  b 1\n  b 2\n  b\n    c x\n    c y\nsrv\n  'x y' 1\n  '!type' f\n  \"7\" q\na b")
+
+	// Every node, addressed by its canonical path, resolves back to itself
+	var walk func(n *Graph)
+	walk = func(n *Graph) {
+		for _, c := range n.Out {
+			path, ok := g.PathFromRoot(c)
+			if !ok {
+				t.Fatal("not found:", c.String())
+			}
+
+			r := g.Get(path)
+			switch c.Len() {
+			case 1:
+				if r != c.Out[0] {
+					t.Errorf("%s: got %v", path, r.Text())
+				}
+			default:
+				if r == nil || !reflect.DeepEqual(r.Out, c.Out) {
+					t.Errorf("%s: got %v", path, r.Text())
+				}
+			}
+			walk(c)
+		}
+	}
+	walk(g)
+
+	b2 := g.Out[0].Out[2]
+	if path, _ := g.PathFromRoot(b2.Out[1]); path != "a.b{2}.c{1}" {
+		t.Error("duplicates:", path)
+	}
+	if path, _ := g.PathFromRoot(g.Out[1].Out[0]); path != "srv.\"x y\"" {
+		t.Error("quoted:", path)
+	}
+	if path, _ := g.PathFromRoot(g.Out[2]); path != "a{1}" {
+		t.Error("top level duplicate:", path)
+	}
+	if _, ok := g.PathFromRoot(NewGraph("z")); ok {
+		t.Error("foreign node found")
+	}
+
+	// The same paths are understood by Set and Remove
+	path, _ := g.PathFromRoot(b2.Out[1])
+	g.Set(path, "z")
+	if s := b2.Out[1].Out[0].String(); s != "z" {
+		t.Error("Set with selector:", s)
+	}
+	if g.Set("a.b{3}", "new") != nil || g.Out[0].Len() != 4 {
+		t.Error("Set one past the last sibling")
+	}
+	if err := g.Set("a.b{9}", "no"); !errors.Is(err, ErrNotFound) {
+		t.Error("Set beyond the last sibling")
+	}
+	if err := g.Remove(path); err != nil || b2.Len() != 1 {
+		t.Error("Remove with selector:", err)
+	}
+	if g.Remove("a.b{9}") == nil {
+		t.Error("Remove of a missing sibling")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+
+	g := ParseString("name web\nport 8080\nusers\n  alice\n  bob\nx old")
+	before := g.Text()
+	g.Freeze()
+
+	if !g.IsFrozen() || !g.Node("users").Out[0].IsFrozen() {
+		t.Fatal("not frozen")
+	}
+
+	// Mutations fail with ErrFrozen (or panic in debug builds)
+	mutate := func(name string, fn func() error) {
+		defer func() {
+			r := recover()
+			if debugFrozen && r != ErrFrozen {
+				t.Errorf("%s: expected panic, got %v", name, r)
+			}
+		}()
+		if err := fn(); !debugFrozen && err != ErrFrozen {
+			t.Errorf("%s: expected ErrFrozen, got %v", name, err)
+		}
+	}
+	nilErr := func(n *Graph) error {
+		if n != nil {
+			return nil
+		}
+		return ErrFrozen
+	}
+
+	mutate("Add", func() error { return nilErr(g.Add("z")) })
+	mutate("Add below", func() error { return nilErr(g.Node("users").Add("z")) })
+	mutate("Set", func() error { return g.Set("port", 80) })
+	mutate("Remove", func() error { return g.Remove("users.bob") })
+	mutate("DeleteAt", func() error { g.DeleteAt(0); return ErrFrozen })
+	mutate("Add chained", func() error { return nilErr(g.Add("a").Add("b")) })
+	mutate("AddNodes chained", func() error { return nilErr(g.AddNodes(nil).Add("b")) })
+	mutate("Copy", func() error { g.Copy(ParseString("z")); return ErrFrozen })
+
+	// Add, AddNodes and Copy do nothing on nil
+	var none *Graph
+	if none.Add("a").Add("b") != nil || none.AddNodes(g) != nil {
+		t.Error("Add on nil")
+	}
+	none.Copy(g)
+	g.Node("users").Copy(nil)
+
+	if g.Text() != before {
+		t.Fatal("frozen graph modified:\n" + g.Text())
+	}
+
+	// Concurrent readers
+	tpl := NewTemplate("$name:$port $for(x,users)$x,$end")
+	expr := NewExpression("port > 8000 && name == 'web'")
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 1000)
+
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				if !g.EvalBool(expr) {
+					errs <- "Eval"
+				}
+			case 1:
+				if s := string(tpl.Process(g)); s != "web:8080 alice,bob," {
+					errs <- "Process: " + s
+				}
+			case 2:
+				var buf bytes.Buffer
+				writeJSONValue(&buf, g.Out)
+				if !strings.Contains(buf.String(), "alice") {
+					errs <- "JSON: " + buf.String()
+				}
+			case 3:
+				if g.Text() != before {
+					errs <- "Text"
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for e := range errs {
+		t.Error(e)
+	}
+
+	// The template variable lived in an overlay
+	if g.Text() != before {
+		t.Error("frozen graph modified by Process:\n" + g.Text())
+	}
+}
+
+func TestFreeze_State(t *testing.T) {
+
+	// Frozen graphs compare as any other
+	g := ParseString("a\n  b 1")
+	c := ParseString("a\n  b 1")
+	g.Freeze()
+	if !g.Equal(c) || !c.Equal(g) {
+		t.Error("frozen graph differs")
+	}
+
+	// Clones are not frozen
+	if d := g.Clone(); d.IsFrozen() || d.Out[0].IsFrozen() {
+		t.Error("frozen clone")
+	}
+
+	// Attributes are replaced, not changed: a copy of the struct keeps
+	// those of the original when it was made
+	n := *c
+	c.Freeze()
+	if n.IsFrozen() || !c.IsFrozen() || !n.Out[0].IsFrozen() {
+		t.Error("copy of the struct:", n.IsFrozen())
+	}
+
+	// Other nodes have none
+	if ParseString("a b").Out[0].attrs != nil {
+		t.Error("attributes allocated")
+	}
+}
+
+func TestSharedGraph(t *testing.T) {
+
+	var sg SharedGraph
+	if sg.Load() != nil {
+		t.Fatal("zero value")
+	}
+	sg.Store(ParseString("name web\nport 8000\nusers\n  alice"))
+
+	tpl := NewTemplate("$name:$port $for(x,users)$x,$end")
+	expr := NewExpression("port >= 8000 && name == 'web'")
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	stop := make(chan bool)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				g := sg.Load()
+				text := g.Text()
+				if !g.IsFrozen() {
+					errs <- "not frozen"
+					return
+				}
+				if !g.EvalBool(expr) {
+					errs <- "Eval: " + g.Text()
+					return
+				}
+				s := string(tpl.Process(g))
+				if !strings.HasPrefix(s, "web:8") || !strings.Contains(s, "alice,") {
+					errs <- "Process: " + s
+					return
+				}
+				// A version doesn't change while it is used
+				if g.Text() != text {
+					errs <- "changed"
+					return
+				}
+			}
+		}()
+	}
+
+	// The writer
+	for i := 1; i <= 200; i++ {
+		err := sg.Update(func(g *Graph) error {
+			g.Set("port", 8000+i)
+			g.Unshare("users").Add("u" + strconv.Itoa(i))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%50 == 0 {
+			sg.Store(ParseString("name web\nport 8000\nusers\n  alice"))
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+
+	// Errors leave the graph as it was
+	before := sg.Load()
+	if err := sg.Update(func(g *Graph) error {
+		g.Set("port", 1)
+		return errors.New("no")
+	}); err == nil || sg.Load() != before {
+		t.Error("failed update:", err)
+	}
+
+	sg.Update(func(g *Graph) error {
+		g.Set("port", 9000)
+		return nil
+	})
+	if n, _ := sg.Load().GetInt64("port"); n != 9000 {
+		t.Error("port:", n)
+	}
+	if n, _ := before.GetInt64("port"); n != 8000 {
+		t.Error("old version changed:", n)
+	}
+}
+
+func TestGraph_Range(t *testing.T) {
+
+	g := ParseString("a, b, c, d")
+
+	s := ""
+	g.Range(func(i int, n *Graph) bool {
+		s += fmt.Sprint(i) + n.String()
+		return true
+	})
+	if s != "0a1b2c3d" {
+		t.Error("Range", s)
+	}
+
+	s = ""
+	g.Range(func(i int, n *Graph) bool {
+		s += n.String()
+		return n.String() != "b"
+	})
+	if s != "ab" {
+		t.Error("Range with stop", s)
+	}
+
+	var nul *Graph
+	nul.Range(func(i int, n *Graph) bool {
+		t.Error("Range on nil graph")
+		return true
+	})
+}
+
+func TestGraph_Format(t *testing.T) {
+
+	plain := []string{
+		"simple", "with space", "comma,here", "(paren)", "#hash", "a#b",
+		"'single'", "\"double\"", "both ' and \"", "", "multi\nline",
+		"multi\n  indented\n\nblank", "trailing\n", "\\", "C:\\path",
+		"tab\there", "ünïcödé", "a\\b\\", "cr\r\nlf",
+		"`tick`", "in`side", "^\\d+ 'a' \"b\"$",
+	}
+	escaped := append(plain, "back\\", "a\\\"b", "ctrl\x01", "x\n\ty")
+
+	corpus := func(strs []string) *Graph {
+		g := NilGraph()
+		for i, s := range strs {
+			n := g.Add(s)
+			switch i % 3 {
+			case 1:
+				n.Add(strs[(i+1)%len(strs)])
+			case 2:
+				n.Add("x").Add(s).Add(strs[(i+2)%len(strs)])
+				n.Add("y")
+				n.Add(strs[(i+4)%len(strs)])
+			}
+		}
+		return g
+	}
+
+	opts := []*PrintOptions{
+		nil,
+		{Indent: 4},
+		{Indent: 1},
+		{UseTabs: true},
+		{QuoteAlways: true},
+		{MaxLineLen: 40},
+		{Blocks: true},
+		{TripleQuotes: true},
+		{Indent: 2, TripleQuotes: true, Blocks: true},
+		{Indent: 3, MaxLineLen: 80, Blocks: true, QuoteAlways: true},
+		{QuoteStyle: PreferSingle},
+		{QuoteStyle: PreferRaw},
+		{QuoteStyle: PreferRaw, QuoteAlways: true, MaxLineLen: 40},
+	}
+
+	check := func(g *Graph, o *PrintOptions, escapes bool) {
+		s := g.Format(o)
+		p := NewStringParser(s)
+		p.Escapes = escapes
+		if err := p.Ogdl(); err != nil {
+			t.Fatalf("%+v: %v\n%s", o, err, s)
+		}
+		if !p.Graph().Equal(g) {
+			t.Fatalf("%+v: no round trip:\n%s\n---\n%s", o, s, p.Graph().Format(o))
+		}
+	}
+
+	for _, o := range opts {
+		check(corpus(plain), o, false)
+
+		e := PrintOptions{Escapes: true}
+		if o != nil {
+			e = *o
+			e.Escapes = true
+		}
+		check(corpus(escaped), &e, true)
+	}
+
+	// parse -> format -> parse
+	for _, src := range []string{
+		"a b c\nd (e f)",
+		"network\n  eth0 (ip 192.168.1.1, mask 255.255.255.0)\n  'gate way' 10.0.0.1",
+		"text \\\n  line 1\n  line 2\nnext",
+		"q \"multi\n   line\"\nz",
+	} {
+		for _, o := range opts {
+			check(ParseString(src), o, false)
+		}
+	}
+
+	if s := ParseString("a b c\nd").Format(&PrintOptions{MaxLineLen: 80}); s != "a b c\nd\n" {
+		t.Errorf("MaxLineLen: %q", s)
+	}
+	if s := ParseString("a\n  b c").Format(&PrintOptions{UseTabs: true}); s != "a\n\tb\n\t\tc\n" {
+		t.Errorf("UseTabs: %q", s)
+	}
+}
+
+func TestQuoteStyle(t *testing.T) {
+
+	tests := []struct {
+		s                   string
+		double, single, raw string
+	}{
+		{"a b", `"a b"`, `'a b'`, "`a b`"},
+		{`say "hi"`, `'say "hi"'`, `'say "hi"'`, "`say \"hi\"`"},
+		{"it's ok", `"it's ok"`, `"it's ok"`, "`it's ok`"},
+		{`'a' "b"`, `"'a' \"b\""`, `'\'a\' "b"'`, "`'a' \"b\"`"},
+		{`C:\new dir\x`, `"C:\new dir\x"`, `'C:\new dir\x'`, "`C:\\new dir\\x`"},
+		{`\d+ (x)`, `"\d+ (x)"`, `'\d+ (x)'`, "`\\d+ (x)`"},
+		{"a`b c", "\"a`b c\"", "'a`b c'", "\"a`b c\""},
+		{"two\nlines", "\"two\n lines\"", "'two\n lines'", "`two\n lines`"},
+	}
+
+	for _, test := range tests {
+		for _, x := range []struct {
+			style QuoteStyle
+			want  string
+		}{{PreferDouble, test.double}, {PreferSingle, test.single}, {PreferRaw, test.raw}} {
+			g := NewGraph(test.s)
+			s := g.Format(&PrintOptions{QuoteStyle: x.style})
+			if s != x.want+"\n" {
+				t.Errorf("style %d: %q written as %s, want %s", x.style, test.s, s, x.want)
+			}
+			if r := ParseString(s).GetAt(0).String(); r != test.s {
+				t.Errorf("style %d: %s read as %q", x.style, s, r)
+			}
+		}
+	}
+
+	// Only raw strings can hold a final backslash without escapes
+	g := NewGraph(`dir x\`)
+	if s := g.Format(&PrintOptions{QuoteStyle: PreferRaw}); !ParseString(s).GetAt(0).TextEqual(g) {
+		t.Errorf("final backslash: %s", s)
+	}
+
+	// Raw strings keep backslashes, also with escapes enabled
+	p := NewStringParser("a `\\n\\t\\` b")
+	p.Escapes = true
+	p.Ogdl()
+	if s, _ := p.Graph().GetString("a"); s != `\n\t\` {
+		t.Errorf("raw string with Escapes: %q", s)
+	}
+	if s := ParseString("a`b` c").Out[0].String(); s != "a`b`" {
+		t.Errorf("backtick inside a word: %q", s)
+	}
+}
+
+func TestGraph_Truncated(t *testing.T) {
+
+	g := NilGraph()
+	ids := g.Add("ids")
+	for i := 0; i < 1000; i++ {
+		ids.Add(i)
+	}
+	g.Add("name").Add("x")
+
+	// Untruncated by default
+	if !BinParse(g.Binary()).TextEqual(ParseString(g.Text())) || strings.Count(g.Format(nil), "\n") != 1003 {
+		t.Error("default serialization is not complete")
+	}
+
+	tr := g.Truncated(3)
+	want := "ids\n  0\n  1\n  2\n  !truncated\n    997\nname\n  x\n"
+	if s := tr.Format(nil); s != want {
+		t.Errorf("Truncated:\n%s", s)
+	}
+	if s := g.Format(&PrintOptions{MaxChildren: 3}); s != want {
+		t.Errorf("MaxChildren:\n%s", s)
+	}
+	if !BinParse(tr.Binary()).TextEqual(ParseString(want)) {
+		t.Error("truncated binary:", BinParse(tr.Binary()).Text())
+	}
+
+	// g is not changed, and small graphs are returned as is
+	if ids.Len() != 1000 {
+		t.Error("Truncated modified the graph")
+	}
+	small := ParseString("a b, c")
+	if small.Truncated(2) != small {
+		t.Error("graph copied without need")
+	}
+}
+
+// eval.go
+
+func TestEvalCalcMod(t *testing.T) {
+
+	i := calc(11.0, 2.0, '%')
+
+	s := reflect.TypeOf(i).String()
+
+	// % operates on ints!
+	if s != "int" || i != 1 {
+		t.Error("Calc %")
+	}
+}
+
+func TestEvalCalcStr(t *testing.T) {
+
+	i := calc("11.0-", 2.0, '+')
+
+	s := reflect.TypeOf(i).String()
+
+	if s != "string" || i != "11.0-2" {
+		t.Error("string with numbers")
+	}
+}
+
+func TestCompare(t *testing.T) {
+
+	b := compare(1, 1, '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare(1, 1.0, '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare(1.0, 1.0, '=')
+	if !b {
+		t.Error("compare =")
+	}
+
+	b = compare(1, 2, '<')
+	if !b {
+		t.Error("compare 3")
+	}
+	b = compare(1.0, 2, '<')
+	if !b {
+		t.Error("compare 4")
+	}
+
+	b = compare("a", "a", '=')
+	if !b {
+		t.Error("compare =")
+	}
+	b = compare("a", "a", '!')
+	if b {
+		t.Error("compare =")
+	}
+
+	b = compare(2, 1, '>')
+	if !b {
+		t.Error("compare >")
+	}
+	b = compare(2.0, 1.0, '>')
+	if !b {
+		t.Error("compare >")
+	}
+
+	// <=
+	b = compare(1, 2, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+	b = compare(2, 2, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+	b = compare(2.0, 2.0, '-')
+	if !b {
+		t.Error("compare <=")
+	}
+
+	// >=
+	b = compare(2, 1, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+	b = compare(2, 2, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+	b = compare(2.0, 2.0, '+')
+	if !b {
+		t.Error("compare >=")
+	}
+
+	// Cannot compare non numbers
+	b = compare("a", 1, '=')
+	if b {
+		t.Error("compare a string")
+	}
+	b = compare(1, "a", '=')
+	if b {
+		t.Error("compare a string")
+	}
+
+	// !
+	b = compare(1, 2, '!')
+	if !b {
+		t.Error("compare !=")
+	}
+	b = compare(1, 1, '!')
+	if b {
+		t.Error("compare !=")
+	}
+	b = compare(1.0, 2.0, '!')
+	if !b {
+		t.Error("compare !=")
+	}
+	b = compare(1.0, 1.0, '!')
+	if b {
+		t.Error("compare !=")
+	}
+}
+
+func TestEvalPath(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("a").Add(1)
+
+	p := NewPath("a")
+
+	i := g.Eval(p)
+	s := reflect.TypeOf(i).String()
+	if i != 1 || s != "int" {
+		t.Error("EvalPath 1")
+	}
+
+	// Creating a nil root or not should not make a difference
+	g = NewGraph("a")
+	g.Add(1)
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != 1 || s != "int" {
+		t.Error("EvalPath 2")
+	}
+}
+
+func TestEvalPath_Index(t *testing.T) {
+	g := ParseString("a (b 1, b 2)")
+
+	p := NewPath("a.b[0]")
+
+	i := g.EvalPath(p)
+
+	if _string(i) != "1" {
+		t.Error("EvalPath_Index")
+	}
+
+	p = NewPath("a.b{1}")
+
+	i = g.EvalPath(p)
+
+	if _string(i) != "2" {
+		t.Error("EvalPath_Selector")
+	}
+
+	p = NewPath("a.b{}")
+
+	i = g.EvalPath(p)
+
+	if _text(i) != "1\n2" {
+		t.Error("EvalPath_Selector", _text(i))
+	}
+}
+
+func TestEvalPath_Filter(t *testing.T) {
+
+	g := ParseString(`config
+  servers
+    web
+      enabled true
+      host a.example.com
+      port 80
+    db
+      enabled false
+      host b.example.com
+      port 5432
+    cache
+      host c.example.com
+      port 6379
+  servers
+    mail
+      enabled true
+      host d.example.com
+      port 25`)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{`config.servers{enabled == "true"}[0].host`, "a.example.com"},
+		{`config.servers{enabled == "true"}[1].host`, "d.example.com"},
+		{`config.servers{enabled == "true"}[1]`, "mail\n  enabled\n    true\n  host\n    d.example.com\n  port\n    25"},
+		{`config.servers{port > 100}[1].host`, "c.example.com"},
+		{`config.servers{port > 100 && enabled != "false"}[0].host`, "c.example.com"},
+		{`config.servers{enabled}[0].host`, "a.example.com"},
+		{`config.servers{}[2]`, "cache\n  host\n    c.example.com\n  port\n    6379"},
+		{`config.servers{1}[0].host`, "d.example.com"},
+	}
+
+	for _, test := range tests {
+		ee := &evalError{}
+		v := g.evalPath(NewPath(test.path), ee)
+		if ee.err != nil || _text(v) != test.want {
+			t.Errorf("%s: %q, %v", test.path, _text(v), ee.err)
+		}
+	}
+
+	// The result is a list of the nodes that match
+	v := g.EvalPath(NewPath(`config.servers{enabled == "true"}`))
+	if r, ok := v.(*Graph); !ok || r.Len() != 2 || r.Out[0].String() != "web" || r.Out[1].String() != "mail" {
+		t.Error("filter result:", _text(v))
+	}
+
+	// Nothing matches
+	ee := &evalError{}
+	if v := g.evalPath(NewPath(`config.servers{port == 1}`), ee); v != nil || ee.err != nil {
+		t.Error("no match:", v, ee.err)
+	}
+
+	// In templates
+	s := NewTemplate(`$config.servers{enabled == "true"}[1].host $if(config.servers{port < 100}[0].port == 80)yes$end`).Process(g)
+	if string(s) != "d.example.com yes" {
+		t.Errorf("template: %q", s)
+	}
+}
+
+func TestSelectorMatch(t *testing.T) {
+
+	src := `config
+  servers
+    server
+      name web
+      port 80
+    server
+      name db
+      port 5432
+  servers
+    server
+      name cache
+      port 6379
+    server
+      name dns
+      port 53
+    server
+      name search
+      port 9200`
+	g := ParseString(src)
+
+	tpl := NewTemplate(`$for(s, config.servers{port > 1000})$s.server.name (was entry #$s_matchindex under key $s_matchkey) $end`)
+	b, err := tpl.ProcessE(g)
+	if err != nil || string(b) != "db (was entry #1 under key servers) cache (was entry #2 under key servers) search (was entry #4 under key servers) " {
+		t.Errorf("loop: %q %v", b, err)
+	}
+
+	tpl = NewTemplate(`$for(s, config.servers{port > 1000})$matchindex(s),$matchkey(s),$matchpath(s) $end`)
+	b, err = tpl.ProcessE(g)
+	if err != nil || string(b) != "1,servers,config.servers[1] 2,servers,config.servers{1}[0] 4,servers,config.servers{1}[2] " {
+		t.Errorf("functions: %q %v", b, err)
+	}
+
+	// The numbers point to the source document
+	r := g.EvalPath(NewPath("config.servers{port > 1000}")).(*Graph)
+	all := g.EvalPath(NewPath("config.servers{}")).(*Graph)
+	for _, n := range r.Out {
+		if !all.Out[n.MatchIndex()].Equal(n) || g.Get(n.MatchPath()).Text() != n.Text() {
+			t.Error("origin of", n.Text(), n.MatchIndex(), n.MatchPath())
+		}
+	}
+
+	// {n} and {} give matches too
+	r = g.EvalPath(NewPath("config.servers{1}")).(*Graph)
+	if r.Len() != 3 || r.Out[2].MatchIndex() != 2 || r.Out[2].MatchPath() != "config.servers{1}[2]" {
+		t.Error("{1}:", r.Out[2].MatchIndex(), r.Out[2].MatchPath())
+	}
+	if all.Out[3].MatchIndex() != 3 || all.Out[3].MatchKey() != "servers" {
+		t.Error("{}:", all.Out[3].MatchIndex())
+	}
+
+	// Metadata is not part of the output, nor of the nodes
+	if r.Text() != ParseString(src).Get("config.servers{1}").Text() {
+		t.Error("Text:", r.Text())
+	}
+	q, err := Query(strings.NewReader(src), "config.servers{1}[0]", FormatJSON)
+	if err != nil || string(q) != `{"server":{"name":"cache","port":6379}}` {
+		t.Error("JSON:", string(q), err)
+	}
+
+	// Other nodes have no origin
+	if n := g.Get("config"); n.MatchIndex() != -1 || n.MatchKey() != "" || n.MatchPath() != "" {
+		t.Error("not a match")
+	}
+	if b, _ := NewTemplate("$matchindex(config)").ProcessE(g); string(b) != "-1" {
+		t.Errorf("matchindex of a plain node: %q", b)
+	}
+}
+
+func TestEvalScalar(t *testing.T) {
+
+	g := NilGraph()
+	p := NewGraph("1")
+
+	// constants
+	i := g.Eval(p)
+	s := reflect.TypeOf(i).String()
+	if i != int64(1) || s != "int64" {
+		t.Error("Eval constant")
+	}
+
+	p = NewGraph("1.1")
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != float64(1.1) || s != "float64" {
+		t.Error("Eval constant int")
+	}
+
+	p = NewGraph(1.1)
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != float64(1.1) || s != "float64" {
+		t.Error("Eval constant float")
+	}
+
+	p = NewGraph('c')
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != int64('c') || s != "int64" {
+		t.Error("Eval constant char")
+	}
+
+	p = NewGraph("true")
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != true || s != "bool" {
+		t.Error("Eval constant bool")
+	}
+
+	p = NewGraph(true)
+	i = g.Eval(p)
+	s = reflect.TypeOf(i).String()
+	if i != true || s != "bool" {
+		t.Error("Eval constant bool 2")
+	}
+}
+
+// TestEvalArgOfGraph tests the following situation:
+//
+//    $a(b)
+//
+// where a is a graph and b is a variable containing a path
+//
+func TestEvalArgOfGraph(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("a").Add("c").Add(int64(1))
+	g.Add("b").Add("c")
+
+	p := NewPath("a(b)")
+	r := g.Eval(p)
+	ty := _typeOf(r)
+
+	if ty != "int64" || r != int64(1) {
+		t.Errorf("a(b): %s %v", ty, r)
+	}
+}
+
+func TestEvalExpression(t *testing.T) {
+
+	// The context
+	g := NewGraph("a")
+	g.Add("b")
+
+	// 'a' is a string constant
+	p := NewExpression("a=='b'")
+	r := g.Eval(p)
+
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("a=='b'")
+	}
+
+	p = NewExpression("'a'!='b'")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+
+	p = NewExpression("2>1")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("2>=2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<=2")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error("'a'!='b'")
+	}
+	p = NewExpression("1<0")
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != false {
+		t.Error("'a'!='b'")
+	}
+
+	// logic
+	e := "'false' || 'true'"
+	p = NewExpression(e)
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error(e)
+	}
+	e = "'true' && 'true'"
+	p = NewExpression(e)
+	r = g.Eval(p)
+	if _typeOf(r) != "bool" || r != true {
+		t.Error(e)
+	}
+
+	// Assign
+	g = NilGraph()
+	e = "a=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 1 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a+=12"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 13 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a-=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 12 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a*=2"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 24 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a/=4"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 6 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "a%=4"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("a"); i != 2 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// b non existent
+	e = "b+=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("b"); i != 1 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// c non existent
+	e = "c-=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("c"); i != -1 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// d non existent
+	e = "d*=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if i, _ := g.GetInt64("d"); i != 0 {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	// e non existent
+	e = "e/=1"
+	p = NewExpression(e)
+	g.Eval(p)
+
+	if _, err := g.GetInt64("e"); err == nil {
+		t.Error(e, _typeOf(g), _text(g))
+	}
+
+	e = "1+2"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "1+2.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "1.0+2.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "2-4"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(-2) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10*3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10.0*3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10*3.0"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != float64(30) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10/3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(3) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+
+	e = "10%3"
+	p = NewExpression(e)
+	r = g.Eval(p)
+
+	if r != int64(1) {
+		t.Error(e, _typeOf(r), _text(r))
+	}
+}
+
+func TestEvalBool(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("a").Add(1)
+
+	p := NewExpression("1=='1'")
+	r := g.EvalBool(p)
+	if r != true {
+		t.Error("1=='1'")
+	}
+
+	p = NewExpression("true")
+	r = g.EvalBool(p)
+	if r != false {
+		t.Error("true as a path")
+	}
+
+	p = NewExpression("'true'")
+	r = g.EvalBool(p)
+	if r != true {
+		t.Error("'true' keyword")
+	}
+}
+
+func TestEvalLogic(t *testing.T) {
+
+	n := 0
+	FunctionAdd("count", func(c *Graph, p *Graph, i int) []byte {
+		n++
+		return []byte("true")
+	})
+
+	g := NilGraph()
+	g.Add("count").Add("!type").Add("function")
+	g.Add("age").Add(20)
+	g.Add("country").Add("ES")
+	g.Add("s").Add("10")
+	g.Add("f").Add(10.0)
+	g.Add("yes").Add(true)
+
+	var tests = []struct {
+		expr  string
+		want  bool
+		calls int
+	}{
+		// precedence: ! > comparison > && > ||
+		{"age >= 18 && country == 'ES'", true, 0},
+		{"age < 18 && country == 'ES'", false, 0},
+		{"1 == 2 || 2 == 2 && 3 == 3", true, 0},
+		{"(1 == 2 || 2 == 2) && 3 == 4", false, 0},
+		{"!yes || yes", true, 0},
+		{"!(age > 18)", false, 0},
+		{"!missing", true, 0},
+		{"missing || yes", true, 0},
+
+		// short-circuit
+		{"1 == 2 && count()", false, 0},
+		{"1 == 1 || count()", true, 0},
+		{"1 == 1 && count()", true, 1},
+		{"1 == 2 || count()", true, 1},
+
+		// numeric and lexical comparisons
+		{"s == 10", true, 0},
+		{"10 == s", true, 0},
+		{"f == 10", true, 0},
+		{"s == f", true, 0},
+		{"s == '10.0'", true, 0},
+		{"s < 9", false, 0},
+		{"'abc' < 'abd'", true, 0},
+		{"country != 'es'", true, 0},
+		{"country == 10", false, 0},
+	}
+
+	for _, test := range tests {
+		n = 0
+		r := g.EvalBool(NewExpression(test.expr))
+		if r != test.want {
+			t.Errorf("%s: got %v, expected %v", test.expr, r, test.want)
+		}
+		if n != test.calls {
+			t.Errorf("%s: function called %d times, expected %d", test.expr, n, test.calls)
+		}
+	}
+
+	if g.EvalBool(NewExpression("a.b.c")) {
+		t.Error("missing path should be false")
+	}
+}
+
+// expr.go
+
+func TestExpr(t *testing.T) {
+
+	g := ParseString("cpu\n  load 0.95\nname \"web 1\"\ndisks\n  d 10\n  d 30")
+
+	tests := []struct {
+		e    Expr
+		src  string
+		want interface{}
+	}{
+		{Binary(">", Path("cpu.load"), Const(0.9)), "cpu.load > 0.9", true},
+		{And(Binary(">", Path("cpu.load"), Const(0.9)), Not(Path("maintenance"))), "cpu.load > 0.9 && !maintenance", true},
+		{Or(Const(false), Binary("==", Path("name"), Const("web 1"))), `"false" || name == "web 1"`, true},
+		{Binary("*", Binary("+", Const(2), Const(1)), Const(3)), "(2 + 1) * 3", int64(9)},
+		{Binary("-", Const(1), Binary("-", Const(2), Const(-3))), "1 - (2 - -3)", int64(-4)},
+		{Binary("-", Binary("-", Const(1), Const(2)), Const(3)), "1 - 2 - 3", int64(-4)},
+		{Unary("-", Const(3)), "-(3)", int64(-3)},
+		{Unary("-", Binary("+", Const(2), Const(1))), "-(2 + 1)", int64(-3)},
+		{Binary(">", Path("disks.d{1}"), Const(20)), "disks.d{1} > 20", true},
+		{Binary("==", Const(`say "hi"`), Const(`say "hi"`)), `'say "hi"' == 'say "hi"'`, true},
+		{Binary("==", Const("a) || (b"), Path("name")), `"a) || (b" == name`, false},
+	}
+
+	for _, test := range tests {
+		if err := test.e.Validate(); err != nil {
+			t.Errorf("%s: %v", test.src, err)
+			continue
+		}
+		if test.e.String() != test.src {
+			t.Errorf("String() = %q, expected %q", test.e.String(), test.src)
+		}
+
+		parsed := NewExpression(test.e.String())
+		if !test.e.Graph().Equal(parsed) {
+			t.Errorf("%s: built and parsed graphs differ:\n%s\n%s", test.src, test.e.Graph().Text(), parsed.Text())
+		}
+		if r := g.Eval(test.e.Graph()); r != test.want || g.Eval(parsed) != r {
+			t.Errorf("%s: got %v (%T), parsed %v, expected %v", test.src, r, r, g.Eval(parsed), test.want)
+		}
+	}
+
+	invalid := []Expr{
+		Path("a) || (b"),
+		Path(""),
+		Const(math.NaN()),
+		Const([]int{1}),
+		Const("+"),
+		Binary("=", Const(1), Const(2)),
+		And(),
+		Binary(">", Path("a"), Const(struct{}{})),
+		Expr{},
+	}
+	for i, e := range invalid {
+		if e.Validate() == nil || e.Graph() != nil || e.String() != "" {
+			t.Errorf("invalid expression %d accepted", i)
+		}
+	}
+}
+
+// Get types
+
+func TestGetTypes(t *testing.T) {
+
+	g := ParseString("aa, ab, bb, axx, aj, vv")
+	r, _ := g.GetSimilar("a[a-b]")
+
+	if r.Len() != 2 || r.Text() != "aa\nab" {
+		t.Error("similar")
+	}
+
+	g = NewGraph("111")
+	if i, _ := g.Int64(); i != 111 {
+		t.Error("Int64")
+	}
+
+	g = NewGraph("111.1")
+	if i, _ := g.Float64(); i != 111.1 {
+		t.Error("Float64")
+	}
+
+	g = NewGraph(float32(111.2))
+	if i, _ := g.Float64(); i != 111.2 {
+		t.Error("Float64")
+	}
+
+	g = NewGraph("true")
+	if i, _ := g.Bool(); i != true {
+		t.Error("Bool")
+	}
+
+	g = ParseString("a 1")
+	if i, _ := g.GetInt64("a"); i != 1 {
+		t.Error("GetInt64")
+	}
+
+	g = ParseString("a 1.1")
+	if i, _ := g.GetFloat64("a"); i != 1.1 {
+		t.Error("GetFloat64")
+	}
+
+	g = ParseString("a 'false'")
+	if i, err := g.GetBool("a"); err != nil || i != false {
+		t.Error("GetBool")
+	}
+
+	g = ParseString("a 'text'")
+	if i, err := g.GetBytes("a"); err != nil || len(i) != 4 {
+		t.Error("GetBytes", len(i))
+	}
+}
+
+func TestGetTypes_Errors(t *testing.T) {
+
+	g := ParseString("server\n  port 8080\n  debug yes\n  ratio 0.5\n  host a\n  list\n    x\n    0")
+
+	if _, err := g.GetInt64("server.missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("GetInt64 of a missing path:", err)
+	}
+	if _, err := g.GetString("nothing"); !errors.Is(err, ErrNotFound) {
+		t.Error("GetString of a missing path:", err)
+	}
+	if _, err := g.GetInt64("server.host"); !errors.Is(err, ErrConversion) || errors.Is(err, ErrNotFound) {
+		t.Error("GetInt64 of text:", err)
+	}
+	if _, err := g.GetBool("server.host"); !errors.Is(err, ErrConversion) {
+		t.Error("GetBool of text:", err)
+	}
+	if _, err := g.GetFloat64("server.host"); !errors.Is(err, ErrConversion) {
+		t.Error("GetFloat64 of text:", err)
+	}
+
+	if b, err := g.GetBool("server.debug"); err != nil || !b {
+		t.Error("GetBool yes:", b, err)
+	}
+	if b, err := g.GetBool("server.list[1]"); err != nil || b {
+		t.Error("GetBool with index:", b, err)
+	}
+
+	if n := g.GetIntDef("server.port", 80); n != 8080 {
+		t.Error("GetIntDef:", n)
+	}
+	if n := g.GetIntDef("server.timeout", 30); n != 30 {
+		t.Error("GetIntDef of a missing path:", n)
+	}
+	if n := g.GetIntDef("server.host", 1); n != 1 {
+		t.Error("GetIntDef of text:", n)
+	}
+	if f := g.GetFloatDef("server.ratio", 1); f != 0.5 {
+		t.Error("GetFloatDef:", f)
+	}
+	if b := g.GetBoolDef("server.verbose", true); !b {
+		t.Error("GetBoolDef")
+	}
+	if s := g.GetStringDef("server.user", "root"); s != "root" {
+		t.Error("GetStringDef")
+	}
+
+	// Native values
+	g = NilGraph()
+	g.Add("n").Add(int64(1) << 62)
+	g.Add("f").Add(2.5)
+	g.Add("b").Add(true)
+	if n, err := g.GetInt64("n"); err != nil || n != 1<<62 {
+		t.Error("GetInt64 of int64:", n, err)
+	}
+	if f, err := g.GetFloat64("f"); err != nil || f != 2.5 {
+		t.Error("GetFloat64 of float64:", f, err)
+	}
+	if b, err := g.GetBool("b"); err != nil || !b {
+		t.Error("GetBool of bool:", b, err)
+	}
+}
+
+func TestUnits(t *testing.T) {
+
+	for _, c := range []struct {
+		in    string
+		value interface{}
+	}{
+		{"2GB", Size{2000000000, "2GB"}},
+		{"2gb", Size{2000000000, "2gb"}},
+		{"512kB", Size{512000, "512kB"}},
+		{"10Mi", Size{10 << 20, "10Mi"}},
+		{"10MiB", Size{10 << 20, "10MiB"}},
+		{"1.5KiB", Size{1536, "1.5KiB"}},
+		{"3tib", Size{3 << 40, "3tib"}},
+		{"100B", Size{100, "100B"}},
+		{"250ms", Duration{250 * time.Millisecond, "250ms"}},
+		{"1h30m", Duration{90 * time.Minute, "1h30m"}},
+		{"1m", Duration{time.Minute, "1m"}},
+		{"10us", Duration{10 * time.Microsecond, "10us"}},
+		{"5ns", Duration{5, "5ns"}},
+		{"-2s", Duration{-2 * time.Second, "-2s"}},
+		// Not sizes nor durations
+		{"10GBs", "10GBs"},
+		{"1M", "1M"},
+		{"10MS", "10MS"},
+		{"GB", "GB"},
+		{"10", "10"},
+		{"-1GB", "-1GB"},
+		{"1.2.3KB", "1.2.3KB"},
+		{"99999999999GB", "99999999999GB"},
+		{"1h30", "1h30"},
+	} {
+		p := NewStringParser("v " + c.in)
+		p.Sizes = true
+		p.Durations = true
+		if err := p.Ogdl(); err != nil {
+			t.Fatal(err)
+		}
+		g := p.Graph()
+		if v := g.Node("v").GetAt(0).This; v != c.value {
+			t.Errorf("%s: %#v", c.in, v)
+		}
+
+		// The original text is kept
+		if g.Text() != "v\n  "+c.in {
+			t.Errorf("%s: written as %q", c.in, g.Text())
+		}
+	}
+
+	// Each kind is enabled separately, and quoted strings are never typed
+	p := NewStringParser("a 2GB\nb 2s\nc '2s'")
+	p.Sizes = true
+	p.Ogdl()
+	g := p.Graph()
+	if _, ok := g.Node("a").GetAt(0).This.(Size); !ok {
+		t.Error("size not parsed")
+	}
+	if _, ok := g.Node("b").GetAt(0).This.(string); !ok {
+		t.Error("duration parsed without Durations")
+	}
+	p = NewStringParser("c '2s'")
+	p.Durations = true
+	p.Ogdl()
+	if _, ok := p.Graph().Node("c").GetAt(0).This.(string); !ok {
+		t.Error("quoted duration parsed")
+	}
+
+	// Accessors take both the typed values and the text
+	p = NewStringParser("mem 2GB\nt 250ms\nbad 10GBs")
+	p.Sizes = true
+	p.Durations = true
+	p.Ogdl()
+	for _, g := range []*Graph{ParseString("mem 2GB\nt 250ms\nbad 10GBs"), p.Graph()} {
+		if n, err := g.GetInt64("mem"); err != nil || n != 2000000000 {
+			t.Error("GetInt64 of a size:", n, err)
+		}
+		if d, err := g.GetDuration("t"); err != nil || d != 250*time.Millisecond {
+			t.Error("GetDuration:", d, err)
+		}
+		if _, err := g.GetInt64("bad"); err == nil {
+			t.Error("GetInt64 of an invalid size")
+		}
+		if _, err := g.GetDuration("mem"); err == nil {
+			t.Error("GetDuration of a size")
+		}
+	}
+}
+
+func TestIsInteger(t *testing.T) {
+	ss := [...]string{"-1", "2", "9.1", " 14", " - 1", " -1 ", "a", "3a", ""}
+	rr := [...]bool{true, true, false, true, false, true, false, false, false}
+
+	for i, s := range ss {
+		b := IsInteger(s)
+		if b != rr[i] {
+			t.Error("IsInteger() failed")
+		}
+	}
+}
+
+// interface conversion to native types
+
+func TestI2string(t *testing.T) {
+
+	var i interface{}
+
+	i = "2.2"
+
+	s := _string(i)
+	ty := reflect.TypeOf(s).String()
+
+	if ty != "string" {
+		t.Error("should return a string")
+	}
+
+	i = 1.1
+
+	s = _string(i)
+	ty = reflect.TypeOf(s).String()
+
+	if ty != "string" {
+		t.Error("should return a string")
+	}
+}
+
+// Templates
+
+func TestTemplate1(ts *testing.T) {
+	// Context
+	g := NewGraph("b")
+	g.Add(1)
+
+	t := NewTemplate("a $b")
+	t.This = "!t"
+
+	s := t.Process(g)
+
+	if string(s) != "a 1" {
+		ts.Error("template")
+	}
+}
+
+func TestTemplateIf(ts *testing.T) {
+	// Context
+	g := NilGraph()
+
+	t := NewTemplate("$if('false') a $else b $end")
+
+	s := t.Process(g)
+	if string(s) != " b " {
+		ts.Error("template")
+	}
+
+	t = NewTemplate("$if('true') a $else b $end")
+	s = t.Process(g)
+	if string(s) != " a " {
+		ts.Error("template")
+	}
+}
+
+func TestProcessE(ts *testing.T) {
+
+	g := ParseString("name Ann\nitems\n  a\n  b\nn 3\nword abc")
+	g.Add("user").Add(struct{ Name string }{"Bob"})
+
+	// Templates that evaluate without problems give the same output
+	for _, s := range []string{
+		"$name $items.a $(2 * 3) $user.Name",
+		"$for(x,items)<$x>$end",
+		"$if(n > 2)big$else;small$end",
+		"$(v = 1)$v",
+	} {
+		t := NewTemplate(s)
+		b, err := t.ProcessE(g)
+		if err != nil {
+			ts.Errorf("%q: %v", s, err)
+		}
+		if string(b) != string(t.Process(g)) {
+			ts.Errorf("%q: output %q differs from Process", s, b)
+		}
+	}
+
+	var tests = []struct {
+		tpl, out, err string
+	}{
+		{"a $nope.b z", "a  z", "not found: nope.b"},
+		{"a $items[7] z", "a  z", "not found: items[7]"},
+		{"a $user.Age z", "a No method or field Age z", "No method or field Age"},
+		{"$for(x,name)<$x>$end z", " z", "not iterable: name"},
+		{"$for(x,missing)<$x>$end z", " z", "not found: missing"},
+		{"$if(nope == 1)yes$else no$end", " no", "not found: nope"},
+		{"$(word * 2)z", "z", "invalid operands for *"},
+		{"$(nope + 1)z", "z", "not found: nope"},
+		{"$include(footer)z", "", "template not found: footer"},
+	}
+
+	for _, test := range tests {
+		t := NewTemplate(test.tpl)
+		b, err := t.ProcessE(g)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			ts.Errorf("%q: error %v, expected %q", test.tpl, err, test.err)
+		}
+		if string(b) != test.out || string(b) != string(t.Process(g)) {
+			ts.Errorf("%q: output %q", test.tpl, b)
+		}
+	}
+
+	// Paths not found are ErrNotFound, and only the first error is kept
+	_, err := NewTemplate("$x $y").ProcessE(NilGraph())
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "x") {
+		ts.Error("first error:", err)
+	}
+}
+
+func TestTemplateElseIf(ts *testing.T) {
+
+	t := NewTemplate("$if(n == 1)one$elseif(n == 2)two$elseif(n > 1)many$else$if(n == 0)zero$else?$end$end;")
+
+	for n, want := range []string{"zero;", "one;", "two;", "many;", "many;"} {
+		g := NilGraph()
+		g.Set("n", n)
+		if s := string(t.Process(g)); s != want {
+			ts.Errorf("n=%d: %q, expected %q", n, s, want)
+		}
+	}
+
+	g := NilGraph()
+	g.Set("n", -1)
+	if s := string(t.Process(g)); s != "?;" {
+		ts.Errorf("no branch matches: %q", s)
+	}
+
+	// Without $else
+	t = NewTemplate("[$if(a)A$elseif(b)B$end]")
+	g = ParseString("b 'true'")
+	if s := string(t.Process(g)); s != "[B]" {
+		ts.Errorf("elseif: %q", s)
+	}
+	if s := string(t.Process(NilGraph())); s != "[]" {
+		ts.Errorf("no match: %q", s)
+	}
+
+	// Chains nested in a loop, and in a branch of another chain, are
+	// evaluated again for each element
+	t = NewTemplate("$for(x,l)$if(x < 2)a$elseif(x < 4)$if(x == 2)b$elseif(x == 3)c$end$elseif(x == 4)d$else-$end$end")
+	g = ParseString("l (0, 1, 2, 3, 4, 5, 6)")
+	if s := string(t.Process(g)); s != "aabcd--" {
+		ts.Errorf("nested chains: %q", s)
+	}
+
+	// A $break in a branch ends the loop
+	t = NewTemplate("$for(x,l)$if(x == 0)z$elseif(x == 2)$break$else$x$end$end")
+	if s := string(t.Process(g)); s != "z1" {
+		ts.Errorf("break in elseif: %q", s)
+	}
+}
+
+func TestTemplateFor(ts *testing.T) {
+	// Context
+	g := NilGraph()
+	c := g.Add("b")
+	c.Add(1)
+	c.Add(2)
+
+	t := NewTemplate("$b\n---\n$for(a,b) [$a] $end")
+
+	s := t.Process(g)
+	if string(s) != "1\n2\n---\n [1]  [2] " {
+		ts.Error("template")
+	}
+}
+
+func TestTemplateForIndex(ts *testing.T) {
+
+	g := NilGraph()
+	c := g.Add("b")
+	c.Add("x")
+	c.Add("y")
+
+	t := NewTemplate("$for(i,a,b)$i=$a $end")
+	if s := string(t.Process(g)); s != "0=x 1=y " {
+		ts.Error("for with index:", s)
+	}
+
+	// Nested loops keep their own counters
+	g = ParseString("rows\n  r1\n    a\n    b\n  r2\n    c\n    d")
+	t = NewTemplate("$for(i,r,rows)$for(j,x,r)<$i$j$x>$end$end")
+	if s := string(t.Process(g)); s != "<00a><01b><10c><11d>" {
+		ts.Error("nested for with index:", s)
+	}
+
+	// Go values stored in This
+	g = NilGraph()
+	g.Add("list").Add([]string{"p", "q"})
+	g.Add("map").Add(map[string]int{"z": 1, "y": 2})
+
+	t = NewTemplate("$for(i,a,list)$i:$a $end| $for(k,v,map)$k:$v $end")
+	if s := string(t.Process(g)); s != "0:p 1:q | y:2 z:1 " {
+		ts.Error("for over Go values:", s)
+	}
+
+	// Position and count of the elements
+	g = ParseString("rows\n  a\n  b\n  c")
+	t = NewTemplate("$for(r,rows)$if(r_index > 0), $end$r ($r_index/$r_len)$end")
+	if s := string(t.Process(g)); s != "a (0/3), b (1/3), c (2/3)" {
+		ts.Error("for with position:", s)
+	}
+	if g.Node("r_index") != nil || g.Node("r_len") != nil {
+		ts.Error("loop variables leaked:", g.Text())
+	}
+
+	// Nested loops and previous values
+	g = ParseString("x_len outer\nrows\n  r1\n    a\n    b\n  r2\n    c")
+	t = NewTemplate("$for(x,rows)<$for(y,x)$y_index$end>$x_len $end$x_len")
+	if s := string(t.Process(g)); s != "<01>2 <0>2 outer" {
+		ts.Error("nested for with position:", s)
+	}
+
+	// Non iterable values are skipped
+	t = NewTemplate("$for(a,nothing)x$end|")
+	if s := string(t.Process(g)); s != "|" {
+		ts.Error("for over nothing:", s)
+	}
+}
+
+func TestTemplateLoops(ts *testing.T) {
+
+	g := ParseString("n 4\nlist\n  1\n  2\n  3")
+
+	for _, c := range [][2]string{
+		// Ranges
+		{"$for(i, range(1, 5)) $i$end", " 1 2 3 4"},
+		{"$for(i, range(0, n)) $i$end", " 0 1 2 3"},
+		{"$for(i, range(5, 1, -1)) $i$end", " 5 4 3 2"},
+		{"$for(i, range(0, 10, 3)) $i$end", " 0 3 6 9"},
+		{"$for(i, range(10, 0, -3)) $i$end", " 10 7 4 1"},
+		{"$for(i, range(3, 3))x$end|", "|"},
+		{"$for(i, range(3, 1))x$end|", "|"},
+		{"$for(k, x, range(3, 6)) $k:$x/$x_len$end", " 0:3/3 1:4/3 2:5/3"},
+		{"$for(i, range(0, 10)) $i$if(i == 2)$break$end$end", " 0 1 2"},
+
+		// $while
+		{"$set(i, 0)$while(i < 3) $i$set(i, i+1)$end", " 0 1 2"},
+		{"$set(i, 10)$while(i < 3) $i$end|", "|"},
+		{"$set(i, 0)$while(i >= 0) $i$if(i == 2)$break$end$set(i, i+1)$end", " 0 1 2"},
+
+		// $break inside $if in a $for over a list
+		{"$for(x, list)$if(x == 2)$break$end $x$end", " 1"},
+	} {
+		out, err := NewTemplate(c[0]).ProcessE(g)
+		if string(out) != c[1] || err != nil {
+			ts.Errorf("%s: %q %v", c[0], out, err)
+		}
+	}
+
+	// The iteration limit
+	for _, s := range []string{
+		"$while(1 == 1)x$end",
+		"$for(i, range(0, 1000000000))x$end",
+	} {
+		var buf bytes.Buffer
+		err := NewTemplate(s).ProcessTo(g, &buf, &TemplateOptions{MaxIterations: 5})
+		if err != ErrIterationLimit || buf.String() != "xxxxx" {
+			ts.Errorf("%s: %q %v", s, buf.String(), err)
+		}
+	}
+	_, err := NewTemplate("$set(i, 0)$while(i >= 0)$set(i, i+1)$end").ProcessE(g)
+	if err != ErrIterationLimit {
+		ts.Error("default iteration limit:", err)
+	}
+
+	// Invalid ranges
+	if _, err := NewTemplate("$for(i, range(1, 5, 0))x$end").ProcessE(g); err == nil {
+		ts.Error("range with step 0")
+	}
+}
+
+func TestTemplateWithDelim(ts *testing.T) {
+
+	g := ParseString("user alice\nhome /home/alice\nfiles\n  a.txt\n  b.txt")
+
+	for _, d := range []byte{'%', '@'} {
+		o := "%"
+		if d == '%' {
+			o = "@"
+		}
+		// ^ stands for the delimiter, and ~ for the other character
+		src := "echo \"$HOME ${PATH} ~O\" > ~/^{user}.log\n^for(f,files)cp ^home/^f $TARGET\n^end^\\"
+		src = strings.Replace(src, "~O", o+"O", 1)
+		src = strings.Replace(src, "^", string(d), -1)
+
+		s := string(NewTemplateWithDelim(src, d).Process(g))
+		want := "echo \"$HOME ${PATH} " + o + "O\" > ~/alice.log\ncp /home/alice/a.txt $TARGET\ncp /home/alice/b.txt $TARGET\n" + string(d)
+		if s != want {
+			ts.Errorf("delimiter %c: %q", d, s)
+		}
+	}
+
+	if s := string(NewTemplate("$user costs 5% @home").Process(g)); s != "alice costs 5% @home" {
+		ts.Error("default delimiter:", s)
+	}
+}
+
+func TestTemplateAssign(ts *testing.T) {
+
+	src := "list\n  1\n  2\n  3\nname x\nserver\n  port 80"
+	g := ParseString(src)
+
+	tests := []struct {
+		tpl, want string
+	}{
+		{"$(total = 0)$for(x, list)$(total += x)$end total $total", " total 6"},
+		{"$set(total, 0)$for(x, list)$set(total, total + x + x)$end$total", "12"},
+		{"$(s = 'n')$for(x, list)$(s += x)$(s += ',')$end$s", "n1,2,3,"},
+		{"$(n = 10)$for(x, list)$(n -= x)$end$if(n == 4)four$end", "four"},
+		{"$set(name, 'y')$name $set(server.port, 8080)$server.port", "y 8080"},
+		{"$set(a.b.c, 1)$a.b.c", "1"},
+	}
+
+	for _, test := range tests {
+		if s := string(NewTemplate(test.tpl).Process(g)); s != test.want {
+			ts.Errorf("%s: %q, want %q", test.tpl, s, test.want)
+		}
+	}
+
+	// The caller's context is not changed
+	if g.Text() != ParseString(src).Text() {
+		ts.Error("context modified:", g.Text())
+	}
+
+	// Unless asked to
+	var buf bytes.Buffer
+	err := NewTemplate("$set(server.port, 8080)$(n = 1)$for(x, list)$(n += x)$end").ProcessTo(g, &buf, &TemplateOptions{ModifyContext: true})
+	if p, _ := g.GetInt64("server.port"); err != nil || p != 8080 {
+		ts.Error("ModifyContext:", g.Text(), err)
+	}
+	if n, _ := g.GetInt64("n"); n != 7 {
+		ts.Error("ModifyContext: n is", n)
+	}
+
+	if _, err = NewTemplate("$set(1, 2)").ProcessE(g); err == nil {
+		ts.Error("no error for $set without a path")
+	}
+}
+
+func TestHTMLTemplate(ts *testing.T) {
+
+	g := NilGraph()
+	g.Add("name").Add(`<script>alert("x & 'y'")</script>`)
+	g.Add("footer").Add(`<p class="f">&copy; 2014</p>`)
+	g.Add("part").Add(`<b>$name</b>`)
+
+	t := NewHTMLTemplate(`<h1 title="t">$name</h1>$raw(footer)`)
+	s := string(t.Process(g))
+	if s != `<h1 title="t">&lt;script&gt;alert(&#34;x &amp; &#39;y&#39;&#34;)&lt;/script&gt;</h1><p class="f">&copy; 2014</p>` {
+		ts.Error("HTML template:", s)
+	}
+
+	// Included templates are escaped too, and plain templates are not
+	s = string(NewHTMLTemplate(`<div>$include(part)</div>`).Process(g))
+	if s != `<div><b>&lt;script&gt;alert(&#34;x &amp; &#39;y&#39;&#34;)&lt;/script&gt;</b></div>` {
+		ts.Error("included template:", s)
+	}
+	if s = string(NewTemplate(`$name`).Process(g)); s != g.Node("name").GetAt(0).String() {
+		ts.Error("plain template:", s)
+	}
+}
+
+func TestTemplateFilters(ts *testing.T) {
+
+	g := NilGraph()
+	g.Add("name").Add(`<script>alert("x")</script>`)
+	g.Add("q").Add("a b&c=d")
+	list := g.Add("list")
+	list.Add("<i>")
+	list.Add("<b>")
+
+	tests := []struct{ tpl, out string }{
+		{`$name|html`, `&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;`},
+		{`$name|raw`, `<script>alert("x")</script>`},
+		{`$name`, `<script>alert("x")</script>`},
+		{`?q=$q|url&x=1`, `?q=a+b%26c%3Dd&x=1`},
+		{`${q|url}.`, `a+b%26c%3Dd.`},
+		{`$for(x,list)<$x|html>$end`, `<&lt;i&gt;><&lt;b&gt;>`},
+		{`$shout(name)|html`, `&lt;SCRIPT&gt;ALERT(&#34;X&#34;)&lt;/SCRIPT&gt;`},
+		// Not filters
+		{`$q|$q`, `a b&c=d|a b&c=d`},
+		{`$q|other|`, `a b&c=d|other|`},
+	}
+
+	fs := NewFunctionSet()
+	fs.AddFunc("shout", func(args ...interface{}) interface{} {
+		return strings.ToUpper(_string(args[0]))
+	})
+	g.SetFunctions(fs)
+
+	for _, t := range tests {
+		if s := string(NewTemplate(t.tpl).Process(g)); s != t.out {
+			ts.Errorf("%s: %s", t.tpl, s)
+		}
+	}
+
+	// In HTML templates, filters replace the default escaping
+	s := string(NewHTMLTemplate(`$name|raw $q|url $q`).Process(g))
+	if s != `<script>alert("x")</script> a+b%26c%3Dd a b&amp;c=d` {
+		ts.Error("HTML template:", s)
+	}
+}
+
+func TestTemplateMaxOutput(ts *testing.T) {
+
+	g := NilGraph()
+	list := g.Add("list")
+	for i := 0; i < 1000; i++ {
+		list.Add("0123456789")
+	}
+
+	t := NewTemplate("$for(x,list)$x$end")
+
+	var buf bytes.Buffer
+	err := t.ProcessTo(g, &buf, &TemplateOptions{MaxOutputBytes: 25})
+	if err != ErrOutputLimit {
+		ts.Fatal("expected ErrOutputLimit, got", err)
+	}
+	if buf.String() != "0123456789012345678901234" {
+		ts.Errorf("truncated output: %q", buf.String())
+	}
+
+	// Below the limit, and without options, ProcessTo equals Process
+	buf.Reset()
+	if err := t.ProcessTo(g, &buf, &TemplateOptions{MaxOutputBytes: 10000}); err != nil {
+		ts.Error(err)
+	}
+	buf2 := bytes.Buffer{}
+	if err := t.ProcessTo(g, &buf2, nil); err != nil {
+		ts.Error(err)
+	}
+	if buf.String() != string(t.Process(g)) || buf2.String() != buf.String() {
+		ts.Error("ProcessTo differs from Process")
+	}
+}
+
+// flushCounter is a writer that counts bytes and flushes.
+type flushCounter struct {
+	n       int
+	flushes []int
+}
+
+func (w *flushCounter) Write(b []byte) (int, error) {
+	w.n += len(b)
+	return len(b), nil
+}
+
+func (w *flushCounter) Flush() {
+	w.flushes = append(w.flushes, w.n)
+}
+
+func TestTemplateProgress(ts *testing.T) {
+
+	g := NilGraph()
+	list := g.Add("list")
+	for i := 0; i < 100; i++ {
+		list.Add("0123456789")
+	}
+
+	t := NewTemplate("$for(x,list)$x$end")
+
+	// 1000 bytes in writes of 10: a checkpoint every 100 bytes
+	w := &flushCounter{}
+	var calls []int64
+	progress := func(n int64, nodes int) bool {
+		calls = append(calls, n)
+		if nodes <= 0 {
+			ts.Error("no nodes reported")
+		}
+		return true
+	}
+
+	err := t.ProcessTo(g, w, &TemplateOptions{FlushEvery: 100, Progress: progress})
+	if err != nil {
+		ts.Fatal(err)
+	}
+	if len(w.flushes) != 10 || len(calls) != 10 {
+		ts.Fatal("flushes, calls:", w.flushes, calls)
+	}
+	for i, n := range calls {
+		if n != int64(100*(i+1)) || w.flushes[i] != 100*(i+1) {
+			ts.Error("cadence:", w.flushes, calls)
+		}
+	}
+
+	// Aborting stops at the checkpoint
+	w = &flushCounter{}
+	stop := func(n int64, nodes int) bool { return n < 300 }
+
+	err = t.ProcessTo(g, w, &TemplateOptions{FlushEvery: 100, Progress: stop})
+	if err != ErrRenderAborted {
+		ts.Fatal("expected ErrRenderAborted, got", err)
+	}
+	if w.n != 300 {
+		ts.Error("render didn't stop promptly:", w.n)
+	}
+
+	// No FlushEvery, no flushes
+	w = &flushCounter{}
+	t.ProcessTo(g, w, &TemplateOptions{Progress: stop})
+	if len(w.flushes) != 0 || w.n != 1000 {
+		ts.Error("unexpected flushes:", w.flushes)
+	}
+}
+
+func TestTemplateInclude(ts *testing.T) {
+
+	// From the context: template text or parsed templates
+	g := NilGraph()
+	g.Set("title", "Home")
+	g.Set("header", "<h1>$title</h1>$include(nav)")
+	g.Add("nav").Add(NewTemplate("<nav>$title</nav>"))
+
+	t := NewTemplate("$include(header)<p>body</p>")
+	var buf bytes.Buffer
+	if err := t.ProcessTo(g, &buf, nil); err != nil {
+		ts.Fatal(err)
+	}
+	if buf.String() != "<h1>Home</h1><nav>Home</nav><p>body</p>" {
+		ts.Error("include from context:", buf.String())
+	}
+
+	// Missing templates
+	buf.Reset()
+	err := NewTemplate("a$include(footer)b").ProcessTo(g, &buf, nil)
+	if err == nil || !strings.Contains(err.Error(), "footer") || buf.String() != "a" {
+		ts.Error("missing template:", err, buf.String())
+	}
+
+	// Templates in a set
+	set := NewTemplateSet()
+	set.Add("page", "$include(header)|$for(x,items)$include(item)$end|$include(footer)")
+	set.Add("item", "[$x]")
+	set.Add("footer", "end")
+
+	items := g.Add("items")
+	items.Add("a")
+	items.Add("b")
+	b, err := set.Process("page", g)
+	if err != nil || string(b) != "<h1>Home</h1><nav>Home</nav>|[a][b]|end" {
+		ts.Error("template set:", string(b), err)
+	}
+
+	if _, err := set.Process("nope", g); err == nil {
+		ts.Error("missing template in set")
+	}
+
+	// Recursion is limited
+	set.Add("a", "a$include(b)")
+	set.Add("b", "b$include(a)")
+	buf.Reset()
+	err = set.ProcessTo("a", g, &buf, &TemplateOptions{MaxIncludeDepth: 3})
+	if err != ErrIncludeDepth || buf.String() != "abab" {
+		ts.Error("include depth:", err, buf.String())
+	}
+	if _, err = set.Process("a", g); err != ErrIncludeDepth {
+		ts.Error("default include depth:", err)
+	}
+}
+
+func TestTemplateIncludeFile(ts *testing.T) {
+
+	dir := ts.TempDir()
+	files := map[string]string{
+		"header.html":      "<h1>$title</h1>$include(\"parts/nav.html\")",
+		"parts/nav.html":   "<nav>$for(x,items)<$x>$end</nav>",
+		"loop.html":        "x$include(\"loop.html\")",
+		"../outside.html":  "secret",
+		"parts/title.html": "not used",
+	}
+	for name, text := range files {
+		name = filepath.Join(dir, "tpl", name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			ts.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(text), 0644); err != nil {
+			ts.Fatal(err)
+		}
+	}
+	opts := &TemplateOptions{Dir: filepath.Join(dir, "tpl")}
+
+	g := NilGraph()
+	g.Set("title", "Home")
+	items := g.Add("items")
+	items.Add("a")
+	items.Add("b")
+
+	var buf bytes.Buffer
+	err := NewTemplate("$include(\"header.html\")<p>body</p>").ProcessTo(g, &buf, opts)
+	if err != nil || buf.String() != "<h1>Home</h1><nav><a><b></nav><p>body</p>" {
+		ts.Error("include file:", buf.String(), err)
+	}
+
+	// The context comes first
+	buf.Reset()
+	NewTemplate("$include(title)").ProcessTo(g, &buf, opts)
+	if buf.String() != "Home" {
+		ts.Error("context before files:", buf.String())
+	}
+
+	// Recursion is limited
+	buf.Reset()
+	err = NewTemplate("$include(\"loop.html\")").ProcessTo(g, &buf, &TemplateOptions{Dir: opts.Dir, MaxIncludeDepth: 3})
+	if err != ErrIncludeDepth || buf.String() != "xxx" {
+		ts.Error("include depth:", buf.String(), err)
+	}
+
+	// Files are only looked for in Dir
+	for _, name := range []string{"../outside.html", "parts/../../outside.html", filepath.Join(dir, "outside.html"), "none.html"} {
+		buf.Reset()
+		err = NewTemplate("$include(\""+name+"\")").ProcessTo(g, &buf, opts)
+		if err == nil || buf.Len() != 0 {
+			ts.Error(name, "included:", buf.String())
+		}
+	}
+	if err := NewTemplate("$include(\"header.html\")").ProcessTo(g, &buf, nil); err == nil {
+		ts.Error("include file without Dir")
+	}
+}
+
+// function.go
+
+func TestFunction1(ts *testing.T) {
+	// Context
+	g := NilGraph()
+	c := g.Add("T")
+	ty := c.Add("!type")
+	ty.Add("function")
+	g.Add("a").Add("Title: $b")
+	g.Add("b").Add("A nice title")
+
+	t := NewTemplate("$T(a)")
+	b := t.Process(g)
+
+	if string(b) != "Title: A nice title" {
+		ts.Error("function T")
+	}
+}
+
+func TestFunctionSet(ts *testing.T) {
+
+	fs := NewFunctionSet()
+	fs.Add("hello", func(c *Graph, p *Graph, i int) []byte {
+		return []byte("hello " + p.Text())
+	})
+
+	g := NilGraph()
+	g.Add("hello").Add("!type").Add("function")
+	g.Add("T").Add("!type").Add("function")
+	g.Add("a").Add("$b")
+	g.Add("b").Add("world")
+
+	t := NewTemplate("$hello(b)")
+
+	// Not in the default set
+	if string(t.Process(g)) == "hello world" {
+		ts.Error("function found without set")
+	}
+
+	g.SetFunctions(fs)
+	if s := string(t.Process(g)); s != "hello world" {
+		ts.Error("function from attached set:", s)
+	}
+
+	// Fallback to the default set
+	t = NewTemplate("$T(a)")
+	if s := string(t.Process(g)); s != "world" {
+		ts.Error("fallback to default set:", s)
+	}
+
+	// The set is not part of the graph
+	text := "hello\n  !type\n    function\nT\n  !type\n    function\na\n  $b\nb\n  world"
+	if g.Text() != text || g.Len() != 4 || g.Node("!functions") != nil {
+		ts.Error("set in the graph:", g.Text())
+	}
+	if j, err := g.JSON(); err != nil || strings.Contains(string(j), "functions") {
+		ts.Error("JSON:", string(j), err)
+	}
+
+	// Copies keep it, and it can be detached
+	for _, c := range []*Graph{g.Clone(), g.CloneCOW()} {
+		if s := string(NewTemplate("$hello(b)").Process(c)); s != "hello world" || c.Text() != text {
+			ts.Error("copy:", s, c.Text())
+		}
+	}
+	g.SetFunctions(nil)
+	if string(NewTemplate("$hello(b)").Process(g)) == "hello world" {
+		ts.Error("set not detached")
+	}
+}
+
+func TestBoundFunction(ts *testing.T) {
+
+	fs := NewFunctionSet()
+	fs.Add("printf", func(c *Graph, p *Graph, i int) []byte {
+		var args []interface{}
+		for _, a := range p.Out[1:] {
+			if f, err := strconv.ParseFloat(a.String(), 64); err == nil {
+				args = append(args, f)
+			} else {
+				args = append(args, a.String())
+			}
+		}
+		return []byte(fmt.Sprintf(p.Out[0].String(), args...))
+	})
+
+	g := ParseString("amount 9.5\nqty 3")
+	g.SetFunctions(fs)
+
+	t := NewTemplate(`$(fmtPrice = bind(printf, "%s: %0.2f"))$(total = bind(fmtPrice, "Total"))$fmtPrice("Price", amount) / $total(qty)`)
+	if s := string(t.Process(g)); s != "Price: 9.50 / Total: 3.00" {
+		ts.Error("bound function:", s)
+	}
+
+	// Bound functions are runtime values, written as bind(...)
+	c := NilGraph()
+	c.SetFunctions(fs)
+	c.Eval(NewExpression(`f = bind(printf, "%s=%0.1f", 'x')`))
+	b := c.Node("f").boundFunction()
+	if b == nil || b.Name != "printf" || len(b.Args) != 2 {
+		ts.Fatal("bind value:", c.Get("f").Text())
+	}
+	if b.String() != `bind(printf, "%s=%0.1f", "x")` {
+		ts.Error("String():", b.String())
+	}
+	if s := _string(c.Eval(NewPath("f(2)"))); s != "x=2.0" {
+		ts.Error("call from path:", s)
+	}
+}
+
+func TestTemplateFuncAdd(ts *testing.T) {
+
+	TemplateFuncAdd("joinWith", func(args ...interface{}) interface{} {
+		if len(args) != 2 {
+			return "bad args"
+		}
+		return _string(args[0]) + "-" + _string(args[1])
+	})
+
+	g := ParseString("first Ada\nlast Lovelace")
+
+	t := NewTemplate(`$joinWith(first, last) $(x = joinWith(last, 'x')) $x`)
+	if s := string(t.Process(g)); s != "Ada-Lovelace  Lovelace-x" {
+		ts.Error("template function:", s)
+	}
+
+	// The context and its function set take precedence
+	fs := NewFunctionSet()
+	fs.AddFunc("joinWith", func(args ...interface{}) interface{} {
+		return "from set"
+	})
+	c := ParseString("first Ada\nlast Lovelace")
+	c.SetFunctions(fs)
+	if s := string(NewTemplate("$joinWith(first, last)").Process(c)); s != "from set" {
+		ts.Error("function set precedence:", s)
+	}
+	c.Add("joinWith").Add("Ada").Add("node")
+	if s := string(NewTemplate("$joinWith(first)").Process(c)); s != "node" {
+		ts.Error("context precedence:", s)
+	}
+}
+
+func TestFunctionQuota(ts *testing.T) {
+
+	calls := 0
+	fs := NewFunctionSet()
+	fs.Add("lookup", func(c *Graph, p *Graph, i int) []byte {
+		calls++
+		return []byte("x")
+	})
+
+	g := NilGraph()
+	g.SetFunctions(fs)
+	g.Add("lookup").Add("!type").Add("function")
+	items := g.Add("items")
+	for i := 0; i < 10; i++ {
+		items.Add(i)
+	}
+
+	t := NewTemplate("$for(n,items)$lookup(n)$end")
+
+	var buf bytes.Buffer
+	err := t.ProcessTo(g, &buf, &TemplateOptions{MaxFunctionCalls: 3})
+	q, ok := err.(*QuotaExceededError)
+	if !ok || q.Function != "lookup" || q.Quota != "MaxFunctionCalls" || q.Limit != 3 {
+		ts.Fatal("quota error:", err)
+	}
+	if calls != 3 || buf.String() != "xxx" {
+		ts.Error("calls made:", calls, buf.String())
+	}
+
+	// Quotas are per render, and per function
+	calls = 0
+	buf.Reset()
+	err = t.ProcessTo(g, &buf, &TemplateOptions{MaxCallsPerFunction: map[string]int{"": 1, "lookup": 5}})
+	if q, ok := err.(*QuotaExceededError); !ok || q.Quota != "MaxCallsPerFunction" || q.Limit != 5 || calls != 5 {
+		ts.Error("per function quota:", err, calls)
+	}
+
+	calls = 0
+	if err = t.ProcessTo(g, &buf, &TemplateOptions{MaxFunctionCalls: 10}); err != nil || calls != 10 {
+		ts.Error("within quota:", err, calls)
+	}
+
+	// Counting is safe for concurrent use
+	qt := newQuota(&TemplateOptions{MaxFunctionCalls: 50, MaxRemoteCalls: 20})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if qt.take("remote", true) == nil {
+					mu.Lock()
+					taken++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 20 || qt.err.(*QuotaExceededError).Quota != "MaxRemoteCalls" {
+		ts.Error("concurrent quota:", taken, qt.err)
+	}
+}
+
+func TestFunctionAddConcurrent(ts *testing.T) {
+
+	echo := func(args ...interface{}) interface{} {
+		return args[0]
+	}
+	TemplateFuncAdd("echoConcurrent", echo)
+
+	t := NewTemplate("$T(a)$echoConcurrent(a)")
+	done := make(chan bool)
+
+	// Run with -race to detect unsynchronized access
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 50; j++ {
+				FunctionAdd(fmt.Sprintf("f%d_%d", i, j), templateProcess)
+				FunctionAddConstructor(fmt.Sprintf("c%d_%d", i, j), newMath)
+				TemplateFuncAdd(fmt.Sprintf("p%d_%d", i, j), echo)
+			}
+			done <- true
+		}(i)
+		go func() {
+			for j := 0; j < 50; j++ {
+				g := NilGraph()
+				g.Add("T").Add("!type").Add("function")
+				g.Add("a").Add("x")
+				if string(t.Process(g)) != "xx" {
+					ts.Error("concurrent Process")
+				}
+			}
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		<-done
+	}
+}
+
+func TestFunctionRemove(ts *testing.T) {
+
+	FunctionAdd("removable", templateProcess)
+	FunctionAddConstructor("removableType", newMath)
+
+	has := func(l []string, s string) bool {
+		for _, x := range l {
+			if x == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !has(FunctionList(), "removable") || !has(FunctionList(), "T") {
+		ts.Error("FunctionList:", FunctionList())
+	}
+	if !has(FunctionConstructorList(), "removableType") {
+		ts.Error("FunctionConstructorList:", FunctionConstructorList())
+	}
+
+	g := NilGraph()
+	g.Add("removable").Add("!type").Add("function")
+	g.Add("a").Add("x")
+	path := NewPath("removable(a)")
+
+	if v, err := g.Node("removable").Function(path, 1, g); err != nil || _string(v) != "x" {
+		ts.Error("function before removal:", v, err)
+	}
+
+	FunctionRemove("removable")
+	FunctionConstructorRemove("removableType")
+
+	if has(FunctionList(), "removable") || has(FunctionConstructorList(), "removableType") {
+		ts.Error("removed names still listed")
+	}
+	if _, err := g.Node("removable").Function(path, 1, g); err == nil || !strings.Contains(err.Error(), "not in table") {
+		ts.Error("function after removal:", err)
+	}
+
+	// Removing an unknown name does nothing
+	FunctionRemove("removable")
+}
+
+type Math struct {
+}
+
+func newMath() interface{} {
+	return &Math{}
+}
+
+func (*Math) Sin(x float64) float64 {
+	return math.Sin(x)
+}
+
+func TestFunction2(t *testing.T) {
+
+	FunctionAddConstructor("math", newMath)
+
+	g := NilGraph()
+	f := g.Add("math")
+	f.Add("!type").Add("math")
+
+	path := NewPath("math.Sin(1.0)")
+
+	i := g.Eval(path)
+	s := _typeOf(i)
+	v := _string(i)[:10]
+
+	if s != "float64" || v != "0.84147098" {
+		t.Error("math.Sin()")
+	}
+}
+
+type tally struct {
+	n, inits int
+}
+
+func (t *tally) Init(g *Graph) {
+	t.inits++
+}
+
+func (t *tally) Inc() int {
+	t.n++
+	return t.n*10 + t.inits
+}
+
+// openConns is a listener that counts its connections still open.
+type openConns struct {
+	net.Listener
+	mu sync.Mutex
+	n  int
+}
+
+func (l *openConns) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.n++
+	l.mu.Unlock()
+	return &countedConn{Conn: c, l: l}, nil
+}
+
+func (l *openConns) open() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+type countedConn struct {
+	net.Conn
+	l    *openConns
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.l.mu.Lock()
+		c.l.n--
+		c.l.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func TestFunction_Objects(t *testing.T) {
+
+	FunctionAddConstructor("tally", func() interface{} { return &tally{} })
+
+	g := ParseString("t\n  !type tally\n  !init")
+	text := g.Text()
+	g.Freeze()
+
+	// An object lives as long as a render, and the context doesn't change
+	for i := 0; i < 2; i++ {
+		s, err := NewTemplate("$t.Inc() $t.Inc()").ProcessE(g)
+		if string(s) != "11 21" || err != nil {
+			t.Errorf("render %d: %q %v", i, s, err)
+		}
+	}
+	h := ParseString("t\n  !type tally\n  !init")
+	NewTemplate("$t.Inc()").Process(h)
+	if g.Text() != text || h.Text() != text {
+		t.Error("context changed:", h.Text())
+	}
+
+	// Remote functions are connected once per render, and closed after it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ol := &openConns{Listener: l}
+	defer l.Close()
+	go ServeRFunction(ol, func(req *Graph) (*Graph, error) {
+		r := NilGraph()
+		r.Add("ok")
+		return r, nil
+	})
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	g = ParseString("r\n  !type rfunction\n  !init\n    host 127.0.0.1\n    port " + port + "\n    timeout 2s")
+	text = g.Text()
+	g.Freeze()
+
+	for i := 0; i < 3; i++ {
+		s, err := NewTemplate("$r.f() $r.f()").ProcessE(g)
+		if string(s) != "ok ok" || err != nil {
+			t.Fatalf("remote render %d: %q %v", i, s, err)
+		}
+	}
+	for i := 0; i < 100 && ol.open() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ol.open(); n != 0 {
+		t.Error("connections left open:", n)
+	}
+	if g.Text() != text {
+		t.Error("remote function context changed:", g.Text())
+	}
+}
+
+type counter struct {
+	N    int
+	Name string
+}
+
+func (c counter) Get() int {
+	return c.N
+}
+
+func (c *counter) Inc(n int) int {
+	c.N += n
+	return c.N
+}
+
+func TestFunction2_PointerReceiver(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("c").Add(counter{N: 1, Name: "hits"})
+
+	call := func(path string) interface{} {
+		v, err := g.Node("c").Function2(NewPath(path), 1, g)
+		if err != nil {
+			t.Error(path, err)
+		}
+		return v
+	}
+
+	if v := call("c.Get()"); v != 1 {
+		t.Error("value receiver:", v)
+	}
+	if v := call("c.Inc(2)"); v != 3 {
+		t.Error("pointer receiver:", v)
+	}
+
+	// The change is made on a copy: evaluating doesn't modify the graph
+	if v := call("c.Get()"); v != 1 {
+		t.Error("value after Inc:", v)
+	}
+	if _, ok := g.Node("c").Out[0].This.(counter); !ok {
+		t.Errorf("stored value is %T", g.Node("c").Out[0].This)
+	}
+	if v := call("c.Name"); v != "hits" {
+		t.Error("field:", v)
+	}
+
+	// Pointers work as before, fields included
+	g.Add("p").Add(&counter{N: 10, Name: "p"})
+	if v, err := g.Node("p").Function2(NewPath("p.Inc(1)"), 1, g); err != nil || v != 11 {
+		t.Error("pointer:", v, err)
+	}
+	if v, err := g.Node("p").Function2(NewPath("p.Name"), 1, g); err != nil || v != "p" {
+		t.Error("pointer field:", v, err)
+	}
+
+	if b := NewTemplate("$c.Inc(1) $c.Get()").Process(g); string(b) != "2 1" {
+		t.Errorf("template: %q", b)
+	}
+
+	// Errors in the arguments are reported
+	_, err := NewTemplate("$c.Inc(nope)").ProcessE(g)
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "nope") {
+		t.Error("argument error:", err)
+	}
+
+	// And calls in them count in the quotas of the render
+	calls := 0
+	fs := NewFunctionSet()
+	fs.AddFunc("two", func(args ...interface{}) interface{} {
+		calls++
+		return 2
+	})
+	g.SetFunctions(fs)
+	var buf bytes.Buffer
+	err = NewTemplate("$two() $c.Inc(two())").ProcessTo(g, &buf, &TemplateOptions{MaxFunctionCalls: 1})
+	if q, ok := err.(*QuotaExceededError); !ok || q.Function != "two" || calls != 1 {
+		t.Error("quota in arguments:", err, calls)
+	}
+}
+
+func TestMethodCache(t *testing.T) {
+
+	for _, x := range []interface{}{counter{}, &counter{}, joiner{}, &Math{}, directory{}, NilGraph()} {
+		v := reflect.ValueOf(x)
+		for i := 0; i < 2; i++ {
+			for j := 0; j < v.NumMethod(); j++ {
+				name := v.Type().Method(j).Name
+				if method(v, name).Type() != v.MethodByName(name).Type() {
+					t.Errorf("%T.%s", x, name)
+				}
+			}
+			if method(v, "NoSuchMethod").IsValid() {
+				t.Errorf("%T.NoSuchMethod", x)
+			}
+		}
+	}
+
+	// Same name, different types
+	g := NilGraph()
+	g.Add("c").Add(counter{N: 7})
+	g.Add("d").Add(directory{"Get": "x"})
+	if b := NewTemplate("$c.Get() $d.Lookup('Get') $c.Get()").Process(g); string(b) != "7 x 7" {
+		t.Errorf("%q", b)
+	}
+}
+
+type directory map[string]string
+
+func (d directory) Lookup(s string) (string, error) {
+	if v, ok := d[s]; ok {
+		return v, nil
+	}
+	return "", errors.New("no entry " + s)
+}
+
+type joiner struct{}
+
+func (joiner) Join(sep string, parts ...string) string {
+	return "<" + strings.Join(parts, sep) + ">"
+}
+
+func (joiner) Sum(n ...int) int {
+	s := 0
+	for _, i := range n {
+		s += i
+	}
+	return s
+}
+
+func TestFunction2_Variadic(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("j").Add(joiner{})
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"j.Join(', ')", "<>"},
+		{"j.Join(', ', 'a')", "<a>"},
+		{"j.Join(', ', 'a', 'b', 'c')", "<a, b, c>"},
+		{"j.Join(',', 1, 2.5, 'x')", "<1,2.5,x>"},
+		{"j.Sum()", 0},
+		{"j.Sum(1, 2, '3')", 6},
+	}
+
+	for _, test := range tests {
+		v, err := g.Node("j").Function2(NewPath(test.path), 1, g)
+		if err != nil || v != test.want {
+			t.Errorf("%s: %v, %v", test.path, v, err)
+		}
+	}
+
+	// Missing fixed argument, argument that doesn't convert
+	if _, err := g.Node("j").Function2(NewPath("j.Join()"), 1, g); err == nil {
+		t.Error("Join() should fail")
+	}
+	if _, err := g.Node("j").Function2(NewPath("j.Sum(1, 'x')"), 1, g); !errors.Is(err, ErrConversion) {
+		t.Error("Sum(1, 'x'):", err)
+	}
+
+	if b := NewTemplate("$j.Join(' ', 'usr', 'local')").Process(g); string(b) != "<usr local>" {
+		t.Errorf("template: %q", b)
+	}
+}
+
+func TestFunction2_Error(t *testing.T) {
+
+	g := NilGraph()
+	g.Add("dir").Add(directory{"a": "1"})
+
+	v, err := g.Node("dir").Function2(NewPath("dir.Lookup('a')"), 1, g)
+	if err != nil || v != "1" {
+		t.Error("nil error:", v, err)
+	}
+
+	v, err = g.Node("dir").Function2(NewPath("dir.Lookup('b')"), 1, g)
+	if err == nil || err.Error() != "no entry b" || v != nil {
+		t.Error("non nil error:", v, err)
+	}
+
+	// Errors reach the caller of templates
+	if _, err = NewTemplate("$dir.Lookup('b')").ProcessE(g); err == nil || !strings.Contains(err.Error(), "no entry b") {
+		t.Error("template:", err)
+	}
+	if b, err := NewTemplate("$dir.Lookup('a')").ProcessE(g); err != nil || string(b) != "1" {
+		t.Error("template:", string(b), err)
+	}
+}
+
+// shapes has methods with the different signatures that templates can call.
+type shapes struct {
+	calls *int
+}
+
+func (s shapes) Void()               { *s.calls++ }
+func (s shapes) One() string         { return "one" }
+func (s shapes) Fail() error         { return errors.New("failed") }
+func (s shapes) Ok() error           { return nil }
+func (s shapes) Pair() (string, int) { return "a", 1 }
+func (s shapes) Triple(fail bool) (string, int, error) {
+	if fail {
+		return "", 0, errors.New("triple failed")
+	}
+	return "b", 2, nil
+}
+func (s shapes) Args(i int, f float64, b bool) string {
+	return fmt.Sprint(i*2, f/2, !b)
+}
+
+func TestFunction2_Results(t *testing.T) {
+
+	n := 0
+	g := NilGraph()
+	g.Add("s").Add(shapes{&n})
+
+	for _, c := range []struct {
+		tpl, out, err string
+	}{
+		{"[$s.Void()]", "[]", ""},
+		{"[$s.One()]", "[one]", ""},
+		{"[$s.Ok()]", "[]", ""},
+		{"[$s.Fail()]", "[]", "s.Fail(): failed"},
+		{"[$s.Pair()]", "[a\n1]", ""},
+		{"[$s.Triple('false')]", "[b\n2]", ""},
+		{"[$s.Triple('true')]", "[]", "triple failed"},
+		{"[$s.Args('3', '5', 'true')]", "[6 2.5 false]", ""},
+		{"[$s.Args(3, 5, 'false')]", "[6 2.5 true]", ""},
+		{"[$s.Args(1, 2)]", "[]", "Args: 2 arguments, want 3"},
+		{"[$s.Args('x', 2, 0)]", "[]", "argument 1 (string) to int"},
+	} {
+		b, err := NewTemplate(c.tpl).ProcessE(g)
+		if string(b) != c.out || c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("%s: %q %v", c.tpl, b, err)
+		}
+	}
+	if n != 1 {
+		t.Error("Void not called")
+	}
+
+	// Function2 returns nil for no value, and a Graph for several
+	p := NewPath("s.Void()")
+	if v, err := g.Node("s").Function2(p, 1, g); v != nil || err != nil {
+		t.Error("Void:", v, err)
+	}
+	p = NewPath("s.Pair()")
+	if v, err := g.Node("s").Function2(p, 1, g); err != nil || v.(*Graph).Text() != "a\n1" {
+		t.Error("Pair:", v, err)
+	}
+}
+
+// log.go
+
+// rfServer starts a remote function server that echoes requests. With
+// mode "once", the first connection is closed after one response; with
+// "drop", connections are closed without response, and with "mute" they
+// are never answered. It returns the configuration to reach it and a
+// function giving the number of connections accepted.
+func rfServer(t *testing.T, mode string, settings string) (*Graph, func() int) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	accepted := 0
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			first := accepted == 1
+			mu.Unlock()
+
+			go func() {
+				defer conn.Close()
+				p := NewBinParser(conn)
+				for {
+					g, err := p.parse()
+					if err != nil || mode == "drop" {
+						return
+					}
+					if mode == "mute" {
+						continue
+					}
+					if mode == "garbage" {
+						conn.Write([]byte("not binary OGDL"))
+						continue
+					}
+					conn.Write(g.Binary())
+					if mode == "once" && first {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	cfg := ParseString("host 127.0.0.1\nport " + port + "\n" + settings)
+
+	return cfg, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+func TestRFunction_Reconnect(t *testing.T) {
+
+	cfg, accepted := rfServer(t, "once", "timeout 2s\npool 2")
+	rf, err := NewRFunction(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// The server closes the connection after the first call: the second
+	// one reconnects transparently
+	for _, s := range []string{"a", "b", "c"} {
+		r, err := rf.Call(NewGraph(s))
+		if err != nil || r.GetAt(0).String() != s {
+			t.Fatal("call", s, err)
+		}
+	}
+	if n := accepted(); n != 2 {
+		t.Error("connections:", n)
+	}
+
+	// Concurrent calls use several connections
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if r, err := rf.Call(NewGraph(i)); err != nil || r.GetAt(0).String() != strconv.Itoa(i) {
+				t.Error("concurrent call", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRFunction_Errors(t *testing.T) {
+
+	cfg, accepted := rfServer(t, "drop", "")
+	rf, err := NewRFunction(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retried once, and then the error tells the address
+	_, err = rf.Call(NewGraph("a"))
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:"+cfg.Node("port").GetAt(0).String()) || accepted() != 2 {
+		t.Error("dropped connection:", err, accepted())
+	}
+
+	// Errors after the request was sent are not retried: the server may
+	// have run it
+	cfg, accepted = rfServer(t, "mute", "timeout\n  read 50ms")
+	if rf, err = NewRFunction(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var ne net.Error
+	if _, err = rf.Call(NewGraph("a")); !errors.As(err, &ne) || !ne.Timeout() || accepted() != 1 {
+		t.Error("read timeout:", err, accepted())
+	}
+
+	cfg, accepted = rfServer(t, "garbage", "timeout\n  read 1s")
+	if rf, err = NewRFunction(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rf.Call(NewGraph("a")); err == nil || errors.As(err, &ne) || accepted() != 1 {
+		t.Error("invalid response:", err, accepted())
+	}
+
+	if _, err = NewRFunction(ParseString("host 127.0.0.1\nport 1\ntimeout x")); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+}
+
+func TestServeRFunction(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var inits int
+
+	// sum adds its arguments, fail and panic fail
+	handler := func(req *Graph) (*Graph, error) {
+		switch req.GetAt(0).String() {
+		case "init":
+			mu.Lock()
+			inits++
+			mu.Unlock()
+			return NewGraph("ok"), nil
+		case "sum":
+			var n int64
+			for _, a := range req.GetAt(0).Out {
+				i, _ := a.Int64()
+				n += i
+			}
+			r := NilGraph()
+			r.Add("result").Add(n)
+			return r, nil
+		case "fail":
+			return nil, errors.New("failed")
+		case "panic":
+			panic("oops")
+		}
+		return req, nil
+	}
+
+	done := make(chan error)
+	go func() { done <- ServeRFunction(l, handler) }()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	rf, err := NewRFunction(ParseString("host 127.0.0.1\nport " + port + "\ntimeout 2s\ninit\n  x 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Several calls on the same connection
+	for i := 0; i < 3; i++ {
+		r, err := rf.Call(ParseString("sum (1, 2, " + strconv.Itoa(i) + ")"))
+		if n, _ := r.GetInt64("result"); err != nil || n != int64(3+i) {
+			t.Error("sum:", r.Text(), err)
+		}
+	}
+	mu.Lock()
+	if inits != 1 {
+		t.Error("init calls:", inits)
+	}
+	mu.Unlock()
+
+	// Errors are returned to the caller, and the connection goes on
+	var re *RemoteError
+	if _, err = rf.Call(NewGraph("fail")); !errors.As(err, &re) || re.Message != "failed" {
+		t.Error("handler error:", err)
+	}
+	if _, err = rf.Call(NewGraph("panic")); !errors.As(err, &re) || !strings.Contains(re.Message, "oops") {
+		t.Error("handler panic:", err)
+	}
+	if r, err := rf.Call(NewGraph("echo")); err != nil || r.GetAt(0).String() != "echo" {
+		t.Error("call after errors:", err)
+	}
+	rf.Close()
+
+	// Malformed requests are answered, and the connection is kept
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	p := NewBinParser(conn)
+	conn.Write([]byte("not binary OGDL"))
+	if r, err := p.ParseE(); err != nil || remoteError(r) == nil || !strings.Contains(r.GetAt(0).GetAt(0).String(), "invalid binary") {
+		t.Error("malformed request:", r.Text(), err)
+	}
+	conn.Write(NewGraph("again").Binary())
+	if r, err := p.ParseE(); err != nil || r.GetAt(0).String() != "again" {
+		t.Error("request after a malformed one:", r.Text(), err)
+	}
+
+	// Closing the listener ends the connections left, and the server
+	l.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error("ServeRFunction:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server still running")
+	}
+	if _, err = p.ParseE(); err == nil {
+		t.Error("connection open after shutdown")
+	}
+	conn.Close()
+}
+
+func TestLog(t *testing.T) {
+
+	file := "/tmp/log.gb"
+
+	log, _ := OpenLog(file)
+
+	g := ParseString("a b, c, d")
+	b := g.Binary()
+
+	n := log.Add(g)
+	m := log.Add(g)
+	o := log.AddBinary(b)
+
+	if n != 0 || m != 16 || o != 32 {
+		t.Error("log.Add", o)
+	}
+
+	g2, _, n2 := log.Get(0)
+	g3, _, n3 := log.Get(n2)
+	b2, _, _ := log.GetBinary(n3)
+
+	g4 := BinParse(b2)
+
+	if !g.Equal(g2) {
+		t.Error("n!=n2")
+	}
+
+	if !g.Equal(g3) {
+		t.Error("n!=n3")
+	}
+
+	if !g.Equal(g4) {
+		t.Error("n!=n3")
+	}
+
+	log.Sync()
+
+	log.Close()
+
+	os.Remove(file)
+}
+
+func TestLog_ForEach(t *testing.T) {
+
+	log, err := OpenLog(t.TempDir() + "/log.gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	records := []*Graph{ParseString("a b"), ParseString("c\n  d\n  e"), ParseString("f")}
+	var pos []int64
+	for _, g := range records {
+		pos = append(pos, log.Add(g))
+	}
+
+	i := 0
+	err = log.ForEach(func(p int64, g *Graph) error {
+		if i >= len(records) || p != pos[i] || !g.Equal(records[i]) {
+			t.Errorf("record %d at %d: %s", i, p, g.Text())
+		}
+		i++
+		return nil
+	})
+	if err != nil || i != 3 {
+		t.Error("ForEach visited", i, "records:", err)
+	}
+
+	// fn stops the iteration with an error
+	stop := errors.New("stop")
+	i = 0
+	err = log.ForEach(func(p int64, g *Graph) error {
+		i++
+		if i == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || i != 2 {
+		t.Error("ForEach not stopped:", i, err)
+	}
+
+	// A truncated last record
+	log.Truncate(pos[2] + 2)
+	i = 0
+	err = log.ForEach(func(p int64, g *Graph) error {
+		i++
+		return nil
+	})
+	if err != ErrLogTruncated || i != 2 {
+		t.Error("truncated log:", i, err)
+	}
+}
+
+func TestLog_Count(t *testing.T) {
+
+	file := t.TempDir() + "/log.gb"
+	log, err := OpenLogWith(file, &LogOptions{Preamble: &Preamble{SchemaVersion: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	if n, err := log.Count(); n != 0 || err != nil {
+		t.Error("empty log:", n, err)
+	}
+
+	var pos int64
+	for i := 0; i < 10; i++ {
+		pos = log.Add(ParseString("a " + strconv.Itoa(i) + "\nb\n  c"))
+	}
+	if n, err := log.Count(); n != 10 || err != nil {
+		t.Error("Count:", n, err)
+	}
+
+	log.Truncate(pos + 3)
+	if n, err := log.Count(); n != 9 || err != ErrLogTruncated {
+		t.Error("truncated log:", n, err)
+	}
+}
+
+func TestLog_Checksums(t *testing.T) {
+
+	file := t.TempDir() + "/log.gb"
+	log, err := OpenLogWith(file, &LogOptions{Preamble: &Preamble{SchemaVersion: 1}, Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	var pos []int64
+	for i := 0; i < 3; i++ {
+		pos = append(pos, log.Add(ParseString("a "+strconv.Itoa(i))))
+	}
+	pos = append(pos, log.AddBinary(ParseString("b").Binary()))
+
+	for i, p := range pos[:3] {
+		g, err, next := log.Get(p)
+		if err != nil || g.Text() != "a\n  "+strconv.Itoa(i) {
+			t.Fatal("Get:", p, g.Text(), err)
+		}
+		if next != pos[i+1] {
+			t.Error("next:", next, pos[i+1])
+		}
+	}
+	if g, _, _ := log.Read(pos[3]); g.Text() != "b" {
+		t.Error("AddBinary:", g.Text())
+	}
+	if n, err := log.Count(); n != 4 || err != nil {
+		t.Error("Count:", n, err)
+	}
+	_, _, end := log.Get(pos[3])
+	if g, err, next := log.Get(end); g != nil || err != nil || next != -1 {
+		t.Error("end of log:", g, err, next)
+	}
+
+	// Flip a byte of the second object
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b [1]byte
+	f.ReadAt(b[:], pos[1]+9)
+	b[0] ^= 0x20
+	f.WriteAt(b[:], pos[1]+9)
+	f.Close()
+
+	if _, err, _ := log.Get(pos[0]); err != nil {
+		t.Error("valid record:", err)
+	}
+	if g, err, _ := log.Get(pos[1]); g != nil || err != ErrCorrupt {
+		t.Error("Get:", g, err)
+	}
+	if _, _, err := log.Read(pos[1]); err != ErrCorrupt {
+		t.Error("Read:", err)
+	}
+	if _, _, err := log.ReadBinary(pos[1]); err != ErrCorrupt {
+		t.Error("ReadBinary:", err)
+	}
+	if at, err := log.Iterate(func(int64, *Graph) bool { return true }); at != pos[1] || err != ErrCorrupt {
+		t.Error("Iterate:", at, err)
+	}
+
+	// A length beyond the end of the log is rejected before reading
+	f, _ = os.OpenFile(file, os.O_RDWR, 0)
+	f.WriteAt([]byte{0xf0}, pos[2])
+	f.Close()
+	var m0, m1 runtime.MemStats
+	runtime.ReadMemStats(&m0)
+	if _, _, err := log.Read(pos[2]); err != ErrLogTruncated {
+		t.Error("corrupt length:", err)
+	}
+	runtime.ReadMemStats(&m1)
+	if m1.TotalAlloc-m0.TotalAlloc > 1<<20 {
+		t.Error("corrupt length allocated", m1.TotalAlloc-m0.TotalAlloc)
+	}
+
+	// A record cut short
+	log.Truncate(pos[3] + 5)
+	if _, _, err := log.Read(pos[3]); err != ErrLogTruncated {
+		t.Error("truncated:", err)
+	}
+
+	// Logs without checksums are read as before
+	log2, err := OpenLog(t.TempDir() + "/plain.gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Close()
+	p := log2.Add(ParseString("c 1"))
+	if g, err, _ := log2.Get(p); err != nil || g.Text() != "c\n  1" {
+		t.Error("plain log:", g.Text(), err)
+	}
+}
+
+func TestLog_Rotate(t *testing.T) {
+
+	file := t.TempDir() + "/log.gb"
+	log, err := OpenLogWith(file, &LogOptions{Preamble: &Preamble{SchemaVersion: 3}, MaxSize: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	type entry struct {
+		seg int
+		pos int64
+	}
+	var l []entry
+	for i := 0; log.Segment() < 3; i++ {
+		p := log.Add(ParseString("n " + strconv.Itoa(i)))
+		l = append(l, entry{log.Segment(), p})
+	}
+
+	if log.SegmentFile(1) != file+".1" || log.SegmentFile(3) != file {
+		t.Error("SegmentFile:", log.SegmentFile(1), log.SegmentFile(3))
+	}
+
+	for seg := 1; seg <= 3; seg++ {
+		sl, err := OpenLog(log.SegmentFile(seg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sl.Preamble() == nil || sl.Preamble().SchemaVersion != 3 {
+			t.Error("preamble of segment", seg, sl.Preamble())
+		}
+		for i, e := range l {
+			if e.seg != seg {
+				continue
+			}
+			g, _, err := sl.Read(e.pos)
+			if err != nil || g.Text() != "n\n  "+strconv.Itoa(i) {
+				t.Error("segment", seg, e.pos, g.Text(), err)
+			}
+		}
+		sl.Close()
+	}
+
+	// Reopening finds the segments rotated
+	log2, err := OpenLogWith(file, &LogOptions{MaxSize: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Close()
+	if log2.Segment() != 3 {
+		t.Error("reopened:", log2.Segment())
+	}
+}
+
+func TestLog_Index(t *testing.T) {
+
+	for _, checksums := range []bool{false, true} {
+		file := t.TempDir() + "/log.gb"
+		opts := &LogOptions{Preamble: &Preamble{SchemaVersion: 1}, Checksums: checksums}
+		log, err := OpenLogWith(file, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := []string{"a", "b", "c", "d"}
+		add := func(from, to int) {
+			for i := from; i < to; i++ {
+				log.AddIndexed(keys[i%len(keys)], ParseString("n "+strconv.Itoa(i)))
+				log.Add(ParseString("plain " + strconv.Itoa(i)))
+			}
+		}
+		check := func(when string, n int) {
+			for j, k := range keys {
+				last := n - 1 - (n-1-j)%len(keys)
+				g, err := log.Lookup(k)
+				if v, _ := g.GetInt64("n"); err != nil || v != int64(last) || g.Len() != 1 {
+					t.Errorf("%s %v: Lookup(%s) = %v %v", when, checksums, k, g.Text(), err)
+				}
+				l, err := log.LookupAll(k)
+				if err != nil || len(l) != (n-j+len(keys)-1)/len(keys) {
+					t.Errorf("%s %v: LookupAll(%s) = %d %v", when, checksums, k, len(l), err)
+					continue
+				}
+				for x, g := range l {
+					if v, _ := g.GetInt64("n"); v != int64(j+x*len(keys)) {
+						t.Errorf("%s %v: LookupAll(%s)[%d] = %s", when, checksums, k, x, g.Text())
+					}
+				}
+			}
+			if _, err := log.Lookup("x"); err != ErrNotFound {
+				t.Error(when, "unknown key:", err)
+			}
+		}
+		reopen := func() {
+			log.Close()
+			if log, err = OpenLogWith(file, opts); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		add(0, 10)
+		check("added", 10)
+
+		// Plain reads see the key
+		if g, _, _ := log.Read(0); g.Get("'!key'").String() != "a" {
+			t.Error("key node:", g.Text())
+		}
+
+		// Rebuilt without the index file
+		reopen()
+		os.Remove(file + ".idx")
+		check("rebuilt", 10)
+		add(10, 14)
+		check("added after rebuild", 14)
+
+		// An index file that is behind the log is completed
+		idx, _ := os.ReadFile(file + ".idx")
+		add(14, 20)
+		reopen()
+		os.WriteFile(file+".idx", idx, 0666)
+		check("stale", 20)
+
+		// And one that doesn't match the log is rebuilt
+		reopen()
+		os.WriteFile(file+".idx", []byte("junk"), 0666)
+		check("invalid", 20)
+
+		// Positions change with Compact
+		log.Compact(func(pos int64, g *Graph) bool { return g.Node("plain") == nil })
+		check("compacted", 20)
+		if n, _ := log.Count(); n != 20 {
+			t.Error("Count after Compact:", n)
+		}
+		log.Close()
+	}
+}
+
+func TestLog_Compact(t *testing.T) {
+
+	file := t.TempDir() + "/log.gb"
+	log, err := OpenLogWith(file, &LogOptions{Preamble: &Preamble{SchemaVersion: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	var pos []int64
+	for i := 0; i < 10; i++ {
+		pos = append(pos, log.Add(ParseString("n "+strconv.Itoa(i))))
+	}
+
+	// Drop every other object
+	m, err := log.Compact(func(p int64, g *Graph) bool {
+		i, _ := g.GetInt64("n")
+		return i%2 == 0
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 5 {
+		t.Error("positions:", m)
+	}
+
+	for i, p := range pos {
+		q, ok := m[p]
+		if ok != (i%2 == 0) {
+			t.Error("position of", i, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		g, _, err := log.Read(q)
+		if n, _ := g.GetInt64("n"); err != nil || n != int64(i) {
+			t.Errorf("object %d at %d: %v %v", i, q, g, err)
+		}
+	}
+	if n, _ := log.Count(); n != 5 {
+		t.Error("Count after Compact:", n)
+	}
+
+	// The log can be appended to, and reopened with its preamble
+	p := log.Add(ParseString("n 10"))
+	if g, _, _ := log.Read(p); g.Get("n").String() != "10" {
+		t.Error("Add after Compact")
+	}
+	log.Close()
+
+	log, err = OpenLog(file)
+	if err != nil || log.Preamble() == nil || log.Preamble().SchemaVersion != 2 {
+		t.Fatal("reopen:", err)
+	}
+	if n, _ := log.Count(); n != 6 {
+		t.Error("Count after reopen:", n)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left")
+	}
+
+	// Truncated logs are not compacted
+	log.Truncate(p + 2)
+	if _, err := log.Compact(func(int64, *Graph) bool { return true }); err != ErrLogTruncated {
+		t.Error("truncated log compacted:", err)
+	}
+	log.Close()
+}
+
+func TestLog_CompactWhileReading(t *testing.T) {
+
+	for _, checksums := range []bool{false, true} {
+		log, err := OpenLogWith(t.TempDir()+"/log.gb", &LogOptions{Checksums: checksums})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			log.Add(ParseString("n " + strconv.Itoa(i)))
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := log.FollowWith(ctx, Checkpoint{}, &FollowOptions{Buffer: 1, Poll: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := (<-f.C).Checkpoint
+
+		// Iterate at the same time
+		done := make(chan error)
+		go func() {
+			_, err := log.Iterate(func(int64, *Graph) bool { return true })
+			done <- err
+		}()
+
+		if _, err = log.Compact(func(p int64, g *Graph) bool {
+			n, _ := g.GetInt64("n")
+			return n%2 == 1
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = <-done; err != nil && err != ErrCheckpointInvalid {
+			t.Error("Iterate during Compact:", err)
+		}
+
+		// The follower ends at the last record it delivered
+		for r := range f.C {
+			last = r.Checkpoint
+		}
+		var ce *CheckpointError
+		if !errors.As(f.Err(), &ce) || ce.Checkpoint != last {
+			t.Errorf("follower after Compact: %v", f.Err())
+		}
+		cancel()
+
+		if n, err := log.Count(); n != 50 || err != nil {
+			t.Error("Count after Compact:", n, err)
+		}
+		log.Close()
+	}
+}
+
+func TestLog_RotateWhileReading(t *testing.T) {
+
+	for _, checksums := range []bool{false, true} {
+		log, err := OpenLogWith(t.TempDir()+"/log.gb", &LogOptions{MaxSize: 40, Checksums: checksums})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := log.FollowWith(ctx, Checkpoint{}, &FollowOptions{Buffer: 1, Poll: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The follower reads while the log rotates
+		go func() {
+			for i := 0; i < 10; i++ {
+				log.Add(ParseString("n " + strconv.Itoa(i)))
+			}
+		}()
+
+		for i := 0; i < 10; i++ {
+			select {
+			case r, ok := <-f.C:
+				if !ok {
+					t.Fatal("follower ended:", f.Err())
+				}
+				if n, _ := r.Graph.GetInt64("n"); n != int64(i) {
+					t.Fatalf("record %d: n %d", i, n)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout at record", i)
+			}
+		}
+		cancel()
+		for range f.C {
+		}
+		if f.Err() != nil && f.Err() != context.Canceled {
+			t.Error("follower:", f.Err())
+		}
+		if log.Segment() < 2 {
+			t.Error("no rotation, segment", log.Segment())
+		}
+
+		// Iterate stops when fn makes the log rotate
+		_, err = log.Iterate(func(int64, *Graph) bool {
+			for seg := log.Segment(); log.Segment() == seg; {
+				log.Add(ParseString("n 10"))
+			}
+			return true
+		})
+		if err != ErrCheckpointInvalid {
+			t.Error("Iterate during rotation:", err)
+		}
+		log.Close()
+	}
+}
+
+func TestLog_ConcurrentAdd(t *testing.T) {
+
+	log, err := OpenLog(t.TempDir() + "/log.gb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	log.autoSync = false
+
+	const writers, adds = 8, 50
+
+	type entry struct {
+		pos int64
+		g   *Graph
+	}
+	entries := make(chan entry, writers*adds)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				g := ParseString(fmt.Sprintf("writer %d\nentry %d\ndata %s", w, i, strings.Repeat("x", w*10+i)))
+				var pos int64
+				if i%2 == 0 {
+					pos = log.Add(g)
+				} else {
+					pos = log.AddBinary(g.Binary())
+				}
+				entries <- entry{pos, g}
+				if _, _, err := log.Read(pos); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(entries)
+
+	seen := map[int64]bool{}
+	for e := range entries {
+		if seen[e.pos] {
+			t.Error("position returned twice:", e.pos)
+		}
+		seen[e.pos] = true
+		g, _, err := log.Read(e.pos)
+		if err != nil || !g.Equal(e.g) {
+			t.Errorf("entry at %d: %v", e.pos, err)
+		}
+	}
+	if n, err := log.Count(); n != writers*adds || err != nil {
+		t.Error("Count:", n, err)
+	}
+}
+
+func TestLog_Iterate(t *testing.T) {
 
-	// 'a' is a string constant
-	p := NewExpression("a=='b'")
-	r := g.Eval(p)
+	file := t.TempDir() + "/log.gb"
 
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("a=='b'")
+	log, err := OpenLog(file)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	p = NewExpression("'a'!='b'")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	records := []*Graph{ParseString("a b"), ParseString("c\n  d\n  e"), ParseString("f")}
+	var pos []int64
+	for _, g := range records {
+		pos = append(pos, log.Add(g))
 	}
+	size := pos[2] + int64(len(records[2].Binary()))
 
-	p = NewExpression("2>1")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	// Read and ReadBinary walk the log with the error last
+	var i int64
+	for k, g := range records {
+		g2, next, err := log.Read(i)
+		if err != nil || !g.Equal(g2) {
+			t.Fatal("Read:", k, err)
+		}
+		b, next2, err := log.ReadBinary(i)
+		if err != nil || next2 != next || !bytes.Equal(b, g.Binary()) {
+			t.Fatal("ReadBinary:", k, err)
+		}
+		i = next
 	}
-	p = NewExpression("2>=2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	if _, _, err := log.Read(i); err != io.EOF {
+		t.Error("Read at end:", err)
 	}
-	p = NewExpression("1<2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+
+	// Cut the last record in the middle
+	log.Close()
+	os.Truncate(file, size-2)
+	log, _ = OpenLog(file)
+	defer log.Close()
+
+	var got []int64
+	end, err := log.Iterate(func(p int64, g *Graph) bool {
+		if !g.Equal(records[len(got)]) {
+			t.Error("record", len(got))
+		}
+		got = append(got, p)
+		return true
+	})
+	if err != ErrLogTruncated || end != pos[2] || len(got) != 2 || got[1] != pos[1] {
+		t.Fatal("Iterate:", got, end, err)
 	}
-	p = NewExpression("1<=2")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error("'a'!='b'")
+	if _, _, err := log.Read(pos[2]); err != ErrLogTruncated {
+		t.Error("Read of truncated record:", err)
 	}
-	p = NewExpression("1<0")
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != false {
-		t.Error("'a'!='b'")
+	if _, err, next := log.Get(pos[2]); err != io.ErrUnexpectedEOF || next != -1 {
+		t.Error("Get of truncated record:", err, next)
 	}
 
-	// logic
-	e := "'false' || 'true'"
-	p = NewExpression(e)
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error(e)
+	// Recover and continue appending
+	if err := log.Truncate(end); err != nil {
+		t.Fatal(err)
 	}
-	e = "'true' && 'true'"
-	p = NewExpression(e)
-	r = g.Eval(p)
-	if _typeOf(r) != "bool" || r != true {
-		t.Error(e)
-	}
-
-	// Assign
-	g = NilGraph()
-	e = "a=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	log.Add(records[2])
 
-	if i, _ := g.GetInt64("a"); i != 1 {
-		t.Error(e, _typeOf(g), _text(g))
+	n := 0
+	end, err = log.Iterate(func(p int64, g *Graph) bool {
+		n++
+		return true
+	})
+	if err != nil || n != 3 || end != size {
+		t.Error("Iterate after recovery:", n, end, err)
 	}
 
-	e = "a+=12"
-	p = NewExpression(e)
-	g.Eval(p)
+	// Stopping early
+	end, err = log.Iterate(func(p int64, g *Graph) bool { return false })
+	if err != nil || end != pos[1] {
+		t.Error("Iterate stopped:", end, err)
+	}
 
-	if i, _ := g.GetInt64("a"); i != 13 {
-		t.Error(e, _typeOf(g), _text(g))
+	// Garbage at the end
+	log.AddBinary([]byte("xyz"))
+	end, err = log.Iterate(func(p int64, g *Graph) bool { return true })
+	if err != ErrLogTruncated || end != size {
+		t.Error("Iterate with garbage:", end, err)
 	}
+	if _, err, _ := log.Get(size); !errors.Is(err, ErrInvalidBinary) {
+		t.Error("Get of garbage:", err)
+	}
+}
 
-	e = "a-=1"
-	p = NewExpression(e)
-	g.Eval(p)
+func TestLogFollow(t *testing.T) {
 
-	if i, _ := g.GetInt64("a"); i != 12 {
-		t.Error(e, _typeOf(g), _text(g))
-	}
+	dir := t.TempDir()
+	file := dir + "/follow.gb"
+	sidecar := dir + "/consumer.checkpoint"
 
-	e = "a*=2"
-	p = NewExpression(e)
-	g.Eval(p)
+	log, err := OpenLogWith(file, &LogOptions{Preamble: &Preamble{SchemaVersion: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
 
-	if i, _ := g.GetInt64("a"); i != 24 {
-		t.Error(e, _typeOf(g), _text(g))
+	add := func(from, to int) {
+		for i := from; i < to; i++ {
+			log.Add(ParseString("n " + strconv.Itoa(i)))
+		}
 	}
 
-	e = "a/=4"
-	p = NewExpression(e)
-	g.Eval(p)
+	var processed []string
 
-	if i, _ := g.GetInt64("a"); i != 6 {
-		t.Error(e, _typeOf(g), _text(g))
-	}
+	// consume processes records, saving the checkpoint of each, until n
+	// have been processed in total, and then is killed.
+	consume := func(n int) {
+		c, err := LoadCheckpoint(sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-	e = "a%=4"
-	p = NewExpression(e)
-	g.Eval(p)
+		f, err := log.FollowWith(ctx, c, &FollowOptions{Buffer: 2, Poll: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if i, _ := g.GetInt64("a"); i != 2 {
-		t.Error(e, _typeOf(g), _text(g))
+		timeout := time.After(5 * time.Second)
+		for len(processed) < n {
+			select {
+			case r := <-f.C:
+				processed = append(processed, r.Graph.Get("n").String())
+				if err := r.Checkpoint.Save(sidecar); err != nil {
+					t.Fatal(err)
+				}
+			case <-timeout:
+				t.Fatal("timeout, processed", len(processed))
+			}
+		}
+		cancel()
+		for range f.C {
+		}
+		if f.Err() != context.Canceled {
+			t.Error("Err:", f.Err())
+		}
 	}
 
-	// b non existent
-	e = "b+=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	add(0, 20)
+	consume(7)
 
-	if i, _ := g.GetInt64("b"); i != 1 {
-		t.Error(e, _typeOf(g), _text(g))
-	}
+	// Records added while the consumer is down, and while it runs
+	add(20, 25)
+	go add(25, 30)
+	consume(30)
 
-	// c non existent
-	e = "c-=1"
-	p = NewExpression(e)
-	g.Eval(p)
+	if len(processed) != 30 {
+		t.Fatal("processed", len(processed))
+	}
+	for i, s := range processed {
+		if s != strconv.Itoa(i) {
+			t.Fatal("lost or duplicated records:", processed)
+		}
+	}
 
-	if i, _ := g.GetInt64("c"); i != -1 {
-		t.Error(e, _typeOf(g), _text(g))
+	// A slow consumer: reading stops when the buffer is full
+	ctx, cancel := context.WithCancel(context.Background())
+	f, err := log.FollowWith(ctx, Checkpoint{}, &FollowOptions{Buffer: 3, Poll: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(f.C) != 3 || cap(f.C) != 3 {
+		t.Error("buffer:", len(f.C), cap(f.C))
 	}
+	cancel()
+}
 
-	// d non existent
-	e = "d*=1"
-	p = NewExpression(e)
-	g.Eval(p)
+func TestLogFollow_InvalidCheckpoint(t *testing.T) {
 
-	if i, _ := g.GetInt64("d"); i != 0 {
-		t.Error(e, _typeOf(g), _text(g))
+	file := t.TempDir() + "/follow.gb"
+	log, err := OpenLog(file)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer log.Close()
 
-	// e non existent
-	e = "e/=1"
-	p = NewExpression(e)
-	g.Eval(p)
-
-	if _, err := g.GetInt64("e"); err == nil {
-		t.Error(e, _typeOf(g), _text(g))
+	for i := 0; i < 5; i++ {
+		log.Add(ParseString("n " + strconv.Itoa(i)))
 	}
 
-	e = "1+2"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if r != int64(3) {
-		t.Error(e, _typeOf(r), _text(r))
+	f, err := log.Follow(ctx, Checkpoint{})
+	if err != nil {
+		t.Fatal(err)
 	}
+	var c Checkpoint
+	for i := 0; i < 3; i++ {
+		c = (<-f.C).Checkpoint
+	}
+	cancel()
 
-	e = "1+2.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
-
-	if r != float64(3) {
-		t.Error(e, _typeOf(r), _text(r))
+	// Still valid: the next record is n 3
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	if f, err = log.Follow(ctx, c); err != nil || (<-f.C).Graph.Get("n").String() != "3" {
+		t.Fatal("valid checkpoint:", err)
 	}
 
-	e = "1.0+2.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	// The log is rewritten (as by a compaction) with other records
+	if err = log.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		log.Add(ParseString("m " + strconv.Itoa(i)))
+	}
 
-	if r != float64(3) {
-		t.Error(e, _typeOf(r), _text(r))
+	_, err = log.Follow(ctx, c)
+	var ce *CheckpointError
+	if !errors.Is(err, ErrCheckpointInvalid) || !errors.As(err, &ce) || ce.Checkpoint != c || ce.Restart != (Checkpoint{}) {
+		t.Fatal("rewritten log:", err)
+	}
+	if f, err = log.Follow(ctx, ce.Restart); err != nil || (<-f.C).Graph.Get("m").String() != "0" {
+		t.Error("restart:", err)
 	}
 
-	e = "2-4"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	// Truncated before the checkpoint
+	log.Truncate(c.Prev)
+	if _, err = log.Follow(ctx, c); !errors.Is(err, ErrCheckpointInvalid) {
+		t.Error("truncated log:", err)
+	}
 
-	if r != int64(-2) {
-		t.Error(e, _typeOf(r), _text(r))
+	// Sidecar files
+	sidecar := t.TempDir() + "/c"
+	if c2, err := LoadCheckpoint(sidecar); err != nil || c2 != (Checkpoint{}) {
+		t.Error("missing sidecar:", c2, err)
 	}
+	c.Hash = math.MaxUint32
+	if err = c.Save(sidecar); err != nil {
+		t.Fatal(err)
+	}
+	if c2, err := LoadCheckpoint(sidecar); err != nil || c2 != c {
+		t.Error("sidecar:", c2, err)
+	}
+	os.WriteFile(sidecar, []byte("offset x"), 0666)
+	if _, err = LoadCheckpoint(sidecar); err == nil {
+		t.Error("invalid sidecar")
+	}
+}
 
-	e = "10*3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+func TestPreamble(t *testing.T) {
 
-	if r != int64(30) {
-		t.Error(e, _typeOf(r), _text(r))
+	full := &Preamble{TypedScalars: true, Compression: "zstd", KeyID: "k2", SchemaVersion: 3}
+	caps := &Capabilities{TypedScalars: true, Compression: []string{"gzip", "zstd"}, KeyIDs: []string{"k1", "k2"}, MaxSchemaVersion: 3}
+	g := ParseString("a b\nc")
+
+	for _, pr := range []*Preamble{nil, {}, {Compression: "gzip"}, full} {
+		var buf bytes.Buffer
+		if _, err := g.BinaryTo(&buf, &BinaryOptions{Preamble: pr}); err != nil {
+			t.Fatal(err)
+		}
+		g.WriteBinary(&buf)
+
+		p := NewBinParser(&buf)
+		p.Capabilities = caps
+		for i := 0; i < 2; i++ {
+			if h, err := p.parse(); err != nil || !h.Equal(g) {
+				t.Fatal("decoding", pr, err)
+			}
+		}
+		if pr == nil && p.Preamble() != nil || pr != nil && !reflect.DeepEqual(p.Preamble(), pr) {
+			t.Errorf("preamble %v read as %v", pr, p.Preamble())
+		}
 	}
 
-	e = "10.0*3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	// Readers without some features fail before decoding
+	for _, c := range []struct {
+		caps *Capabilities
+		err  string
+	}{
+		{&Capabilities{}, "unsupported feature: typed scalars, compression zstd, encryption key k2"},
+		{&Capabilities{TypedScalars: true, Compression: []string{"gzip"}, KeyIDs: []string{"k2"}, MaxSchemaVersion: 2}, "unsupported feature: compression zstd, schema version 3"},
+		{&Capabilities{TypedScalars: true, Compression: []string{"zstd"}, KeyIDs: []string{"k1"}}, "unsupported feature: encryption key k2"},
+	} {
+		var buf bytes.Buffer
+		g.BinaryTo(&buf, &BinaryOptions{Preamble: full})
+		p := NewBinParser(&buf)
+		p.Capabilities = c.caps
+		_, err := p.parse()
+		var fe *FeatureError
+		if !errors.Is(err, ErrUnsupportedFeature) || !errors.As(err, &fe) || err.Error() != c.err {
+			t.Error("capabilities", c.caps, ":", err)
+		}
+	}
 
-	if r != float64(30) {
-		t.Error(e, _typeOf(r), _text(r))
+	// Features from newer writers are never supported
+	var buf bytes.Buffer
+	ParseString("!preamble\n  typed\n  checksum crc32").WriteBinary(&buf)
+	g.WriteBinary(&buf)
+	p := NewBinParser(&buf)
+	p.Capabilities = caps
+	if _, err := p.parse(); err == nil || err.Error() != "unsupported feature: checksum" {
+		t.Error("unknown feature:", err)
 	}
 
-	e = "10*3.0"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	// Logs
+	file := t.TempDir() + "/archive.gb"
+	log, err := OpenLogWith(file, &LogOptions{Preamble: full})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Add(g)
+	log.Add(ParseString("d"))
+	log.Close()
 
-	if r != float64(30) {
-		t.Error(e, _typeOf(r), _text(r))
+	if _, err = OpenLogWith(file, &LogOptions{Capabilities: &Capabilities{TypedScalars: true}}); !errors.Is(err, ErrUnsupportedFeature) {
+		t.Error("log opened without capabilities:", err)
+	}
+	if log, err = OpenLogWith(file, &LogOptions{Capabilities: caps}); err != nil {
+		t.Fatal(err)
 	}
+	defer log.Close()
+	if !reflect.DeepEqual(log.Preamble(), full) {
+		t.Error("log preamble:", log.Preamble())
+	}
+	h, next, err := log.Read(0)
+	if err != nil || !h.Equal(g) {
+		t.Fatal("first record:", err)
+	}
+	var seen []int64
+	log.Iterate(func(pos int64, g *Graph) bool {
+		seen = append(seen, pos)
+		return true
+	})
+	if len(seen) != 2 || seen[0] != int64(len(full.Graph().Binary())) || seen[1] != next {
+		t.Error("Iterate positions:", seen, next)
+	}
+}
 
-	e = "10/3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+// query.go
 
-	if r != int64(3) {
-		t.Error(e, _typeOf(r), _text(r))
-	}
+func TestQuery(t *testing.T) {
 
-	e = "10%3"
-	p = NewExpression(e)
-	r = g.Eval(p)
+	src := "server\n  host example.com\n  port 80\n  alias (www, web)"
 
-	if r != int64(1) {
-		t.Error(e, _typeOf(r), _text(r))
+	b, err := Query(strings.NewReader(src), "server.port", FormatRaw)
+	if err != nil || string(b) != "80" {
+		t.Error("Query raw:", string(b), err)
 	}
-}
 
-func TestEvalBool(t *testing.T) {
+	b, err = Query(strings.NewReader(src), "server.alias", FormatText)
+	if err != nil || string(b) != "www\nweb" {
+		t.Error("Query text:", string(b), err)
+	}
 
-	g := NilGraph()
-	g.Add("a").Add(1)
+	b, err = Query(strings.NewReader(src), ".", FormatJSON)
+	if err != nil || string(b) != `{"server":{"host":"example.com","port":80,"alias":["www","web"]}}` {
+		t.Error("Query json:", string(b), err)
+	}
 
-	p := NewExpression("1=='1'")
-	r := g.EvalBool(p)
-	if r != true {
-		t.Error("1=='1'")
+	// Multiple matches are rendered as a list
+	src = "a (b 1, c 2, b 3)"
+	b, err = Query(strings.NewReader(src), "a.b{}", FormatJSON)
+	if err != nil || string(b) != "[1,3]" {
+		t.Error("Query json list:", string(b), err)
+	}
+	b, err = Query(strings.NewReader(src), "a.b{}", FormatRaw)
+	if err != nil || string(b) != "1\n3" {
+		t.Error("Query raw list:", string(b), err)
 	}
 
-	p = NewExpression("true")
-	r = g.EvalBool(p)
-	if r != false {
-		t.Error("true as a path")
+	_, err = Query(strings.NewReader(src), "a.x", FormatText)
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("Query not found:", err)
 	}
 
-	p = NewExpression("'true'")
-	r = g.EvalBool(p)
-	if r != true {
-		t.Error("'true' keyword")
+	_, err = Query(strings.NewReader("a (b"), "a", FormatText)
+	if !errors.Is(err, ErrSyntax) {
+		t.Error("Query syntax error:", err)
 	}
 }
 
-// Get types
-
-func TestGetTypes(t *testing.T) {
+// runtime.go
 
-	g := ParseString("aa, ab, bb, axx, aj, vv")
-	r, _ := g.GetSimilar("a[a-b]")
+func TestRuntimeGraph(ts *testing.T) {
 
-	if r.Len() != 2 || r.Text() != "aa\nab" {
-		t.Error("similar")
-	}
+	g := RuntimeGraph()
 
-	g = NewGraph("111")
-	if i, _ := g.Int64(); i != 111 {
-		t.Error("Int64")
+	for _, path := range []string{"mem.heap_alloc", "mem.sys", "mem.num_gc", "goroutines", "gomaxprocs", "uptime"} {
+		i := g.Get(path)
+		if i == nil {
+			ts.Error("missing", path)
+			continue
+		}
+		if _, ok := i.This.(int64); !ok {
+			ts.Error("not an int64:", path)
+		}
 	}
 
-	g = NewGraph("111.1")
-	if i, _ := g.Float64(); i != 111.1 {
-		t.Error("Float64")
+	if s, _ := g.GetString("start_time"); len(s) == 0 {
+		ts.Error("missing start_time")
 	}
 
-	g = NewGraph(float32(111.2))
-	if i, _ := g.Float64(); i != 111.2 {
-		t.Error("Float64")
-	}
+	t := NewTemplate("$(kb = mem.heap_alloc / 1024)$if(kb > 0)heap: $kb KB$else empty$end, goroutines: $goroutines")
+	s := string(t.Process(g))
 
-	g = NewGraph("true")
-	if i, _ := g.Bool(); i != true {
-		t.Error("Bool")
+	if !strings.HasPrefix(s, "heap: ") || !strings.Contains(s, " KB, goroutines: ") {
+		ts.Error("runtime template:", s)
 	}
+}
 
-	g = ParseString("a 1")
-	if i, _ := g.GetInt64("a"); i != 1 {
-		t.Error("GetInt64")
-	}
+// -------------------------------------------------------------------------
+// S-expressions
+
+func TestSexpr(t *testing.T) {
+
+	for _, s := range []string{
+		"a",
+		"(a b c)",
+		"(a (b 1 2) (c \"x y\" \"\") d)\n(e f)",
+		"(s \"quote \\\" and \\\\\" \"line\\nbreak\" \".\" \"(p)\")",
+		"(n 42 -3.5 1e10 \"42\")",
+		"((a))",
+	} {
+		g, err := FromSexpr(strings.NewReader(s))
+		if s == "((a))" {
+			if err == nil {
+				t.Error("list head is not an atom, no error")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(s, err)
+		}
 
-	g = ParseString("a 1.1")
-	if i, _ := g.GetFloat64("a"); i != 1.1 {
-		t.Error("GetFloat64")
+		for _, opts := range []*SexprOptions{nil, {Indent: 2}} {
+			var buf bytes.Buffer
+			if err = g.Sexpr(&buf, opts); err != nil {
+				t.Fatal(err)
+			}
+			h, err := FromSexpr(&buf)
+			if err != nil || !h.TextEqual(g) {
+				t.Errorf("round trip of %s: %v\n%s", s, err, h.Text())
+			}
+		}
 	}
 
-	g = ParseString("a 'false'")
-	if i, err := g.GetBool("a"); err != nil || i != false {
-		t.Error("GetBool")
+	g, _ := FromSexpr(strings.NewReader("; comment\n[list a, b] (x (y \"1\\t2\"))"))
+	if g.Len() != 2 || g.Node("list").Len() != 2 || g.Node("x").Node("y").GetAt(0).String() != "1\t2" {
+		t.Error("EDN-like input:", g.Text())
 	}
 
-	g = ParseString("a 'text'")
-	if i, err := g.GetBytes("a"); err != nil || len(i) != 4 {
-		t.Error("GetBytes", len(i))
+	var buf bytes.Buffer
+	ParseString("a\n  b 1\n  c\n    d\n    e\n  f").Sexpr(&buf, &SexprOptions{Indent: 2})
+	if buf.String() != "(a\n  (b 1)\n  (c d e)\n  f)\n" {
+		t.Errorf("indented output:\n%s", buf.String())
 	}
-}
-
-func TestIsInteger(t *testing.T) {
-	ss := [...]string{"-1", "2", "9.1", " 14", " - 1", " -1 ", "a", "3a", ""}
-	rr := [...]bool{true, true, false, true, false, true, false, false, false}
 
-	for i, s := range ss {
-		b := IsInteger(s)
-		if b != rr[i] {
-			t.Error("IsInteger() failed")
+	for _, s := range []string{"(a . b)", "()", "(a b", ")", "(a]", "(a \"b)"} {
+		if _, err := FromSexpr(strings.NewReader(s)); err == nil {
+			t.Error("no error for", s)
 		}
 	}
 }
 
-// interface conversion to native types
-
-func TestI2string(t *testing.T) {
-
-	var i interface{}
+func TestSexpr_Config(t *testing.T) {
 
-	i = "2.2"
+	g := ParseFile("testdata/config.ogdl")
+	if g == nil {
+		t.Fatal("cannot read config")
+	}
 
-	s := _string(i)
-	ty := reflect.TypeOf(s).String()
+	var buf bytes.Buffer
+	if err := g.Sexpr(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "(server (host localhost) (port 8080) (timeout 30) (tls") {
+		t.Error("exported:", buf.String())
+	}
 
-	if ty != "string" {
-		t.Error("should return a string")
+	h, err := FromSexpr(&buf)
+	if err != nil || !h.TextEqual(g) {
+		t.Errorf("re-imported config differs: %v\n%s", err, h.Text())
 	}
+}
 
-	i = 1.1
+// diff.go
+
+func TestDiffText(t *testing.T) {
+
+	a := ParseFile("testdata/diff_old.ogdl")
+	b := ParseFile("testdata/diff_new.ogdl")
+
+	want := `~ database.password: hunter2 -> correct-horse-battery-staple
++ database.replica
+    host db2
+    password s3cret
++ log.format
+    "a very long format string that goes on and on: %time %level %message"
+~ log.level: info -> debug
+- server.debug
+~ server.port: 80 -> 8080
++ server.tags.internal
+- server.tags.public
++ server.tls
+    cert /etc/ssl/server.crt
+    key /etc/ssl/server.key
+`
+	if s := string(DiffText(a, b, nil)); s != want {
+		t.Errorf("DiffText:\n%s", s)
+	}
+
+	// Secrets are redacted in the report and in the patch, wherever they
+	// appear; long scalars and lines are cut
+	patch := NilGraph()
+	opts := &DiffOptions{Redact: []string{"*password*", "KEY"}, MaxScalar: 30, Width: 36, Patch: patch}
+
+	want = `~ database.password: [redacted] -...
++ database.replica
+    host db2
+    password [redacted]
++ log.format
+    "a very long format string t..."
+~ log.level: info -> debug
+- server.debug
+~ server.port: 80 -> 8080
++ server.tags.internal
+- server.tags.public
++ server.tls
+    cert /etc/ssl/server.crt
+    key [redacted]
+`
+	if s := string(DiffText(a, b, opts)); s != want {
+		t.Errorf("DiffText with options:\n%s", s)
+	}
+	if strings.Contains(patch.Text(), "s3cret") || strings.Contains(patch.Text(), "hunter2") || strings.Contains(patch.Text(), "server.key") {
+		t.Error("secrets in the patch:", patch.Text())
+	}
+
+	// The patch has the same changes as Diff, in the same order
+	d := Diff(a, b)
+	if patch.Len() != d.Len() || patch.Len() != 9 {
+		t.Fatal("patch:", patch.Text())
+	}
+	for i, n := range d.Out {
+		if patch.Out[i].String() != n.String() || patch.Out[i].GetAt(0).String() != n.GetAt(0).String() {
+			t.Error("patch differs at", i, patch.Out[i].Text())
+		}
+	}
+	if s, _ := d.GetString("changed{2}.'server.port'[1]"); s != "8080" {
+		t.Error("changed value:", d.Text())
+	}
 
-	s = _string(i)
-	ty = reflect.TypeOf(s).String()
+	if len(DiffText(a, a, nil)) != 0 || Diff(b, b).Len() != 0 {
+		t.Error("differences between equal graphs")
+	}
 
-	if ty != "string" {
-		t.Error("should return a string")
+	// Repeated names are matched by occurrence
+	s := string(DiffText(ParseString("host a\nhost b"), ParseString("host a\nhost c\nhost d"), nil))
+	if s != "~ host{1}: b -> c\n+ host{2}\n    d\n" {
+		t.Errorf("repeated names:\n%s", s)
 	}
 }
 
-// Templates
+// unmarshal.go
 
-func TestTemplate1(ts *testing.T) {
-	// Context
-	g := NewGraph("b")
-	g.Add(1)
+type tlsConfig struct {
+	Cert string
+	Key  string
+}
 
-	t := NewTemplate("a $b")
-	t.This = "!t"
+type common struct {
+	Name  string
+	Debug bool
+}
 
-	s := t.Process(g)
+type serverConfig struct {
+	common
+	Host    string
+	Port    int
+	Timeout time.Duration
+	TLS     *tlsConfig `ogdl:"tls"`
+	Tags    []string
+	Limits  map[string]int
+	Extra   *Graph `ogdl:",rest"`
+}
 
-	if string(s) != "a 1" {
-		ts.Error("template")
+type appConfig struct {
+	Server  serverConfig
+	Retries int
+	Routes  []struct {
+		Path    string
+		Handler string
 	}
 }
 
-func TestTemplateIf(ts *testing.T) {
-	// Context
-	g := NilGraph()
+func TestUnmarshal(t *testing.T) {
+
+	src := `
+server
+  name api
+  debug yes
+  host localhost
+  port 8080
+  timeout 30s
+  tls
+    cert a.pem
+    key a.key
+  tags
+    a
+    b
+  limits
+    rps 100
+    burst 20
+  metrics on
+  owner
+    team core
+retrys 3
+routes
+  route
+    path /a
+    handler x
+  route
+    path /b
+    handlr y
+`
+	g := ParseString(src)
+
+	var c appConfig
+	if err := g.Unmarshal(&c); err != nil {
+		t.Fatal(err)
+	}
+
+	s := c.Server
+	if s.Name != "api" || !s.Debug || s.Host != "localhost" || s.Port != 8080 || s.Timeout != 30*time.Second {
+		t.Errorf("scalars: %+v", s)
+	}
+	if s.TLS == nil || s.TLS.Cert != "a.pem" || s.TLS.Key != "a.key" {
+		t.Errorf("pointer: %+v", s.TLS)
+	}
+	if len(s.Tags) != 2 || s.Tags[1] != "b" || s.Limits["burst"] != 20 {
+		t.Errorf("slice and map: %v %v", s.Tags, s.Limits)
+	}
+	if len(c.Routes) != 2 || c.Routes[0].Handler != "x" || c.Routes[1].Path != "/b" {
+		t.Errorf("slice of structs: %+v", c.Routes)
+	}
+
+	// The rest field holds what matches no field of server
+	if s.Extra == nil || s.Extra.Text() != "metrics\n  on\nowner\n  team\n    core" {
+		t.Errorf("rest field: %v", s.Extra.Text())
+	}
+
+	// Unknown keys are reported, except those in the rest field
+	var unknown []string
+	err := g.UnmarshalWith(&appConfig{}, &DecodeOptions{DisallowUnknownFields: true, CollectUnknown: &unknown})
+	var ue *UnknownFieldsError
+	if !errors.As(err, &ue) || !errors.Is(err, ErrUnknownField) {
+		t.Fatal("no unknown fields error:", err)
+	}
+	want := []string{"retrys", "routes[1].handlr"}
+	if !reflect.DeepEqual(ue.Paths, want) || !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown paths: %v %v", ue.Paths, unknown)
+	}
+	if err = g.UnmarshalStrict(&appConfig{}); err == nil || err.Error() != "unknown field: retrys, routes[1].handlr" {
+		t.Error("UnmarshalStrict:", err)
+	}
+
+	// Without a rest field, its keys would be unknown too
+	var cfg struct {
+		Server struct {
+			Host string
+		}
+	}
+	unknown = nil
+	ParseString("server\n  host x\n  prot 80").UnmarshalWith(&cfg, &DecodeOptions{CollectUnknown: &unknown})
+	if cfg.Server.Host != "x" || len(unknown) != 1 || unknown[0] != "server.prot" {
+		t.Error("unknown without rest field:", unknown)
+	}
 
-	t := NewTemplate("$if('false') a $else b $end")
+	// Conversion errors give the path
+	err = ParseString("server\n  port http").Unmarshal(&c)
+	if !errors.Is(err, ErrConversion) || !strings.HasPrefix(err.Error(), "server.port:") {
+		t.Error("conversion error:", err)
+	}
+	if err = g.Unmarshal(c); err == nil {
+		t.Error("no error for a non pointer")
+	}
+}
 
-	s := t.Process(g)
-	if string(s) != " b " {
-		ts.Error("template")
+// xml.go
+
+func TestXML_RoundTrip(t *testing.T) {
+
+	for _, s := range []string{
+		"a",
+		"a b",
+		"server\n  @id 1\n  host example.com\n  port 80\n  alias\n    www\n    web",
+		"list\n  item 1\n  item 2\n  item 3",
+		"a\n  b\n    c 1\n    c 2\n  d",
+		"page\n  title 'Fish & <chips>'\n  body \"say \\\"hi\\\"\"",
+		"ns:root\n  @xmlns:ns urn:x\n  ns:item 1",
+		"'not a name'\n  '1.5'\n  x\n    'a b'\n    '@'",
+	} {
+		g := ParseString(s)
+		b := g.XML()
+		g2, err := FromXML(b)
+		if err != nil || !g.Equal(g2) {
+			t.Errorf("%q:\n%s\n%s, %v", s, b, g2.Text(), err)
+		}
 	}
 
-	t = NewTemplate("$if('true') a $else b $end")
-	s = t.Process(g)
-	if string(s) != " a " {
-		ts.Error("template")
+	g := ParseString("server\n  @id 1\n  host example.com\n  alias\n    www\n    web\n  '2nd' x")
+	want := `<server id="1">
+  <host>example.com</host>
+  <alias>
+    <www/>
+    <web/>
+  </alias>
+  <_ _name="2nd">x</_>
+</server>
+`
+	if string(g.XML()) != want {
+		t.Errorf("XML:\n%s", g.XML())
 	}
 }
 
-func TestTemplateFor(ts *testing.T) {
-	// Context
-	g := NilGraph()
-	c := g.Add("b")
-	c.Add(1)
-	c.Add(2)
+func TestFromXML(t *testing.T) {
+
+	src := `<?xml version="1.0" encoding="UTF-8"?>
+<!-- order service response -->
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:m="urn:orders">
+  <soap:Header/>
+  <soap:Body>
+    <m:GetOrderResponse>
+      <m:Order id="1042" status="shipped">
+        <m:Customer>ACME &amp; Sons</m:Customer>
+        <m:Line sku="A-1" qty="2">Widget</m:Line>
+        <m:Line sku="B-7" qty="1">Gadget</m:Line>
+        <m:Note><![CDATA[Leave at <door>]]></m:Note>
+      </m:Order>
+    </m:GetOrderResponse>
+  </soap:Body>
+</soap:Envelope>`
+
+	g, err := FromXML([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names with prefixes and '@' are not valid in paths
+	node := func(n *Graph, names ...string) *Graph {
+		for _, s := range names {
+			if n = n.Node(s); n == nil {
+				return nil
+			}
+		}
+		return n
+	}
+	value := func(n *Graph) string {
+		if n == nil || n.Len() != 1 {
+			return ""
+		}
+		return n.Out[0].String()
+	}
 
-	t := NewTemplate("$b\n---\n$for(a,b) [$a] $end")
+	env := node(g, "soap:Envelope")
+	order := node(env, "soap:Body", "m:GetOrderResponse", "m:Order")
+	if env == nil || order == nil || order.Len() != 6 {
+		t.Fatal("order:", g.Text())
+	}
 
-	s := t.Process(g)
-	if string(s) != "1\n2\n---\n [1]  [2] " {
-		ts.Error("template")
+	tests := []struct {
+		n    *Graph
+		want string
+	}{
+		{node(env, "@xmlns:soap"), "http://schemas.xmlsoap.org/soap/envelope/"},
+		{node(order, "@id"), "1042"},
+		{node(order, "@status"), "shipped"},
+		{node(order, "m:Customer"), "ACME & Sons"},
+		{node(order.Out[4], "@sku"), "B-7"},
+		{node(order, "m:Note"), "Leave at <door>"},
+	}
+	for i, test := range tests {
+		if s := value(test.n); s != test.want {
+			t.Errorf("%d: %q", i, s)
+		}
 	}
-}
 
-// function.go
+	if l := order.Out[3]; l.Len() != 3 || l.Out[2].String() != "Widget" {
+		t.Error("text after attributes:", l.Text())
+	}
+	if h := node(env, "soap:Header"); h == nil || h.Len() != 0 {
+		t.Error("empty element")
+	}
 
-func TestFunction1(ts *testing.T) {
-	// Context
-	g := NilGraph()
-	c := g.Add("T")
-	ty := c.Add("!type")
-	ty.Add("function")
-	g.Add("a").Add("Title: $b")
-	g.Add("b").Add("A nice title")
+	for _, bad := range []string{"<a>", "<a></b>", "<a>x</a>y", "<a x='1' x='2'"} {
+		if _, err := FromXML([]byte(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
 
-	t := NewTemplate("$T(a)")
-	b := t.Process(g)
+// json.go
 
-	if string(b) != "Title: A nice title" {
-		ts.Error("function T")
+func TestGraph_JSON(t *testing.T) {
+
+	tests := []struct{ src, want string }{
+		{"", `null`},
+		{"a 1", `{"a":1}`},
+		{"server\n  host example.com\n  port 8080\ntags\n  a\n  b", `{"server":{"host":"example.com","port":8080},"tags":["a","b"]}`},
+		{"x\n  pi 3.14\n  neg -2\n  hex 0x1f\n  on true\n  off false\n  nan NaN\n  zip 007", `{"x":{"hex":31,"nan":"NaN","neg":-2,"off":false,"on":true,"pi":3.14,"zip":7}}`},
+		{"list\n  a 1\n  b\n  a 2", `{"list":[{"a":1},"b",{"a":2}]}`},
+		{"a\n  b\n    c\n      d 'x y'", `{"a":{"b":{"c":{"d":"x y"}}}}`},
+		{"a\nb", `["a","b"]`},
+		{"e\n  s \"say \\\"hi\\\"\"", `{"e":{"s":"say \"hi\""}}`},
 	}
-}
 
-type Math struct {
-}
+	for _, test := range tests {
+		g := ParseString(test.src)
+		if test.src == "" {
+			g = nil
+		}
+		b, err := g.JSON()
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
 
-func newMath() interface{} {
-	return &Math{}
-}
+		// Compare as values, as objects are unordered
+		var got, want interface{}
+		if err = json.Unmarshal(b, &got); err != nil {
+			t.Errorf("%q: invalid JSON %s: %v", test.src, b, err)
+			continue
+		}
+		json.Unmarshal([]byte(test.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: %s", test.src, b)
+		}
+	}
 
-func (*Math) Sin(x float64) float64 {
-	return math.Sin(x)
-}
+	// A node that is not transparent is written as an object
+	g := NewGraph("a")
+	g.Add("b").Add("1")
+	if b, _ := g.JSON(); string(b) != `{"a":{"b":1}}` {
+		t.Error("root node:", string(b))
+	}
 
-func TestFunction2(t *testing.T) {
+	g.Add(g)
+	if _, err := g.JSON(); err == nil {
+		t.Error("cycle: no error")
+	}
+}
 
-	FunctionAddConstructor("math", newMath)
+func TestFromJSON(t *testing.T) {
+
+	src := `{
+		"name": "app",
+		"port": 8080,
+		"ratio": 0.5,
+		"debug": false,
+		"owner": null,
+		"db": {"host": "localhost", "opts": {"ssl": true}},
+		"servers": [
+			{"host": "a", "port": 1},
+			{"host": "b", "port": 2}
+		],
+		"tags": ["x", "y", null, [1, 2]],
+		"empty": {}
+	}`
+
+	g, err := FromJSON([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !g.IsNil() || g.Len() != 9 || g.GetAt(0).String() != "name" || g.GetAt(8).String() != "empty" {
+		t.Fatal("members:", g.Text())
+	}
+
+	tests := []struct{ path, want string }{
+		{"name", "app"},
+		{"port", "8080"},
+		{"ratio", "0.5"},
+		{"debug", "false"},
+		{"db.host", "localhost"},
+		{"db.opts.ssl", "true"},
+		{"servers[1].host", "b"},
+		{"tags[1]", "y"},
+		{"tags[3][0]", "1"},
+	}
+	for _, test := range tests {
+		if s := g.Get(test.path).String(); s != test.want {
+			t.Errorf("%s: %q", test.path, s)
+		}
+	}
 
-	g := NilGraph()
-	f := g.Add("math")
-	f.Add("!type").Add("math")
+	// Navigation with Node and GetAt
+	s := g.Node("servers").GetAt(0)
+	if !s.IsNil() || s.Node("port").GetAt(0).String() != "1" {
+		t.Error("servers[0]:", s.Text())
+	}
+	if !g.Node("owner").GetAt(0).IsNil() || !g.Node("tags").GetAt(2).IsNil() {
+		t.Error("null values")
+	}
+	if n, _ := g.GetInt64("port"); n != 8080 {
+		t.Error("GetInt64:", n)
+	}
 
-	path := NewPath("math.Sin(1.0)")
+	// Back to JSON
+	b, err := g.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	json.Unmarshal(b, &got)
+	json.Unmarshal([]byte(strings.Replace(src, `"empty": {}`, `"empty": null`, 1)), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Error("round trip:", string(b))
+	}
 
-	i := g.Eval(path)
-	s := _typeOf(i)
-	v := _string(i)[:10]
+	for _, s := range []string{`[1, 2]`, `"x"`, `[{"a": 1}, {"b": [true, 2]}]`} {
+		g, err := FromJSON([]byte(s))
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		b, _ := g.JSON()
+		json.Unmarshal(b, &got)
+		json.Unmarshal([]byte(s), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: %s", s, b)
+		}
+	}
 
-	if s != "float64" || v != "0.84147098" {
-		t.Error("math.Sin()")
+	for _, bad := range []string{``, `{`, `{"a": }`, `[1, 2`, `{} {}`, `{"a": 1]`} {
+		if _, err := FromJSON([]byte(bad)); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
 	}
 }
 
-// log.go
+// builtin.go
+
+func TestBuiltins(ts *testing.T) {
+
+	g := ParseString("name '  Ada Lovelace '\nlist\n  a\n  b\n  c\nobj\n  k\n    x\n    y\nempty\nword héllo")
+	g.Add("nums").Add([]int{1, 2})
+
+	tests := []struct{ tpl, out string }{
+		{`$len(list)`, `3`},
+		{`$len(obj)`, `1`},
+		{`$len(obj.k)`, `2`},
+		{`$len(empty)`, `0`},
+		{`$len(missing)`, `0`},
+		{`$len(missing.deep)`, `0`},
+		{`$len(nums)`, `2`},
+		{`$len(word)`, `5`},
+		{`$len('abc')`, `3`},
+		{`$trim(name)`, `Ada Lovelace`},
+		{`$upper(trim(name))`, `ADA LOVELACE`},
+		{`$lower('MiXed')`, `mixed`},
+		{`$contains(name, 'Love')`, `true`},
+		{`$hasprefix(trim(name), 'Ada')`, `true`},
+		{`$hassuffix(name, 'Ada')`, `false`},
+		{`$if(len(list) > 0)non-empty$else empty$end`, `non-empty`},
+		{`$if(len(missing) == 0)none$end`, `none`},
+		{`$if(len(empty))x$else empty$end`, ` empty`},
+		{`$if(contains(name, 'Ada'))yes$end`, `yes`},
+		{`$if(hasprefix(trim(name), 'Ada'))yes$end`, `yes`},
+		{`$if(hassuffix(trim(name), 'lace'))yes$end`, `yes`},
+		{`$if(lower('ADA') == 'ada')yes$end`, `yes`},
+		{`$if(upper('ada') == 'ADA')yes$end`, `yes`},
+		{`$if(trim(' a ') == 'a')yes$end`, `yes`},
+		{`$for(x,list)$upper(x)$end`, `ABC`},
+	}
+	for _, t := range tests {
+		s, err := NewTemplate(t.tpl).ProcessE(g)
+		if string(s) != t.out || err != nil {
+			ts.Errorf("%s: %q %v", t.tpl, s, err)
+		}
+	}
 
-func TestLog(t *testing.T) {
+	// Registered functions don't replace builtins, but context keys do
+	fs := NewFunctionSet()
+	fs.AddFunc("upper", func(args ...interface{}) interface{} {
+		return "registered"
+	})
+	g.SetFunctions(fs)
+	if s := string(NewTemplate(`$upper('a')`).Process(g)); s != "A" {
+		ts.Error("registered function:", s)
+	}
+	fs.AddFunc("range", func(args ...interface{}) interface{} {
+		return []int{7}
+	})
+	fs.AddFunc("matchindex", func(args ...interface{}) interface{} {
+		return "registered"
+	})
+	if s := string(NewTemplate(`$for(i, range(0, 3))$i$end`).Process(g)); s != "012" {
+		ts.Error("registered range:", s)
+	}
+	if s := string(NewTemplate(`$matchindex(list)`).Process(g)); s != "-1" {
+		ts.Error("registered matchindex:", s)
+	}
+	g.Add("len").Add("x").Add("key")
+	if s := string(NewTemplate(`$len('x')`).Process(g)); s != "key" {
+		ts.Error("context key:", s)
+	}
 
-	file := "/tmp/log.gb"
+	if _, err := NewTemplate(`$contains('a')`).ProcessE(g); err == nil {
+		ts.Error("wrong number of arguments: no error")
+	}
+}
 
-	log, _ := OpenLog(file)
+// marshal.go
 
-	g := ParseString("a b, c, d")
-	b := g.Binary()
+type mAddr struct {
+	Host string
+	Port int `ogdl:"port"`
+}
 
-	n := log.Add(g)
-	m := log.Add(g)
-	o := log.AddBinary(b)
+type mBase struct {
+	ID int64 `ogdl:"id"`
+}
 
-	if n != 0 || m != 16 || o != 32 {
-		t.Error("log.Add", o)
+type mConfig struct {
+	mBase
+	Name    string            `ogdl:"name"`
+	Debug   bool              `ogdl:"debug"`
+	Ratio   float64           `ogdl:"ratio"`
+	Timeout time.Duration     `ogdl:"timeout"`
+	Tags    []string          `ogdl:"tags"`
+	Servers []mAddr           `ogdl:"servers"`
+	Limits  map[string]int    `ogdl:"limits"`
+	Hosts   map[string]*mAddr `ogdl:"hosts"`
+	Primary *mAddr            `ogdl:"primary"`
+	Backup  *mAddr            `ogdl:"backup"`
+	Secret  string            `ogdl:"-"`
+	Extra   *Graph            `ogdl:",rest"`
+	private int
+}
+
+func TestFromStruct(t *testing.T) {
+
+	c := mConfig{
+		mBase:   mBase{ID: 7},
+		Name:    "app",
+		Debug:   true,
+		Ratio:   0.5,
+		Timeout: 3 * time.Second,
+		Tags:    []string{"a", "b"},
+		Servers: []mAddr{{"x", 1}, {"y", 2}},
+		Limits:  map[string]int{"max": 10, "min": 1},
+		Hosts:   map[string]*mAddr{"web": {"w", 80}},
+		Primary: &mAddr{"p", 443},
+		Secret:  "s3cret",
+		Extra:   ParseString("color blue"),
+		private: 1,
+	}
+
+	g, err := FromStruct(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, n := range g.Out {
+		keys = append(keys, n.String())
+	}
+	if s := strings.Join(keys, " "); s != "name debug ratio timeout tags servers limits hosts primary backup id color" {
+		t.Error("keys:", s)
+	}
+
+	tests := []struct{ path, want string }{
+		{"name", "app"},
+		{"debug", "true"},
+		{"ratio", "0.5"},
+		{"timeout", "3s"},
+		{"tags[1]", "b"},
+		{"servers[1].Host", "y"},
+		{"servers[1].port", "2"},
+		{"limits.max", "10"},
+		{"hosts.web.port", "80"},
+		{"primary.Host", "p"},
+		{"id", "7"},
+		{"color", "blue"},
+	}
+	for _, test := range tests {
+		if s := g.Get(test.path).String(); s != test.want {
+			t.Errorf("%s: %q", test.path, s)
+		}
 	}
 
-	g2, _, n2 := log.Get(0)
-	g3, _, n3 := log.Get(n2)
-	b2, _, _ := log.GetBinary(n3)
+	// The shape of the tree
+	if n := g.Node("tags"); n.Len() != 2 || n.Out[0].Len() != 0 {
+		t.Error("tags:", n.Text())
+	}
+	if n := g.Node("servers"); n.Len() != 2 || !n.Out[0].IsNil() || n.Out[0].Len() != 2 {
+		t.Error("servers:", n.Text())
+	}
+	if n := g.Node("limits"); n.Len() != 2 || n.Out[0].String() != "max" || n.Out[1].String() != "min" {
+		t.Error("limits:", n.Text())
+	}
+	if n := g.Node("backup"); n == nil || n.Len() != 0 {
+		t.Error("nil pointer:", n)
+	}
+	if v, ok := g.Node("debug").GetAt(0).This.(bool); !ok || !v {
+		t.Error("typed scalar:", g.Node("debug").GetAt(0).This)
+	}
 
-	g4 := BinParse(b2)
+	// Back with Unmarshal
+	var d mConfig
+	if err = g.Unmarshal(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Backup == nil || *d.Backup != (mAddr{}) {
+		t.Error("empty node:", d.Backup)
+	}
+	c.Secret, c.private, c.Extra, d.Extra, d.Backup = "", 0, nil, nil, nil
+	if !reflect.DeepEqual(c, d) {
+		t.Errorf("round trip:\n%+v\n%+v", c, d)
+	}
 
-	if !g.Equal(g2) {
-		t.Error("n!=n2")
+	// Errors
+	if _, err = FromStruct(42); err == nil {
+		t.Error("not a struct: no error")
+	}
+	type node struct {
+		Next *node
+	}
+	n := &node{}
+	n.Next = n
+	if _, err = FromStruct(n); err == nil {
+		t.Error("cycle: no error")
+	}
+	if _, err = FromStruct(struct{ F func() }{func() {}}); err == nil {
+		t.Error("func field: no error")
 	}
+}
 
-	if !g.Equal(g3) {
-		t.Error("n!=n3")
+// find.go
+
+func TestGraph_Find(t *testing.T) {
+
+	g := ParseString(`servers
+  web
+    host a.example.com
+    port 80
+  db
+    host db.example.com
+    password secret
+    replica
+      host r1
+      password x
+  web
+    host b.example.com
+"example.com"
+  password y
+password z`)
+
+	strs := func(l []*Graph) string {
+		var s []string
+		for _, n := range l {
+			s = append(s, n.String())
+		}
+		return strings.Join(s, " ")
+	}
+
+	for _, c := range [][2]string{
+		{"servers.*.host", "host host host"},
+		{"servers.web.host", "host host"},
+		{"**.password", "password password password password"},
+		{"**.password.*", "secret x y z"},
+		{"servers.**.host.*", "a.example.com db.example.com r1 b.example.com"},
+		{"*.*.replica.*", "host password"},
+		{`"example.com".*`, "password"},
+		{"**.**.replica", "replica"},
+		{"*", "servers example.com password"},
+		{"servers.*.*.*.*", "r1 x"},
+		{"servers.nothing.*", ""},
+		{"**.nothing", ""},
+		{"a..b", ""},
+		{"a*", ""},
+		{"", ""},
+	} {
+		if s := strs(g.Find(c[0])); s != c[1] {
+			t.Errorf("Find(%s) = %s, expected %s", c[0], s, c[1])
+		}
 	}
 
-	if !g.Equal(g4) {
-		t.Error("n!=n3")
+	// Everything, once, in the order of Walk
+	var all []*Graph
+	g.Walk(func(_ []string, n *Graph) bool {
+		all = append(all, n)
+		return true
+	})
+	if l := g.Find("**"); len(l) != len(all) || strs(l) != strs(all) {
+		t.Error("Find(**):", strs(l))
 	}
 
-	log.Sync()
+	// Paths address the nodes found, also under repeated keys
+	paths, nodes := g.FindPaths("servers.*.host")
+	want := []string{"servers.web.host", "servers.db.host", "servers.web{1}.host"}
+	if len(paths) != len(want) {
+		t.Fatal("FindPaths:", paths)
+	}
+	for i, p := range paths {
+		if q, _ := g.PathFromRoot(nodes[i]); p != want[i] || p != q {
+			t.Errorf("path %d: %s", i, p)
+		}
+	}
+	if paths, _ = g.FindPaths(`**.password`); paths[3] != "password" || paths[2] != `"example.com".password` {
+		t.Error("FindPaths:", paths)
+	}
 
-	log.Close()
+	// Repeated deep elements don't multiply the work
+	deep := NilGraph()
+	n := deep
+	for i := 0; i < 200; i++ {
+		n = n.Add("a")
+	}
+	if l := deep.Find("**.**.**.**.**.**.**.**.a.**.a"); len(l) != 199 {
+		t.Error("deep:", len(l))
+	}
 
-	os.Remove(file)
+	if (*Graph)(nil).Find("**") != nil {
+		t.Error("nil graph")
+	}
 }
 
-// -------------------------------------------------------------------------
 // EXAMPLES
 // -------------------------------------------------------------------------
 
@@ -1406,3 +7798,249 @@ func ExampleGraph_Eval() {
 	// 7
 	// 43
 }
+
+// Parse statistics
+
+func TestParser_Stats(t *testing.T) {
+
+	s := "a\n  b 1\n  c (d, e)"
+
+	p := NewStringParser(s)
+	if st := p.Stats(); st.Bytes != 0 || st.Nodes != 0 {
+		t.Error("stats before parse:", st)
+	}
+
+	p.CollectStats()
+	if err := p.Ogdl(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Bytes != int64(len(s)) || st.Nodes != 6 {
+		t.Error("stats:", st)
+	}
+
+	// Not collecting: nodes are still counted, bytes are not
+	p = NewStringParser(s)
+	p.Ogdl()
+	if st := p.Stats(); st.Bytes != 0 || st.Nodes != 6 {
+		t.Error("stats without collecting:", st)
+	}
+
+	// Collection survives Reset, counting from zero
+	p = NewStringParser(s)
+	p.CollectStats()
+	p.Ogdl()
+	p.Reset("x y")
+	p.Ogdl()
+	if st := p.Stats(); st.Bytes != 3 || st.Nodes != 2 {
+		t.Error("stats after Reset:", st)
+	}
+}
+
+// Benchmarks
+
+// benchInputs returns OGDL documents of increasing size, from testdata.
+func benchInputs(b *testing.B) []struct {
+	name string
+	text []byte
+} {
+	small, err := os.ReadFile("testdata/config.ogdl")
+	if err != nil {
+		b.Fatal(err)
+	}
+	medium, err := os.ReadFile("testdata/catalog.ogdl")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return []struct {
+		name string
+		text []byte
+	}{
+		{"small", small},
+		{"medium", medium},
+		{"large", bytes.Repeat(medium, 20)},
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, in := range benchInputs(b) {
+		b.Run(in.name, func(b *testing.B) {
+			b.SetBytes(int64(len(in.text)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p := NewBytesParser(in.text)
+				if err := p.Ogdl(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		// A parser reused with Reset, that interns repeated scalars
+		b.Run(in.name+"-intern", func(b *testing.B) {
+			s := string(in.text)
+			p := NewStringParser(s)
+			p.Intern = true
+			b.SetBytes(int64(len(in.text)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p.Reset(s)
+				if err := p.Ogdl(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	for _, in := range benchInputs(b) {
+		g := Parse(in.text)
+		b.Run(in.name+"/text", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				g.Text()
+			}
+		})
+		b.Run(in.name+"/binary", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				g.Binary()
+			}
+		})
+	}
+}
+
+func BenchmarkTemplateRender(b *testing.B) {
+
+	tpl, err := os.ReadFile("testdata/page.tpl")
+	if err != nil {
+		b.Fatal(err)
+	}
+	t := NewTemplate(string(tpl))
+
+	for _, in := range benchInputs(b)[1:] {
+		c := NilGraph()
+		c.Set("title", "Catalog")
+		c.Add("catalog").AddNodes(Parse(in.text))
+
+		b.Run(in.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				t.Process(c)
+			}
+		})
+	}
+}
+
+type benchItem struct {
+	Name  string
+	Price float64
+}
+
+func (i benchItem) Label() string {
+	return i.Name
+}
+
+// BenchmarkMethodCall renders a loop calling a method of 10k structs, and
+// compares looking up a method by name with the cached lookup.
+func BenchmarkMethodCall(b *testing.B) {
+
+	items := make([]benchItem, 10000)
+	for i := range items {
+		items[i] = benchItem{"item" + strconv.Itoa(i), float64(i)}
+	}
+	c := NilGraph()
+	c.Add("items").Add(items)
+	t := NewTemplate("$for(x,items)$x.Label()$end")
+	if !bytes.HasPrefix(t.Process(c), []byte("item0item1item2")) {
+		b.Fatal("wrong output")
+	}
+
+	b.Run("loop", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t.Process(c)
+		}
+	})
+
+	v := reflect.ValueOf(items[0])
+	b.Run("lookup/byname", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			v.MethodByName("Label")
+		}
+	})
+	b.Run("lookup/cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			method(v, "Label")
+		}
+	})
+}
+
+func BenchmarkLogAppend(b *testing.B) {
+	for _, in := range benchInputs(b)[:2] {
+		g := Parse(in.text)
+		b.Run(in.name, func(b *testing.B) {
+			log, err := OpenLog(b.TempDir() + "/bench.log")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer log.Close()
+
+			b.SetBytes(int64(len(g.Binary())))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				log.Add(g)
+			}
+		})
+	}
+}
+
+// BenchmarkClone compares a deep clone with a copy-on-write clone, each
+// followed by a single edit.
+func BenchmarkClone(b *testing.B) {
+	in := benchInputs(b)[2]
+	g := Parse(in.text)
+	path := "product{" + strconv.Itoa(g.Len()/2) + "}.stock.north"
+
+	b.Run("deep", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if g.Clone().Set(path, 0) == nil {
+				b.Fatal("Set failed")
+			}
+		}
+	})
+	b.Run("cow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if g.CloneCOW().Set(path, 0) == nil {
+				b.Fatal("Set failed")
+			}
+		}
+	})
+}
+
+// BenchmarkWideNode serializes a node with many leaf children. The time per
+// child should not grow with the width.
+func BenchmarkWideNode(b *testing.B) {
+	for _, n := range []int{100000, 1000000} {
+		g := NilGraph()
+		ids := g.Add("ids")
+		for i := 0; i < n; i++ {
+			ids.Add("id" + strconv.Itoa(i))
+		}
+
+		b.Run(fmt.Sprintf("text/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.Text()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/child")
+		})
+		b.Run(fmt.Sprintf("binary/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				g.Binary()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/child")
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+// Flags of a node
+const (
+	flagFrozen = 1 << iota // set by Freeze
+	flagShared             // the node has several parents (see CloneCOW)
+)
+
+// nodeAttrs holds what is known of a node besides This and Out: its flags,
+// its origin if it was returned by a selector (see MatchIndex), and the
+// FunctionSet attached with SetFunctions. Most nodes have none: Graph only
+// holds a pointer, which is nil until they are set.
+//
+// Attributes are not changed once set, but replaced: a copy of a Graph
+// struct keeps those of the original at the time of the copy.
+type nodeAttrs struct {
+	flags     uint32
+	match     *match
+	functions *FunctionSet
+}
+
+// updateAttrs replaces the attributes of g by a copy changed by fn.
+func (g *Graph) updateAttrs(fn func(a *nodeAttrs)) {
+	var a nodeAttrs
+	if g.attrs != nil {
+		a = *g.attrs
+	}
+	fn(&a)
+	g.attrs = &a
+}
+
+// flags returns the flags of g.
+func (g *Graph) flags() uint32 {
+	if g == nil || g.attrs == nil {
+		return 0
+	}
+	return g.attrs.flags
+}
+
+// hasFlag returns true if g has the flag f.
+func (g *Graph) hasFlag(f uint32) bool {
+	return g.flags()&f != 0
+}
+
+// setFlag gives g the flag f.
+func (g *Graph) setFlag(f uint32) {
+	if g.hasFlag(f) {
+		return
+	}
+	g.updateAttrs(func(a *nodeAttrs) { a.flags |= f })
+}
+
+// inherit gives c, a copy of g, the attributes of g that go with copies: the
+// FunctionSet.
+func (c *Graph) inherit(g *Graph) *Graph {
+	if fs := g.functionSet(); fs != nil {
+		c.updateAttrs(func(a *nodeAttrs) { a.functions = fs })
+	}
+	return c
+}
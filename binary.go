@@ -7,8 +7,12 @@ package ogdl
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"time"
 )
 
 // BinParser and its methods implement a parser for binary OGDL, as defined in the
@@ -22,28 +26,64 @@ import (
 //
 //     text-node ::= text 0x00
 //     binary-node ::= 0x01 ( length data )* 0x00
+//     typed-node ::= tag value
 //
 //     length ::= multibyte-integer
 //     data :: byte[length]
+//
+// Typed nodes hold an int64, a float64, a bool or a time.Time (see typed).
+// Their tags (0x02 to 0x08) cannot start text, which is then written after
+// 0x06. Streams written before typed nodes existed decode the same, unless
+// they have text starting with those control characters.
+//
+// A stream can start with a preamble object, that describes the features
+// used by the rest (see Preamble). The parser reads it with the first
+// object, and checks it against Capabilities.
 type BinParser struct {
 	r    *bufio.Reader
 	last int
 	// n counts the bytes read. Used in log.go.
 	n int
+
+	// Capabilities, if not nil, are the features the reader of the stream
+	// supports. A stream whose preamble asks for more fails with a
+	// *FeatureError.
+	Capabilities *Capabilities
+
+	// preamble is the one read, and begun is true after the first object
+	preamble *Preamble
+	begun    bool
+
+	// MaxDepth is the maximum level of a node, MaxScalarLen the maximum
+	// length in bytes of its content and MaxInputBytes the maximum length
+	// of an object. Input beyond them is rejected with an error that wraps
+	// ErrLimitExceeded. Zero, the default, means unlimited.
+	MaxDepth      int
+	MaxScalarLen  int
+	MaxInputBytes int
+
+	// size is the length of the input, if known (else 0), depth the level
+	// of the last line read, start the position of the object and err the
+	// first error found in it.
+	size  int
+	depth int
+	start int
+	err   error
 }
 
 // NewBytesBinParser creates a parser that can convert a binary OGDL byte stream into an
 // ogdl.Graph object. To actually parse the stream, the method Parse() has to be invoked.
 func NewBytesBinParser(b []byte) *BinParser {
-	return &BinParser{bufio.NewReader(bytes.NewReader(b)), 0, 0}
+	return &BinParser{r: bufio.NewReader(bytes.NewReader(b)), size: len(b)}
 }
 
 // NewFileBinParser creates a parser that can convert a binary OGDL file into an
 // ogdl.Graph object. To actually parse the stream, the method Parse() has to be invoked.
+// Gzip compressed files are decompressed transparently.
 func NewFileBinParser(file string) *BinParser {
 
 	// Read the entire file into memory
-	b, err := ioutil.ReadFile(file)
+	b, err := readFile(file)
 	if err != nil || len(b) == 0 {
 		return nil
 	}
@@ -54,7 +94,7 @@ func NewFileBinParser(file string) *BinParser {
 //NewBinParser creates a parser that can convert a binary OGDL stream into an
 // ogdl.Graph object. To actually parse the stream, the method Parse() has to be invoked.
 func NewBinParser(r io.Reader) *BinParser {
-	return &BinParser{bufio.NewReader(r), 0, 0}
+	return &BinParser{r: bufio.NewReader(r)}
 }
 
 // BinParse converts an OGDL binary stream of bytes into a Graph.
@@ -63,15 +103,19 @@ func BinParse(b []byte) *Graph {
 	return p.Parse()
 }
 
-// Binary converts a Graph to a binary OGDL byte stream.
+// Binary converts a Graph to a binary OGDL byte stream. Nodes holding
+// integers, floats, bools or a time.Time are written as typed nodes, and
+// []byte as binary nodes, which decode to int64, float64, bool, time.Time
+// and []byte. Other values are written as text.
 func (g *Graph) Binary() []byte {
 
 	if g == nil {
 		return nil
 	}
 
-	// Header
-	buf := make([]byte, 3)
+	// Header. The size is computed first, so that wide or large graphs
+	// don't need repeated growth of the buffer.
+	buf := make([]byte, 3, 4+g.binLen(1))
 	buf[0] = 1
 	buf[1] = 'G'
 	buf[2] = 0
@@ -84,12 +128,115 @@ func (g *Graph) Binary() []byte {
 	return buf
 }
 
+// WriteBinary writes the graph to w as a binary OGDL stream, the same that
+// Binary returns, without building it in memory first. It returns the
+// number of bytes written.
+func (g *Graph) WriteBinary(w io.Writer) (int, error) {
+
+	if g == nil {
+		return 0, nil
+	}
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	// Header
+	cw.Write([]byte{1, 'G', 0})
+
+	g.writeBin(1, cw)
+
+	// Ending null
+	cw.Write([]byte{0})
+
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	if cw.err != nil {
+		// Bytes still buffered were not written
+		return cw.n - bw.Buffered(), cw.err
+	}
+	return cw.n, nil
+}
+
+// countingWriter counts the bytes written and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) {
+	if c.err != nil {
+		return
+	}
+	n, err := c.w.Write(b)
+	c.n += n
+	c.err = err
+}
+
+// writeBin is the streaming version of bin.
+func (g *Graph) writeBin(level int, w *countingWriter) {
+
+	// Skip empty nodes
+	if v := binValue(g.This); v != nil {
+		w.Write(newVarInt(level))
+		w.Write(v)
+		level++
+	} else if s := g.String(); len(s) != 0 {
+		w.Write(newVarInt(level))
+		if s[0] <= binLastTag {
+			w.Write([]byte{binString})
+		}
+		w.Write([]byte(s))
+		w.Write([]byte{0})
+		level++
+	}
+
+	for _, node := range g.Out {
+		if w.err != nil {
+			return
+		}
+		node.writeBin(level, w)
+	}
+}
+
+// binLen returns the size of the binary form of g (without header and
+// ending null) at the given level.
+func (g *Graph) binLen(level int) int {
+
+	n := 0
+
+	if v := binValue(g.This); v != nil {
+		n += len(newVarInt(level)) + len(v)
+		level++
+	} else if s := g.String(); len(s) != 0 {
+		n += len(newVarInt(level)) + len(s) + 1
+		if s[0] <= binLastTag {
+			n++
+		}
+		level++
+	}
+
+	for _, node := range g.Out {
+		n += node.binLen(level)
+	}
+
+	return n
+}
+
 func (g *Graph) bin(level int, buf []byte) []byte {
 
 	// Skip empty nodes
-	if len(g.String()) != 0 {
+	if v := binValue(g.This); v != nil {
+		buf = append(buf, newVarInt(level)...)
+		buf = append(buf, v...)
+		level++
+	} else if s := g.String(); len(s) != 0 {
 		buf = append(buf, newVarInt(level)...)
-		buf = append(buf, g.Bytes()...)
+		if s[0] <= binLastTag {
+			buf = append(buf, binString)
+		}
+		buf = append(buf, s...)
 		buf = append(buf, 0)
 		level++
 	}
@@ -101,28 +248,232 @@ func (g *Graph) bin(level int, buf []byte) []byte {
 	return buf
 }
 
-// Parse parses a binary OGDL stream and returns a Graph.
+// binValue returns the binary form of a typed or binary node holding v, or
+// nil if v is written as text (or is empty).
+func binValue(v interface{}) []byte {
+
+	var i int64
+
+	switch v := v.(type) {
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return nil
+		}
+		i = int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return nil
+		}
+		i = int64(v)
+	case float32:
+		return binFloat64(float64(v))
+	case float64:
+		return binFloat64(v)
+	case bool:
+		if v {
+			return []byte{binBool, 1}
+		}
+		return []byte{binBool, 0}
+	case time.Time:
+		b, err := v.MarshalBinary()
+		if err != nil || len(b) > 0xff {
+			return nil
+		}
+		return append([]byte{binTime, byte(len(b))}, b...)
+	case []byte:
+		if len(v) == 0 {
+			return nil
+		}
+		b := []byte{binBytes}
+		for len(v) > 0 {
+			n := len(v)
+			if n >= 0x10000000 {
+				n = 0x10000000 - 1
+			}
+			b = append(b, newVarInt(n)...)
+			b = append(b, v[:n]...)
+			v = v[n:]
+		}
+		return append(b, 0)
+	default:
+		return nil
+	}
+
+	b := make([]byte, 1+binary.MaxVarintLen64)
+	b[0] = binInt
+	return b[:1+binary.PutVarint(b[1:], i)]
+}
+
+func binFloat64(f float64) []byte {
+	b := make([]byte, 9)
+	b[0] = binFloat
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(f))
+	return b
+}
+
+// Parse parses a binary OGDL stream and returns a Graph. Errors are not
+// reported: use ParseE to know if the input was valid.
 func (p *BinParser) Parse() *Graph {
+	g, _ := p.parse()
+	return g
+}
+
+// ParseE parses one object of a binary OGDL stream and returns it. At the
+// end of the stream it returns io.EOF, and io.ErrUnexpectedEOF if the
+// object is truncated. Malformed input, such as a bad header, an impossible
+// level or a length beyond the end of the input, returns an error that
+// wraps ErrInvalidBinary, and input beyond the limits of the parser one that
+// wraps ErrLimitExceeded, with the part of the object read before it.
+func (p *BinParser) ParseE() (*Graph, error) {
+	return p.parse()
+}
+
+// parse parses one binary OGDL object. At the end of the stream it returns
+// io.EOF, and io.ErrUnexpectedEOF (with the part read) if the object is
+// truncated. A preamble at the start of the stream is read and checked
+// first.
+func (p *BinParser) parse() (*Graph, error) {
+
+	g, err := p.object()
+	if err != nil || p.begun {
+		p.begun = true
+		return g, err
+	}
+	p.begun = true
+
+	pr := preambleOf(g)
+	if pr == nil {
+		return g, nil
+	}
+	if err = p.Capabilities.Check(pr); err != nil {
+		return nil, err
+	}
+	p.preamble = pr
+
+	return p.object()
+}
+
+// Preamble returns the preamble found at the start of the stream, or nil.
+// It is available after the first object is parsed.
+func (p *BinParser) Preamble() *Preamble {
+	return p.preamble
+}
+
+// object parses one binary OGDL object.
+func (p *BinParser) object() (*Graph, error) {
+
+	if _, err := p.r.Peek(1); err != nil {
+		return nil, err
+	}
 
 	if !p.header() {
-		return nil
+		if p.last < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, errInvalidHeader
 	}
 
 	ev := NewEventHandler()
 
 	for {
-		lev, bin, b := p.line(true)
+		lev, v := p.line(true)
+		if p.last < 0 {
+			return ev.Graph(), io.ErrUnexpectedEOF
+		}
+		if p.err != nil {
+			return ev.Graph(), p.err
+		}
 		if lev == 0 {
 			break
 		}
-		// Store the content in the same format as it was sent (string or []byte)
-		if bin {
-			ev.AddBytesAt(b, lev)
-		} else {
-			ev.AddAt(string(b), lev)
+		// Store the content in the same format as it was sent (string,
+		// []byte or typed value)
+		switch v := v.(type) {
+		case string:
+			ev.AddAt(v, lev)
+		case []byte:
+			ev.AddBytesAt(v, lev)
+		default:
+			ev.AddAt("", lev)
+			ev.setValue(v)
 		}
 	}
-	return ev.Graph()
+	return ev.Graph(), nil
+}
+
+// ErrInvalidBinary is wrapped by the errors returned when the input is not
+// valid binary OGDL.
+var ErrInvalidBinary = errors.New("invalid binary OGDL")
+
+var (
+	errInvalidHeader = fmt.Errorf("%w: bad header", ErrInvalidBinary)
+	errInvalidLevel  = fmt.Errorf("%w: bad level", ErrInvalidBinary)
+	errInvalidLength = fmt.Errorf("%w: length beyond the end of the input", ErrInvalidBinary)
+	errInvalidTag    = fmt.Errorf("%w: unknown type tag", ErrInvalidBinary)
+	errInvalidScalar = fmt.Errorf("%w: bad typed scalar", ErrInvalidBinary)
+)
+
+// Tags of binary nodes other than text, which is the first byte of the node
+// content. Tags up to binLastTag are reserved; text starting with one of
+// these bytes is written after binString.
+const (
+	binBytes   = 0x01
+	binInt     = 0x02
+	binFloat   = 0x03
+	binBool    = 0x04
+	binTime    = 0x05
+	binString  = 0x06
+	binLastTag = 0x08
+)
+
+// Skip advances the stream past one binary OGDL object, without building a
+// Graph, and returns its length in bytes. At the end of the stream it returns
+// io.EOF, and io.ErrUnexpectedEOF if the object is truncated.
+func (p *BinParser) Skip() (int64, error) {
+
+	start := p.n
+
+	if _, err := p.r.Peek(1); err != nil {
+		return 0, err
+	}
+
+	if !p.header() {
+		if p.last < 0 {
+			return int64(p.n - start), io.ErrUnexpectedEOF
+		}
+		return int64(p.n - start), errInvalidHeader
+	}
+
+	for {
+		lev, _ := p.line(false)
+		if p.last < 0 {
+			return int64(p.n - start), io.ErrUnexpectedEOF
+		}
+		if p.err != nil {
+			return int64(p.n - start), p.err
+		}
+		if lev == 0 {
+			break
+		}
+	}
+
+	return int64(p.n - start), nil
 }
 
 // newVarInt produces a variable integer from an int.
@@ -157,7 +508,7 @@ func newVarInt(i int) []byte {
 	if i < 0x10000000 {
 		b := make([]byte, 4)
 		b[0] = byte(i>>24 | 0xe0)
-		b[1] = byte(i>>16 | 0xff)
+		b[1] = byte(i >> 16 & 0xff)
 		b[2] = byte(i >> 8 & 0xff)
 		b[3] = byte(i & 0xff)
 		return b
@@ -166,11 +517,16 @@ func newVarInt(i int) []byte {
 	return nil
 }
 
-// header is the parser production that reads the header from the stream
+// header is the parser production that reads the header from the stream,
+// which starts an object.
 //
 // header ::= 0x01 'G' 0x00
 func (p *BinParser) header() bool {
 
+	p.depth = 0
+	p.start = p.n
+	p.err = nil
+
 	if p.read() != 1 {
 		return false
 	}
@@ -224,66 +580,206 @@ func (p *BinParser) varInt() int {
 //
 //     line  ::= level node 0x00
 //     level ::= varInt
-//     node  ::= text-node | binary-node
+//     node  ::= text-node | binary-node | typed-node
 //
-// This function returns:
-// - the level (1..)
-// - the byte stream
-// - a boolean that is true for binary nodes, false for text nodes
+// This function returns the level (1..) and the content of the node: a
+// string for text nodes, a []byte for binary nodes, or the value of a typed
+// node.
 //
 // This function accepts one boolean parameter that can be set to false if the
-// actual byte content is not needed and we just want to walk through the
-// stream. This functionality is used in log.go.
-func (p *BinParser) line(write bool) (int, bool, []byte) {
+// actual content is not needed and we just want to walk through the stream.
+// The content returned is then nil. This functionality is used in log.go.
+//
+// A level can be at most one more than the previous one (the first is 1),
+// and lengths cannot go beyond the end of the input, if known, or the
+// limits. Otherwise p.err is set and 0 returned.
+func (p *BinParser) line(write bool) (int, interface{}) {
 
 	// Read an integer (the level)
 	level := p.varInt()
-	if level < 1 {
-		return 0, false, nil
+	if p.last >= 0 && p.exceeded(0, 0) {
+		return 0, nil
 	}
-
-	// create a byte buffer to accumulate the bytes read.
-	buf := bytes.Buffer{}
+	if level == 0 || p.last < 0 {
+		return 0, nil
+	}
+	if level < 0 || level > p.depth+1 {
+		p.err = errInvalidLevel
+		return 0, nil
+	}
+	if p.MaxDepth > 0 && level > p.MaxDepth {
+		p.err = fmt.Errorf("%w: depth exceeded (max %d)", ErrLimitExceeded, p.MaxDepth)
+		return 0, nil
+	}
+	p.depth = level
 
 	// read first byte of the node content.
 	n := p.read()
 
-	// Binary node if n==1
-	if n == 1 {
-		// Read length, then bytes
-		for {
-			n = p.varInt()
-			if n < 0 {
-				break
+	switch {
+	case n == binBytes:
+		return p.bytes(level, write)
+	case n == binString:
+		return p.text(level, p.read(), write)
+	case n > binBytes && n <= binLastTag:
+		v := p.typed(n)
+		if !write || p.err != nil {
+			return level, nil
+		}
+		return level, v
+	}
+
+	return p.text(level, n, write)
+}
+
+// bytes reads the content of a binary node.
+//
+//     binary-node ::= 0x01 ( length data )* 0x00
+func (p *BinParser) bytes(level int, write bool) (int, interface{}) {
+
+	// create a byte buffer to accumulate the bytes read.
+	buf := bytes.Buffer{}
+	size := 0
+
+	// Read length, then bytes
+	for {
+		n := p.varInt()
+		if n == 0 || p.last < 0 {
+			break
+		}
+		if n < 0 || p.size > 0 && n > p.size-p.n {
+			p.err = errInvalidLength
+			return 0, nil
+		}
+		size += n
+		if p.exceeded(size, n) {
+			return 0, nil
+		}
+		for ; n != 0; n-- {
+			c := p.read()
+			if c < 0 {
+				return level, buf.Bytes()
 			}
-			for ; n != 0; n-- {
-				c := p.read()
-				if c < 0 {
-					return level, true, buf.Bytes()
-				}
-				if write {
-					buf.WriteByte(byte(c))
-				}
+			if write {
+				buf.WriteByte(byte(c))
 			}
 		}
-		return level, true, buf.Bytes()
 	}
+	if !write {
+		return level, nil
+	}
+	return level, buf.Bytes()
+}
 
-	// Text node. Read bytes until 0
+// text reads the content of a text node, of which c is the first byte.
+// Read bytes until 0 (or the end of the stream).
+//
+//     text-node ::= 0x06? text 0x00
+func (p *BinParser) text(level, c int, write bool) (int, interface{}) {
 
-	if write {
-		buf.WriteByte(byte(n))
-	}
+	buf := bytes.Buffer{}
 
-	for {
-		c := p.read()
-		if c == 0 {
-			return level, false, buf.Bytes()
+	for size := 1; c > 0; size++ {
+		if p.exceeded(size, 0) {
+			return 0, nil
 		}
 		if write {
 			buf.WriteByte(byte(c))
 		}
+		c = p.read()
+	}
+
+	if !write {
+		return level, nil
+	}
+	return level, buf.String()
+}
+
+// typed reads the value of a typed node, with the tag given.
+//
+//     typed-node ::= 0x02 zigzag-varint     (int64)
+//                  | 0x03 byte[8]            (float64, IEEE 754, big endian)
+//                  | 0x04 ( 0x00 | 0x01 )    (bool)
+//                  | 0x05 length byte[length] (time.Time, MarshalBinary)
+//
+// Other tags up to binLastTag are reserved, and rejected.
+func (p *BinParser) typed(tag int) interface{} {
+
+	switch tag {
+	case binInt:
+		var b [binary.MaxVarintLen64]byte
+		for i := range b {
+			c := p.read()
+			if c < 0 {
+				return nil
+			}
+			b[i] = byte(c)
+			if c < 0x80 {
+				v, _ := binary.Varint(b[:i+1])
+				return v
+			}
+		}
+	case binFloat:
+		if b := p.readN(8); b != nil {
+			return math.Float64frombits(binary.BigEndian.Uint64(b))
+		}
+		return nil
+	case binBool:
+		switch p.read() {
+		case 0:
+			return false
+		case 1:
+			return true
+		case -1:
+			return nil
+		}
+	case binTime:
+		n := p.read()
+		if n < 0 {
+			return nil
+		}
+		if b := p.readN(n); b != nil {
+			var t time.Time
+			if t.UnmarshalBinary(b) == nil {
+				return t
+			}
+		} else {
+			return nil
+		}
+	default:
+		p.err = errInvalidTag
+		return nil
 	}
+
+	p.err = errInvalidScalar
+	return nil
+}
+
+// readN reads n bytes, or returns nil at the end of the stream.
+func (p *BinParser) readN(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		c := p.read()
+		if c < 0 {
+			return nil
+		}
+		b[i] = byte(c)
+	}
+	return b
+}
+
+// exceeded returns true, and sets p.err, if a node of the given size, or the
+// object once ahead more bytes are read, go beyond the limits.
+func (p *BinParser) exceeded(size, ahead int) bool {
+	switch {
+	case p.MaxScalarLen > 0 && size > p.MaxScalarLen:
+		p.err = fmt.Errorf("%w: node longer than %d bytes", ErrLimitExceeded, p.MaxScalarLen)
+	case p.MaxInputBytes > 0 && p.n-p.start+ahead > p.MaxInputBytes:
+		p.err = fmt.Errorf("%w: object longer than %d bytes", ErrLimitExceeded, p.MaxInputBytes)
+	default:
+		return false
+	}
+	return true
 }
 
 // read reads one character (byte) from the stream, returning it in the for of an int.
@@ -305,7 +801,6 @@ func (p *BinParser) read() int {
 }
 
 // unread puts the last character readed back into the stream.
-// (unread is used in rfunction.go, not in this file)
 func (p *BinParser) unread() {
 	if p.last > 0 {
 		p.n--
@@ -0,0 +1,134 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// builtins are the functions available in expressions without
+// registration:
+//
+//     len(x)              the number of subnodes of a node, the number of
+//                         characters of a string, or the number of elements
+//                         of a Go slice or map; 0 if x doesn't exist
+//     contains(s, sub)    true if sub is within s
+//     hasprefix(s, p)     true if s begins with p
+//     hassuffix(s, p)     true if s ends with p
+//     lower(s), upper(s)  s in lower or upper case
+//     trim(s)             s without leading and trailing spaces
+//     range(a, b[, step]) the integers from a up to b, excluded (see $for)
+//     matchindex(x)       the origin of x if it was returned by a selector
+//     matchkey(x)         (see Graph.MatchIndex, MatchKey and MatchPath)
+//     matchpath(x)
+//
+// They are found before the functions of function sets, which cannot
+// replace them, but after the nodes of the context: a key named len hides
+// the builtin, as it hides any function. As elsewhere in expressions, a key
+// with a single value, as 'name abc', stands for the value, so len(name) is
+// 3.
+var builtins map[string]func(c *Graph, args *Graph, ee *evalError) interface{}
+
+func init() {
+	builtins = map[string]func(*Graph, *Graph, *evalError) interface{}{
+		"len":       builtinLen,
+		"contains":  stringBuiltin(2, func(s []string) interface{} { return strings.Contains(s[0], s[1]) }),
+		"hasprefix": stringBuiltin(2, func(s []string) interface{} { return strings.HasPrefix(s[0], s[1]) }),
+		"hassuffix": stringBuiltin(2, func(s []string) interface{} { return strings.HasSuffix(s[0], s[1]) }),
+		"lower":     stringBuiltin(1, func(s []string) interface{} { return strings.ToLower(s[0]) }),
+		"upper":     stringBuiltin(1, func(s []string) interface{} { return strings.ToUpper(s[0]) }),
+		"trim":      stringBuiltin(1, func(s []string) interface{} { return strings.TrimSpace(s[0]) }),
+		"range":     valueBuiltin(newRange),
+		"matchindex": valueBuiltin(func(a ...interface{}) interface{} {
+			if len(a) != 1 {
+				return -1
+			}
+			return matchOf(a[0]).MatchIndex()
+		}),
+		"matchkey": valueBuiltin(func(a ...interface{}) interface{} {
+			if len(a) != 1 {
+				return ""
+			}
+			return matchOf(a[0]).MatchKey()
+		}),
+		"matchpath": valueBuiltin(func(a ...interface{}) interface{} {
+			if len(a) != 1 {
+				return ""
+			}
+			return matchOf(a[0]).MatchPath()
+		}),
+	}
+}
+
+// valueBuiltin returns a builtin that calls fn with the values of its
+// arguments, as plain functions are called.
+func valueBuiltin(fn func(...interface{}) interface{}) func(*Graph, *Graph, *evalError) interface{} {
+	return func(c *Graph, args *Graph, ee *evalError) interface{} {
+		var a []interface{}
+		for _, n := range args.Out {
+			a = append(a, c.eval(n, ee))
+		}
+		return fn(a...)
+	}
+}
+
+// stringBuiltin returns a builtin that calls fn with its n arguments as
+// strings.
+func stringBuiltin(n int, fn func([]string) interface{}) func(*Graph, *Graph, *evalError) interface{} {
+	return func(c *Graph, args *Graph, ee *evalError) interface{} {
+		if args.Len() != n {
+			ee.set(errors.New("wrong number of arguments"))
+			return nil
+		}
+		s := make([]string, n)
+		for i, a := range args.Out {
+			s[i] = _string(c.eval(a, ee))
+		}
+		return fn(s)
+	}
+}
+
+// builtinLen implements len(x). A missing x is not an error.
+func builtinLen(c *Graph, args *Graph, ee *evalError) interface{} {
+
+	if args.Len() != 1 {
+		ee.set(errors.New("wrong number of arguments"))
+		return nil
+	}
+
+	fe := &evalError{}
+	if ee != nil {
+		fe.quota, fe.owned, fe.objects = ee.quota, ee.owned, ee.objects
+	}
+	v := c.eval(args.Out[0], fe)
+
+	var qe *QuotaExceededError
+	if errors.As(fe.err, &qe) {
+		ee.set(fe.err)
+		return 0
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return utf8.RuneCountInString(v)
+	case []byte:
+		return utf8.RuneCount(v)
+	case *Graph:
+		// A node with a single subnode evaluates to it: count those of the
+		// node itself.
+		if p := unwrap(args.Out[0]); p.String() == TypePath {
+			q := &Graph{This: TypePath, Out: append(append([]*Graph{}, p.Out...), NewGraph("_len"))}
+			if n, ok := c.eval(q, fe).(int); ok {
+				return n
+			}
+		}
+		return v.Len()
+	}
+	return iterLen(v)
+}
@@ -33,7 +33,13 @@ func IsSpaceChar(c int) bool {
 
 // IsTemplateTextChar returns true for all not END chars and not $
 func IsTemplateTextChar(c int) bool {
-	return !IsEndChar(c) && c != '$'
+	return isTemplateTextChar(c, '$')
+}
+
+// isTemplateTextChar is IsTemplateTextChar for templates where variables
+// start with delim.
+func isTemplateTextChar(c, delim int) bool {
+	return !IsEndChar(c) && c != delim
 }
 
 // IsOperatorChar returns true for all operator characters used in OGDL
@@ -0,0 +1,306 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of changes, as found in the patch graph returned by Diff.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// Diff compares two graphs and returns the differences as a patch graph,
+// with a node per change. Each one holds the path of the change and, below
+// it, the subnodes of the node added or removed, or the old and new value
+// if a value changed:
+//
+//     added
+//       server.tls
+//         cert a.pem
+//     removed
+//       debug
+//         true
+//     changed
+//       server.port
+//         80
+//         8080
+//
+// Nodes are matched by name; the second node with the same name as a
+// sibling is written as name{1} in paths, the third as name{2}, and so on. A
+// node with a single leaf below it, as 'port 80', holds a value. Changes are
+// ordered by path. The patch shares nodes with a and b.
+func Diff(a, b *Graph) *Graph {
+	d := NilGraph()
+	for _, c := range changes(a, b) {
+		n := d.Add(c.kind).Add(c.pathString())
+		switch c.kind {
+		case DiffChanged:
+			n.Add(c.old)
+			n.Add(c.new)
+		case DiffAdded:
+			n.Out = append(n.Out, c.new.Out...)
+		case DiffRemoved:
+			n.Out = append(n.Out, c.old.Out...)
+		}
+	}
+	return d
+}
+
+// DiffOptions control the report written by DiffText.
+type DiffOptions struct {
+	// Redact lists patterns of secret names, as for path.Match and ignoring
+	// case, such as "*password*". Values below a node whose name matches
+	// are written as [redacted].
+	Redact []string
+	// Width, if > 0, is the maximum length of a line. Longer lines are cut
+	// and end with "...".
+	Width int
+	// MaxScalar, if > 0, cuts scalars longer than MaxScalar bytes, which
+	// then end with "...".
+	MaxScalar int
+	// Patch, if not nil, receives the patch graph (see Diff), redacted and
+	// cut as the report.
+	Patch *Graph
+}
+
+// redacted replaces secret values.
+const redacted = "[redacted]"
+
+// DiffText compares two graphs, as Diff does, and returns a report for
+// humans, with a line per change ordered by path: added paths, followed by
+// their new subnodes, removed paths and changed values:
+//
+//     + server.tls
+//         cert a.pem
+//     - debug
+//     ~ server.port: 80 -> 8080
+//
+// The report is empty if the graphs are equal. opts can be nil.
+func DiffText(a, b *Graph, opts *DiffOptions) []byte {
+
+	o := DiffOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	buf := &bytes.Buffer{}
+
+	for _, c := range changes(a, b) {
+		hide := o.secret(c.path)
+		p := c.pathString()
+
+		var n *Graph
+		if o.Patch != nil {
+			n = o.Patch.Add(c.kind).Add(p)
+		}
+
+		switch c.kind {
+		case DiffAdded:
+			o.line(buf, "+ "+p)
+			v := o.view(c.new, hide)
+			if n != nil {
+				n.Out = append(n.Out, v.Out...)
+			}
+			if v.Len() == 0 {
+				continue
+			}
+			lineLen := 80
+			if o.Width > 4 {
+				lineLen = o.Width - 4
+			}
+			text := (&Graph{Out: v.Out}).Format(&PrintOptions{MaxLineLen: lineLen})
+			for _, s := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+				o.line(buf, "    "+s)
+			}
+		case DiffRemoved:
+			o.line(buf, "- "+p)
+			if n != nil {
+				n.Out = append(n.Out, o.view(c.old, hide).Out...)
+			}
+		case DiffChanged:
+			from := o.view(c.old, hide)
+			to := o.view(c.new, hide)
+			q := &PrintOptions{Escapes: true}
+			o.line(buf, "~ "+p+": "+q.scalar(from.String(), 0)+" -> "+q.scalar(to.String(), 0))
+			if n != nil {
+				n.Add(from)
+				n.Add(to)
+			}
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// line writes s and a newline, cutting s to the width.
+func (o *DiffOptions) line(buf *bytes.Buffer, s string) {
+	if o.Width > 0 {
+		s = cut(s, o.Width)
+	}
+	buf.WriteString(s)
+	buf.WriteByte('\n')
+}
+
+// secret returns true if an element of the path has a secret name.
+func (o *DiffOptions) secret(elems []string) bool {
+	for _, e := range elems {
+		if o.isSecret(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *DiffOptions) isSecret(s string) bool {
+	s = strings.ToLower(s)
+	for _, p := range o.Redact {
+		if ok, _ := path.Match(strings.ToLower(p), s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// view returns a copy of g with scalars cut to MaxScalar, and with the
+// values below secret names redacted. If hide is true, the value of g is
+// redacted too.
+func (o *DiffOptions) view(g *Graph, hide bool) *Graph {
+
+	v := &Graph{This: g.This}
+	if hide {
+		v.This = redacted
+	} else if o.MaxScalar > 0 {
+		if s := g.String(); len(s) > o.MaxScalar {
+			v.This = cut(s, o.MaxScalar)
+		}
+	}
+
+	below := hide || o.isSecret(g.String())
+	for _, n := range g.Out {
+		v.Out = append(v.Out, o.view(n, below))
+	}
+	return v
+}
+
+// cut returns s cut to n bytes, ending with "...", if it is longer. Runes
+// are not split.
+func cut(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	i := n - 3
+	if i < 0 {
+		i = 0
+	}
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return s[:i] + "..."
+}
+
+// change is a difference between two graphs. old and new are the nodes at
+// path if it was removed or added, or the old and new values.
+type change struct {
+	kind     string
+	path     []string
+	old, new *Graph
+}
+
+func (c *change) pathString() string {
+	return strings.Join(c.path, ".")
+}
+
+// changes returns the differences between a and b, ordered by path.
+func changes(a, b *Graph) []change {
+	var l []change
+	diff(&l, nil, a, b)
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].pathString() < l[j].pathString()
+	})
+	return l
+}
+
+// diff appends to l the differences between the subnodes of a and b, which
+// are at the path given.
+func diff(l *[]change, at []string, a, b *Graph) {
+
+	ka := keyed(a)
+	kb := keyed(b)
+
+	ma := map[string]*Graph{}
+	for _, k := range ka {
+		ma[k.key] = k.node
+	}
+	mb := map[string]*Graph{}
+	for _, k := range kb {
+		mb[k.key] = k.node
+	}
+
+	sub := func(key string) []string {
+		return append(append([]string(nil), at...), key)
+	}
+
+	for _, k := range ka {
+		y, ok := mb[k.key]
+		switch {
+		case !ok:
+			*l = append(*l, change{DiffRemoved, sub(k.key), k.node, nil})
+		case isValueNode(k.node) && isValueNode(y):
+			if k.node.Out[0].String() != y.Out[0].String() {
+				*l = append(*l, change{DiffChanged, sub(k.key), k.node.Out[0], y.Out[0]})
+			}
+		default:
+			diff(l, sub(k.key), k.node, y)
+		}
+	}
+
+	for _, k := range kb {
+		if _, ok := ma[k.key]; !ok {
+			*l = append(*l, change{DiffAdded, sub(k.key), nil, k.node})
+		}
+	}
+}
+
+// keyedNode is a node and its path element.
+type keyedNode struct {
+	key  string
+	node *Graph
+}
+
+// keyed returns the subnodes of g with their path elements.
+func keyed(g *Graph) []keyedNode {
+
+	if g == nil {
+		return nil
+	}
+
+	var l []keyedNode
+	seen := map[string]int{}
+
+	for _, n := range g.Out {
+		s := n.String()
+		key := pathElement(s)
+		if i := seen[s]; i > 0 {
+			key += "{" + strconv.Itoa(i) + "}"
+		}
+		seen[s]++
+		l = append(l, keyedNode{key, n})
+	}
+	return l
+}
+
+// isValueNode returns true for nodes with a single leaf below them.
+func isValueNode(g *Graph) bool {
+	return g.Len() == 1 && g.Out[0].Len() == 0
+}
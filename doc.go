@@ -77,4 +77,31 @@
 //
 //     The gateway's IP is 192.168.1.10
 //
+// Shared nodes
+//
+// Graph.Add attaches a *Graph by reference, so the same node can be a
+// subnode of several parents. Such graphs are supported: a change made to
+// the node is seen from all its parents, deleting it from one parent leaves
+// it under the others, and serializations (Text, Format, Binary) write it
+// at each place where it appears, so that parsing the output gives a tree.
+// Use Clone to attach a copy instead, and IsTree or SharedNodes to find
+// shared nodes. Cycles (a node below itself) are not supported, except by
+// IsTree, SharedNodes and Depth, which detect them.
+//
+// Repeated names
+//
+// The same name can appear several times below a parent, which is the
+// natural way to write a list of objects:
+//
+//     server
+//       host a
+//     server
+//       host b
+//
+// Node returns the first one, Nodes all of them, in order, and Count their
+// number. NodeOrAdd returns the first one, adding it if missing, while Add
+// always adds a new one. In paths, name{N} is the N-th (from 0) node with
+// that name, so server{1}.host is b, and name alone is the first one. Note
+// that name[N] is the N-th subnode of the first node with that name.
+//
 package ogdl
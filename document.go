@@ -0,0 +1,564 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// ErrNotEditable is returned by the Document mutation methods when the
+// change cannot be expressed as a text edit that parses back into the
+// expected graph.
+var ErrNotEditable = errors.New("document cannot be edited at this node")
+
+// Document is OGDL text together with the position of every node in it, so
+// that it can be edited without reformatting. Comments, blank lines, quoting
+// style, indentation and line endings are kept as they are: Source returns
+// the original text byte for byte until the Document is modified, and each
+// modification only touches the lines of the nodes involved.
+//
+// Changes that cannot be made in place, such as adding a subnode to "a b"
+// under a, rewrite the line of the node and the lines below it with Format.
+// Comments among those lines are then lost.
+//
+// Nodes are addressed by canonical paths (see Graph.Get). Every change is
+// checked by parsing the new text, so that the graph of the Document is
+// always the one of its Source.
+type Document struct {
+	src   []byte
+	lines []docLine
+	graph *Graph
+	where map[*Graph]docPos
+}
+
+// docLine is a logical line: a line of text plus the lines taken by quoted
+// strings or blocks started on it.
+type docLine struct {
+	// start and end in the source, end including the line break.
+	start, end int
+	// indent is the number of bytes of indentation.
+	indent int
+	// nodes are the nodes of the line, in order.
+	nodes []*Graph
+	// spans are the positions of nodes in the source, or nil if unknown.
+	spans [][2]int
+	// roots is the number of nodes whose parent is on another line.
+	roots int
+}
+
+// docPos is the line of a node and its index among the nodes of the line.
+type docPos struct {
+	line, i int
+}
+
+// ParseLossless parses OGDL text into a Document.
+func ParseLossless(src []byte) (*Document, error) {
+
+	// Offsets of the lines of src
+	offsets := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+
+	// Logical lines are those seen by the parser
+	var starts, levels []int
+
+	p := NewBytesParser(src)
+	p.Hook = func(ev ParseEvent) {
+		if ev.Kind != ParseLine || ev.Line > len(offsets) {
+			return
+		}
+		s := offsets[ev.Line-1]
+		if len(starts) > 0 && starts[len(starts)-1] >= s {
+			return
+		}
+		if len(starts) == 0 {
+			s = 0
+		}
+		starts = append(starts, s)
+		levels = append(levels, ev.Level)
+	}
+	if err := p.Ogdl(); err != nil {
+		return nil, err
+	}
+
+	d := &Document{src: src, graph: NilGraph(), where: map[*Graph]docPos{}}
+
+	// Each line is parsed on its own, and its nodes attached where the
+	// parser would have placed them.
+	parents := []*Graph{d.graph}
+
+	for i, s := range starts {
+		e := len(src)
+		if i+1 < len(starts) {
+			e = starts[i+1]
+		}
+
+		l := docLine{start: s, end: e}
+		for l.indent < e-s && IsSpaceChar(int(src[s+l.indent])) {
+			l.indent++
+		}
+
+		q := NewBytesParser(src[s:e])
+		if err := q.Ogdl(); err != nil {
+			return nil, err
+		}
+
+		lev := levels[i]
+		var nodes []*Graph
+		if g := q.Graph(); g != nil {
+			nodes = g.Out
+		}
+		for _, n := range nodes {
+			if lev >= len(parents) {
+				return nil, errors.New("unsupported document layout")
+			}
+			parents[lev].Out = append(parents[lev].Out, n)
+			l.roots++
+			d.index(n, lev, &parents, &l, len(d.lines))
+		}
+
+		if spans := scanLine(src[s:e]); len(spans) == len(l.nodes) {
+			for j := range spans {
+				spans[j][0] += s
+				spans[j][1] += s
+			}
+			l.spans = spans
+		}
+
+		d.lines = append(d.lines, l)
+	}
+
+	if !d.graph.Equal(p.Graph()) {
+		return nil, errors.New("unsupported document layout")
+	}
+
+	return d, nil
+}
+
+// index records the position of n and its subnodes, which are at line i,
+// and makes n the parent of the nodes at the next level.
+func (d *Document) index(n *Graph, lev int, parents *[]*Graph, l *docLine, i int) {
+
+	d.where[n] = docPos{i, len(l.nodes)}
+	l.nodes = append(l.nodes, n)
+
+	*parents = append((*parents)[:lev+1], n)
+
+	for _, c := range n.Out {
+		d.index(c, lev+1, parents, l, i)
+	}
+}
+
+// scanLine returns the position of the scalars of a logical line.
+func scanLine(t []byte) [][2]int {
+
+	var spans [][2]int
+
+	for i := 0; i < len(t); {
+		c := t[i]
+
+		switch {
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(t) && t[j] != c {
+				if t[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(t) {
+				return nil
+			}
+			spans = append(spans, [2]int{i, j + 1})
+			i = j + 1
+		case c == '`':
+			j := i + 1
+			for j < len(t) && t[j] != c {
+				j++
+			}
+			if j >= len(t) {
+				return nil
+			}
+			spans = append(spans, [2]int{i, j + 1})
+			i = j + 1
+		case c == '\\' && i+1 < len(t) && IsBreakChar(int(t[i+1])):
+			// A block takes the rest of the line, except the final break
+			j := len(t)
+			if j > i && t[j-1] == '\n' {
+				j--
+			}
+			if j > i && t[j-1] == '\r' {
+				j--
+			}
+			return append(spans, [2]int{i, j})
+		case c == '#':
+			for i < len(t) && t[i] != '\n' {
+				i++
+			}
+		case IsTextChar(int(c)):
+			j := i
+			for j < len(t) && IsTextChar(int(t[j])) {
+				j++
+			}
+			spans = append(spans, [2]int{i, j})
+			i = j
+		default:
+			i++
+		}
+	}
+
+	return spans
+}
+
+// Source returns the text of the document.
+func (d *Document) Source() []byte {
+	return d.src
+}
+
+// Graph returns the graph of the document. It should not be modified: use
+// Set, Add and Remove instead.
+func (d *Document) Graph() *Graph {
+	return d.graph
+}
+
+// Set makes v the only subnode of the node at path, as Graph.Set does. The
+// node must exist. Replacing a single value changes only the value in the
+// text.
+func (d *Document) Set(path string, v interface{}) error {
+
+	parent, j, err := d.graph.locate(path)
+	if err != nil {
+		return err
+	}
+	n := parent.Out[j]
+	s := _string(v)
+
+	want := d.expect(path, func(parent *Graph, j int) {
+		parent.Out[j].Out = nil
+		parent.Out[j].Add(s)
+	})
+
+	var edits []Edit
+
+	if n.Len() == 1 && n.Out[0].Len() == 0 {
+		// Replace the value where it is
+		if sp, ok := d.span(n.Out[0]); ok {
+			edits = append(edits, Edit{sp[0], sp[1] - sp[0], []byte(d.quote(s, sp[0]))})
+		}
+	}
+
+	// Put the value after the node, removing its subnodes
+	if sp, ok := d.span(n); ok {
+		if e, ok := d.replace(n, sp[1], " "+d.quote(s, sp[1]+1)); ok {
+			edits = append(edits, e)
+		}
+	}
+
+	return d.edit(n, want, edits...)
+}
+
+// Add adds v as the last subnode of the node at path (the empty path is the
+// root of the document). New nodes are written with the indentation of their
+// siblings, or on the line of their parent if it has no subnodes.
+func (d *Document) Add(path string, v interface{}) error {
+
+	s := _string(v)
+	n := d.graph
+	if path != "" {
+		parent, j, err := d.graph.locate(path)
+		if err != nil {
+			return err
+		}
+		n = parent.Out[j]
+	}
+
+	want := NilGraph()
+	want.Copy(d.graph)
+	if path != "" {
+		parent, j, _ := want.locate(path)
+		parent.Out[j].Add(s)
+	} else {
+		want.Add(s)
+	}
+
+	if n == d.graph {
+		at := len(d.src)
+		return d.edit(n, want, Edit{at, 0, []byte(d.newline(at) + d.quote(s, 0) + d.eol())})
+	}
+
+	var edits []Edit
+	pos := d.where[n]
+
+	if last := d.lastLine(n); last > pos.line {
+		// After the last line of the node, indented as its last subnode
+		// that begins a line
+		for i := len(n.Out) - 1; i >= 0; i-- {
+			if c := d.where[n.Out[i]]; c.i == 0 && c.line != pos.line {
+				l := d.lines[c.line]
+				ind := string(d.src[l.start : l.start+l.indent])
+				at := d.lines[last].end
+				edits = append(edits, Edit{at, 0, []byte(d.newline(at) + ind + d.quote(s, l.indent) + d.eol())})
+				break
+			}
+		}
+	} else if n.Len() == 0 {
+		if sp, ok := d.span(n); ok {
+			edits = append(edits, Edit{sp[1], 0, []byte(" " + d.quote(s, sp[1]+1))})
+		}
+	}
+
+	return d.edit(n, want, edits...)
+}
+
+// Remove deletes the node at path, together with its subnodes.
+func (d *Document) Remove(path string) error {
+
+	parent, j, err := d.graph.locate(path)
+	if err != nil {
+		return err
+	}
+	n := parent.Out[j]
+
+	want := d.expect(path, func(parent *Graph, j int) {
+		parent.DeleteAt(j)
+	})
+
+	var edits []Edit
+	pos := d.where[n]
+	l := d.lines[pos.line]
+
+	if pos.i == 0 && l.roots == 1 {
+		// The node takes whole lines
+		edits = append(edits, Edit{l.start, d.lines[d.lastLine(n)].end - l.start, nil})
+	} else if sp, ok := d.span(n); ok {
+		// From the end of the previous node, or up to the next one
+		if pos.i > 0 {
+			if e, ok := d.replace(n, l.spans[pos.i-1][1], ""); ok {
+				edits = append(edits, e)
+			}
+		}
+		if next := pos.i + 1 + d.count(n); next < len(l.nodes) {
+			edits = append(edits, Edit{sp[0], l.spans[next][0] - sp[0], nil})
+		}
+	}
+
+	return d.edit(n, want, edits...)
+}
+
+// expect returns a copy of the graph of the document, with fn applied to the
+// node at path.
+func (d *Document) expect(path string, fn func(parent *Graph, j int)) *Graph {
+	g := NilGraph()
+	g.Copy(d.graph)
+	parent, j, _ := g.locate(path)
+	fn(parent, j)
+	return g
+}
+
+// replace returns the edit that replaces the text from offset at to the end
+// of the subnodes of n with s. The rest of the line of n is kept.
+func (d *Document) replace(n *Graph, at int, s string) (Edit, bool) {
+
+	end, ok := d.inlineEnd(n)
+	if !ok {
+		return Edit{}, false
+	}
+
+	pos := d.where[n]
+	last := d.lastLine(n)
+	if last == pos.line {
+		return Edit{at, end - at, []byte(s)}, true
+	}
+
+	// Subnodes on other lines go too
+	rest := string(d.src[end:d.lines[pos.line].end])
+	return Edit{at, d.lines[last].end - at, []byte(s + rest)}, true
+}
+
+// edit applies the first of edits that gives the expected graph. If none
+// does, the line of n and the lines below it are written anew.
+func (d *Document) edit(n *Graph, want *Graph, edits ...Edit) error {
+
+	for _, e := range edits {
+		if d.apply(e, want) == nil {
+			return nil
+		}
+	}
+	if n == d.graph {
+		return ErrNotEditable
+	}
+
+	l := d.lines[d.where[n].line]
+	if l.roots != 1 {
+		return ErrNotEditable
+	}
+
+	// The first node of the line, in want
+	h := l.nodes[0]
+	path, _ := d.graph.PathFromRoot(h)
+	parent, j, err := want.locate(path)
+	if err != nil {
+		return ErrNotEditable
+	}
+
+	unit := d.unit()
+	opts := &PrintOptions{Indent: len(unit), UseTabs: strings.IndexByte(unit, '\t') != -1, MaxLineLen: 80}
+	ind := string(d.src[l.start : l.start+l.indent])
+
+	var buf bytes.Buffer
+	for _, s := range strings.SplitAfter(parent.Out[j].Format(opts), "\n") {
+		if s == "" {
+			continue
+		}
+		if s != "\n" {
+			buf.WriteString(ind)
+		}
+		buf.WriteString(strings.TrimSuffix(s, "\n"))
+		if strings.HasSuffix(s, "\n") {
+			buf.WriteString(d.eol())
+		}
+	}
+
+	e := Edit{l.start, d.lines[d.lastLine(h)].end - l.start, buf.Bytes()}
+	if d.apply(e, want) != nil {
+		return ErrNotEditable
+	}
+	return nil
+}
+
+// apply makes e on the text of the document, if the result parses into want.
+func (d *Document) apply(e Edit, want *Graph) error {
+
+	src := make([]byte, 0, len(d.src)-e.Removed+len(e.Inserted))
+	src = append(src, d.src[:e.Offset]...)
+	src = append(src, e.Inserted...)
+	src = append(src, d.src[e.Offset+e.Removed:]...)
+
+	nd, err := ParseLossless(src)
+	if err != nil {
+		return err
+	}
+	if !nd.graph.Equal(want) {
+		return ErrNotEditable
+	}
+
+	*d = *nd
+	return nil
+}
+
+// span returns the position of n in the source.
+func (d *Document) span(n *Graph) ([2]int, bool) {
+	pos, ok := d.where[n]
+	if !ok || d.lines[pos.line].spans == nil {
+		return [2]int{}, false
+	}
+	return d.lines[pos.line].spans[pos.i], true
+}
+
+// inlineEnd returns the end of n and the subnodes of n that are on the same
+// line, including the parentheses that close groups opened among them.
+func (d *Document) inlineEnd(n *Graph) (int, bool) {
+
+	sp, ok := d.span(n)
+	if !ok {
+		return 0, false
+	}
+	pos := d.where[n]
+	l := d.lines[pos.line]
+
+	// Subnodes on the line follow n
+	end := sp[1]
+	for i := pos.i + 1; i < len(l.nodes) && d.below(l.nodes[i], n); i++ {
+		end = l.spans[i][1]
+	}
+
+	open := bytes.Count(d.src[sp[1]:end], []byte{'('}) - bytes.Count(d.src[sp[1]:end], []byte{')'})
+	for i := end; open > 0 && i < l.end; i++ {
+		switch d.src[i] {
+		case ')':
+			open--
+			end = i + 1
+		case ' ', '\t', ',':
+		default:
+			return 0, false
+		}
+	}
+
+	return end, true
+}
+
+// below returns true if n is a subnode of p, at any depth.
+func (d *Document) below(n, p *Graph) bool {
+	for _, c := range p.Out {
+		if c == n || d.below(n, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns the number of subnodes of n, at any depth.
+func (d *Document) count(n *Graph) int {
+	c := len(n.Out)
+	for _, s := range n.Out {
+		c += d.count(s)
+	}
+	return c
+}
+
+// lastLine returns the index of the last line holding n or its subnodes.
+func (d *Document) lastLine(n *Graph) int {
+	last := d.where[n].line
+	for _, c := range n.Out {
+		if l := d.lastLine(c); l > last {
+			last = l
+		}
+	}
+	return last
+}
+
+// quote returns s as a scalar to be written at offset at.
+func (d *Document) quote(s string, at int) string {
+	col := at - (bytes.LastIndexByte(d.src[:at], '\n') + 1)
+	return (&PrintOptions{}).scalar(s, col)
+}
+
+// unit returns the indentation added at each level, as found in the text.
+func (d *Document) unit() string {
+	prev := ""
+	for _, l := range d.lines {
+		if len(l.nodes) == 0 {
+			continue
+		}
+		ind := string(d.src[l.start : l.start+l.indent])
+		if len(ind) > len(prev) && strings.HasPrefix(ind, prev) {
+			return ind[len(prev):]
+		}
+		prev = ind
+	}
+	return "  "
+}
+
+// eol returns the line break used in the text.
+func (d *Document) eol() string {
+	if i := bytes.IndexByte(d.src, '\n'); i > 0 && d.src[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// newline returns a line break if the text before offset at doesn't end
+// with one.
+func (d *Document) newline(at int) string {
+	if at == 0 || d.src[at-1] == '\n' {
+		return ""
+	}
+	return d.eol()
+}
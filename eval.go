@@ -4,17 +4,59 @@
 
 package ogdl
 
-import "strconv"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// evalError keeps the first error found during an evaluation, for
+// ProcessE. Evaluation doesn't stop at errors: the results are the same
+// whether they are kept or not. A nil *evalError discards them.
+//
+// It also carries the function call quota of a render, if any. Calls
+// beyond the quota are not made, and evaluate to nil.
+type evalError struct {
+	err   error
+	quota *quota
+
+	// owned, if not nil, holds the nodes private to a template render:
+	// assignments copy the other nodes they modify (see own).
+	owned map[*Graph]bool
+
+	// objects, if not nil, holds the instances of the !type nodes used in
+	// a template render, by the node that has the !type (see function).
+	objects map[*Graph]interface{}
+}
+
+func (e *evalError) set(err error) {
+	if e != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// count accounts for a function call in the quota, if any.
+func (e *evalError) count(name string, remote bool) error {
+	if e == nil || e.quota == nil {
+		return nil
+	}
+	return e.quota.take(name, remote)
+}
 
 // Eval takes a parsed expression and evaluates it
 // in the context of the current graph.
 func (g *Graph) Eval(e *Graph) interface{} {
+	return g.eval(e, nil)
+}
+
+func (g *Graph) eval(e *Graph, ee *evalError) interface{} {
 
 	switch e.String() {
 	case TypePath:
-		return g.EvalPath(e)
+		return g.evalPath(e, ee)
 	case TypeExpression:
-		return g.EvalExpression(e)
+		return g.evalExpression(e, ee)
 	}
 
 	if e.Len() != 0 {
@@ -27,7 +69,8 @@ func (g *Graph) Eval(e *Graph) interface{} {
 }
 
 // EvalBool takes a parsed expression and evaluates it in the context of the 
-// current graph, and converts the result to a boolean.
+// current graph, and converts the result to a boolean. Missing paths and
+// values that are not booleans evaluate to false.
 func (g *Graph) EvalBool(e *Graph) bool {
 	b, _ := _boolf(g.Eval(e))
 	return b
@@ -38,16 +81,32 @@ func (g *Graph) EvalBool(e *Graph) bool {
 //
 // This function is similar to ogdl.Get, but for complexer paths. Code could
 // be shared.
+//
+// A selector after a token takes its occurrences: key{} gives the subnodes
+// of all of them as a flat list, key{n} those of the n-th one, and
+// key{expr} the subnodes for which expr, evaluated with each one as
+// context, is true. For example, servers{enabled == "true"}[0].host is the
+// host of the first server enabled.
+//
+// A * element fans out as in Get: servers.*.port evaluates the rest of the
+// path from each server, and gives the results, in order, as the subnodes
+// of a node with a nil root (a single one as is). Branches where the rest
+// cannot be evaluated are left out.
 func (g *Graph) EvalPath(p *Graph) interface{} {
+	return g.evalPath(p, nil)
+}
+
+func (g *Graph) evalPath(p *Graph, ee *evalError) interface{} {
 
 	if p.Len() == 0 {
+		ee.set(errors.New("empty path"))
 		return nil
 	}
 
 	// Normalize the context graph, so that the root is
 	// always transparent.
 
-	var node, nodePrev *Graph
+	var node *Graph
 
 	if !g.IsNil() {
 		node = NilGraph()
@@ -56,9 +115,17 @@ func (g *Graph) EvalPath(p *Graph) interface{} {
 		node = g
 	}
 
+	return g.evalFrom(p, 0, node, ee)
+}
+
+// evalFrom evaluates the elements of the path p from the i-th on, starting
+// at node. Expressions in the path are evaluated in the context g.
+func (g *Graph) evalFrom(p *Graph, i int, node *Graph, ee *evalError) interface{} {
+
+	var nodePrev *Graph
 	iknow := false
 
-	for i := 0; i < len(p.Out); i++ {
+	for ; i < len(p.Out); i++ {
 		n := p.Out[i]
 
 		// For each path element, look at its type:
@@ -72,76 +139,92 @@ func (g *Graph) EvalPath(p *Graph) interface{} {
 		case TypeIndex:
 			// must evaluate to an integer
 			if n.Len() == 0 {
+				ee.set(fmt.Errorf("empty [] in %s", pathString(p)))
 				return "empty []"
 			}
-			itf := g.EvalExpression(n.Out[0])
+			itf := g.evalExpression(n.Out[0], ee)
 			ix, ok := _int64(itf)
 			if !ok || ix < 0 {
+				ee.set(fmt.Errorf("[] does not evaluate to a valid integer in %s", pathString(p)))
 				return "[] does not evaluate to a valid integer"
 			}
 
 			nodePrev = node
 			node = node.GetAt(int(ix))
+			if node == nil {
+				ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
+			}
 
 		case TypeSelector:
 			if nodePrev == nil || nodePrev.Len() == 0 || i < 1 {
+				ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
 				return nil
 			}
 
 			elemPrev := p.Out[i-1].String()
 			if len(elemPrev) == 0 {
+				ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
 				return nil
 			}
 
-			r := NilGraph()
+			// The nodes returned know where they come from
+			prefix := pathString(&Graph{Out: p.Out[:i]})
 
 			if n.Len() == 0 {
 				// This case is {}, meaning that we must return
 				// all ocurrences of the token just before (elemPrev).
 				// And that means creating a new Graph object.
 
-				r.addEqualNodes(nodePrev, elemPrev, false)
+				r := matches(nodePrev, elemPrev, prefix, -1)
 
 				if r.Len() == 0 {
+					ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
 					return nil
 				}
 				node = r
+			} else if n.Len() > 1 || !isInteger(n.Out[0].String()) {
+				// {expr}: the subnodes of all ocurrences for which expr,
+				// evaluated in their context, is true.
+				node = g.filter(matches(nodePrev, elemPrev, prefix, -1), n, ee)
 			} else {
 				i, err := strconv.Atoi(n.Out[0].String())
 				if err != nil || i < 0 {
+					ee.set(fmt.Errorf("invalid selector in %s", pathString(p)))
 					return nil
 				}
 
-				// {0} must still be handled: add it to r
-				i++
 				// of all the nodes with name elemPrev, select the ith.
-				for _, nn := range nodePrev.Out {
-					if nn.String() == elemPrev {
-						i--
-						if i == 0 {
-
-							r.AddNodes(nn)
-							node = r
-							break
-						}
-					}
-				}
-
-				if i > 0 {
+				if j, _ := nodePrev.occurrence(elemPrev, i); j < 0 {
+					ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
 					return nil
 				}
+				node = matches(nodePrev, elemPrev, prefix, i)
 			}
 
+		case TypeAny:
+			return g.evalAny(p, i, node, ee)
+
 		case "_len":
 			return node.Len()
 
 		case TypeGroup:
+			// Call of a bound function stored in the context
+			if b := node.boundFunction(); b != nil {
+				return b.call(g, n, ee)
+			}
+
 			// The following format is supported: ( expression )
 			// The expression is evaluated and used as path element
-			itf := g.EvalExpression(n.Out[0])
+			if n.Len() == 0 {
+				// Empty argument list: only a function call makes sense
+				return node.call(p, i, g, ee)
+			}
+			itf := g.evalExpression(n.Out[0], ee)
 			str := _string(itf)
 			if len(str) == 0 {
-				return nil // expr does not evaluate to a string
+				// expr does not evaluate to a string
+				ee.set(fmt.Errorf("() does not evaluate to a string in %s", pathString(p)))
+				return nil
 			}
 			s = str
 			fallthrough
@@ -149,13 +232,24 @@ func (g *Graph) EvalPath(p *Graph) interface{} {
 			nn := node.Node(s)
 
 			if nn == nil {
-				// It may have a !type
-				itf, _ := node.Function(p, i, g)
-				
-				if itf == nil { 				
-				    itf, _ = node.Function2(p,i,g)
+				// bind(function, args...)
+				if s == "bind" && i+1 < len(p.Out) && p.Out[i+1].String() == TypeGroup {
+					return g.bind(p.Out[i+1])
+				}
+
+				// A builtin, or a plain function, as added with
+				// TemplateFuncAdd
+				if i == 0 && i+1 < len(p.Out) && p.Out[i+1].String() == TypeGroup {
+					if b := builtins[s]; b != nil {
+						return b(g, p.Out[i+1], ee)
+					}
+					if fn := g.lookupFunc(s); fn != nil {
+						return g.callFunc(s, fn, p.Out[i+1], ee)
+					}
 				}
-				return itf
+
+				// It may have a !type
+				return node.call(p, i, g, ee)
 			}
 
 			iknow = true
@@ -166,6 +260,7 @@ func (g *Graph) EvalPath(p *Graph) interface{} {
 	}
 
 	if node == nil {
+		ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
 		return nil
 	}
 
@@ -196,11 +291,133 @@ func (g *Graph) EvalPath(p *Graph) interface{} {
 	return node
 }
 
+// evalAny evaluates the rest of the path p, after the * element at i, from
+// each subnode of node, and returns the results as a list.
+func (g *Graph) evalAny(p *Graph, i int, node *Graph, ee *evalError) interface{} {
+
+	r := NilGraph()
+
+	for _, n := range node.Out {
+		// At the end, * stands for the subnodes, as a key would
+		if i == len(p.Out)-1 {
+			r.Out = append(r.Out, n.Out...)
+			continue
+		}
+
+		fe := &evalError{}
+		if ee != nil {
+			fe.quota, fe.owned, fe.objects = ee.quota, ee.owned, ee.objects
+		}
+		v := g.evalFrom(p, i+1, n, fe)
+
+		var qe *QuotaExceededError
+		if errors.As(fe.err, &qe) {
+			ee.set(fe.err)
+			return nil
+		}
+		if fe.err != nil {
+			continue
+		}
+
+		switch v := v.(type) {
+		case nil:
+		case *Graph:
+			if v.IsNil() {
+				r.Out = append(r.Out, v.Out...)
+			} else {
+				r.Out = append(r.Out, v)
+			}
+		default:
+			r.Add(v)
+		}
+	}
+
+	switch r.Len() {
+	case 0:
+		ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
+		return nil
+	case 1:
+		if r.Out[0].Len() == 0 {
+			return r.Out[0].This
+		}
+		return r.Out[0]
+	}
+	return r
+}
+
+// call calls the function (with a !type, or a Go method or field) that
+// element i of path p refers to, in g. If there is none, the path is not
+// found.
+func (g *Graph) call(p *Graph, i int, context *Graph, ee *evalError) interface{} {
+
+	itf, err := g.function(p, i, context, ee)
+	var qe *QuotaExceededError
+	if itf == nil && err != errNoValue && !errors.As(err, &qe) {
+		var err2 error
+		itf, err2 = g.function2(p, i, context, ee)
+		if itf != nil || err == nil || err2 == errNoValue {
+			err = err2
+		}
+	}
+
+	switch {
+	case err == errNoValue:
+		// A method that returns nothing
+	case err != nil:
+		ee.set(fmt.Errorf("%s: %w", pathString(p), err))
+	case itf == nil:
+		ee.set(fmt.Errorf("%w: %s", ErrNotFound, pathString(p)))
+	}
+	return itf
+}
+
+// filter returns the nodes of the list all for which the expression held by
+// the selector sel is true, evaluated with each one as context. Paths
+// missing in a node make it false.
+func (g *Graph) filter(all *Graph, sel *Graph, ee *evalError) *Graph {
+
+	e := NewGraph(TypeExpression)
+	for _, n := range sel.Out {
+		e.Add(n.Clone())
+	}
+	e._ast()
+
+	r := NilGraph()
+	for _, n := range all.Out {
+		fe := &evalError{}
+		if ee != nil {
+			fe.quota, fe.owned, fe.objects = ee.quota, ee.owned, ee.objects
+		}
+
+		b, _ := _boolf((&Graph{Out: n.Out}).eval(e, fe))
+
+		var qe *QuotaExceededError
+		if errors.As(fe.err, &qe) {
+			ee.set(fe.err)
+			return r
+		}
+		if b {
+			r.Out = append(r.Out, n)
+		}
+	}
+	return r
+}
+
+// isInteger returns true if s is a decimal integer, as in {1}.
+func isInteger(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
 // EvalExpression evaluates expressions (!e)
 // g can have native types (other things than strings), but
 // p only []byte or string
 //
 func (g *Graph) EvalExpression(p *Graph) interface{} {
+	return g.evalExpression(p, nil)
+}
+
+func (g *Graph) evalExpression(p *Graph, ee *evalError) interface{} {
 
 	// Return nil and empty strings as is
 	if p.This == nil {
@@ -222,16 +439,19 @@ func (g *Graph) EvalExpression(p *Graph) interface{} {
 	switch s {
 	case "!":
 		// Unary expression !expr
-		return !g.EvalBool(p.Out[0])
+		if p.Len() == 0 {
+			return nil
+		}
+		return !g.evalBool(p.Out[0], ee)
 	case TypeExpression:
-		return g.EvalExpression(p.GetAt(0))
+		return g.evalExpression(p.GetAt(0), ee)
 	case TypePath:
-		return g.EvalPath(p)
+		return g.evalPath(p, ee)
 	case TypeGroup:
 		// expression list
 		r := NewGraph(TypeGroup)
 		for _, expr := range p.Out {
-			r.Add(g.EvalExpression(expr))
+			r.Add(g.evalExpression(expr, ee))
 		}
 		return r
 	}
@@ -243,7 +463,7 @@ func (g *Graph) EvalExpression(p *Graph) interface{} {
 	if IsOperatorChar(c) {
 	    if len(s)<=2 {
 	        if len(s)==1 || IsOperatorChar(int(s[1])) {
-		        return g.evalBinary(p)
+		        return g.evalBinary(p, ee)
 		    }
 		}
 	}
@@ -265,175 +485,232 @@ func (g *Graph) EvalExpression(p *Graph) interface{} {
 	return p
 }
 
-func (g *Graph) evalBinary(p *Graph) interface{} {
+// evalBool evaluates an expression node and converts the result to a
+// boolean.
+func (g *Graph) evalBool(p *Graph, ee *evalError) bool {
+	b, _ := _boolf(g.evalExpression(p, ee))
+	return b
+}
+
+func (g *Graph) evalBinary(p *Graph, ee *evalError) interface{} {
 	// p.String() is the operator
 
+	switch p.Len() {
+	case 0:
+		ee.set(fmt.Errorf("operator %s without operands", p.String()))
+		return nil
+	case 1:
+		// Unary + and -
+		switch p.String() {
+		case "-":
+			return arith(int64(0), g.evalExpression(p.Out[0], ee), '-', ee)
+		case "+":
+			return g.evalExpression(p.Out[0], ee)
+		}
+		ee.set(fmt.Errorf("operator %s needs two operands", p.String()))
+		return nil
+	}
+
 	n1 := p.Out[0]
-	i2 := g.EvalExpression(p.Out[1])
+
+	// Logical operators short-circuit: the right side is only
+	// evaluated if needed.
+	switch p.String() {
+	case "&&":
+		return g.evalBool(n1, ee) && g.evalBool(p.Out[1], ee)
+	case "||":
+		return g.evalBool(n1, ee) || g.evalBool(p.Out[1], ee)
+	}
+
+	i2 := g.evalExpression(p.Out[1], ee)
 
 	switch p.String() {
 
 	case "+":
-		return calc(g.EvalExpression(n1), i2, '+')
+		return arith(g.evalExpression(n1, ee), i2, '+', ee)
 	case "-":
-		return calc(g.EvalExpression(n1), i2, '-')
+		return arith(g.evalExpression(n1, ee), i2, '-', ee)
 	case "*":
-		return calc(g.EvalExpression(n1), i2, '*')
+		return arith(g.evalExpression(n1, ee), i2, '*', ee)
 	case "/":
-		return calc(g.EvalExpression(n1), i2, '/')
+		return arith(g.evalExpression(n1, ee), i2, '/', ee)
 	case "%":
-		return calc(g.EvalExpression(n1), i2, '%')
+		return arith(g.evalExpression(n1, ee), i2, '%', ee)
 
 	case "=":
-		return g.assign(n1, i2, '=')
+		return g.assign(n1, i2, '=', ee)
 	case "+=":
-		return g.assign(n1, i2, '+')
+		return g.assign(n1, i2, '+', ee)
 	case "-=":
-		return g.assign(n1, i2, '-')
+		return g.assign(n1, i2, '-', ee)
 	case "*=":
-		return g.assign(n1, i2, '*')
+		return g.assign(n1, i2, '*', ee)
 	case "/=":
-		return g.assign(n1, i2, '/')
+		return g.assign(n1, i2, '/', ee)
 	case "%=":
-		return g.assign(n1, i2, '%')
+		return g.assign(n1, i2, '%', ee)
 
 	case "==":
-		return compare(g.EvalExpression(n1), i2, '=')
+		return compare(g.evalExpression(n1, ee), i2, '=')
 	case ">=":
-		return compare(g.EvalExpression(n1), i2, '+')
+		return compare(g.evalExpression(n1, ee), i2, '+')
 	case "<=":
-		return compare(g.EvalExpression(n1), i2, '-')
+		return compare(g.evalExpression(n1, ee), i2, '-')
 	case "!=":
-		return compare(g.EvalExpression(n1), i2, '!')
+		return compare(g.evalExpression(n1, ee), i2, '!')
 	case ">":
-		return compare(g.EvalExpression(n1), i2, '>')
+		return compare(g.evalExpression(n1, ee), i2, '>')
 	case "<":
-		return compare(g.EvalExpression(n1), i2, '<')
-
-	case "&&":
-		return logic(g.EvalExpression(n1), i2, '&')
-	case "||":
-		return logic(g.EvalExpression(n1), i2, '|')
-
+		return compare(g.evalExpression(n1, ee), i2, '<')
 	}
 
+	ee.set(fmt.Errorf("unknown operator %s", p.String()))
 	return nil
 }
 
-// int* | float* | string
-// first element determines type
-func compare(v1, v2 interface{}, op int) bool {
-	//	fmt.Printf("compare [%v] [%v]\n", v1, v2)
-	i1, ok := _int64(v1)
+// arith is calc, reporting operands it cannot operate on.
+func arith(v1, v2 interface{}, op int, ee *evalError) interface{} {
+	v := calc(v1, v2, op)
+	if v == nil {
+		ee.set(fmt.Errorf("invalid operands for %c: %v and %v", op, v1, v2))
+	}
+	return v
+}
 
-	if ok {
-		i2, ok := _int64f(v2)
-		if !ok {
-			return false
-		}
+// compare compares two values numerically if both are numbers or strings
+// that represent numbers, and lexically otherwise.
+func compare(v1, v2 interface{}, op int) bool {
 
-		switch op {
-		case '=':
-			return i1 == i2
-		case '+':
-			return i1 >= i2
-		case '-':
-			return i1 <= i2
-		case '>':
-			return i1 > i2
-		case '<':
-			return i1 < i2
-		case '!':
-			return i1 != i2
+	n1 := numeric(v1)
+	n2 := numeric(v2)
+
+	if n1 != nil && n2 != nil {
+		i1, ok1 := n1.(int64)
+		i2, ok2 := n2.(int64)
+		if ok1 && ok2 {
+			switch {
+			case i1 < i2:
+				return ordered(-1, op)
+			case i1 > i2:
+				return ordered(1, op)
+			}
+			return ordered(0, op)
 		}
-		return false
-	}
 
-	f1, ok := _float64(v1)
-	if ok {
-		f2, ok := _float64f(v2)
-		if !ok {
-			return false
+		f1, _ := _float64f(n1)
+		f2, _ := _float64f(n2)
+		switch {
+		case f1 < f2:
+			return ordered(-1, op)
+		case f1 > f2:
+			return ordered(1, op)
+		case f1 == f2:
+			return ordered(0, op)
 		}
-		switch op {
-		case '=':
-			return f1 == f2
-		case '+':
-			return f1 >= f2
-		case '-':
-			return f1 <= f2
-		case '>':
-			return f1 > f2
-		case '<':
-			return f1 < f2
-		case '!':
-			return f1 != f2
-		}
-		return false
+		// NaN
+		return op == '!'
 	}
 
-	s1 := _string(v1)
-	s2 := _string(v2)
+	return ordered(strings.Compare(_string(v1), _string(v2)), op)
+}
 
+// ordered returns the result of the comparison operator op given the
+// ordering c (-1, 0 or 1) of its operands.
+func ordered(c int, op int) bool {
 	switch op {
 	case '=':
-		return s1 == s2
+		return c == 0
 	case '!':
-		return s1 != s2
+		return c != 0
+	case '+':
+		return c >= 0
+	case '-':
+		return c <= 0
+	case '>':
+		return c > 0
+	case '<':
+		return c < 0
 	}
 	return false
 }
 
-func logic(i1, i2 interface{}, op int) bool {
-
-	b1, ok1 := _boolf(i1)
-	b2, ok2 := _boolf(i2)
-
-	if !ok1 || !ok2 {
-		return false
+// isNative returns true if v is of an integer or floating point type.
+func isNative(v interface{}) bool {
+	_, ok := _int64(v)
+	if !ok {
+		_, ok = _float64(v)
 	}
+	return ok
+}
 
-	switch op {
-	case '&':
-		return b1 && b2
-	case '|':
-		return b1 || b2
+// numeric returns v as an int64 or float64 if it is a number or a string
+// that represents one, and nil otherwise.
+func numeric(v interface{}) interface{} {
+	if _, ok := _int64(v); ok {
+		return number(v)
 	}
-
-	return false
+	if _, ok := _float64(v); ok {
+		return number(v)
+	}
+	if s := _string(v); !isNumber(s) {
+		return nil
+	}
+	return number(v)
 }
 
-// assign modifies the context graph
-func (g *Graph) assign(p *Graph, v interface{}, op int) interface{} {
+// assign modifies the context graph. In a template render, the nodes on the
+// path are first made private to it.
+func (g *Graph) assign(p *Graph, v interface{}, op int, ee *evalError) interface{} {
+
+	if ee != nil && ee.owned != nil {
+		g.own(p, ee.owned)
+	}
 
 	if op == '=' {
-		return g.set(p, v)
+		return g.setValue(p, v)
 	}
 
 	// if p doesn't exist, just set it to the value given
 	left := g.get(p)
 	if left != nil {
-		return g.set(p, calc(left.This, v, op))
+		return g.setValue(p, calc(left.This, v, op))
 	}
 
 	switch op {
 	case '+':
-		return g.set(p, v)
+		return g.setValue(p, v)
 	case '-':
-		return g.set(p, calc(0, v, '-'))
+		return g.setValue(p, calc(0, v, '-'))
 	case '*':
-		return g.set(p, 0)
+		return g.setValue(p, 0)
 	case '/':
-		return g.set(p, "infinity")
+		return g.setValue(p, "infinity")
 	case '%':
-		return g.set(p, "undefined")
+		return g.setValue(p, "undefined")
 	}
 
 	return nil
 }
 
+// setValue is set for expressions, which evaluate to the node set, or nil.
+func (g *Graph) setValue(p *Graph, v interface{}) *Graph {
+	n, _ := g.set(p, v)
+	return n
+}
+
 // calc: int64 | float64 | string
+//
+// The left operand decides: a number and a string that represents one are
+// operated as numbers, so that values read from a graph can be added to a
+// total, while a string and a number are concatenated.
 func calc(v1, v2 interface{}, op int) interface{} {
+
+	if isNative(v1) {
+		if n := numeric(v2); n != nil {
+			v2 = n
+		}
+	}
+
 	//fmt.Printf("calc: %v %v %s %s\n",v1,v2, _typeOf(v1),_typeOf(v2) )
 	i1, ok := _int64(v1)
 	i2, ok2 := _int64(v2)
@@ -8,6 +8,11 @@ package ogdl
 type EventHandler struct {
 	level int
 	gl    []*Graph
+
+	// rec, if not nil, records the events received (see Parser.RecordEvents)
+	rec *Graph
+	// line points to the line counter of the parser, if any
+	line *int
 }
 
 // NewEventHandler creates an event handler that produces a Graph object
@@ -19,6 +24,10 @@ func NewEventHandler() EventHandler {
 // AddBytes creates a node at the current level, with the given byte array as content.
 func (e *EventHandler) AddBytes(b []byte) bool {
 
+	if e.rec != nil {
+		e.record("bytes", b)
+	}
+
 	if len(e.gl) == 0 {
 		e.gl = append(e.gl, NilGraph())
 	}
@@ -40,6 +49,15 @@ func (e *EventHandler) AddBytes(b []byte) bool {
 // Only one error is possible: an empty graph where we should be writing the
 // event. It that case, false is returned.
 func (e *EventHandler) Add(s string) bool {
+	return e.add(s)
+}
+
+// add is Add for a string already stored in an interface{}.
+func (e *EventHandler) add(s interface{}) bool {
+
+	if e.rec != nil {
+		e.record("add", s)
+	}
 
 	// Create a transparent node to start with,
 	// or else events at level 0 will overwrite
@@ -62,13 +80,51 @@ func (e *EventHandler) Add(s string) bool {
 	return true
 }
 
+// setValue replaces the value of the last node added.
+func (e *EventHandler) setValue(v interface{}) {
+	if e.level+1 < len(e.gl) && e.gl[e.level+1] != nil {
+		e.gl[e.level+1].This = v
+	}
+}
+
+// AddComment creates a comment node (TypeComment, with the given text as
+// subnode) at the current level. Unlike Add, the new node doesn't become the
+// parent of events at the next level.
+func (e *EventHandler) AddComment(s string) bool {
+
+	if e.rec != nil {
+		e.record("comment", s)
+	}
+
+	if len(e.gl) == 0 {
+		e.gl = append(e.gl, NilGraph())
+	}
+
+	for len(e.gl) < e.level+2 {
+		e.gl = append(e.gl, nil)
+	}
+
+	if e.gl[e.level] == nil {
+		return false
+	}
+
+	e.gl[e.level].Add(TypeComment).Add(s)
+	return true
+}
+
 // Delete removes the last event added
 func (e *EventHandler) Delete() {
+
+	if e.rec != nil {
+		e.record("delete", nil)
+	}
 	g := e.gl[e.level]
 	n := g.Len()
 	g.DeleteAt(n - 1)
 
-	e.gl[e.level+1] = g.Out[n-2]
+	if n > 1 {
+		e.gl[e.level+1] = g.Out[n-2]
+	}
 }
 
 // AddAt creates a node at the specified level
@@ -140,3 +196,57 @@ func (e *EventHandler) GraphTop(s string) *Graph {
 	}
 	return g
 }
+
+// record appends an event to the recording. Each event is a node named
+// after the kind of event (add, bytes, comment, delete), with the level,
+// line and value as subnodes:
+//
+//     add
+//       level 1
+//       line 3
+//       value b
+func (e *EventHandler) record(kind string, v interface{}) {
+	n := e.rec.Add(kind)
+	n.Add("level").Add(int64(e.level))
+	if e.line != nil {
+		n.Add("line").Add(int64(*e.line))
+	}
+	if v != nil {
+		n.Add("value").Add(v)
+	}
+}
+
+// ReplayEvents builds a Graph out of a recorded event stream, as returned by
+// Parser.Events. The stream can come from a serialized form (text or binary
+// OGDL), in which case byte values are replayed as strings.
+func ReplayEvents(g *Graph) *Graph {
+
+	if g == nil {
+		return nil
+	}
+
+	e := NewEventHandler()
+
+	for _, ev := range g.Out {
+		l, _ := ev.GetInt64("level")
+		e.SetLevel(int(l))
+
+		var v interface{}
+		if n := ev.Node("value"); n != nil && n.Len() > 0 {
+			v = n.Out[0].This
+		}
+
+		switch ev.String() {
+		case "add":
+			e.Add(_string(v))
+		case "bytes":
+			e.AddBytes(_bytes(v))
+		case "comment":
+			e.AddComment(_string(v))
+		case "delete":
+			e.Delete()
+		}
+	}
+
+	return e.Graph()
+}
@@ -0,0 +1,358 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is an expression built programmatically, with Path, Const, Binary,
+// Unary, And, Or and Not, instead of parsed from text. It has the same shape
+// that NewExpression produces for its String() form, so both evaluate
+// identically:
+//
+//	e := And(Binary(">", Path("cpu.load"), Const(0.9)), Not(Path("maintenance")))
+//	g.EvalBool(e.Graph())
+//
+// Constants are never parsed, so they need no quoting or escaping by the
+// caller.
+type Expr struct {
+	node *Graph
+	err  error
+}
+
+// Path returns an expression that evaluates the given path, as in
+// "cpu.load" or "disks[0].free".
+func Path(s string) Expr {
+
+	p := NewStringParser(s)
+	if !p.Path() || p.Read() != 0 {
+		return Expr{err: fmt.Errorf("invalid path %q", s)}
+	}
+	if p.err != nil {
+		return Expr{err: p.err}
+	}
+
+	return Expr{node: p.GraphTop(TypePath)}
+}
+
+// Const returns a constant expression. v can be a string, a bool or any
+// integer or floating point number.
+func Const(v interface{}) Expr {
+
+	var s string
+
+	switch v := v.(type) {
+	case string:
+		s = v
+	case bool:
+		s = strconv.FormatBool(v)
+	case int:
+		s = strconv.FormatInt(int64(v), 10)
+	case int8:
+		s = strconv.FormatInt(int64(v), 10)
+	case int16:
+		s = strconv.FormatInt(int64(v), 10)
+	case int32:
+		s = strconv.FormatInt(int64(v), 10)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case uint:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		s = strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		s = strconv.FormatUint(v, 10)
+	case float32:
+		return constFloat(float64(v))
+	case float64:
+		return constFloat(v)
+	default:
+		return Expr{err: fmt.Errorf("unsupported constant type %T", v)}
+	}
+
+	return Expr{node: NewGraph(s)}
+}
+
+func constFloat(f float64) Expr {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return Expr{err: fmt.Errorf("unsupported constant %v", f)}
+	}
+	return Expr{node: NewGraph(strconv.FormatFloat(f, 'g', -1, 64))}
+}
+
+// Binary returns the expression l op r, where op is one of the binary
+// operators of NewExpression: arithmetic, comparison, logical or
+// assignment.
+func Binary(op string, l, r Expr) Expr {
+
+	if err := firstErr(l, r); err != nil {
+		return Expr{err: err}
+	}
+
+	// Operands that bind less tightly than op are grouped, as the parser
+	// does with parentheses. Operators are left associative.
+	prec := precedence(op)
+	n := NewGraph(op)
+	n.Add(group(l.node, prec))
+	n.Add(group(r.node, prec+1))
+
+	return Expr{node: n}
+}
+
+// Unary returns the expression op e, where op is "!", "-" or "+".
+func Unary(op string, e Expr) Expr {
+
+	if e.err != nil {
+		return e
+	}
+
+	n := NewGraph(op)
+
+	switch e.node.String() {
+	case TypePath, TypeExpression:
+		n.Add(e.node)
+	default:
+		n.Add(wrap(e.node))
+	}
+
+	return Expr{node: n}
+}
+
+// And returns the logical conjunction of the given expressions.
+func And(e ...Expr) Expr {
+	return fold("&&", e)
+}
+
+// Or returns the logical disjunction of the given expressions.
+func Or(e ...Expr) Expr {
+	return fold("||", e)
+}
+
+// Not returns the logical negation of e.
+func Not(e Expr) Expr {
+	return Unary("!", e)
+}
+
+func fold(op string, e []Expr) Expr {
+
+	if len(e) == 0 {
+		return Expr{err: fmt.Errorf("%s needs at least one operand", op)}
+	}
+
+	r := e[0]
+	for _, x := range e[1:] {
+		r = Binary(op, r, x)
+	}
+	return r
+}
+
+// group wraps n in an expression node if it is a binary operator with a
+// precedence lower than prec.
+func group(n *Graph, prec int) *Graph {
+	if n.Len() == 2 && precedence(n.String()) >= 0 && precedence(n.String()) < prec {
+		return wrap(n)
+	}
+	return n
+}
+
+func wrap(n *Graph) *Graph {
+	e := NewGraph(TypeExpression)
+	e.Add(n)
+	return e
+}
+
+// unwrap returns the expression inside a TypeExpression node.
+func unwrap(e *Graph) *Graph {
+	if e.String() == TypeExpression && e.Len() == 1 {
+		return e.Out[0]
+	}
+	return e
+}
+
+func firstErr(e ...Expr) error {
+	for _, x := range e {
+		if x.err != nil {
+			return x.err
+		}
+	}
+	return nil
+}
+
+// Graph returns the expression as a Graph, ready for Eval or EvalBool. It
+// returns nil if the expression is not valid (see Validate).
+func (e Expr) Graph() *Graph {
+	if e.Validate() != nil {
+		return nil
+	}
+	return wrap(e.node)
+}
+
+// String returns the expression in canonical text form, which
+// NewExpression parses back into an equal graph. It returns "" if the
+// expression is not valid.
+func (e Expr) String() string {
+	if e.Validate() != nil {
+		return ""
+	}
+	return exprString(e.node)
+}
+
+// Validate checks that operators have the right number of operands and that
+// operands are of a valid kind: paths, constants or expressions.
+func (e Expr) Validate() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.node == nil {
+		return errors.New("empty expression")
+	}
+	return validate(e.node)
+}
+
+func validate(n *Graph) error {
+
+	s := n.String()
+
+	switch s {
+	case TypeExpression:
+		if n.Len() != 1 {
+			return errors.New("expression group needs one subnode")
+		}
+		return validateOperand(n.Out[0])
+	case TypePath:
+		if n.Len() == 0 {
+			return errors.New("empty path")
+		}
+		return nil
+	}
+
+	op := s == "!" || precedence(s) >= 0
+
+	switch {
+	case n.Len() == 0:
+		// Constant. Operators would be read back as such.
+		if op {
+			return fmt.Errorf("operator %s without operands", s)
+		}
+		if !isNumber(s) && !quotable(s) {
+			return fmt.Errorf("constant %q cannot be quoted", s)
+		}
+		return nil
+	case !op:
+		return fmt.Errorf("constant %q with subnodes", s)
+	case n.Len() == 1:
+		if s != "!" && s != "-" && s != "+" {
+			return fmt.Errorf("operator %s needs two operands", s)
+		}
+	case n.Len() == 2:
+		if s == "!" {
+			return errors.New("operator ! needs one operand")
+		}
+		if precedence(s) == 0 && n.Out[0].String() != TypePath {
+			return fmt.Errorf("operator %s needs a path on the left", s)
+		}
+	default:
+		return fmt.Errorf("operator %s with %d operands", s, n.Len())
+	}
+
+	for _, o := range n.Out {
+		if err := validateOperand(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateOperand(n *Graph) error {
+	switch n.String() {
+	case TypeGroup, TypeIndex, TypeSelector, TypeTemplate:
+		return fmt.Errorf("%s is not a valid operand", n.String())
+	}
+	return validate(n)
+}
+
+// exprString returns the text form of an expression node.
+func exprString(n *Graph) string {
+
+	s := n.String()
+
+	switch s {
+	case TypeExpression:
+		return "(" + exprString(n.Out[0]) + ")"
+	case TypePath:
+		return pathString(n)
+	}
+
+	switch n.Len() {
+	case 1:
+		return s + exprString(n.Out[0])
+	case 2:
+		return exprString(n.Out[0]) + " " + s + " " + exprString(n.Out[1])
+	}
+
+	if isNumber(s) {
+		return s
+	}
+	if strings.IndexByte(s, '"') != -1 && strings.IndexByte(s, '\'') == -1 {
+		return "'" + s + "'"
+	}
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// pathString returns the text form of a path node.
+func pathString(p *Graph) string {
+
+	var b bytes.Buffer
+
+	for i, n := range p.Out {
+		switch n.String() {
+		case TypeIndex:
+			b.WriteString("[" + exprList(n, " ") + "]")
+		case TypeSelector:
+			b.WriteString("{" + exprList(n, "") + "}")
+		case TypeGroup:
+			b.WriteString("(" + exprList(n, ", ") + ")")
+		case TypeAny:
+			if i != 0 {
+				b.WriteByte('.')
+			}
+			b.WriteByte('*')
+		default:
+			if i != 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(pathElement(n.String()))
+		}
+	}
+
+	return b.String()
+}
+
+func exprList(g *Graph, sep string) string {
+	var s []string
+	for _, n := range g.Out {
+		switch {
+		case n.String() == TypeExpression:
+			s = append(s, exprString(n.Out[0]))
+		case n.Len() == 0 && (n.String() == "!" || precedence(n.String()) >= 0):
+			// Index expressions are kept as flat lists of operands and
+			// operators
+			s = append(s, n.String())
+		default:
+			s = append(s, exprString(n))
+		}
+	}
+	return strings.Join(s, sep)
+}
@@ -8,7 +8,7 @@ package ogdl
 // in the form of a suitable syntax tree.
 //
 //     expression := expr1 (op2 expr1)*
-//     expr1 := path | constant | op1 path | op1 constant | '(' expr ')' | op1 '(' expr ')'
+//     expr1 := path | constant | op1 expr1 | '(' expr ')'
 //     constant ::= quoted | number
 func NewExpression(s string) *Graph {
 	p := NewStringParser(s)
@@ -37,12 +37,16 @@ func (g *Graph) Ast() {
 
 func (g *Graph) _ast() {
 
-	if g.Len() < 3 {
-		return
+	for _, node := range g.Out {
+		if node.String() == TypeExpression {
+			node._ast()
+		} else {
+			node.Ast()
+		}
 	}
 
-	for _, node := range g.Out {
-		node.Ast()
+	if g.Len() < 3 {
+		return
 	}
 
 	var e1, e2 *Graph
@@ -51,8 +55,9 @@ func (g *Graph) _ast() {
 
 		for i := 0; i < len(g.Out); i++ {
 
+			// Unary operators already hold their operand
 			node := g.Out[i]
-			if precedence(node.String()) == j {
+			if node.Len() == 0 && precedence(node.String()) == j {
 				e1 = g.Out[i-1]
 				e2 = g.Out[i+1]
 				g.Out = append(g.Out[:i-1], g.Out[i:]...)
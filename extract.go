@@ -0,0 +1,100 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExtractPath parses OGDL text from r only up to the end of the node at the
+// given path, and returns what Get(path) would return for the whole
+// document. The rest of the input is neither parsed nor read, beyond what
+// the parser buffers, which makes it fast for sections near the start of
+// big documents.
+//
+// Limits: the path can only have plain elements (no indexes, selectors or
+// groups), and as with Get, the first node with a matching name is followed
+// at each level. The end of a node is only known when the parser finds a
+// node at the same or an upper level, so the line after it is read too. A
+// path that is not found is an ErrNotFound, reported as soon as the node
+// that should contain it ends.
+func ExtractPath(r io.Reader, path string) (*Graph, error) {
+
+	p := NewPath(path)
+	if p == nil || p.Len() == 0 {
+		return nil, errors.New("invalid path: " + path)
+	}
+
+	var keys []string
+	for _, e := range p.Out {
+		switch e.String() {
+		case TypeIndex, TypeSelector, TypeGroup, TypeAny:
+			return nil, errors.New("unsupported path element in " + path)
+		}
+		keys = append(keys, e.String())
+	}
+
+	ps := NewParser(r)
+
+	// anc holds the nodes found along the path, and next the number of
+	// subnodes of the last one already checked.
+	var anc []*Graph
+	next := 0
+
+	for {
+		more, err := ps.Line()
+		if err != nil {
+			return nil, err
+		}
+
+		g := ps.Graph()
+		if g == nil {
+			if !more {
+				break
+			}
+			continue
+		}
+
+		for len(anc) < len(keys) {
+			parent := g
+			if len(anc) > 0 {
+				parent = anc[len(anc)-1]
+			}
+			var found *Graph
+			for ; next < parent.Len(); next++ {
+				if parent.Out[next].String() == keys[len(anc)] {
+					found = parent.Out[next]
+					break
+				}
+			}
+			if found == nil {
+				break
+			}
+			anc = append(anc, found)
+			next = 0
+		}
+
+		// A node found is complete when it, or one of its ancestors, is no
+		// longer the last node added at its level.
+		closed := !more
+		for k, n := range anc {
+			if ps.ev.gl[k+1] != n {
+				closed = true
+				break
+			}
+		}
+
+		if closed && len(anc) == len(keys) {
+			return g.Get(path), nil
+		}
+		if closed && len(anc) > 0 || !more {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+}
@@ -0,0 +1,168 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "strings"
+
+// Kinds of glob elements.
+const (
+	globKey  = iota // a key, matched exactly
+	globAny         // *, one level
+	globDeep        // **, zero or more levels
+)
+
+type globElem struct {
+	kind int
+	key  string
+}
+
+// Find returns the nodes below g that match the pattern, in the order Walk
+// visits them. A pattern is a sequence of elements separated by '.': keys,
+// written as in paths (quoted if they are not tokens, as "example.com"),
+// '*', which matches any node, and '**', which matches any number of
+// levels, none included:
+//
+//     servers.*.host    the host of each server
+//     **.password       every password, at any depth
+//     **                every node
+//
+// A node that matches in several ways, as a.b.c for **.**.c, is returned
+// once. An invalid pattern matches nothing.
+func (g *Graph) Find(pattern string) []*Graph {
+	_, l := g.find(pattern, false)
+	return l
+}
+
+// FindPaths is Find, returning also the canonical path (see Get) of each
+// node found.
+func (g *Graph) FindPaths(pattern string) ([]string, []*Graph) {
+	return g.find(pattern, true)
+}
+
+func (g *Graph) find(pattern string, paths bool) ([]string, []*Graph) {
+
+	elems, ok := compileGlob(pattern)
+	if !ok || g == nil {
+		return nil, nil
+	}
+
+	// Matching goes through the elements like an automaton: the state of a
+	// node is the set of elements matched up to it, which is computed from
+	// that of its parent. The states and nodes of the ancestors of the node
+	// visited are kept in stacks.
+	m := len(elems)
+	closure := func(set []bool) {
+		for i, e := range elems {
+			if set[i] && e.kind == globDeep {
+				set[i+1] = true
+			}
+		}
+	}
+
+	start := make([]bool, m+1)
+	start[0] = true
+	closure(start)
+	states := [][]bool{start}
+	nodes := []*Graph{g}
+
+	var lp []string
+	var ln []*Graph
+
+	g.Walk(func(path []string, n *Graph) bool {
+
+		d := len(path)
+		states = states[:d+1]
+		nodes = nodes[:d+1]
+
+		s := n.String()
+		set := make([]bool, m+1)
+		for i, e := range elems {
+			if !states[d][i] {
+				continue
+			}
+			switch e.kind {
+			case globDeep:
+				set[i] = true
+			case globAny:
+				set[i+1] = true
+			default:
+				if e.key == s {
+					set[i+1] = true
+				}
+			}
+		}
+		closure(set)
+
+		states = append(states, set)
+		nodes = append(nodes, n)
+
+		if set[m] {
+			ln = append(ln, n)
+			if paths {
+				lp = append(lp, globPath(nodes))
+			}
+		}
+
+		// Go on if more elements can match below
+		for _, b := range set[:m] {
+			if b {
+				return true
+			}
+		}
+		return false
+	})
+
+	return lp, ln
+}
+
+// globPath returns the canonical path of the last node in l, where each
+// node is a subnode of the previous one.
+func globPath(l []*Graph) string {
+
+	var elems []string
+	for k := 1; k < len(l); k++ {
+		for i, n := range l[k-1].Out {
+			if n == l[k] {
+				elems = append(elems, l[k-1].canonicalElement(i))
+				break
+			}
+		}
+	}
+	return strings.Join(elems, ".")
+}
+
+// compileGlob splits a pattern into its elements.
+func compileGlob(s string) ([]globElem, bool) {
+
+	var elems []globElem
+	p := NewStringParser(s)
+
+	for {
+		var e globElem
+
+		if p.NextByteIs('*') {
+			e.kind = globAny
+			if p.NextByteIs('*') {
+				e.kind = globDeep
+			}
+		} else if q, ok := p.Quoted(); ok {
+			e.key = q
+		} else if t, ok := p.Token(); ok {
+			e.key = t
+		} else {
+			return nil, false
+		}
+		elems = append(elems, e)
+
+		c := p.Read()
+		if c == '.' {
+			continue
+		}
+		if c != 0 || p.Err() != nil {
+			return nil, false
+		}
+		return elems, true
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrCheckpointInvalid is wrapped by the *CheckpointError returned when a
+// checkpoint doesn't match the log anymore, because it was truncated or
+// rewritten.
+var ErrCheckpointInvalid = errors.New("log: invalid checkpoint")
+
+// Checkpoint is the position of a consumer in a log: the records before
+// Offset have been processed. Prev and Hash identify the record before
+// Offset (its position and CRC-32), so that a log that was rewritten is
+// detected. The zero Checkpoint is the start of the log.
+type Checkpoint struct {
+	Offset int64
+	Prev   int64
+	Hash   uint32
+}
+
+// CheckpointError tells that a checkpoint is not valid for a log, and where
+// to restart: the start of the log, as the records processed may not be
+// there anymore.
+type CheckpointError struct {
+	Checkpoint Checkpoint
+	Restart    Checkpoint
+}
+
+func (e *CheckpointError) Error() string {
+	return ErrCheckpointInvalid.Error() + " at offset " + strconv.FormatInt(e.Checkpoint.Offset, 10)
+}
+
+func (e *CheckpointError) Unwrap() error {
+	return ErrCheckpointInvalid
+}
+
+// Record is an object read from a log by Follow. Checkpoint is the
+// position after it, to be saved once the record is processed.
+type Record struct {
+	Graph      *Graph
+	Pos        int64
+	Checkpoint Checkpoint
+}
+
+// FollowOptions control how FollowWith reads a log.
+type FollowOptions struct {
+	// Buffer is the number of records read ahead of the consumer. A slow
+	// consumer stops the reading when it is full. The default is 16.
+	Buffer int
+	// Poll is how often the end of the log is checked for new records. The
+	// default is 100ms.
+	Poll time.Duration
+}
+
+// Follower delivers the records of a log, in order, as they are added.
+type Follower struct {
+	// C receives the records. It is closed when following ends.
+	C <-chan Record
+
+	err error
+}
+
+// Err returns why following ended, once C is closed: the error of the
+// context, ErrLogTruncated if a corrupt record was found, or a
+// *CheckpointError if the log was rewritten by Compact. The checkpoint in
+// it is that of the last record delivered.
+func (f *Follower) Err() error {
+	return f.err
+}
+
+// Follow reads the records of the log from the checkpoint given, and then
+// those added later, until ctx is done. A consumer that saves the
+// checkpoint of each record after processing it, and follows from the last
+// one saved when it starts, sees every record exactly once.
+//
+// If the checkpoint doesn't match the log, Follow returns a
+// *CheckpointError.
+//
+// When the log is rotated (see LogOptions.MaxSize), the follower reads the
+// rest of the segment from its file, and goes on with the next one. The
+// positions and checkpoints of records are those in their segment.
+func (log *Log) Follow(ctx context.Context, from Checkpoint) (*Follower, error) {
+	return log.FollowWith(ctx, from, nil)
+}
+
+// FollowWith is Follow with options, which can be nil.
+func (log *Log) FollowWith(ctx context.Context, from Checkpoint, opts *FollowOptions) (*Follower, error) {
+
+	o := FollowOptions{Buffer: 16, Poll: 100 * time.Millisecond}
+	if opts != nil {
+		if opts.Buffer > 0 {
+			o.Buffer = opts.Buffer
+		}
+		if opts.Poll > 0 {
+			o.Poll = opts.Poll
+		}
+	}
+
+	// The checkpoint is checked in the file of gen. A Compact after
+	// that ends following.
+	var gen logGen
+	for {
+		_, gen = log.file()
+		valid := log.validCheckpoint(from)
+		if _, g := log.file(); g != gen {
+			continue
+		}
+		if !valid {
+			return nil, &CheckpointError{Checkpoint: from, Restart: Checkpoint{}}
+		}
+		break
+	}
+	start := log.pos(0)
+	pos := log.pos(from.Offset)
+
+	c := make(chan Record, o.Buffer)
+	f := &Follower{C: c}
+
+	go func() {
+		defer close(c)
+
+		cp := from
+
+		// seg is the segment read, and rotated its file once it is no
+		// longer the current one.
+		seg := gen.segment
+		var rotated *os.File
+		defer func() {
+			if rotated != nil {
+				rotated.Close()
+			}
+		}()
+
+		for {
+			cur, now := log.file()
+			if now.compactions != gen.compactions {
+				f.err = &CheckpointError{Checkpoint: cp, Restart: Checkpoint{}}
+				return
+			}
+			if rotated == nil && now.segment != seg {
+				var err error
+				if rotated, err = os.Open(segmentFile(cur.Name(), seg)); err != nil {
+					f.err = err
+					return
+				}
+			}
+
+			var b, obj []byte
+			var err error
+			if rotated != nil {
+				b, obj, err = log.readRecord(rotated, pos)
+			} else {
+				b, obj, err = log.readRecord(cur, pos)
+				if _, g := log.file(); g != now {
+					// Changed while reading
+					continue
+				}
+			}
+
+			switch {
+			case err == nil:
+			case rotated != nil && err == io.EOF:
+				// The end of a rotated segment: on to the next one
+				rotated.Close()
+				rotated = nil
+				seg++
+				pos = start
+				continue
+			case rotated == nil && (err == io.EOF || err == io.ErrUnexpectedEOF):
+				// At the end, or a record being written
+				select {
+				case <-ctx.Done():
+					f.err = ctx.Err()
+					return
+				case <-time.After(o.Poll):
+				}
+				continue
+			default:
+				f.err = recordError(err)
+				return
+			}
+
+			g, _ := log.parser(bytes.NewReader(obj)).parse()
+			next := pos + int64(len(b))
+			r := Record{g, pos, Checkpoint{next, pos, crc32.ChecksumIEEE(b)}}
+
+			select {
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				return
+			case c <- r:
+			}
+			pos = next
+			cp = r.Checkpoint
+		}
+	}()
+
+	return f, nil
+}
+
+// record returns the record at pos, as stored, and the binary object in it,
+// which are the same unless the log has checksums. Errors are those of
+// BinParser.Skip, and ErrCorrupt.
+func (log *Log) record(pos int64) ([]byte, []byte, error) {
+	f, _ := log.file()
+	return log.readRecord(f, pos)
+}
+
+// readRecord is record, reading from the file f.
+func (log *Log) readRecord(f *os.File, pos int64) ([]byte, []byte, error) {
+
+	if log.checksums {
+		var h [8]byte
+		if n, err := f.ReadAt(h[:], pos); n < len(h) {
+			if n == 0 && err == io.EOF {
+				return nil, nil, io.EOF
+			}
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
+		// A length beyond the end of the file is not trusted
+		size := 8 + int64(binary.BigEndian.Uint32(h[:]))
+		if fi, err := f.Stat(); err != nil || pos+size > fi.Size() {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+
+		rec := make([]byte, size)
+		if n, _ := f.ReadAt(rec, pos); n < len(rec) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if crc32.ChecksumIEEE(rec[8:]) != binary.BigEndian.Uint32(h[4:]) {
+			return nil, nil, ErrCorrupt
+		}
+		return rec, rec[8:], nil
+	}
+
+	n, err := log.parser(io.NewSectionReader(f, pos, math.MaxInt64-pos)).Skip()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := make([]byte, n)
+	if _, err = f.ReadAt(b, pos); err != nil {
+		return nil, nil, err
+	}
+	return b, b, nil
+}
+
+// validCheckpoint returns true if c is the start of the log, or the record
+// before c.Offset is still the one it was.
+func (log *Log) validCheckpoint(c Checkpoint) bool {
+
+	if c == (Checkpoint{}) {
+		return true
+	}
+	if c.Prev < log.start || c.Prev >= c.Offset {
+		return false
+	}
+
+	b, _, err := log.record(c.Prev)
+	return err == nil && c.Prev+int64(len(b)) == c.Offset && crc32.ChecksumIEEE(b) == c.Hash
+}
+
+// Save writes the checkpoint to a file, atomically: the file holds either
+// the old checkpoint or the new one, even after a crash.
+func (c Checkpoint) Save(file string) error {
+
+	g := NilGraph()
+	g.Add("offset").Add(c.Offset)
+	g.Add("prev").Add(c.Prev)
+	g.Add("hash").Add(int64(c.Hash))
+
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(g.Text() + "\n"); err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadCheckpoint reads a checkpoint written by Checkpoint.Save. If the file
+// doesn't exist, it returns the zero Checkpoint: the start of the log.
+func LoadCheckpoint(file string) (Checkpoint, error) {
+
+	b, err := readFile(file)
+	if os.IsNotExist(err) {
+		return Checkpoint{}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	g := Parse(b)
+	var c Checkpoint
+	if c.Offset, err = g.GetInt64("offset"); err == nil {
+		if c.Prev, err = g.GetInt64("prev"); err == nil {
+			var h int64
+			h, err = g.GetInt64("hash")
+			c.Hash = uint32(h)
+		}
+	}
+	if err != nil {
+		return Checkpoint{}, errors.New("invalid checkpoint file " + file + ": " + err.Error())
+	}
+	return c, nil
+}
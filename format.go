@@ -0,0 +1,437 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"strings"
+)
+
+// QuoteStyle selects the quotes used by Format for scalars that need them.
+type QuoteStyle int
+
+const (
+	// PreferDouble uses double quotes, or single quotes if that avoids
+	// escaping.
+	PreferDouble QuoteStyle = iota
+	// PreferSingle uses single quotes, or double quotes if that avoids
+	// escaping.
+	PreferSingle
+	// PreferRaw uses backticks, so that backslashes and quotes are written
+	// as they are, as in regular expressions and Windows paths. Strings that
+	// raw strings cannot hold, as those with a backtick, fall back to
+	// PreferDouble.
+	PreferRaw
+)
+
+// PrintOptions control how Format writes a Graph as OGDL text. The zero
+// value writes one node per line, indented with two spaces per level.
+type PrintOptions struct {
+	// Indent is the number of spaces per level (2 if zero).
+	Indent int
+	// UseTabs indents with one tab per level instead of spaces.
+	UseTabs bool
+	// QuoteAlways quotes all scalars, not only those that need it.
+	QuoteAlways bool
+	// MaxLineLen, if > 0, allows writing a node and its only child on the
+	// same line, as in "name value", as long as the line is not longer than
+	// MaxLineLen bytes.
+	MaxLineLen int
+	// Blocks writes multiline leaf scalars as blocks (introduced by '\')
+	// where the block syntax can hold them, instead of quoted strings.
+	Blocks bool
+	// TripleQuotes writes multiline leaf scalars between triple quotes,
+	// starting on the line after the quotes and indented as them, where
+	// they can be written so without changes (see Parser.Quoted). It
+	// applies to those that Blocks doesn't write.
+	TripleQuotes bool
+	// Escapes writes newlines, tabs, control characters, backslashes and
+	// quotes inside quoted strings as escape sequences. The output must then
+	// be read by a Parser with Escapes set.
+	Escapes bool
+	// MaxChildren, if > 0, limits the subnodes written for each node, as
+	// Truncated does.
+	MaxChildren int
+	// QuoteStyle selects the quotes used (PreferDouble if zero).
+	QuoteStyle QuoteStyle
+}
+
+// Format returns the graph as OGDL text that parses back into an equal
+// graph. Scalars are quoted when needed. Each line, including the last one,
+// ends with a newline. opts can be nil.
+//
+// Without opts.Escapes, some scalars cannot be represented: those with
+// control characters other than tab, newline and carriage return, with a tab
+// at the start of a line after the first, or with a backslash followed by a
+// quote or at the end of a string that needs quoting. PreferRaw can write
+// the latter, if they have no backtick.
+func (g *Graph) Format(opts *PrintOptions) string {
+
+	if g == nil {
+		return ""
+	}
+
+	o := PrintOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Indent <= 0 {
+		o.Indent = 2
+	}
+
+	if o.MaxChildren > 0 {
+		g = g.Truncated(o.MaxChildren)
+	}
+
+	buf := &bytes.Buffer{}
+	o.format(buf, g, 0, true)
+
+	return buf.String()
+}
+
+// Truncated returns a view of the graph where nodes with more than max
+// subnodes keep only the first max, followed by a TypeTruncated node whose
+// subnode is the number of subnodes left out. It is meant for serializing
+// huge graphs where completeness is not needed, as in logs:
+//
+//     log.Print(g.Truncated(100).Text())
+//
+// Nodes are shared with g when possible, so the view should not be
+// modified.
+func (g *Graph) Truncated(max int) *Graph {
+
+	if g == nil || max < 0 {
+		return g
+	}
+
+	var out []*Graph
+	changed := false
+
+	for i, n := range g.Out {
+		if i == max {
+			m := NewGraph(TypeTruncated)
+			m.Add(len(g.Out) - max)
+			out = append(out[:max:max], m)
+			changed = true
+			break
+		}
+		t := n.Truncated(max)
+		if t != n {
+			changed = true
+		}
+		out = append(out, t)
+	}
+
+	if !changed {
+		return g
+	}
+	return &Graph{This: g.This, Out: out}
+}
+
+// format writes g and its subnodes at the given level. last tells if g is
+// the last subnode of its parent.
+func (o *PrintOptions) format(buf *bytes.Buffer, g *Graph, level int, last bool) {
+
+	// Nil nodes are transparent
+	if g.IsNil() {
+		for i, n := range g.Out {
+			o.format(buf, n, level, last && i == len(g.Out)-1)
+		}
+		return
+	}
+
+	ind := o.indent(level)
+	if writeComment(buf, g, ind) {
+		return
+	}
+	buf.WriteString(ind)
+	col := len(ind)
+
+	for {
+		s := g.String()
+
+		// A block swallows the deeper lines that follow it, so it can only
+		// be used for the last leaf of a parent (or at the top level).
+		if o.Blocks && g.Len() == 0 && (last || level == 0) && isBlock(s) {
+			buf.WriteString("\\\n")
+			for _, line := range strings.Split(s, "\n") {
+				buf.WriteString(o.indent(level + 1))
+				buf.WriteString(line)
+				buf.WriteByte('\n')
+			}
+			return
+		}
+
+		if o.TripleQuotes && g.Len() == 0 {
+			if q, ok := tripleQuoted(s, ind); ok {
+				buf.WriteString(q)
+				buf.WriteByte('\n')
+				return
+			}
+		}
+
+		q := o.scalar(s, col)
+		buf.WriteString(q)
+		col += len(q)
+
+		// Write the only subnode on the same line if it fits
+		if o.MaxLineLen > 0 && g.Len() == 1 && !g.Out[0].IsNil() && !isComment(g.Out[0]) && strings.IndexByte(q, '\n') == -1 {
+			next := o.scalar(g.Out[0].String(), col+1)
+			if strings.IndexByte(next, '\n') == -1 && col+1+len(next) <= o.MaxLineLen {
+				buf.WriteByte(' ')
+				col++
+				g = g.Out[0]
+				continue
+			}
+		}
+
+		// Avoid '\' + newline, which would start a block
+		if q == "\\" {
+			buf.WriteByte(' ')
+		}
+		buf.WriteByte('\n')
+
+		for i, n := range g.Out {
+			o.format(buf, n, level+1, i == len(g.Out)-1)
+		}
+		return
+	}
+}
+
+// isComment returns true for the comment nodes kept by the parser (see
+// Parser.KeepComments).
+func isComment(g *Graph) bool {
+	s, ok := g.This.(string)
+	return ok && s == TypeComment
+}
+
+// writeComment writes g as a comment, with one '#' line per line of its text
+// and indented with ind, if it is a comment node. It returns false, writing
+// nothing, otherwise.
+func writeComment(buf *bytes.Buffer, g *Graph, ind string) bool {
+
+	if !isComment(g) {
+		return false
+	}
+
+	for _, n := range g.Out {
+		for _, line := range strings.Split(n.String(), "\n") {
+			buf.WriteString(ind)
+			buf.WriteByte('#')
+			buf.WriteString(strings.TrimRight(line, "\r"))
+			buf.WriteByte('\n')
+		}
+	}
+	return true
+}
+
+// indent returns the indentation for the given level.
+func (o *PrintOptions) indent(level int) string {
+	if o.UseTabs {
+		return strings.Repeat("\t", level)
+	}
+	return strings.Repeat(" ", level*o.Indent)
+}
+
+// scalar returns s ready to be written at column col, quoted if needed.
+func (o *PrintOptions) scalar(s string, col int) string {
+
+	raw := o.QuoteStyle == PreferRaw && isRaw(s)
+
+	if !needsQuotes(s) && (!o.QuoteAlways || !raw && !o.Escapes && !quotable(s)) {
+		return s
+	}
+
+	quote := o.quote(s, raw)
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(quote)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == quote:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case !o.Escapes || raw:
+			buf.WriteByte(c)
+			// Continuation lines are indented up to the opening quote,
+			// empty ones need no indentation.
+			if c == '\n' && i+1 < len(s) && s[i+1] != '\n' {
+				buf.WriteString(strings.Repeat(" ", col+1))
+			}
+		case c == '\\':
+			buf.WriteString("\\\\")
+		case c == '\n':
+			buf.WriteString("\\n")
+		case c == '\t':
+			buf.WriteString("\\t")
+		case c == '\r':
+			buf.WriteString("\\r")
+		case c < 32:
+			buf.WriteString("\\x")
+			buf.WriteByte("0123456789abcdef"[c>>4])
+			buf.WriteByte("0123456789abcdef"[c&15])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	buf.WriteByte(quote)
+	return buf.String()
+}
+
+// quote returns the quote character to use for s, given the style. raw
+// tells if s can be written as a raw string.
+func (o *PrintOptions) quote(s string, raw bool) byte {
+
+	if raw {
+		return '`'
+	}
+
+	// Prefer the quote character that doesn't need escaping
+	double := strings.IndexByte(s, '"') != -1
+	single := strings.IndexByte(s, '\'') != -1
+
+	if o.QuoteStyle == PreferSingle {
+		if single && !double {
+			return '"'
+		}
+		return '\''
+	}
+	if double && !single {
+		return '\''
+	}
+	return '"'
+}
+
+// isRaw returns true if s can be written between backticks: it has no
+// backtick, no control characters other than tab and newline, and no tab at
+// the start of a line after the first.
+func isRaw(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '`' || c < 32 && c != '\t' && c != '\n' {
+			return false
+		}
+		if c == '\n' && i+1 < len(s) && s[i+1] == '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// needsQuotes returns true if s cannot be written as an unquoted string.
+func needsQuotes(s string) bool {
+
+	if len(s) == 0 {
+		return true
+	}
+
+	switch s[0] {
+	case '#', '"', '\'', '`':
+		return true
+	}
+
+	for i := 0; i < len(s); i++ {
+		if !IsTextChar(int(s[i])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// quotable returns true if s can be quoted without escape sequences: it has
+// no backslash before a quote or at the end.
+func quotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && (i == len(s)-1 || s[i+1] == '"' || s[i+1] == '\'') {
+			return false
+		}
+	}
+	return true
+}
+
+// tripleQuoted returns s between triple quotes, with its lines indented by
+// ind, as the closing quotes, if the parser reads it back the same: it must
+// have no triple quotes of one kind, no control characters other than tab
+// and newline, no lines with only spaces or tabs, and a line that doesn't
+// start with them, so that the indentation removed is ind.
+func tripleQuoted(s, ind string) (string, bool) {
+
+	if strings.IndexByte(s, '\n') == -1 {
+		return "", false
+	}
+
+	q := `"""`
+	if strings.Contains(s, q) {
+		q = "'''"
+		if strings.Contains(s, q) {
+			return "", false
+		}
+	}
+
+	lines := strings.Split(s, "\n")
+	indented := true
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if strings.Trim(line, " \t") == "" {
+			return "", false
+		}
+		for i := 0; i < len(line); i++ {
+			if c := line[i]; c < 32 && c != '\t' {
+				return "", false
+			}
+		}
+		if !IsSpaceChar(int(line[0])) {
+			indented = false
+		}
+	}
+	if indented {
+		return "", false
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(q)
+	buf.WriteByte('\n')
+	for _, line := range lines {
+		if line != "" {
+			buf.WriteString(ind)
+			buf.WriteString(line)
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString(ind)
+	buf.WriteString(q)
+	return buf.String(), true
+}
+
+// isBlock returns true if s is a multiline string that can be written as a
+// block: lines must not be empty, nor start with space, and only contain
+// text characters or spaces.
+func isBlock(s string) bool {
+
+	if strings.IndexByte(s, '\n') == -1 {
+		return false
+	}
+
+	for _, line := range strings.Split(s, "\n") {
+		if len(line) == 0 || IsSpaceChar(int(line[0])) {
+			return false
+		}
+		for i := 0; i < len(line); i++ {
+			c := int(line[i])
+			if c < 32 && c != '\t' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,247 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrFrozen is returned (or, in builds with the ogdl_debug tag, used to
+// panic) when a frozen graph is modified.
+var ErrFrozen = errors.New("graph is frozen")
+
+// Freeze makes g and all its subnodes read-only. Methods that would modify a
+// frozen node (Add, AddNodes, Copy, Delete, DeleteAt, Set, Remove, Merge,
+// MergeWith, Substitute, SetFunctions) do nothing and return nil or
+// ErrFrozen instead. Add and AddNodes accept a nil receiver, so a chain of
+// them on a frozen graph stops at the first one.
+// Built with the ogdl_debug tag, they panic, so that mutations can be found.
+//
+// A frozen graph can be safely shared by any number of goroutines calling
+// Get, Eval, Text, Binary and Process on it. Process and Eval don't modify
+// it: template variables ($for loops) are set in a private overlay, and
+// the objects of !type nodes are kept with each render (see Function).
+//
+// Freezing cannot be undone, and the This field is not protected: it must
+// not be assigned directly. Freeze itself modifies g: call it before sharing
+// the graph.
+func (g *Graph) Freeze() {
+	if g == nil || g.IsFrozen() {
+		return
+	}
+	g.setFlag(flagFrozen)
+	for _, n := range g.Out {
+		n.Freeze()
+	}
+}
+
+// IsFrozen returns true if Freeze has been called on g or on a node above it.
+func (g *Graph) IsFrozen() bool {
+	return g.hasFlag(flagFrozen)
+}
+
+// mutable returns ErrFrozen if g is frozen (or panics in debug builds).
+func (g *Graph) mutable() error {
+	if !g.IsFrozen() {
+		return nil
+	}
+	if debugFrozen {
+		panic(ErrFrozen)
+	}
+	return ErrFrozen
+}
+
+// thaw replaces the subnode at index i by a shallow copy if it is frozen or
+// shared (see CloneCOW) and g is not frozen, and returns the subnode. This
+// lets Set, Remove and Merge write through such nodes in a copy-on-write
+// fashion when starting at an overlay, or at a CloneCOW or its source.
+func (g *Graph) thaw(i int) *Graph {
+	n := g.Out[i]
+	f := n.flags()
+	if f&(flagFrozen|flagShared) == 0 || g.IsFrozen() {
+		return n
+	}
+
+	c := &Graph{This: n.This, Out: append([]*Graph(nil), n.Out...)}
+	if f&flagFrozen == 0 {
+		// The subnodes are now shared by n and c
+		for _, m := range c.Out {
+			m.setFlag(flagShared)
+		}
+	}
+	g.Out[i] = c
+	return c
+}
+
+// overlay returns g if it is not frozen. Otherwise it returns a new root that
+// shares the subnodes of g, and where Set can add or replace nodes without
+// modifying g.
+func (g *Graph) overlay() *Graph {
+	if !g.IsFrozen() {
+		return g
+	}
+	return (&Graph{This: g.This, Out: append([]*Graph(nil), g.Out...)}).inherit(g)
+}
+
+// scope returns a private root for a template render on g, sharing its
+// subnodes, and the set of nodes owned by the render, which is the root
+// only. Assignments then copy the nodes they modify (see own), so that g is
+// not changed.
+func (g *Graph) scope() (*Graph, map[*Graph]bool) {
+	if g == nil {
+		return nil, nil
+	}
+	r := (&Graph{This: g.This, Out: append([]*Graph(nil), g.Out...)}).inherit(g)
+	return r, map[*Graph]bool{r: true}
+}
+
+// own replaces the nodes on the path p (made of tokens, indexes and
+// selectors), starting at g, by copies owned by the render, unless they are
+// already owned. It stops where the path doesn't resolve: set adds the rest
+// below an owned node.
+func (g *Graph) own(p *Graph, owned map[*Graph]bool) {
+
+	node := g
+
+	// parent and key of the last token, used by selectors
+	var parent *Graph
+	var key string
+
+	for _, elem := range p.Out {
+		k := -1
+
+		switch elem.String() {
+		case TypeIndex:
+			if j, ok := pathIndex(elem); ok && j < node.Len() {
+				k = j
+			}
+			parent = nil
+		case TypeSelector:
+			j, ok := pathIndex(elem)
+			if !ok || parent == nil {
+				return
+			}
+			node = parent
+			k, _ = node.occurrence(key, j)
+			parent = nil
+		case TypeGroup, TypeAny:
+			return
+		default:
+			parent, key = node, elem.String()
+			k, _ = node.occurrence(key, 0)
+		}
+
+		if k < 0 {
+			return
+		}
+
+		n := node.Out[k]
+		if !owned[n] {
+			n = &Graph{This: n.This, Out: append([]*Graph(nil), n.Out...)}
+			node.Out[k] = n
+			owned[n] = true
+		}
+		node = n
+	}
+}
+
+// CloneCOW returns a copy-on-write clone of g, which is much cheaper than
+// Clone for big graphs: only the root node is copied, and the subnodes are
+// shared between g and the clone until one of them changes them.
+//
+// For that, the subnodes are marked as shared: Set, Remove, Merge and
+// DeletePath, on g or on the clone, copy the shared nodes on the path to the
+// change before making it. g is otherwise unchanged, and its subnodes can
+// still be modified directly, with Add or DeleteAt, but a shared node
+// changed that way changes in both graphs. To modify a subnode directly in
+// one of them only, get it with Unshare instead of Get.
+func (g *Graph) CloneCOW() *Graph {
+	if g == nil {
+		return nil
+	}
+	// The subnodes of a frozen graph are copied on write anyway
+	if !g.IsFrozen() {
+		for _, n := range g.Out {
+			n.setFlag(flagShared)
+		}
+	}
+	c := (&Graph{This: g.This, Out: append([]*Graph(nil), g.Out...)}).inherit(g)
+	if g.IsFrozen() {
+		c.setFlag(flagFrozen)
+	}
+	return c
+}
+
+// Unshare returns the node at the given path (a canonical path, as for
+// Remove), after copying it and the nodes above it if they are shared with
+// a CloneCOW (or frozen), so that it can be modified directly. It returns nil if the
+// path is not found or g is frozen. The empty path returns g.
+func (g *Graph) Unshare(path string) *Graph {
+	if g == nil || g.IsFrozen() {
+		return nil
+	}
+	if path == "" {
+		return g
+	}
+	parent, j, err := g.locate(path)
+	if err != nil {
+		return nil
+	}
+	return parent.thaw(j)
+}
+
+// SharedGraph holds a graph that goroutines read while it is replaced, as a
+// configuration that is reloaded in the background. Readers get the current
+// version with Load: a frozen graph, safe to use concurrently (see Freeze),
+// that doesn't change while they use it. Writers replace it with Store, or
+// change it with Update. The zero value holds nil.
+type SharedGraph struct {
+	v atomic.Value
+
+	// mu serializes the writers
+	mu sync.Mutex
+}
+
+// graphBox lets atomic.Value hold nil graphs.
+type graphBox struct{ g *Graph }
+
+// Load returns the current graph, which is frozen.
+func (s *SharedGraph) Load() *Graph {
+	b, _ := s.v.Load().(graphBox)
+	return b.g
+}
+
+// Store freezes g and makes it the current graph.
+func (s *SharedGraph) Store(g *Graph) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g.Freeze()
+	s.v.Store(graphBox{g})
+}
+
+// Update calls fn with a copy of the current graph, and makes the copy the
+// current graph, frozen, if fn returns nil. The copy shares the subnodes of
+// the current graph, as with CloneCOW: fn changes it with Set, Remove and
+// Merge, or with Add and DeleteAt on nodes got with Unshare. Updates are
+// serialized, so that none is lost. If the current graph is nil, fn
+// receives an empty one.
+func (s *SharedGraph) Update(fn func(g *Graph) error) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g := s.Load().overlay()
+	if g == nil {
+		g = NilGraph()
+	}
+	if err := fn(g); err != nil {
+		return err
+	}
+	g.Freeze()
+	s.v.Store(graphBox{g})
+	return nil
+}
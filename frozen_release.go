@@ -0,0 +1,11 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !ogdl_debug
+// +build !ogdl_debug
+
+package ogdl
+
+// debugFrozen makes modifications of frozen graphs panic.
+const debugFrozen = false
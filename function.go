@@ -6,38 +6,299 @@ package ogdl
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"sort"
+	"sync"
 )
 
-// factory[] is a map that stores type constructors.
-var factory map[string]func() interface{}
+// FunctionSet holds the functions and type constructors that can be called
+// from templates. It is safe for concurrent use.
+//
+// A FunctionSet can be attached to a context Graph with SetFunctions, so that
+// different parts of an application have different function tables. Lookups
+// consult the attached set first, and then the package default set, which is
+// the one used by FunctionAdd and FunctionAddConstructor.
+type FunctionSet struct {
+	mu sync.RWMutex
+
+	// factory is a map that stores type constructors.
+	factory map[string]func() interface{}
+
+	// functions is a map for storing functions with a suitable signature so
+	// that they can be called from within templates.
+	functions map[string]func(g *Graph, p *Graph, i int) []byte
+
+	// funcs holds plain Go functions, called by name (see AddFunc).
+	funcs map[string]func(args ...interface{}) interface{}
+}
+
+// NewFunctionSet returns an empty FunctionSet.
+func NewFunctionSet() *FunctionSet {
+	return &FunctionSet{
+		factory:   make(map[string]func() interface{}),
+		functions: make(map[string]func(g *Graph, p *Graph, i int) []byte),
+		funcs:     make(map[string]func(args ...interface{}) interface{}),
+	}
+}
+
+// defaultFunctions is the package level function set.
+var defaultFunctions = NewFunctionSet()
+
+// Add adds a function to the set.
+func (fs *FunctionSet) Add(s string, f func(*Graph, *Graph, int) []byte) {
+	fs.mu.Lock()
+	fs.functions[s] = f
+	fs.mu.Unlock()
+}
+
+// AddConstructor adds a factory kind of function to the set.
+func (fs *FunctionSet) AddConstructor(s string, f func() interface{}) {
+	fs.mu.Lock()
+	fs.factory[s] = f
+	fs.mu.Unlock()
+}
+
+// AddFunc adds a plain Go function to the set, that templates and
+// expressions call by name, as in $upper(name) or $(s = join(a, b)), without
+// a !type node in the context. It receives the values of the arguments.
+//
+// A node of the context with the same name takes precedence: this
+// includes functions added with Add, which are called through a !type
+// function node.
+func (fs *FunctionSet) AddFunc(name string, fn func(args ...interface{}) interface{}) {
+	fs.mu.Lock()
+	fs.funcs[name] = fn
+	fs.mu.Unlock()
+}
+
+// Remove removes a function added with Add. Removing a name that is not in
+// the set does nothing.
+func (fs *FunctionSet) Remove(s string) {
+	fs.mu.Lock()
+	delete(fs.functions, s)
+	fs.mu.Unlock()
+}
+
+// RemoveConstructor removes a constructor added with AddConstructor.
+func (fs *FunctionSet) RemoveConstructor(s string) {
+	fs.mu.Lock()
+	delete(fs.factory, s)
+	fs.mu.Unlock()
+}
+
+// Functions returns the names of the functions added with Add, sorted.
+func (fs *FunctionSet) Functions() []string {
+	fs.mu.RLock()
+	l := make([]string, 0, len(fs.functions))
+	for s := range fs.functions {
+		l = append(l, s)
+	}
+	fs.mu.RUnlock()
+
+	sort.Strings(l)
+	return l
+}
+
+// Constructors returns the names of the constructors added with
+// AddConstructor, sorted.
+func (fs *FunctionSet) Constructors() []string {
+	fs.mu.RLock()
+	l := make([]string, 0, len(fs.factory))
+	for s := range fs.factory {
+		l = append(l, s)
+	}
+	fs.mu.RUnlock()
+
+	sort.Strings(l)
+	return l
+}
+
+func (fs *FunctionSet) function(s string) func(*Graph, *Graph, int) []byte {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.functions[s]
+}
+
+func (fs *FunctionSet) constructor(s string) func() interface{} {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.factory[s]
+}
+
+func (fs *FunctionSet) fn(s string) func(...interface{}) interface{} {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.funcs[s]
+}
+
+// SetFunctions attaches a FunctionSet to the graph, to be used when the graph
+// acts as context of a template or expression. A nil set detaches the
+// current one.
+//
+// The set is not a node of the graph: it doesn't appear in its text or
+// among its subnodes. Clone and CloneCOW keep it.
+func (g *Graph) SetFunctions(fs *FunctionSet) {
+	if g == nil || g.mutable() != nil {
+		return
+	}
+	if fs == nil && g.functionSet() == nil {
+		return
+	}
+	g.updateAttrs(func(a *nodeAttrs) { a.functions = fs })
+}
 
-// functions[] is a map for storing functions with a suitable signature so that
-// they can be called from within templates.
-var functions map[string]func(g *Graph, p *Graph, i int) []byte // interface{}
+// functionSet returns the FunctionSet attached to the context graph, or nil.
+func (g *Graph) functionSet() *FunctionSet {
+	if g == nil || g.attrs == nil {
+		return nil
+	}
+	return g.attrs.functions
+}
+
+// lookupFunction returns the function with the given name, looking first in
+// the set attached to the context and then in the default set.
+func (g *Graph) lookupFunction(s string) func(*Graph, *Graph, int) []byte {
+	if fs := g.functionSet(); fs != nil {
+		if f := fs.function(s); f != nil {
+			return f
+		}
+	}
+	return defaultFunctions.function(s)
+}
 
-// FunctionAddConstructor adds a factory kind of function to the context.
+// lookupFunc returns the plain function with the given name, looking first
+// in the set attached to the context and then in the default set.
+func (g *Graph) lookupFunc(s string) func(...interface{}) interface{} {
+	if fs := g.functionSet(); fs != nil {
+		if f := fs.fn(s); f != nil {
+			return f
+		}
+	}
+	return defaultFunctions.fn(s)
+}
+
+// callFunc calls a plain function with the values of args, evaluated in
+// the context g.
+func (g *Graph) callFunc(name string, fn func(...interface{}) interface{}, args *Graph, ee *evalError) interface{} {
+
+	if err := ee.count(name, false); err != nil {
+		ee.set(err)
+		return nil
+	}
+
+	var a []interface{}
+	for _, n := range args.Out {
+		a = append(a, g.eval(n, ee))
+	}
+	return fn(a...)
+}
+
+// lookupConstructor returns the type constructor with the given name,
+// looking first in the set attached to the context and then in the default
+// set.
+func (g *Graph) lookupConstructor(s string) func() interface{} {
+	if fs := g.functionSet(); fs != nil {
+		if f := fs.constructor(s); f != nil {
+			return f
+		}
+	}
+	return defaultFunctions.constructor(s)
+}
+
+// FunctionAddConstructor adds a factory kind of function to the default
+// function set.
 func FunctionAddConstructor(s string, f func() interface{}) {
-	factory[s] = f
+	defaultFunctions.AddConstructor(s, f)
 }
 
-// FunctionAdd adds a function to the context.
+// FunctionAdd adds a function to the default function set.
 func FunctionAdd(s string, f func(*Graph, *Graph, int) []byte) {
-	functions[s] = f
+	defaultFunctions.Add(s, f)
+}
+
+// FunctionRemove removes a function from the default function set.
+func FunctionRemove(s string) {
+	defaultFunctions.Remove(s)
+}
+
+// FunctionList returns the names of the functions in the default function
+// set, sorted.
+func FunctionList() []string {
+	return defaultFunctions.Functions()
+}
+
+// FunctionConstructorRemove removes a constructor from the default function
+// set.
+func FunctionConstructorRemove(s string) {
+	defaultFunctions.RemoveConstructor(s)
+}
+
+// FunctionConstructorList returns the names of the constructors in the
+// default function set, sorted.
+func FunctionConstructorList() []string {
+	return defaultFunctions.Constructors()
+}
+
+// TemplateFuncAdd adds a plain Go function to the default function set (see
+// FunctionSet.AddFunc).
+func TemplateFuncAdd(name string, fn func(args ...interface{}) interface{}) {
+	defaultFunctions.AddFunc(name, fn)
 }
 
 // Function enables calling Go functions from templates. Path in templates
 // are translated into Go functions if !type definitions are present.
 //
-// Functions and type methods are handled here, based on the two maps, factory[]
-// and functions[].
+// Functions and type methods are handled here, based on the function set
+// attached to the context (see SetFunctions) and the default one.
 //
 // Also remote functions are called from here. A remote function is a call to
 // a TCP/IP server, in which both the request and the response are binary encoded
 // OGDL objects.
 //
+// The objects of !type nodes, and the connections of remote functions, are
+// kept for the duration of a template render, and not in the graph. Called
+// directly, Function creates them for each call.
+//
 // (This code can be much improved)
 func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error) {
+	v, err := g.function(p, ix, context, nil)
+	if err == errNoValue {
+		err = nil
+	}
+	return v, err
+}
+
+// object returns the instance of the !type node of g created before in the
+// render of e, or nil.
+func (e *evalError) object(g *Graph) interface{} {
+	if e == nil {
+		return nil
+	}
+	return e.objects[g]
+}
+
+// keep stores v as the instance of the !type node of g for the rest of the
+// render of e. It returns false if there is no render to keep it in.
+func (e *evalError) keep(g *Graph, v interface{}) bool {
+	if e == nil || e.objects == nil {
+		return false
+	}
+	e.objects[g] = v
+	return true
+}
+
+// closeObjects closes the remote functions opened in the render of e.
+func (e *evalError) closeObjects() {
+	for _, v := range e.objects {
+		if rf, ok := v.(*RFunction); ok {
+			rf.Close()
+		}
+	}
+	e.objects = nil
+}
+
+func (g *Graph) function(p *Graph, ix int, context *Graph, ee *evalError) (interface{}, error) {
 
 	n := g.Node("!type")
 
@@ -50,22 +311,25 @@ func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error)
 	// Case 1: simple function
 	//
 	// If type == "function", then call a function directly from the
-	// functions[] table, no need to instantiate an object.
+	// function tables, no need to instantiate an object.
 
 	if "function" == name {
 
 		funame := p.GetAt(ix - 1).String()
 
-		fu := functions[funame]
+		fu := context.lookupFunction(funame)
 		if fu == nil {
 			return nil, errors.New("function not in table " + funame)
 		}
+		if err := ee.count(funame, false); err != nil {
+			return nil, err
+		}
 
 		arg := NilGraph()
 		args := p.Out[ix]
 
 		for i := 0; i < args.Len(); i++ {
-			v := context.Eval(args.Out[i])
+			v := context.eval(args.Out[i], ee)
 
 			arg.Add(_string(v))
 		}
@@ -77,24 +341,27 @@ func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error)
 
 	if "rfunction" == name {
 
-		var rf *RFunction
-		var err error
+		if err := ee.count(p.GetAt(ix-1).String()+"."+p.Out[ix].String(), true); err != nil {
+			return nil, err
+		}
 
-		if n.Len() == 1 {
+		rf, _ := ee.object(g).(*RFunction)
+		if rf == nil {
+			var err error
 			rf, err = NewRFunction(g.Node("!init"))
 			if err != nil {
 				return nil, err
 			}
-			n.Add(rf)
-		} else {
-			rf = n.GetAt(1).This.(*RFunction)
+			if !ee.keep(g, rf) {
+				defer rf.Close()
+			}
 		}
 
 		arg := NewGraph(p.Out[ix].String())
 		args := p.Out[ix+1]
 
 		for _, a := range args.Out {
-			v := context.Eval(a)
+			v := context.eval(a, ee)
 
 			g, ok := v.(*Graph);
 			
@@ -109,25 +376,21 @@ func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error)
 
 	// Case 3: object with methods to be discovered through reflection
 
-	var v reflect.Value
+	// The object is created once per render, and kept with it: the graph
+	// is not changed.
 
-	// If !type has a second node, that means that it has been instantiated
-	// already. The second node points to the type's instance.
+	v, _ := ee.object(g).(reflect.Value)
 
-	if n.Len() == 1 {
+	if !v.IsValid() {
 
-		// !type has one node, so instantiate.
-
-		ff := factory[name]
+		ff := context.lookupConstructor(name)
 		if ff == nil {
 			return nil, errors.New("function not in table " + name)
 		}
 
 		itf := ff()
 		v = reflect.ValueOf(itf)
-
-		// Add the object as second node of !type. Next time w'll pick this object.
-		n.Add(v)
+		ee.keep(g, v)
 
 		// If !init is defined, the init(Graph) function is called on the instantiated type.
 		nn := g.Node("!init")
@@ -135,8 +398,6 @@ func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error)
 		if nn != nil {
 			v.MethodByName("Init").Call([]reflect.Value{reflect.ValueOf(nn)})
 		}
-	} else {
-		v = n.GetAt(1).This.(reflect.Value)
 	}
 
 	// exec: as per path
@@ -163,28 +424,179 @@ func (g *Graph) Function(p *Graph, ix int, context *Graph) (interface{}, error)
 	// TODO: Check if it is a field
 
 	// Check if it is a method
-	me := v.MethodByName(fname)
+	me := method(v, fname)
 
 	if !me.IsValid() {
 		s := "No method " + fname
 		return s, errors.New(s)
 	}
+	if err := ee.count(p.GetAt(ix-1).String()+"."+fname, false); err != nil {
+		return nil, err
+	}
 
-	// Build arguments in the form []reflect.Value
+	var args []interface{}
+	for _, arg := range ag.Out {
+		args = append(args, context.eval(arg, ee))
+	}
 
-	var args []reflect.Value
+	return callMethod(fname, me, args)
+}
 
-	for _, arg := range ag.Out {
-		a := context.Eval(arg)
-		args = append(args, reflect.ValueOf(a))
+// callMethod calls the method me with the arguments given, converted to the
+// types of its parameters. Variadic methods take any number of trailing
+// arguments, including none.
+func callMethod(name string, me reflect.Value, args []interface{}) (interface{}, error) {
+
+	t := me.Type()
+	n := t.NumIn()
+
+	if t.IsVariadic() {
+		if len(args) < n-1 {
+			return nil, fmt.Errorf("%s: %d arguments, want at least %d", name, len(args), n-1)
+		}
+	} else if len(args) != n {
+		return nil, fmt.Errorf("%s: %d arguments, want %d", name, len(args), n)
 	}
 
-	return me.Call(args)[0].Interface(), nil
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && i >= n-1 {
+			pt = t.In(n - 1).Elem()
+		} else {
+			pt = t.In(i)
+		}
+		v, ok := argValue(a, pt)
+		if !ok {
+			return nil, fmt.Errorf("%s: %w: argument %d (%s) to %s", name, ErrConversion, i+1, _typeOf(a), pt)
+		}
+		in[i] = v
+	}
+
+	return results(me.Call(in))
 }
 
-// Function2 enables calling Go functions from templates. 
-//
-func (g *Graph) Function2 (p *Graph, ix int, context *Graph) (interface{}, error) {
+// argValue converts a value, as returned by Eval, to the type t.
+func argValue(a interface{}, t reflect.Type) (reflect.Value, bool) {
+
+	if a == nil {
+		return reflect.Zero(t), true
+	}
+
+	v := reflect.ValueOf(a)
+	if v.Type().AssignableTo(t) {
+		return v, true
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(_string(a)).Convert(t), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := _int64f(a); ok {
+			return reflect.ValueOf(i).Convert(t), true
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := _float64f(a); ok {
+			return reflect.ValueOf(f).Convert(t), true
+		}
+	case reflect.Bool:
+		if b, ok := _boolf(a); ok {
+			return reflect.ValueOf(b).Convert(t), true
+		}
+	default:
+		if v.Type().ConvertibleTo(t) {
+			return v.Convert(t), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// methodCache holds the indexes of the methods of each type by name, so
+// that calls from templates don't look them up each time.
+var methodCache = struct {
+	sync.RWMutex
+	m map[reflect.Type]map[string]int
+}{m: make(map[reflect.Type]map[string]int)}
+
+// method returns the method of v with the given name, as v.MethodByName
+// does, or an invalid Value.
+func method(v reflect.Value, name string) reflect.Value {
+
+	t := v.Type()
+
+	methodCache.RLock()
+	ms, ok := methodCache.m[t]
+	methodCache.RUnlock()
+
+	if !ok {
+		ms = make(map[string]int, t.NumMethod())
+		for i := 0; i < t.NumMethod(); i++ {
+			ms[t.Method(i).Name] = i
+		}
+		methodCache.Lock()
+		methodCache.m[t] = ms
+		methodCache.Unlock()
+	}
+
+	i, ok := ms[name]
+	if !ok {
+		return reflect.Value{}
+	}
+	return v.Method(i)
+}
+
+// errorType is the type of the error interface.
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// errNoValue is returned internally for calls to methods that return no
+// value, so that they are not taken for methods not found.
+var errNoValue = errors.New("no value")
+
+// results returns the value returned by a method call. A trailing error
+// result, if not nil, is returned as the error, and the value is then nil.
+// Several values are returned as the subnodes of a nil Graph, and no value
+// as errNoValue.
+func results(out []reflect.Value) (interface{}, error) {
+
+	if n := len(out); n > 0 && out[n-1].Type() == errorType {
+		if !out[n-1].IsNil() {
+			return nil, out[n-1].Interface().(error)
+		}
+		out = out[:n-1]
+	}
+
+	switch len(out) {
+	case 0:
+		return nil, errNoValue
+	case 1:
+		return out[0].Interface(), nil
+	}
+
+	g := NilGraph()
+	for _, v := range out {
+		g.Add(v.Interface())
+	}
+	return g, nil
+}
+
+// Function2 enables calling Go functions from templates. Methods can
+// return no value (nil is returned), a value, several values (returned as
+// the subnodes of a nil Graph), and a trailing error; a non nil error is
+// returned instead of the values. Arguments are converted to the types of
+// the parameters, and a wrong number of arguments is an error. Methods with
+// a pointer receiver can be called on values stored by value. They are
+// called on a copy: evaluation doesn't change the graph, and the changes
+// they make are not kept.
+func (g *Graph) Function2(p *Graph, ix int, context *Graph) (interface{}, error) {
+	v, err := g.function2(p, ix, context, nil)
+	if err == errNoValue {
+		err = nil
+	}
+	return v, err
+}
+
+func (g *Graph) function2(p *Graph, ix int, context *Graph, ee *evalError) (interface{}, error) {
 
 	// g.This must be an object with associated fields or methods
 
@@ -195,7 +607,8 @@ func (g *Graph) Function2 (p *Graph, ix int, context *Graph) (interface{}, error
 
 // println("type:",reflect.TypeOf(g.GetAt(0).This).String(),"->",g.String(),g.GetAt(0).String())
 
-    v := reflect.ValueOf(g.GetAt(0).This)
+    obj := g.GetAt(0)
+    v := reflect.ValueOf(obj.This)
     if ! v.IsValid() {
         return nil, nil
     }
@@ -211,11 +624,19 @@ func (g *Graph) Function2 (p *Graph, ix int, context *Graph) (interface{}, error
 	fname := fn.String()
 
 	// Check if it is a method
-	me := v.MethodByName(fname)
+	me := method(v, fname)
+
+	// Methods with a pointer receiver of values stored as such are called
+	// on a copy, which is then discarded.
+	if !me.IsValid() && v.Kind() != reflect.Ptr {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		me = method(ptr, fname)
+	}
 
 	if !me.IsValid() {
 	    // Try field
-	    if v.Kind()==reflect.Struct {
+	    if v = reflect.Indirect(v); v.Kind()==reflect.Struct {
 	        v = v.FieldByName(fname)
 	        if v.IsValid() {
 	            return v.Interface(), nil
@@ -226,24 +647,187 @@ func (g *Graph) Function2 (p *Graph, ix int, context *Graph) (interface{}, error
 		return s, errors.New(s)
 	}
 
-	// Build arguments in the form []reflect.Value
+	var args []interface{}
+	for _, arg := range ag.Out {
+		args = append(args, context.eval(arg, ee))
+	}
 
-	var args []reflect.Value
+	return callMethod(fname, me, args)
+}
 
-	for _, arg := range ag.Out {
-		a := context.Eval(arg)		
-		args = append(args, reflect.ValueOf(a))
+// BoundFunction is a function of a FunctionSet with some of its arguments
+// already given. It is created in templates and expressions with
+// bind(name, args...), and can be stored in the context and called like the
+// function itself, with the rest of the arguments:
+//
+//     $(fmtPrice = bind(printf, "%0.2f"))
+//     $fmtPrice(amount)
+//
+// Bound functions are runtime values: they are written as their bind(...)
+// source text, which is not turned back into a function when parsed.
+type BoundFunction struct {
+	// Name is the name of the function in the FunctionSet.
+	Name string
+	// Args are the bound arguments, passed before those of the call.
+	Args []string
+}
+
+// String returns the bind expression that creates the bound function.
+func (b *BoundFunction) String() string {
+	s := "bind(" + pathElement(b.Name)
+	for _, a := range b.Args {
+		s += ", " + exprString(NewGraph(a))
+	}
+	return s + ")"
+}
+
+// bind evaluates the arguments of bind(name, args...). The first one is the
+// name of a function, or a bound function, which is then bound further.
+func (g *Graph) bind(args *Graph) interface{} {
+
+	if args.Len() == 0 {
+		return nil
+	}
+
+	b := &BoundFunction{}
+
+	switch v := g.Eval(args.Out[0]).(type) {
+	case *BoundFunction:
+		b.Name = v.Name
+		b.Args = append(b.Args, v.Args...)
+	default:
+		// A plain token names a function, a string constant as well.
+		e := args.Out[0].GetAt(0)
+		switch {
+		case e == nil:
+			return nil
+		case e.String() == TypePath && e.Len() == 1:
+			b.Name = e.Out[0].String()
+		case e.Len() == 0:
+			b.Name = e.String()
+		default:
+			return nil
+		}
+	}
+
+	for _, a := range args.Out[1:] {
+		b.Args = append(b.Args, _string(g.Eval(a)))
 	}
 
-	return me.Call(args)[0].Interface(), nil
+	return b
 }
 
-func init() {
-	factory = make(map[string]func() interface{})
-	factory["nil"] = nilGraphI
+// boundFunction returns the bound function held by node, or nil.
+func (g *Graph) boundFunction() *BoundFunction {
+	if g == nil || g.Len() != 1 {
+		return nil
+	}
+	b, _ := g.Out[0].This.(*BoundFunction)
+	return b
+}
+
+// call calls the bound function with the given argument list, evaluated
+// in the context g.
+func (b *BoundFunction) call(g *Graph, args *Graph, ee *evalError) interface{} {
+
+	fu := g.lookupFunction(b.Name)
+	if fu == nil {
+		return nil
+	}
+	if err := ee.count(b.Name, false); err != nil {
+		ee.set(err)
+		return nil
+	}
+
+	arg := NilGraph()
+	for _, a := range b.Args {
+		arg.Add(a)
+	}
+	for _, a := range args.Out {
+		arg.Add(_string(g.eval(a, ee)))
+	}
+
+	return fu(g, arg, 0)
+}
 
-	functions = make(map[string]func(g *Graph, p *Graph, i int) []byte)
-	functions["T"] = templateProcess
+// QuotaExceededError is the error returned by ProcessTo when a template
+// calls functions more times than allowed by TemplateOptions.
+type QuotaExceededError struct {
+	// Function is the name of the function whose call was refused, as in
+	// "hello" or "obj.method".
+	Function string
+	// Quota is the limit exceeded: "MaxFunctionCalls",
+	// "MaxCallsPerFunction" or "MaxRemoteCalls".
+	Quota string
+	// Limit is the value of that limit.
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("call to %s exceeds %s (%d)", e.Function, e.Quota, e.Limit)
+}
+
+// quota counts the function calls of a render against the limits of
+// TemplateOptions. It is safe for concurrent use.
+type quota struct {
+	mu sync.Mutex
+
+	max       int
+	perFunc   map[string]int
+	maxRemote int
+
+	calls  int
+	remote int
+	byFunc map[string]int
+	err    error
+}
+
+// newQuota returns the quota set by opts, or nil if there are no limits.
+func newQuota(opts *TemplateOptions) *quota {
+	if opts.MaxFunctionCalls <= 0 && len(opts.MaxCallsPerFunction) == 0 && opts.MaxRemoteCalls <= 0 {
+		return nil
+	}
+	return &quota{max: opts.MaxFunctionCalls, perFunc: opts.MaxCallsPerFunction, maxRemote: opts.MaxRemoteCalls, byFunc: map[string]int{}}
+}
+
+// take accounts for a call to the named function, or returns a
+// *QuotaExceededError if it would exceed a limit. Once a limit is exceeded,
+// all further calls are refused with the same error.
+func (q *quota) take(name string, remote bool) error {
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+
+	limit, ok := q.perFunc[name]
+	if !ok {
+		limit = q.perFunc[""]
+	}
+
+	switch {
+	case q.max > 0 && q.calls >= q.max:
+		q.err = &QuotaExceededError{name, "MaxFunctionCalls", q.max}
+	case limit > 0 && q.byFunc[name] >= limit:
+		q.err = &QuotaExceededError{name, "MaxCallsPerFunction", limit}
+	case remote && q.maxRemote > 0 && q.remote >= q.maxRemote:
+		q.err = &QuotaExceededError{name, "MaxRemoteCalls", q.maxRemote}
+	default:
+		q.calls++
+		q.byFunc[name]++
+		if remote {
+			q.remote++
+		}
+	}
+
+	return q.err
+}
+
+func init() {
+	defaultFunctions.AddConstructor("nil", nilGraphI)
+	defaultFunctions.Add("T", templateProcess)
 }
 
 // Example functions and objects
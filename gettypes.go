@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 // GetSimilar returns a Graph with all subnodes found that match the regular
@@ -92,8 +93,8 @@ func number(itf interface{}) interface{} {
 		return nil
 	}
 
-	if IsInteger(s) {
-		n, err := strconv.ParseInt(s, 10, 64)
+	if IsInteger(s) || isHex(s) {
+		n, err := parseInt(s)
 		if err != nil {
 			return nil
 		}
@@ -107,12 +108,30 @@ func number(itf interface{}) interface{} {
 	return n
 }
 
+// ErrConversion is wrapped by the errors of the typed accessors (GetInt64,
+// GetBool, etc.) when the path exists but its value is not of the type
+// requested. A missing path gives ErrNotFound instead.
+var ErrConversion = errors.New("conversion error")
+
+// getValue returns the node found at path, or an error wrapping ErrNotFound.
+func (g *Graph) getValue(path string) (*Graph, error) {
+	i := g.Get(path)
+	if i == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+	return i, nil
+}
+
+func conversionError(i *Graph, what string) error {
+	return fmt.Errorf("%w: %q is not %s", ErrConversion, _string(i), what)
+}
+
 // GetString returns the result of applying a path to the given Graph.
 // The result is returned as a string.
 func (g *Graph) GetString(path string) (string, error) {
-	i := g.Get(path)
-	if i == nil {
-		return "", errors.New("not found")
+	i, err := g.getValue(path)
+	if err != nil {
+		return "", err
 	}
 	return _string(i), nil
 }
@@ -120,61 +139,142 @@ func (g *Graph) GetString(path string) (string, error) {
 // GetBytes returns the result of applying a path to the given Graph.
 // The result is returned as a byte slice.
 func (g *Graph) GetBytes(path string) ([]byte, error) {
-	i := g.Get(path)
-	if i == nil {
-		return nil, errors.New("not found")
+	i, err := g.getValue(path)
+	if err != nil {
+		return nil, err
 	}
 	return _bytes(i), nil
 }
 
 // GetInt64 returns the result of applying a path to the given Graph.
 // The result is returned as an int64. If the path result cannot be converted
-// to an integer, then an error is returned.
+// to an integer, then an error is returned. Sizes, as 2GB, are returned as a
+// number of bytes, whether parsed as a Size or not.
 func (g *Graph) GetInt64(path string) (int64, error) {
-	i := g.Get(path)
-	if i == nil {
-		return 0, errors.New("not found")
+	i, err := g.getValue(path)
+	if err != nil {
+		return 0, err
 	}
 
 	j, ok := _int64f(i)
 	if !ok {
-		return 0, errors.New("not an integer")
+		if j, ok = parseSize(_string(i)); !ok {
+			return 0, conversionError(i, "an integer")
+		}
 	}
 	return j, nil
 }
 
+// GetDuration returns the result of applying a path to the given Graph, as
+// a time.Duration. The value can be a Duration, a time.Duration, or text
+// in the form of time.ParseDuration, whether parsed as a Duration or not.
+func (g *Graph) GetDuration(path string) (time.Duration, error) {
+	i, err := g.getValue(path)
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := i.This.(type) {
+	case Duration:
+		return v.Duration, nil
+	case time.Duration:
+		return v, nil
+	}
+
+	d, ok := parseDuration(_string(i))
+	if !ok {
+		return 0, conversionError(i, "a duration")
+	}
+	return d, nil
+}
+
 // GetFloat64 returns the result of applying a path to the given Graph.
 // The result is returned as a float64. If the path result cannot be converted
 // to a float, then an error is returned.
 func (g *Graph) GetFloat64(path string) (float64, error) {
-	i := g.Get(path)
-	if i == nil {
-		return 0, errors.New("not found")
+	i, err := g.getValue(path)
+	if err != nil {
+		return 0, err
 	}
 
-	j, ok := _float64f(i)
+	j, ok := _float64f(i.This)
 	if !ok {
-		return 0, errors.New("not a number")
+		return 0, conversionError(i, "a number")
 	}
 	return j, nil
 }
 
 // GetBool returns the result of applying a path to the given Graph.
-// The result is returned as a bool. If the path result cannot be converted
-// to a boolean, then an error is returned.
+// The result is returned as a bool. Besides true and false, the text values
+// yes, no, 1 and 0 are accepted. If the path result cannot be converted to
+// a boolean, then an error is returned.
 func (g *Graph) GetBool(path string) (bool, error) {
-	i := g.Get(path)
-	if i == nil {
-		return false, errors.New("not found")
+	i, err := g.getValue(path)
+	if err != nil {
+		return false, err
 	}
 
-	j, ok := _boolf(i)
+	j, ok := boolValue(i)
 	if !ok {
-		return false, errors.New("not a boolean")
+		return false, conversionError(i, "a boolean")
 	}
 	return j, nil
 }
 
+// boolValue converts a node to a boolean as GetBool does.
+func boolValue(i *Graph) (bool, bool) {
+
+	if j, ok := _boolf(i); ok {
+		return j, true
+	}
+
+	switch _string(i) {
+	case "yes", "1":
+		return true, true
+	case "no", "0":
+		return false, true
+	}
+	if n, ok := _int64(i.This); ok && (n == 0 || n == 1) {
+		return n == 1, true
+	}
+	return false, false
+}
+
+// GetStringDef returns the string at path, or def if the path is not found.
+func (g *Graph) GetStringDef(path string, def string) string {
+	if s, err := g.GetString(path); err == nil {
+		return s
+	}
+	return def
+}
+
+// GetIntDef returns the integer at path, as GetInt64 does, or def if the
+// path is not found or is not an integer.
+func (g *Graph) GetIntDef(path string, def int64) int64 {
+	if n, err := g.GetInt64(path); err == nil {
+		return n
+	}
+	return def
+}
+
+// GetFloatDef returns the number at path, as GetFloat64 does, or def if the
+// path is not found or is not a number.
+func (g *Graph) GetFloatDef(path string, def float64) float64 {
+	if f, err := g.GetFloat64(path); err == nil {
+		return f
+	}
+	return def
+}
+
+// GetBoolDef returns the boolean at path, as GetBool does, or def if the
+// path is not found or is not a boolean.
+func (g *Graph) GetBoolDef(path string, def bool) bool {
+	if b, err := g.GetBool(path); err == nil {
+		return b
+	}
+	return def
+}
+
 // _float64 converts an interface{} to a float64 iff its native type is
 // a float, integer or a string representing a number.
 func _float64f(v interface{}) (float64, bool) {
@@ -223,12 +323,12 @@ func _int64f(i interface{}) (int64, bool) {
 
 	switch v := i.(type) {
 	case []byte:
-		n, error := strconv.ParseInt(string(v), 10, 64)
+		n, error := parseInt(string(v))
 		if error == nil {
 			return n, true
 		}
 	case string:
-		n, error := strconv.ParseInt(v, 10, 64)
+		n, error := parseInt(v)
 		if error == nil {
 			return n, true
 		}
@@ -236,6 +336,10 @@ func _int64f(i interface{}) (int64, bool) {
 		return int64(v), true
 	case float64:
 		return int64(v), true
+	case Size:
+		return v.Bytes, true
+	case Duration:
+		return int64(v.Duration), true
 	}
 
 	return _int64(i)
@@ -402,6 +506,31 @@ func isNumber(s string) bool {
 	return true
 }
 
+// isHex returns true for strings of the form 0xNNN or -0xNNN.
+func isHex(s string) bool {
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+	}
+	if len(s) < 3 || s[0] != '0' || (s[1] != 'x' && s[1] != 'X') {
+		return false
+	}
+	for i := 2; i < len(s); i++ {
+		if hexValue(int(s[i])) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseInt parses a decimal or hexadecimal (0x prefixed) integer. A leading
+// zero does not mean octal.
+func parseInt(s string) (int64, error) {
+	if isHex(s) {
+		return strconv.ParseInt(s, 0, 64)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
 // IsInteger returns true for strings containing exclusively digits, with an
 // optional minus sign at the beginning. Starting and trailing spaces are
 // allowed.
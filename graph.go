@@ -6,6 +6,9 @@ package ogdl
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -16,12 +19,16 @@ import (
 type Graph struct {
 	This interface{}
 	Out  []*Graph
+
+	// attrs are the flags and other attributes of the node, if any (see
+	// Freeze, CloneCOW, MatchIndex and SetFunctions)
+	attrs *nodeAttrs
 }
 
 // NewGraph creates a Graph instance with the given name.
 // At this stage it is a single node without outgoing edges.
 func NewGraph(n interface{}) *Graph {
-	return &Graph{n, nil}
+	return &Graph{This: n}
 }
 
 // NilGraph returns a pointer to a 'null' Graph, also called transparent
@@ -51,34 +58,103 @@ func (g *Graph) Type() string {
 	return reflect.TypeOf(g.This).String()
 }
 
-// Depth returns the depth of the graph if it is a tree, or -1 if it has
-// cycles.
-//
-// TODO: Cycles are inferred if level>100, but nodes traversed are not
-// remembered (they should if cycles need to be detected).
+// Depth returns the depth of the graph, or -1 if it has cycles.
 func (g *Graph) Depth() int {
-	if g.Len() == 0 {
+	return g.depth(map[*Graph]bool{})
+}
+
+// depth returns the depth of g, or -1 if a node in path (the ancestors of
+// g) is found below it.
+func (g *Graph) depth(path map[*Graph]bool) int {
+	if g.Len() <= 0 {
 		return 0
 	}
 
+	path[g] = true
+	defer delete(path, g)
+
 	i := 0
 	for _, n := range g.Out {
-		j := n.Depth()
+		if path[n] {
+			return -1
+		}
+		j := n.depth(path)
+		if j < 0 {
+			return -1
+		}
 		if j > i {
 			i = j
 		}
 	}
+	return i + 1
+}
 
-	if i > 100 {
-		return -1
+// IsTree returns true if every node below g can be reached in only one
+// way: no node is attached to several parents, or twice to the same one,
+// and there are no cycles.
+func (g *Graph) IsTree() bool {
+	return len(g.shared(true)) == 0
+}
+
+// SharedNodes returns the nodes below g that can be reached in more than
+// one way (see IsTree), in depth first order. Nodes in cycles are included.
+func (g *Graph) SharedNodes() []*Graph {
+	return g.shared(false)
+}
+
+// shared returns the nodes reachable through more than one path, only the
+// first one found if first is true.
+func (g *Graph) shared(first bool) []*Graph {
+
+	if g == nil {
+		return nil
 	}
-	return i + 1
+
+	var l []*Graph
+	seen := map[*Graph]int{g: 1}
+
+	var walk func(n *Graph) bool
+	walk = func(n *Graph) bool {
+		for _, c := range n.Out {
+			if c == nil {
+				continue
+			}
+			seen[c]++
+			switch seen[c] {
+			case 1:
+				// Descend only once, so that cycles end
+				if walk(c) {
+					return true
+				}
+			case 2:
+				l = append(l, c)
+				if first {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	walk(g)
+	return l
 }
 
-// Equal returns true if the given graph and the receiver graph are equal.
+// Equal returns true if the given graph and the receiver graph are equal:
+// their roots have the same value, and the same subnodes in the same order,
+// compared in the same way. Order matters, as in OGDL text: "a (b, c)" is not
+// equal to "a (c, b)".
+//
+// Values are compared with ==, so that the number 5 is not equal to the
+// string "5" (see TextEqual), except those that cannot, as []byte, which
+// are compared by content. A node without subnodes is equal to one with an
+// empty list of them, but a nil *Graph is only equal to another nil.
 func (g *Graph) Equal(c *Graph) bool {
 
-	if c.This != g.This {
+	if g == nil || c == nil {
+		return g == c
+	}
+	if !equalValue(g.This, c.This) {
 		return false
 	}
 	if g.Len() != c.Len() {
@@ -93,10 +169,91 @@ func (g *Graph) Equal(c *Graph) bool {
 	return true
 }
 
+// TextEqual returns true if g and c have the same structure and their nodes
+// the same string values, that is, if they are written the same as text.
+// Unlike Equal, which compares the values themselves, it finds the number 5
+// equal to the string "5", and can compare values of any type.
+func (g *Graph) TextEqual(c *Graph) bool {
+
+	if g == nil || c == nil {
+		return g == c
+	}
+	if g.IsNil() != c.IsNil() || g.String() != c.String() || len(g.Out) != len(c.Out) {
+		return false
+	}
+
+	for i, n := range g.Out {
+		if !n.TextEqual(c.Out[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualApprox is like Equal, but numeric scalars are equal if they differ by
+// at most epsilon. Strings that represent numbers, such as "1.0000001", are
+// compared as numbers, since that is how values read from OGDL text look.
+// Other scalars must be exactly equal. As with Equal, a nil graph is only
+// equal to nil.
+func (g *Graph) EqualApprox(c *Graph, epsilon float64) bool {
+
+	if g == nil || c == nil {
+		return g == c
+	}
+	if !equalValue(g.This, c.This) && !approx(g.This, c.This, epsilon) {
+		return false
+	}
+	if g.Len() != c.Len() {
+		return false
+	}
+
+	for i := 0; i < g.Len(); i++ {
+		if !g.Out[i].EqualApprox(c.Out[i], epsilon) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalValue returns true if a == b, or for values that are not comparable,
+// if they have the same content.
+func equalValue(a, b interface{}) bool {
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+	if t := reflect.TypeOf(a); t != nil && !t.Comparable() {
+		return reflect.DeepEqual(a, b)
+	}
+	return a == b
+}
+
+// approx returns true if a and b are both numeric and differ by at most
+// epsilon.
+func approx(a, b interface{}, epsilon float64) bool {
+
+	if a == nil || b == nil || numeric(a) == nil || numeric(b) == nil {
+		return false
+	}
+
+	f1, _ := _float64f(numeric(a))
+	f2, _ := _float64f(numeric(b))
+
+	return math.Abs(f1-f2) <= epsilon
+}
+
 // Add adds a subnode to the current node.
 //
-// An eventual nil root will not be bypassed.
+// An eventual nil root will not be bypassed. A *Graph is attached as is,
+// not copied, so that it can end up shared by several parents (see the
+// package documentation); add n.Clone() to attach a copy.
+//
+// On a frozen graph Add does nothing and returns nil. It can be called on
+// nil, and again returns nil, so that g.Add("a").Add("b") is safe.
 func (g *Graph) Add(n interface{}) *Graph {
+	if g == nil || g.mutable() != nil {
+		return nil
+	}
 	if node, ok := n.(*Graph); ok && node!=nil {
 		if node.IsNil() {
 			for _, node2 := range node.Out {
@@ -108,14 +265,18 @@ func (g *Graph) Add(n interface{}) *Graph {
 		return node
 	}
 
-	gg := Graph{n, nil}
+	gg := Graph{This: n}
 	g.Out = append(g.Out, &gg)
 	return &gg
 }
 
-// AddNodes adds subnodes of the given Graph to the current node.
+// AddNodes adds subnodes of the given Graph to the current node, and returns
+// it. Like Add, it returns nil on a frozen or nil graph.
 func (g *Graph) AddNodes(g2 *Graph) *Graph {
 
+	if g == nil || g.mutable() != nil {
+		return nil
+	}
 	if g2 != nil {
 		for _, n := range g2.Out {
 			g.Out = append(g.Out, n)
@@ -150,12 +311,106 @@ func (g *Graph) addEqualNodes(g2 *Graph, key string, recurse bool) *Graph {
 // value holds a pointer, copying the interface value makes a copy of the
 // pointer, but not the data it points to.
 func (g *Graph) Copy(c *Graph) {
+	if g == nil || c == nil || g.mutable() != nil {
+		return
+	}
 	for _, n := range c.Out {
 		nn := g.Add(n.This)
 		nn.Copy(n)
 	}
 }
 
+// Clone returns a deep copy of g: new nodes, not frozen, with the same values
+// and FunctionSet (see SetFunctions).
+// The values (This) are copied as they are, so the copy shares whatever they
+// point to: strings and numbers are independent, but a []byte, pointer or
+// map value is the same in both. A node shared in g is copied at each
+// place, so the copy is a tree. g must not have cycles.
+func (g *Graph) Clone() *Graph {
+
+	if g == nil {
+		return nil
+	}
+
+	c := &Graph{This: g.This}
+	if len(g.Out) > 0 {
+		c.Out = make([]*Graph, len(g.Out))
+		for i, n := range g.Out {
+			c.Out[i] = n.Clone()
+		}
+	}
+	return c.inherit(g)
+}
+
+// MergePolicy selects how MergeWith combines the values of a key present in
+// both graphs.
+type MergePolicy int
+
+const (
+	// MergeReplace makes a single value in the graph merged replace the
+	// values of the key.
+	MergeReplace MergePolicy = iota
+	// MergeAppend adds the values of the graph merged to those of the key,
+	// as for lists: "port 80" merged with "port 8080" gives "port (80,
+	// 8080)".
+	MergeAppend
+)
+
+// Merge overlays o onto g, as when applying overrides to a default
+// configuration. Each subnode of o is matched with the subnode of g with the
+// same string value, and then:
+//
+//   - if it has a single subnode without subnodes (a value, as in
+//     "port 8080"), that value replaces the subnodes of the node in g.
+//   - otherwise, its subnodes are merged into the node in g, in the same way.
+//
+// Subnodes of o without a match are added to g. Repeated keys are matched by
+// position: the second "route" in o is merged into the second "route" in g,
+// or added if there is none. Nodes taken from o are cloned, so that g and o
+// share nothing. Merge returns ErrFrozen if g is frozen.
+func (g *Graph) Merge(o *Graph) error {
+	return g.MergeWith(o, MergeReplace)
+}
+
+// MergeWith is Merge with the given policy for values. With MergeAppend,
+// values are never replaced: they are merged as any other subnode, so that
+// those of o not already in g are added.
+func (g *Graph) MergeWith(o *Graph, policy MergePolicy) error {
+
+	if g == nil || o == nil {
+		return nil
+	}
+	if err := g.mutable(); err != nil {
+		return err
+	}
+
+	// Occurrences of each key already matched
+	seen := map[string]int{}
+
+	for _, n := range o.Out {
+		s := n.String()
+		j, _ := g.occurrence(s, seen[s])
+		seen[s]++
+
+		if j < 0 {
+			g.Out = append(g.Out, n.Clone())
+			continue
+		}
+
+		m := g.thaw(j)
+		if policy == MergeReplace && n.Len() == 1 && n.Out[0].Len() == 0 {
+			if err := m.mutable(); err != nil {
+				return err
+			}
+			m.Out = []*Graph{n.Out[0].Clone()}
+		} else if err := m.MergeWith(n, policy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Node returns the first subnode whose string value is equal to the given string.
 // It returns nil if not found.
 func (g *Graph) Node(s string) *Graph {
@@ -169,6 +424,46 @@ func (g *Graph) Node(s string) *Graph {
 	return nil
 }
 
+// Nodes returns the subnodes whose string value is equal to the given
+// string, in order. In paths, the N-th of them (from 0) is name{N}.
+func (g *Graph) Nodes(s string) []*Graph {
+
+	if g == nil {
+		return nil
+	}
+
+	var l []*Graph
+	for _, node := range g.Out {
+		if s == node.String() {
+			l = append(l, node)
+		}
+	}
+	return l
+}
+
+// Count returns the number of subnodes whose string value is equal to the
+// given string.
+func (g *Graph) Count(s string) int {
+	if g == nil {
+		return 0
+	}
+	_, n := g.occurrence(s, -1)
+	return n
+}
+
+// NodeOrAdd returns the first subnode whose string value is equal to the
+// given string, adding it if there is none. It returns nil if g is nil or
+// frozen and the node doesn't exist.
+func (g *Graph) NodeOrAdd(s string) *Graph {
+	if g == nil {
+		return nil
+	}
+	if n := g.Node(s); n != nil {
+		return n
+	}
+	return g.Add(s)
+}
+
 // GetAt returns a subnode by index, or nil if the index is out of range.
 func (g *Graph) GetAt(i int) *Graph {
 	if i >= len(g.Out) || i < 0 {
@@ -178,6 +473,75 @@ func (g *Graph) GetAt(i int) *Graph {
 	return g.Out[i]
 }
 
+// Range calls fn for each subnode, in order, with its index. If fn returns
+// false, the iteration stops.
+func (g *Graph) Range(fn func(i int, child *Graph) bool) {
+	if g == nil {
+		return
+	}
+	for i, n := range g.Out {
+		if !fn(i, n) {
+			return
+		}
+	}
+}
+
+// Walk visits the nodes below g depth first, in the order of the Out
+// slices, calling fn with the strings of the ancestors of each node (below
+// g) and the node itself. If fn returns false, the subnodes of that node are
+// not visited. The depth of a node, 0 for the subnodes of g, is len(path).
+// fn can add subnodes to the node it receives, which are then visited, but
+// removing nodes during the walk is not supported. The path slice is reused
+// between calls: copy it to keep it.
+//
+// A node shared by several parents is visited once for each; a node that is
+// its own ancestor (a cycle) is not visited again.
+func (g *Graph) Walk(fn func(path []string, node *Graph) bool) {
+	if g == nil {
+		return
+	}
+	g.walk(nil, map[*Graph]bool{g: true}, fn)
+}
+
+// walk visits the subnodes of g, which is at the end of path. on holds g and
+// its ancestors.
+func (g *Graph) walk(path []string, on map[*Graph]bool, fn func([]string, *Graph) bool) {
+	for i := 0; i < len(g.Out); i++ {
+		n := g.Out[i]
+		if n == nil || on[n] || !fn(path, n) {
+			continue
+		}
+		on[n] = true
+		n.walk(append(path, n.String()), on, fn)
+		delete(on, n)
+	}
+}
+
+// WalkDepth visits g and the nodes below it in pre-order, calling fn with
+// each node and its depth, 0 for g. If fn returns false, the subnodes of
+// that node are not visited. Shared nodes and cycles are handled as in Walk.
+func (g *Graph) WalkDepth(fn func(node *Graph, depth int) bool) {
+	if g == nil || !fn(g, 0) {
+		return
+	}
+	g.Walk(func(path []string, n *Graph) bool {
+		return fn(n, len(path)+1)
+	})
+}
+
+// FindAll returns the nodes below g for which pred returns true, in the
+// order Walk visits them.
+func (g *Graph) FindAll(pred func(*Graph) bool) []*Graph {
+	var l []*Graph
+	g.Walk(func(_ []string, n *Graph) bool {
+		if pred(n) {
+			l = append(l, n)
+		}
+		return true
+	})
+	return l
+}
+
 // Get recurses a Graph following the given path and returns
 // the result.
 //
@@ -191,8 +555,34 @@ func (g *Graph) GetAt(i int) *Graph {
 // selector := {N}
 // tokens can be quoted
 //
+// A quoted element is a single key, even if it has dots, spaces or
+// brackets, as in config."example.com".port. A quoted string between
+// brackets is a key too: config["example.com"] is config."example.com",
+// while [N] and [expression] are positions.
+//
+// Canonical paths, as returned by PathFromRoot, address one node and are
+// also accepted by Set and Remove. They are a sequence of elements separated
+// by dots, one for each node from the root (excluded) down to the node:
+//
+//   - the element is the value of the node, written as is if it begins
+//     with a letter and has only letters, digits and '_', and double quoted
+//     otherwise (with \" for embedded double quotes), or between backticks
+//     if it has backslashes.
+//   - if the node is not the first subnode of its parent with that value,
+//     the element is followed by the selector {N}, N being the number of
+//     previous siblings with the same value. Thus key{0} is the same as key,
+//     and key{2} is the third sibling named key.
+//
+// For example, a.b{1}."x y" is the node "x y" below the second b below a.
+//
+// A * element stands for every subnode at its level, and the rest of the
+// path is followed from each of them: servers.*.port gives the port of
+// every server. What each one gives is returned, in order, as the subnodes
+// of a new node with a nil root. A single result is returned as is, as with
+// {}, and none as nil. Set and Remove don't accept *.
+//
 // Future:
-// .*., .**.
+// .**.
 // ./regex/.
 //
 // Nil receiver behavior: return nil.
@@ -213,6 +603,12 @@ func (g *Graph) get(path *Graph) *Graph {
 	if g == nil {
 		return nil
 	}
+	return g.getFrom(path.Out)
+}
+
+// getFrom follows the path elements in l from g, which the previous element,
+// if any, is a key for.
+func (g *Graph) getFrom(l []*Graph) *Graph {
 
 	iknow := true
 
@@ -223,13 +619,17 @@ func (g *Graph) get(path *Graph) *Graph {
 	// elemPrev = previous path element, used in {}
 	var elemPrev string
 
-	for _, elem := range path.Out {
+	for i, elem := range l {
 
-		c := elem.String()[0]
+		// Quoted elements may look like special ones (!x) or be empty:
+		// only the exact special strings are interpreted.
+		if elem.String() == TypeAny {
+			return node.getAny(l[i+1:])
+		}
 
-		if c == '!' {
+		if s := elem.String(); s == TypeIndex || s == TypeSelector || s == TypeGroup {
 			iknow = false
-			c = elem.String()[1]
+			c := s[1]
 
 			switch c {
 
@@ -333,8 +733,37 @@ func (g *Graph) get(path *Graph) *Graph {
 	return node
 }
 
+// getAny follows the path elements in l from each subnode of g, for a *
+// element, and returns what they give, as Get does.
+func (g *Graph) getAny(l []*Graph) *Graph {
+
+	r := NilGraph()
+	for _, n := range g.Out {
+		m := n.getFrom(l)
+		if m == nil {
+			continue
+		}
+		if m.IsNil() {
+			r.Out = append(r.Out, m.Out...)
+		} else {
+			r.Out = append(r.Out, m)
+		}
+	}
+
+	switch r.Len() {
+	case 0:
+		return nil
+	case 1:
+		return r.Out[0]
+	}
+	return r
+}
+
 // Delete removes all subnodes with the given value or content
 func (g *Graph) Delete(n interface{}) {
+	if g.mutable() != nil {
+		return
+	}
 	for i := 0; i < g.Len(); i++ {
 		if g.Out[i].This == n {
 			g.Out = append(g.Out[:i], g.Out[i+1:]...)
@@ -345,7 +774,7 @@ func (g *Graph) Delete(n interface{}) {
 
 // DeleteAt removes a subnode by index
 func (g *Graph) DeleteAt(i int) {
-	if i < 0 {
+	if i < 0 || g.mutable() != nil {
 		return
 	}
 	if i >= g.Len() {
@@ -356,61 +785,404 @@ func (g *Graph) DeleteAt(i int) {
 
 // Set sets the first occurrence of the given path to the value given.
 //
-// TODO: Support indexes
-func (g *Graph) Set(s string, val interface{}) *Graph {
+// Missing intermediate nodes are created. If the last element of the path is
+// a token, the subnodes of that token are replaced by val (if val is a *Graph,
+// it becomes the new subtree). If the last element is an index, the node at
+// that position is replaced by val. An index equal to the number of subnodes
+// appends a new node; larger indexes are an error. A selector (key{N})
+// addresses the N-th sibling named key, and likewise one past the last one
+// adds a new sibling.
+//
+// Set returns an error if the path cannot be resolved, or ErrFrozen if it
+// goes through a frozen node.
+func (g *Graph) Set(s string, val interface{}) error {
 	if g == nil {
-		return nil
+		return errors.New("nil graph")
 	}
 
 	// Parse the input string into a Path graph.
 	path := NewPath(s)
 
 	if path == nil {
-		return nil
+		return errors.New("invalid path: " + s)
 	}
-	return g.set(path, val)
+	_, err := g.set(path, val)
+	return err
 }
 
-func (g *Graph) set(path *Graph, val interface{}) *Graph {
+// set is Set with a parsed path. It returns the node added.
+func (g *Graph) set(path *Graph, val interface{}) (*Graph, error) {
 
 	node := g
 
-	i := 0
-	var prev *Graph
+	// parent and key of the last token, used by selectors
+	var parent *Graph
+	var key interface{}
 
-	for ; i < len(path.Out); i++ {
+	for i, elem := range path.Out {
+
+		switch elem.String() {
+
+		case TypeIndex:
+			j, ok := pathIndex(elem)
+			if !ok || j > node.Len() {
+				return nil, fmt.Errorf("index out of range in %s", pathString(path))
+			}
+			parent = nil
+
+			if i == len(path.Out)-1 {
+				if err := node.mutable(); err != nil {
+					return nil, err
+				}
+				// Replace the node at j, keeping the nodes after it.
+				var rest []*Graph
+				if j < node.Len() {
+					rest = append(rest, node.Out[j+1:]...)
+				}
+				node.Out = node.Out[:j]
+				r := node.Add(val)
+				node.Out = append(node.Out, rest...)
+				return r, nil
+			}
+
+			if j == node.Len() {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, pathString(path))
+			}
+			node = node.thaw(j)
+
+		case TypeSelector:
+			// key{n}: the n-th sibling named key. One past the last
+			// one adds a new sibling.
+			j, ok := pathIndex(elem)
+			if !ok || parent == nil {
+				return nil, fmt.Errorf("invalid selector in %s", pathString(path))
+			}
+			k, n := parent.occurrence(_string(key), j)
+			switch {
+			case k >= 0:
+				node = parent.thaw(k)
+			case j != n:
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, pathString(path))
+			case parent.mutable() != nil:
+				return nil, ErrFrozen
+			default:
+				node = parent.Add(key)
+			}
+			parent = nil
+
+		case TypeGroup, TypeAny:
+			return nil, fmt.Errorf("unsupported path element in %s", pathString(path))
+
+		default:
+			parent, key = node, elem.This
+			var next *Graph
+			if k, _ := node.occurrence(elem.String(), 0); k >= 0 {
+				next = node.thaw(k)
+			} else if !nextIsSelector(path, i) {
+				if err := node.mutable(); err != nil {
+					return nil, err
+				}
+				next = node.Add(elem.This)
+			}
+			node = next
+		}
+	}
+
+	if err := node.mutable(); err != nil {
+		return nil, err
+	}
+	node.Out = nil
+
+	return node.Add(val), nil
+}
+
+// Remove deletes the node addressed by the given path, together with all its
+// subnodes. Paths can include indexes (a.b[2]) and selectors (a.b{1}). If
+// the path doesn't resolve, an error is returned. It is not called Delete
+// because Delete(n), which removes the subnodes with a value, exists.
+func (g *Graph) Remove(s string) error {
+	parent, j, err := g.locate(s)
+	if err != nil {
+		return err
+	}
+	if err := parent.mutable(); err != nil {
+		return err
+	}
+	parent.DeleteAt(j)
+	return nil
+}
+
+// DeletePath removes every node addressed by the given path, together with
+// its subnodes, and returns how many were removed. Unlike Remove, which
+// deletes the first node found, each key in the path stands for all the
+// subnodes with that value: servers.web.port removes the port of every web
+// server, all of them if a server has several. Indexes (a.b[2]) and
+// selectors (a.b{1}) address a single node. A path that doesn't resolve
+// removes nothing, as do paths into frozen nodes.
+func (g *Graph) DeletePath(s string) int {
+
+	path := NewPath(s)
+	if g == nil || path == nil || path.Len() == 0 {
+		return 0
+	}
+
+	// The nodes whose subnodes the next element is matched against
+	parents := []*Graph{g}
+	n := 0
+
+	for i := 0; i < path.Len(); i++ {
 
 		elem := path.Out[i]
+		sel := -1
+		if nextIsSelector(path, i) {
+			k, ok := pathIndex(path.Out[i+1])
+			if !ok {
+				return n
+			}
+			sel = k
+			i++
+		}
 
-		prev = node
-		node = node.Node(elem.String())
+		var next []*Graph
+		seen := map[*Graph]bool{}
 
-		if node == nil {
+		for _, p := range parents {
+			// A node can be reached from several parents
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+
+			l := p.pathMatches(elem, sel)
+			if i < path.Len()-1 {
+				for _, j := range l {
+					next = append(next, p.thaw(j))
+				}
+				continue
+			}
+
+			if len(l) == 0 || p.mutable() != nil {
+				continue
+			}
+			for k := len(l) - 1; k >= 0; k-- {
+				p.DeleteAt(l[k])
+			}
+			n += len(l)
+		}
+		parents = next
+	}
+
+	return n
+}
+
+// pathMatches returns the indexes of the subnodes of g that a path element
+// addresses: all those with its value if it is a key, or only the n-th of
+// them if n >= 0 (for a selector that follows it), or the one at an index.
+func (g *Graph) pathMatches(elem *Graph, n int) []int {
+
+	var l []int
+
+	switch s := elem.String(); s {
+	case TypeIndex:
+		if k, ok := pathIndex(elem); ok && k < g.Len() {
+			l = append(l, k)
+		}
+	case TypeSelector, TypeGroup, TypeAny:
+	default:
+		if n >= 0 {
+			if j, _ := g.occurrence(s, n); j >= 0 {
+				l = append(l, j)
+			}
 			break
 		}
+		for j, node := range g.Out {
+			if node.String() == s {
+				l = append(l, j)
+			}
+		}
 	}
+	return l
+}
 
-	if node == nil {
-		node = prev
+// locate returns the parent of the node addressed by the given path and its
+// index there, or an error if the path doesn't resolve.
+func (g *Graph) locate(s string) (*Graph, int, error) {
+	if g == nil {
+		return nil, 0, errors.New("nil graph")
+	}
+
+	path := NewPath(s)
+	if path == nil || path.Len() == 0 {
+		return nil, 0, errors.New("invalid path: " + s)
+	}
+
+	node := g
+
+	var parent *Graph
+	j := -1
+	key, keyed := "", false
+
+	for _, elem := range path.Out {
+
+		switch elem.String() {
+
+		case TypeIndex:
+			k, ok := pathIndex(elem)
+			if !ok {
+				k = -1
+			}
+			parent, j, keyed = node, k, false
+
+		case TypeSelector:
+			k, ok := pathIndex(elem)
+			if !ok || !keyed {
+				return nil, 0, errors.New("invalid selector in " + s)
+			}
+			j, _ = parent.occurrence(key, k)
+
+		case TypeGroup, TypeAny:
+			return nil, 0, errors.New("unsupported path element in " + s)
 
-		for ; i < len(path.Out); i++ {
-			elem := path.Out[i]
-			node = node.Add(elem.This)
+		default:
+			key, keyed = elem.String(), true
+			parent = node
+			j, _ = node.occurrence(key, 0)
 		}
+
+		if parent.GetAt(j) == nil {
+			return nil, 0, errors.New("not found: " + s)
+		}
+		// Nodes shared with a copy-on-write clone are copied on the way
+		node = parent.thaw(j)
 	}
 
-	node.Out = nil
+	return parent, j, nil
+}
+
+// PathFromRoot returns the canonical path (see Get) of the node n within g,
+// and true, or false if n cannot be reached from g. The path of g itself is
+// the empty string.
+func (g *Graph) PathFromRoot(n *Graph) (string, bool) {
 
-	return node.Add(val)
+	if g == nil || n == nil {
+		return "", false
+	}
+
+	if g == n {
+		return "", true
+	}
+
+	var elems []string
+	if !g.pathTo(n, &elems, map[*Graph]bool{}) {
+		return "", false
+	}
+
+	// elems are collected from the node up
+	for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+		elems[i], elems[j] = elems[j], elems[i]
+	}
+
+	return strings.Join(elems, "."), true
+}
+
+// pathTo searches n below g, adding the path elements to elems, starting
+// with the deepest one.
+func (g *Graph) pathTo(n *Graph, elems *[]string, seen map[*Graph]bool) bool {
+
+	if seen[g] {
+		return false
+	}
+	seen[g] = true
+
+	for i, c := range g.Out {
+		if c != n && !c.pathTo(n, elems, seen) {
+			continue
+		}
+
+		*elems = append(*elems, g.canonicalElement(i))
+		return true
+	}
+
+	return false
+}
+
+// canonicalElement returns the element of a canonical path that addresses
+// the i-th subnode of g: its string, with the number of previous siblings
+// with the same value, if any, as in name{2}.
+func (g *Graph) canonicalElement(i int) string {
+
+	s := g.Out[i].String()
+	e := pathElement(s)
+
+	k := 0
+	for _, d := range g.Out[:i] {
+		if d.String() == s {
+			k++
+		}
+	}
+	if k > 0 {
+		e += "{" + strconv.Itoa(k) + "}"
+	}
+	return e
+}
+
+// pathElement returns s as a path element, quoted if it is not a token
+// beginning with a letter.
+func pathElement(s string) string {
+
+	token := len(s) > 0 && IsLetter(int(s[0]))
+	for i := 0; token && i < len(s); i++ {
+		token = IsTokenChar(int(s[i]))
+	}
+	if token {
+		return s
+	}
+
+	// A backslash could end the string or escape a quote: write it raw
+	if strings.IndexByte(s, '\\') != -1 && strings.IndexByte(s, '`') == -1 {
+		return "`" + s + "`"
+	}
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// occurrence returns the index of the n-th (from 0) subnode with the given
+// value, or -1. It returns also the number of such subnodes found.
+func (g *Graph) occurrence(s string, n int) (int, int) {
+	c := 0
+	for i, node := range g.Out {
+		if node.String() == s {
+			if c == n {
+				return i, c
+			}
+			c++
+		}
+	}
+	return -1, c
+}
+
+// nextIsSelector returns true if the element after the i-th in path is a
+// selector.
+func nextIsSelector(path *Graph, i int) bool {
+	return i+1 < path.Len() && path.Out[i+1].String() == TypeSelector
+}
+
+// pathIndex returns the integer contained in an index path element (!i).
+func pathIndex(elem *Graph) (int, bool) {
+	if elem.Len() == 0 {
+		return 0, false
+	}
+	i, err := strconv.Atoi(elem.Out[0].String())
+	if err != nil || i < 0 {
+		return 0, false
+	}
+	return i, true
 }
 
 // Text is the OGDL text emitter. It converts a Graph into OGDL text.
 //
 // Strings are quoted if they contain spaces, newlines or special
 // characters. Null elements are not printed, and act as transparent nodes.
-//
-// BUG():Handle comments correctly.
-//
+// Comment nodes (see Parser.KeepComments) are written back as '#' lines.
 func (g *Graph) Text() string {
 	if g == nil {
 		return ""
@@ -448,9 +1220,10 @@ func (g *Graph) Text() string {
 // result is printed.
 func (g *Graph) _text(n int, buffer *bytes.Buffer) {
 
-	sp := ""
-	for i := 0; i < n; i++ {
-		sp += "  "
+	sp := indentation(n)
+
+	if writeComment(buffer, g, sp) {
+		return
 	}
 
 	/*
@@ -516,11 +1289,21 @@ func (g *Graph) _text(n int, buffer *bytes.Buffer) {
 	}
 }
 
+// indentation returns the indentation of _text for level n, without
+// allocating for usual depths.
+func indentation(n int) string {
+	const spaces = "                                                                "
+	if 2*n <= len(spaces) {
+		return spaces[:2*n]
+	}
+	return strings.Repeat("  ", n)
+}
+
 // Substitute traverses the graph substituting all nodes with content
 // equal to s by v.
 func (g *Graph) Substitute(s string, v interface{}) {
 	for _, n := range g.Out {
-		if n.String() == s {
+		if n.String() == s && n.mutable() == nil {
 			n.This = v
 		}
 		n.Substitute(s, v)
@@ -0,0 +1,238 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// JSON converts a Graph to JSON. The subnodes of a node become the value of
+// its name, mapped as follows:
+//
+//   - no subnodes: null
+//   - a single leaf: a scalar, as in 'port 80' -> {"port":80}
+//   - subnodes that all have subnodes, and distinct names: an object
+//   - anything else: an array, where leaves are scalars, transparent nodes
+//     (see FromJSON) the value of their subnodes, and other nodes with
+//     subnodes single key objects
+//
+// Scalars that parse as integers (also in hexadecimal, as 0x1f) or floats
+// are written as numbers, true and false as booleans, and all others as
+// strings. Numbers are not kept exactly as written: 007 becomes 7, and
+// 1.50 becomes 1.5. A transparent root is not written, so that
+//
+//     server
+//       host example.com
+//       port 8080
+//     tags
+//       a
+//       b
+//
+// becomes {"server":{"host":"example.com","port":8080},"tags":["a","b"]}.
+// A graph with a cycle cannot be converted, and returns an error.
+func (g *Graph) JSON() ([]byte, error) {
+
+	if g == nil {
+		return []byte("null"), nil
+	}
+	if g.cyclic(map[*Graph]bool{}) {
+		return nil, errors.New("json: graph with a cycle")
+	}
+
+	nodes := []*Graph{g}
+	if g.IsNil() {
+		nodes = g.Out
+	}
+
+	buf := &bytes.Buffer{}
+	writeJSONValue(buf, nodes)
+	return buf.Bytes(), nil
+}
+
+// FromJSON converts a JSON document into a Graph, the inverse of JSON. The
+// members of objects become nodes, in order, holding their values below
+// them. The elements of arrays become ordered subnodes: scalars as leaves,
+// and objects and arrays as transparent nodes (with a nil root) that hold
+// their content, which Text doesn't write but Node, GetAt and paths such as
+// list[1].name reach. Numbers and booleans are stored as written, as
+// strings, and null as a node with a nil root. Members holding an empty
+// object or array hold null instead.
+//
+// Not all documents come back the same from JSON: an array with a single
+// scalar is written as the scalar.
+//
+// A document with an object at the top returns its members below a
+// transparent root, which JSON writes back as the same object.
+func FromJSON(b []byte) (*Graph, error) {
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	g := NilGraph()
+	if err := jsonValue(d, g, false); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("json: data after the top level value")
+	}
+	return g, nil
+}
+
+// jsonValue reads a JSON value and adds it below g. Objects add their
+// members to g itself, unless the value is an element of an array.
+func jsonValue(d *json.Decoder, g *Graph, element bool) error {
+
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+
+	switch t := t.(type) {
+	case json.Delim:
+		if element {
+			g = g.Add(nil)
+		}
+		for d.More() {
+			if t == '[' {
+				err = jsonValue(d, g, true)
+			} else if k, err2 := d.Token(); err2 != nil {
+				err = err2
+			} else {
+				m := g.Add(k.(string))
+				if err = jsonValue(d, m, false); m.Len() == 0 {
+					// null, {} or []
+					m.Add(nil)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = d.Token() // ] or }
+		return err
+	case string:
+		g.Add(t)
+	case json.Number:
+		g.Add(t.String())
+	case bool:
+		g.Add(strconv.FormatBool(t))
+	case nil:
+		g.Add(nil)
+	}
+	return nil
+}
+
+// cyclic returns true if a node below g, whose ancestors are in on, is one
+// of its own ancestors.
+func (g *Graph) cyclic(on map[*Graph]bool) bool {
+	if on[g] {
+		return true
+	}
+	on[g] = true
+	for _, n := range g.Out {
+		if n.cyclic(on) {
+			return true
+		}
+	}
+	delete(on, g)
+	return false
+}
+
+// writeJSONValue writes a list of sibling nodes as a JSON value:
+//
+//   - no nodes: null
+//   - one leaf node: a scalar
+//   - nodes that all have subnodes, and distinct names: an object
+//   - anything else: an array
+//
+// Transparent nodes in arrays, as made by FromJSON, are written as the
+// value of their subnodes.
+func writeJSONValue(buf *bytes.Buffer, nodes []*Graph) {
+
+	if len(nodes) == 0 {
+		buf.WriteString("null")
+		return
+	}
+
+	if len(nodes) == 1 && nodes[0].Len() == 0 {
+		writeJSONScalar(buf, nodes[0])
+		return
+	}
+
+	object := true
+	names := make(map[string]bool)
+	for _, n := range nodes {
+		if n.Len() == 0 || n.IsNil() || names[n.String()] {
+			object = false
+			break
+		}
+		names[n.String()] = true
+	}
+
+	if object {
+		buf.WriteByte('{')
+		for i, n := range nodes {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, n.String())
+			buf.WriteByte(':')
+			writeJSONValue(buf, n.Out)
+		}
+		buf.WriteByte('}')
+		return
+	}
+
+	buf.WriteByte('[')
+	for i, n := range nodes {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		switch {
+		case n.IsNil():
+			writeJSONValue(buf, n.Out)
+		case n.Len() == 0:
+			writeJSONScalar(buf, n)
+		default:
+			buf.WriteByte('{')
+			writeJSONString(buf, n.String())
+			buf.WriteByte(':')
+			writeJSONValue(buf, n.Out)
+			buf.WriteByte('}')
+		}
+	}
+	buf.WriteByte(']')
+}
+
+// writeJSONScalar writes a leaf node as a JSON number, boolean or string.
+// NaN and infinities, which JSON cannot hold, are written as strings.
+func writeJSONScalar(buf *bytes.Buffer, g *Graph) {
+	switch v := g.Scalar().(type) {
+	case nil:
+		buf.WriteString("null")
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			writeJSONString(buf, g.String())
+			break
+		}
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	default:
+		writeJSONString(buf, g.String())
+	}
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
@@ -4,53 +4,284 @@
 
 package ogdl
 
-import "os"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// ErrLogTruncated is returned when a log ends with an incomplete or corrupt
+// record, as left by a write that was interrupted.
+var ErrLogTruncated = errors.New("log: truncated or corrupt record")
+
+// ErrCorrupt is returned when a record of a log with checksums doesn't
+// match its checksum.
+var ErrCorrupt = errors.New("log: checksum mismatch")
 
 // Log is a log store for binary OGDL objects.
 //
-// All objects are appended to a file, and a position is returned.
+// All objects are appended to a file, and a position is returned. Objects
+// can be added and read from several goroutines at the same time.
 //
 type Log struct {
 	f        *os.File
 	autoSync bool
+
+	// checksums tells that records are framed by their length and CRC-32
+	checksums bool
+
+	// idx is the index of the objects added with AddIndexed, loaded
+	// when first needed
+	idx *logIndex
+
+	// maxSize is the size at which the log is rotated, and segment the
+	// number of the current segment
+	maxSize int64
+	segment int
+
+	// mu serializes the operations that move the file offset: appends and
+	// reads with Seek.
+	mu sync.Mutex
+
+	// fmu guards f and segment for the reads that don't hold mu (see
+	// file). rotate and Compact hold both to change them. compactions counts
+	// the times Compact replaced f.
+	fmu         sync.RWMutex
+	compactions int64
+
+	// start is the position of the first object, after the preamble
+	start    int64
+	preamble *Preamble
+}
+
+// LogOptions control how OpenLogWith opens a log.
+type LogOptions struct {
+	// Preamble, if not nil, is written at the start of the log when it is
+	// created.
+	Preamble *Preamble
+	// Capabilities, if not nil, are checked against the preamble of an
+	// existing log. If the log needs more, opening fails with a
+	// *FeatureError.
+	Capabilities *Capabilities
+	// Checksums makes each object be written after its length and CRC-32
+	// (4 bytes each, big endian), which are verified when reading it: a
+	// record that doesn't match returns ErrCorrupt. A log written with
+	// checksums must always be opened with them, and one written without
+	// them, without them.
+	Checksums bool
+	// MaxSize, if > 0, is the size at which the log is rotated: before
+	// adding an object to a file that has reached it, the file is renamed
+	// to its segment file (see SegmentFile) and a new one is started, with
+	// the same preamble.
+	MaxSize int64
 }
 
 // OpenLog opens a log file. If the file doesn't exist, it is created.
 func OpenLog(file string) (*Log, error) {
+	return OpenLogWith(file, nil)
+}
+
+// OpenLogWith opens a log file like OpenLog, writing or checking its
+// preamble as given by opts, which can be nil. Logs without a preamble can
+// always be opened. The preamble is not an object of the log: position 0
+// in Read and ReadBinary refers to the first object after it.
+func OpenLogWith(file string, opts *LogOptions) (*Log, error) {
 
 	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
 
-	log := Log{f, true}
+	if opts == nil {
+		opts = &LogOptions{}
+	}
+	log := &Log{f: f, autoSync: true, checksums: opts.Checksums, maxSize: opts.MaxSize, segment: 1}
 
-	return &log, nil
+	// Segments already rotated
+	for {
+		if _, err := os.Stat(segmentFile(file, log.segment)); err != nil {
+			break
+		}
+		log.segment++
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.Size() == 0 {
+		if opts.Preamble != nil {
+			n, err := opts.Preamble.Graph().WriteBinary(f)
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			log.start = int64(n)
+			log.preamble = opts.Preamble
+		}
+		return log, nil
+	}
+
+	// An existing log: look for a preamble
+	p := NewBinParser(io.NewSectionReader(f, 0, info.Size()))
+	g, err := p.object()
+	if pr := preambleOf(g); err == nil && pr != nil {
+		if err = opts.Capabilities.Check(pr); err != nil {
+			f.Close()
+			return nil, err
+		}
+		log.start = int64(p.n)
+		log.preamble = pr
+	}
+
+	return log, nil
+}
+
+// Preamble returns the preamble of the log, or nil.
+func (log *Log) Preamble() *Preamble {
+	return log.preamble
+}
+
+// parser returns a parser for the objects of the log that r reads, which
+// doesn't look for a preamble.
+func (log *Log) parser(r io.Reader) *BinParser {
+	p := NewBinParser(r)
+	p.begun = true
+	return p
+}
+
+// pos maps position 0 to the first object, after the preamble.
+func (log *Log) pos(i int64) int64 {
+	if i == 0 {
+		return log.start
+	}
+	return i
+}
+
+// Segment returns the number of the segment that objects are added to,
+// starting at 1. It changes when the log is rotated (see
+// LogOptions.MaxSize); positions returned by Add are relative to the segment
+// the object was added to.
+func (log *Log) Segment() int {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.segment
+}
+
+// SegmentFile returns the file that holds the segment n of the log: the
+// log file followed by "." and n for segments already rotated, or the log
+// file itself for the current one. Rotated segments are logs themselves, and
+// can be read with OpenLog.
+func (log *Log) SegmentFile(n int) string {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if n >= log.segment {
+		return log.f.Name()
+	}
+	return segmentFile(log.f.Name(), n)
+}
+
+func segmentFile(file string, n int) string {
+	return file + "." + strconv.Itoa(n)
+}
+
+// rotate starts a new segment if the current one has reached maxSize, and
+// returns the position at the end of the log. If the rotation fails, the
+// log goes on in the same file.
+func (log *Log) rotate() int64 {
+
+	i, _ := log.f.Seek(0, 2)
+	if log.maxSize <= 0 || i < log.maxSize || i <= log.start {
+		return i
+	}
+
+	name := log.f.Name()
+	seg := segmentFile(name, log.segment)
+	if err := os.Rename(name, seg); err != nil {
+		return i
+	}
+
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		os.Rename(seg, name)
+		return i
+	}
+
+	// The index goes with its segment
+	log.closeIndex()
+	os.Rename(indexFile(name), indexFile(seg))
+
+	// Readers may still hold the old file: it is closed once replaced
+	log.fmu.Lock()
+	old := log.f
+	log.f = f
+	log.segment++
+	log.fmu.Unlock()
+	old.Close()
+
+	i, _ = f.Seek(0, 2)
+	if i == 0 && log.preamble != nil {
+		n, _ := log.preamble.Graph().WriteBinary(f)
+		log.start = int64(n)
+		i = log.start
+	}
+	return i
+}
+
+// logGen identifies the file of a log, and changes when positions in it are
+// no longer valid: when the log is rotated or compacted.
+type logGen struct {
+	segment     int
+	compactions int64
+}
+
+// file returns the file of the log and its generation, for reads that don't
+// hold mu.
+func (log *Log) file() (*os.File, logGen) {
+	log.fmu.RLock()
+	defer log.fmu.RUnlock()
+	return log.f, logGen{log.segment, log.compactions}
 }
 
 // Close closes a log file
 func (log *Log) Close() {
+	log.closeIndex()
 	log.f.Close()
 }
 
 // Sync commits the changes to disk (the exact behavior is OS dependent).
 func (log *Log) Sync() {
-	log.f.Sync()
+	f, _ := log.file()
+	f.Sync()
 }
 
 // Add adds an OGDL object to the log. The starting position into the log
-// is returned.
+// (into the current segment, if it is rotated) is returned. The object is streamed to the file, without building its
+// binary form in memory.
 func (log *Log) Add(g *Graph) int64 {
 
-	b := g.Binary()
-
-	if b == nil {
+	if g == nil {
 		return 0
 	}
 
-	i, _ := log.f.Seek(0, 2)
+	log.mu.Lock()
+	defer log.mu.Unlock()
 
-	log.f.Write(b)
+	i := log.rotate()
+
+	if log.checksums {
+		log.f.Write(frame(g.Binary()))
+	} else {
+		g.WriteBinary(log.f)
+	}
 
 	if log.autoSync {
 		log.f.Sync()
@@ -63,7 +294,13 @@ func (log *Log) Add(g *Graph) int64 {
 // the log is returned.
 func (log *Log) AddBinary(b []byte) int64 {
 
-	i, _ := log.f.Seek(0, 2)
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	i := log.rotate()
+	if log.checksums {
+		b = frame(b)
+	}
 	log.f.Write(b)
 
 	if log.autoSync {
@@ -74,53 +311,75 @@ func (log *Log) AddBinary(b []byte) int64 {
 }
 
 // Get returns the OGDL object at the position given and the position of the
-// next object, or an error.
+// next object, or an error (with the part read, if any) if the object is
+// truncated or corrupt. At the end of the log the position is -1.
+//
+// Deprecated: use Read, which returns the error last.
 func (log *Log) Get(i int64) (*Graph, error, int64) {
 
+	i = log.pos(i)
+
+	if log.checksums {
+		g, next, err := log.readChecked(i)
+		if err == io.EOF {
+			return nil, nil, -1
+		}
+		if err != nil {
+			return nil, err, -1
+		}
+		return g, nil, next
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
 	/* Position in file */
 	_, err := log.f.Seek(i, 0)
 	if err != nil {
 		return nil, err, -1
 	}
 
-	p := NewBinParser(log.f)
-	g := p.Parse()
+	p := log.parser(log.f)
+	g, err := p.parse()
 
-    if p.n == 0 {
-        return g, nil, -1
-    }
-    
-	return g, err, i + int64(p.n)
+	switch err {
+	case nil:
+		return g, nil, i + int64(p.n)
+	case io.EOF:
+		return nil, nil, -1
+	}
+	return g, err, -1
 }
 
-// GetBinary returns the OGDL object at the position given and the position of the
-// next object, or an error. The object returned is in binary form, exactly
-// as it is stored in the log.
+// GetBinary returns the OGDL object at the position given and its length,
+// or an error. The object returned is in binary form, exactly as it is
+// stored in the log.
+//
+// Deprecated: use ReadBinary, which returns the error last.
 func (log *Log) GetBinary(i int64) ([]byte, error, int64) {
 
+	i = log.pos(i)
+
+	if log.checksums {
+		rec, b, err := log.record(i)
+		return b, err, int64(len(rec))
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
 	// Position in file
 	_, err := log.f.Seek(i, 0)
 	if err != nil {
 		return nil, err, 0
 	}
 
-	/* Read until EOS of binary OGDL.
+	p := log.parser(log.f)
 
-	   There should be a Header first.
-	*/
-	p := NewBinParser(log.f)
-
-	if !p.header() {
+	n, err := p.Skip()
+	if err != nil {
 		return nil, err, 0
 	}
-	for {
-		lev, _, _ /* typ, b*/ := p.line(false)
-		if lev == 0 {
-			break
-		}
-	}
-
-	n := p.n
 
 	// Read bytes
 	b := make([]byte, n)
@@ -128,3 +387,330 @@ func (log *Log) GetBinary(i int64) ([]byte, error, int64) {
 
 	return b, err, int64(n)
 }
+
+// Read returns the OGDL object at the position given and the position of the
+// next object. At the end of the log it returns io.EOF, and ErrLogTruncated
+// if the object is incomplete or corrupt.
+func (log *Log) Read(i int64) (*Graph, int64, error) {
+
+	i = log.pos(i)
+
+	if log.checksums {
+		g, next, err := log.readChecked(i)
+		if err != nil {
+			return nil, i, err
+		}
+		return g, next, nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if _, err := log.f.Seek(i, 0); err != nil {
+		return nil, i, err
+	}
+
+	p := log.parser(log.f)
+	g, err := p.parse()
+
+	switch err {
+	case nil:
+		return g, i + int64(p.n), nil
+	case io.EOF:
+		return nil, i, io.EOF
+	}
+	return nil, i, ErrLogTruncated
+}
+
+// ReadBinary returns the OGDL object at the position given, in binary form
+// exactly as it is stored in the log, and the position of the next object.
+// Errors are those of Read.
+func (log *Log) ReadBinary(i int64) ([]byte, int64, error) {
+
+	i = log.pos(i)
+
+	if log.checksums {
+		rec, b, err := log.record(i)
+		if err != nil {
+			return nil, i, recordError(err)
+		}
+		return b, i + int64(len(rec)), nil
+	}
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	if _, err := log.f.Seek(i, 0); err != nil {
+		return nil, i, err
+	}
+
+	p := log.parser(log.f)
+
+	n, err := p.Skip()
+	switch err {
+	case nil:
+	case io.EOF:
+		return nil, i, io.EOF
+	default:
+		return nil, i, ErrLogTruncated
+	}
+
+	b := make([]byte, n)
+	if _, err = log.f.ReadAt(b, i); err != nil {
+		return nil, i, err
+	}
+
+	return b, i + n, nil
+}
+
+// Iterate calls fn with the position and content of each object in the log,
+// in order, until fn returns false. It returns the position after the last
+// object visited. If the log ends with an incomplete or corrupt record it
+// returns ErrLogTruncated, and the position is where the valid data ends:
+// the log can be truncated there with Truncate, and appended to again. In
+// a log with checksums, a record that doesn't match its checksum stops it
+// with ErrCorrupt. If the log is rotated or compacted meanwhile, it stops
+// with ErrCheckpointInvalid.
+func (log *Log) Iterate(fn func(pos int64, g *Graph) bool) (int64, error) {
+	return log.iterateFrom(log.start, fn)
+}
+
+// iterateFrom is Iterate starting at the object at pos.
+func (log *Log) iterateFrom(pos int64, fn func(pos int64, g *Graph) bool) (int64, error) {
+
+	f, gen := log.file()
+
+	// moved tells if the log was rotated or compacted, which makes the
+	// positions invalid, after a read.
+	moved := func() bool {
+		_, g := log.file()
+		return g != gen
+	}
+
+	if log.checksums {
+		for {
+			g, next, err := log.readChecked(pos)
+			if moved() {
+				return pos, ErrCheckpointInvalid
+			}
+			switch err {
+			case nil:
+			case io.EOF:
+				return pos, nil
+			default:
+				return pos, err
+			}
+			if !fn(pos, g) {
+				return next, nil
+			}
+			pos = next
+		}
+	}
+
+	// Reading with ReadAt leaves the file offset alone, so that fn can
+	// use the log.
+	start := pos
+	p := log.parser(io.NewSectionReader(f, start, math.MaxInt64-start))
+
+	for {
+		pos := start + int64(p.n)
+
+		g, err := p.parse()
+		if moved() {
+			return pos, ErrCheckpointInvalid
+		}
+		switch err {
+		case nil:
+		case io.EOF:
+			return pos, nil
+		default:
+			return pos, ErrLogTruncated
+		}
+
+		if !fn(pos, g) {
+			return start + int64(p.n), nil
+		}
+	}
+}
+
+// ForEach calls fn with the position and content of each object in the log,
+// in order, until the end of the log or until fn returns an error, which is
+// then returned. If the log ends with an incomplete or corrupt record, the
+// error is ErrLogTruncated.
+func (log *Log) ForEach(fn func(pos int64, g *Graph) error) error {
+
+	var err error
+	_, end := log.Iterate(func(pos int64, g *Graph) bool {
+		err = fn(pos, g)
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+	return end
+}
+
+// Count returns the number of objects in the log. Objects are skipped, not
+// decoded. If the log ends with an incomplete or corrupt record, it returns
+// the number of valid objects before it and ErrLogTruncated.
+func (log *Log) Count() (int, error) {
+
+	if log.checksums {
+		n := 0
+		_, err := log.Iterate(func(int64, *Graph) bool {
+			n++
+			return true
+		})
+		return n, err
+	}
+
+	f, _ := log.file()
+	p := log.parser(io.NewSectionReader(f, log.start, math.MaxInt64))
+
+	n := 0
+	for {
+		_, err := p.Skip()
+		switch err {
+		case nil:
+			n++
+		case io.EOF:
+			return n, nil
+		default:
+			return n, ErrLogTruncated
+		}
+	}
+}
+
+// Compact rewrites the log with only the objects for which keep returns
+// true, to reclaim the space of those superseded. The new log is written to
+// a temporary file, which then replaces the original atomically: a crash
+// leaves either the old log or the new one. The preamble, if any, is kept.
+//
+// Objects change position: the map returned gives the new position of each
+// one kept, by its old position. If the log ends with an incomplete or
+// corrupt record, it is not compacted and ErrLogTruncated is returned.
+// Objects added while Compact runs wait for it, and end up in the new log;
+// keep must not use the log. The index of AddIndexed is rebuilt.
+//
+// The positions known before Compact are no longer valid: an Iterate running
+// at the same time stops with ErrCheckpointInvalid, and followers (see
+// Follow) end with a *CheckpointError.
+func (log *Log) Compact(keep func(pos int64, g *Graph) bool) (map[int64]int64, error) {
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	name := log.f.Name()
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (map[int64]int64, error) {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	// The preamble
+	if _, err = io.Copy(f, io.NewSectionReader(log.f, 0, log.start)); err != nil {
+		return fail(err)
+	}
+
+	m := map[int64]int64{}
+	next := log.start
+
+	_, end := log.Iterate(func(pos int64, g *Graph) bool {
+		if !keep(pos, g) {
+			return true
+		}
+		var b []byte
+		if b, _, err = log.record(pos); err != nil {
+			return false
+		}
+		if _, err = f.Write(b); err != nil {
+			return false
+		}
+		m[pos] = next
+		next += int64(len(b))
+		return true
+	})
+	if err == nil {
+		err = end
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if err = f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	// Continue with the new file
+	nf, err := os.OpenFile(name, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	log.fmu.Lock()
+	old := log.f
+	log.f = nf
+	log.compactions++
+	log.fmu.Unlock()
+	old.Close()
+	log.dropIndex()
+
+	return m, nil
+}
+
+// frame returns the object b preceded by its length and CRC-32, as stored in
+// logs with checksums.
+func frame(b []byte) []byte {
+	r := make([]byte, 8+len(b))
+	binary.BigEndian.PutUint32(r, uint32(len(b)))
+	binary.BigEndian.PutUint32(r[4:], crc32.ChecksumIEEE(b))
+	copy(r[8:], b)
+	return r
+}
+
+// readChecked returns the object at pos of a log with checksums, and the
+// position of the next one. Errors are those of Read.
+func (log *Log) readChecked(pos int64) (*Graph, int64, error) {
+
+	rec, b, err := log.record(pos)
+	if err != nil {
+		return nil, pos, recordError(err)
+	}
+
+	g, err := log.parser(bytes.NewReader(b)).parse()
+	if err != nil {
+		return nil, pos, ErrCorrupt
+	}
+	return g, pos + int64(len(rec)), nil
+}
+
+// recordError maps the errors of record to those of Read.
+func recordError(err error) error {
+	switch err {
+	case io.EOF, ErrCorrupt:
+		return err
+	}
+	return ErrLogTruncated
+}
+
+// Truncate cuts the log at the given position, which should be the end of
+// an object, for example one returned by Iterate.
+func (log *Log) Truncate(pos int64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.dropIndex()
+	return log.f.Truncate(pos)
+}
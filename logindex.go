@@ -0,0 +1,266 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"io"
+	"math"
+	"os"
+)
+
+// logKey is the first node of the objects added with AddIndexed, with the
+// key below it.
+const logKey = "!key"
+
+// logIndex holds the positions of the objects of a log added with
+// AddIndexed, by key, in the order they were added. It is kept in a file
+// next to the log, with one binary object per entry:
+//
+//     key
+//       position
+//
+// which is only appended to, and can always be rebuilt from the log.
+type logIndex struct {
+	f    *os.File
+	keys map[string][]int64
+
+	// end is the position up to which the log is indexed
+	end int64
+}
+
+// indexFile returns the index file of a log file.
+func indexFile(file string) string {
+	return file + ".idx"
+}
+
+// AddIndexed adds an OGDL object to the log under a key, and returns its
+// position as Add does. The object is stored with a first node '!key'
+// holding the key, so that the index, kept in the log file followed by
+// ".idx", can be rebuilt from the log if it is lost or out of date. The
+// objects of a key can then be found with Lookup and LookupAll, without
+// reading the whole log.
+//
+// The key must not be empty. The index is loaded, or rebuilt, the first
+// time it is needed. It covers the current segment only: when the log is
+// rotated, it goes with the segment file.
+func (log *Log) AddIndexed(key string, g *Graph) int64 {
+
+	if g == nil {
+		return 0
+	}
+
+	r := NilGraph()
+	r.Add(logKey).Add(key)
+	r.Add(g)
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	i := log.rotate()
+	x := log.index()
+
+	if log.checksums {
+		log.f.Write(frame(r.Binary()))
+	} else {
+		r.WriteBinary(log.f)
+	}
+
+	if log.autoSync {
+		log.f.Sync()
+	}
+
+	// The index, written after the object, can be behind the log but
+	// never ahead of it.
+	if x != nil {
+		x.add(key, i)
+	}
+
+	return i
+}
+
+// Lookup returns the last object added to the log with the given key,
+// without its '!key' node, or ErrNotFound.
+func (log *Log) Lookup(key string) (*Graph, error) {
+
+	log.mu.Lock()
+	var pos int64 = -1
+	if x := log.index(); x != nil {
+		if l := x.keys[key]; len(l) > 0 {
+			pos = l[len(l)-1]
+		}
+	}
+	log.mu.Unlock()
+
+	if pos < 0 {
+		return nil, ErrNotFound
+	}
+	return log.readIndexed(key, pos)
+}
+
+// LookupAll returns the objects added to the log with the given key, in the
+// order they were added, or ErrNotFound.
+func (log *Log) LookupAll(key string) ([]*Graph, error) {
+
+	log.mu.Lock()
+	var l []int64
+	if x := log.index(); x != nil {
+		l = append(l, x.keys[key]...)
+	}
+	log.mu.Unlock()
+
+	if len(l) == 0 {
+		return nil, ErrNotFound
+	}
+
+	var r []*Graph
+	for _, pos := range l {
+		g, err := log.readIndexed(key, pos)
+		if err != nil {
+			return r, err
+		}
+		r = append(r, g)
+	}
+	return r, nil
+}
+
+// readIndexed reads the object at pos, which should have the given key, and
+// returns it without the key node.
+func (log *Log) readIndexed(key string, pos int64) (*Graph, error) {
+
+	g, _, err := log.Read(pos)
+	if err != nil {
+		return nil, err
+	}
+	k, ok := indexKey(g)
+	if !ok || k != key {
+		return nil, ErrCorrupt
+	}
+	r := NilGraph()
+	r.Out = g.Out[1:]
+	return r, nil
+}
+
+// indexKey returns the key of an object added with AddIndexed.
+func indexKey(g *Graph) (string, bool) {
+	if g == nil || len(g.Out) == 0 || g.Out[0].String() != logKey || g.Out[0].Len() != 1 {
+		return "", false
+	}
+	return g.Out[0].Out[0].String(), true
+}
+
+// index returns the index of the log, loading it the first time. An index
+// file that is missing or doesn't match the log is rebuilt, and one that
+// is behind the log is completed, by reading the objects not in it. If the
+// index file cannot be written, nil is returned. It must be called with mu
+// held.
+func (log *Log) index() *logIndex {
+
+	if log.idx != nil {
+		return log.idx
+	}
+
+	f, err := os.OpenFile(indexFile(log.f.Name()), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil
+	}
+
+	x := log.loadIndex(f)
+	if x == nil {
+		if err = f.Truncate(0); err != nil {
+			f.Close()
+			return nil
+		}
+		x = &logIndex{f: f, keys: map[string][]int64{}, end: log.start}
+	}
+
+	// Objects not yet indexed. A truncated log is indexed up to where the
+	// valid data ends.
+	log.iterateFrom(x.end, func(pos int64, g *Graph) bool {
+		if k, ok := indexKey(g); ok {
+			x.add(k, pos)
+		}
+		return true
+	})
+
+	log.idx = x
+	return x
+}
+
+// loadIndex reads the index file f, and returns nil if it is not valid for
+// the log: its entries must be in order, and the last one must point to an
+// object with the same key.
+func (log *Log) loadIndex(f *os.File) *logIndex {
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+
+	x := &logIndex{f: f, keys: map[string][]int64{}, end: log.start}
+	last, key := int64(-1), ""
+
+	p := NewBytesBinParser(b)
+	p.begun = true
+	for {
+		g, err := p.parse()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || g.Len() != 1 || g.Out[0].Len() != 1 {
+			return nil
+		}
+		pos, ok := g.Out[0].Out[0].Int64()
+		if !ok || pos < log.start || pos <= last {
+			return nil
+		}
+		last, key = pos, g.Out[0].String()
+		x.keys[key] = append(x.keys[key], pos)
+	}
+
+	if last >= 0 {
+		g, next, err := log.readAt(last)
+		if k, _ := indexKey(g); err != nil || k != key {
+			return nil
+		}
+		x.end = next
+	}
+	return x
+}
+
+// add adds an entry to the index, and to its file.
+func (x *logIndex) add(key string, pos int64) {
+	x.keys[key] = append(x.keys[key], pos)
+	g := NilGraph()
+	g.Add(key).Add(pos)
+	g.WriteBinary(x.f)
+}
+
+// closeIndex closes the index file, if open, and forgets the index. It must
+// be called with mu held.
+func (log *Log) closeIndex() {
+	if log.idx != nil {
+		log.idx.f.Close()
+		log.idx = nil
+	}
+}
+
+// dropIndex removes the index, when the positions in it are no longer
+// valid, so that it is rebuilt when needed. It must be called with mu held.
+func (log *Log) dropIndex() {
+	log.closeIndex()
+	os.Remove(indexFile(log.f.Name()))
+}
+
+// readAt returns the object at pos and the position of the next one, like
+// Read, but without using the file offset.
+func (log *Log) readAt(pos int64) (*Graph, int64, error) {
+	if log.checksums {
+		return log.readChecked(pos)
+	}
+	f, _ := log.file()
+	p := log.parser(io.NewSectionReader(f, pos, math.MaxInt64-pos))
+	g, err := p.parse()
+	return g, pos + int64(p.n), err
+}
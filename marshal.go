@@ -0,0 +1,221 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// FromStruct converts a struct, or a pointer to one, into a Graph, as the
+// inverse of Unmarshal: each exported field becomes a node, named by its
+// `ogdl:"name"` tag or by the field name, with the value below it. Fields
+// tagged `ogdl:"-"` are skipped, the fields of embedded structs are written
+// as if they belonged to the outer struct, and the keys of a `ogdl:",rest"`
+// field are added to the struct's own keys.
+//
+//     type Server struct {
+//         Host  string `ogdl:"host"`
+//         Ports []int  `ogdl:"ports"`
+//     }
+//
+// gives
+//
+//     host example.com
+//     ports
+//       80
+//       443
+//
+// Scalars are stored with their basic type (string, bool, int64, uint64,
+// float32 or float64), and time.Time, time.Duration and []byte values as
+// they are, not as text. Nested structs and maps (ordered by key) add their
+// keys below the field node, and slices one node per element. Elements
+// that are structs, maps or slices become transparent nodes (with a nil
+// root) holding their content, as FromJSON does. Pointers and interfaces
+// are followed, and nil ones give a field with no value. *Graph and Graph
+// fields add their subnodes. A cycle of pointers, or a field of a type that
+// cannot be written (a channel or a function), returns an error.
+func FromStruct(v interface{}) (*Graph, error) {
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.New("FromStruct needs a struct or a pointer to one")
+	}
+
+	g := NilGraph()
+	e := &encoder{on: map[uintptr]bool{}}
+	if err := e.object(g, rv, ""); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// encoder holds the state of a FromStruct call: the pointers being
+// followed, to detect cycles.
+type encoder struct {
+	on map[uintptr]bool
+}
+
+// value adds v below g, at the given path.
+func (e *encoder) value(g *Graph, v reflect.Value, path string) error {
+
+	// Values reached through unexported embedded structs cannot be used
+	// with Interface, and are written if they are scalars only.
+	switch v.Type() {
+	case graphType:
+		if !v.IsNil() && v.CanInterface() {
+			g.Out = append(g.Out, v.Interface().(*Graph).Out...)
+		}
+		return nil
+	case graphType.Elem():
+		if v.CanInterface() {
+			g.Out = append(g.Out, v.Interface().(Graph).Out...)
+		}
+		return nil
+	case durationType:
+		g.Add(time.Duration(v.Int()))
+		return nil
+	case timeType:
+		if v.CanInterface() {
+			g.Add(v.Interface())
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Kind() == reflect.Ptr {
+			p := v.Pointer()
+			if e.on[p] {
+				return fmt.Errorf("%s: cycle of pointers", pathOrRoot(path))
+			}
+			e.on[p] = true
+			defer delete(e.on, p)
+		}
+		return e.value(g, v.Elem(), path)
+
+	case reflect.Struct:
+		return e.object(g, v, path)
+
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		var names []string
+		for _, k := range v.MapKeys() {
+			s := keyString(k)
+			keys[s] = k
+			names = append(names, s)
+		}
+		sort.Strings(names)
+		for _, s := range names {
+			if err := e.value(g.Add(s), v.MapIndex(keys[s]), joinPath(path, s)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			for i := range b {
+				b[i] = byte(v.Index(i).Uint())
+			}
+			g.Add(b)
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			n := g
+			if !isScalarType(v.Type().Elem()) {
+				n = g.Add(nil)
+			}
+			if err := e.value(n, v.Index(i), path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.String:
+		g.Add(v.String())
+	case reflect.Bool:
+		g.Add(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		g.Add(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		g.Add(v.Uint())
+	case reflect.Float32:
+		g.Add(float32(v.Float()))
+	case reflect.Float64:
+		g.Add(v.Float())
+	default:
+		return fmt.Errorf("%s: cannot encode %s", pathOrRoot(path), v.Type())
+	}
+	return nil
+}
+
+// keyString returns a map key as text.
+func keyString(k reflect.Value) string {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10)
+	}
+	if k.CanInterface() {
+		return fmt.Sprint(k.Interface())
+	}
+	return ""
+}
+
+// object adds the fields of the struct v below g.
+func (e *encoder) object(g *Graph, v reflect.Value, path string) error {
+
+	fields := structFields(v.Type())
+
+	for _, f := range fields.list {
+		fv, ok := fieldOf(v, f.index)
+		if !ok {
+			continue
+		}
+		if err := e.value(g.Add(f.name), fv, joinPath(path, f.name)); err != nil {
+			return err
+		}
+	}
+
+	if fields.rest != nil {
+		if fv, ok := fieldOf(v, fields.rest); ok {
+			return e.value(g, fv, path)
+		}
+	}
+	return nil
+}
+
+// fieldOf returns the field of v with the given index, and false if it is
+// in an embedded struct through a nil pointer.
+func fieldOf(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return v, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
@@ -0,0 +1,96 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "strconv"
+
+// match is the origin of a node returned by a selector, kept with the
+// attributes of the node (see nodeAttrs).
+type match struct {
+	index int
+	key   string
+	path  string
+}
+
+// matches returns the subnodes of the nodes named key in g, or only of the
+// n-th one if n >= 0, as a list of new nodes that know their origin (see
+// MatchIndex). prefix is the path to key.
+//
+// The nodes are shallow copies: they have the same value and subnodes as
+// those in g.
+func matches(g *Graph, key, prefix string, n int) *Graph {
+
+	r := NilGraph()
+	k := 0
+
+	for _, node := range g.Out {
+		if node.String() != key {
+			continue
+		}
+		if n < 0 || k == n {
+			p := prefix
+			if k > 0 {
+				p += "{" + strconv.Itoa(k) + "}"
+			}
+			for j, c := range node.Out {
+				m := &match{len(r.Out), key, p + "[" + strconv.Itoa(j) + "]"}
+				n := &Graph{This: c.This, Out: c.Out[:len(c.Out):len(c.Out)]}
+				n.attrs = &nodeAttrs{flags: c.flags() & flagFrozen, match: m}
+				r.Out = append(r.Out, n)
+			}
+		}
+		k++
+	}
+	return r
+}
+
+// MatchIndex returns the position of a node returned by a selector among
+// the nodes that the selector chose from, or -1 for other nodes. In the
+// result of servers{port > 1000}, it tells which server each one is:
+// MatchIndex is 2 for the third one under servers.
+func (g *Graph) MatchIndex() int {
+	if m := g.origin(); m != nil {
+		return m.index
+	}
+	return -1
+}
+
+// MatchKey returns the name under which a node returned by a selector was
+// found, as servers in servers{port > 1000}, or "" for other nodes.
+func (g *Graph) MatchKey() string {
+	if m := g.origin(); m != nil {
+		return m.key
+	}
+	return ""
+}
+
+// MatchPath returns a path to a node returned by a selector in the graph it
+// was found in, as servers[2], for Get. It is "" for other nodes.
+func (g *Graph) MatchPath() string {
+	if m := g.origin(); m != nil {
+		return m.path
+	}
+	return ""
+}
+
+// origin returns the origin of g if it was returned by a selector, or nil.
+func (g *Graph) origin() *match {
+	if g == nil || g.attrs == nil {
+		return nil
+	}
+	return g.attrs.match
+}
+
+// matchOf returns the node returned by a selector held in v, if any.
+func matchOf(v interface{}) *Graph {
+	g, ok := v.(*Graph)
+	if !ok || g == nil {
+		return nil
+	}
+	if g.origin() == nil && g.IsNil() && g.Len() == 1 {
+		g = g.Out[0]
+	}
+	return g
+}
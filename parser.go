@@ -7,8 +7,12 @@ package ogdl
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
@@ -20,13 +24,25 @@ const (
 	TypeSelector   = "!s"
 	TypeIndex      = "!i"
 	TypeGroup      = "!g"
+	TypeAny        = "!*"
 	TypeTemplate   = "!t"
 
-	TypeIf    = "!if"
-	TypeEnd   = "!end"
-	TypeElse  = "!else"
-	TypeFor   = "!for"
-	TypeBreak = "!break"
+	TypeIf      = "!if"
+	TypeEnd     = "!end"
+	TypeElse    = "!else"
+	TypeElseIf  = "!elseif"
+	TypeFor     = "!for"
+	TypeWhile   = "!while"
+	TypeBreak   = "!break"
+	TypeInclude = "!include"
+	TypeRaw     = "!raw"
+	TypeHTML    = "!html"
+	TypeSet     = "!set"
+	TypeFilter  = "!filter"
+
+	TypeComment = "!comment"
+
+	TypeTruncated = "!truncated"
 )
 
 // Parser is used to parse textual OGDL streams, paths, empressions and
@@ -47,9 +63,10 @@ type Parser struct {
 	// the number of spaces at each level.
 	ind []int
 
-	// last holds the 2 last characters read.
-	// We need 2 characters of look-ahead (for Block()).
-	last [2]int
+	// last holds the 3 last characters read.
+	// We need 2 characters of look-ahead for Block() and 3 for
+	// number exponents.
+	last [3]int
 
 	// unread index
 	lastn int
@@ -62,33 +79,168 @@ type Parser struct {
 
 	// saved spaces at end of block
 	spaces int
+
+	// err holds the first error found by a production that cannot return
+	// it directly (those returning a string and a bool).
+	err error
+
+	// KeepComments makes comments part of the graph, instead of discarding
+	// them. See Comment().
+	KeepComments bool
+
+	// Escapes enables decoding of escape sequences in quoted strings:
+	// \n, \t, \r, \\, \xXX and \uXXXX (with UTF-16 surrogate pairs for
+	// characters beyond U+FFFF). It is off by default, and never applies
+	// to unquoted strings.
+	Escapes bool
+
+	// MaxDepth is the maximum nesting depth of groups, argument lists and
+	// expressions, and the maximum level of a node. Deeper input is rejected
+	// with an error instead of growing the stack without bound. It is 1000
+	// by default. Zero means unlimited.
+	MaxDepth int
+
+	// MaxScalarLen is the maximum length in bytes of a scalar (quoted,
+	// unquoted or block), and MaxInputBytes that of the whole input. Zero,
+	// the default, means unlimited.
+	MaxScalarLen  int
+	MaxInputBytes int
+
+	// depth is the current nesting depth, and n the number of bytes read.
+	depth int
+	n     int
+
+	// TabWidth is the number of columns a tab counts for, when computing
+	// the level of a line. It is 4 by default. Tabs and spaces can be mixed
+	// in the indentation of a line; a line that goes back to a previous
+	// level must then match the indentation of that level, or the parse
+	// fails.
+	TabWidth int
+
+	// lineInd holds, for each level, the indentation + 1 of the line that
+	// opened it (zero if none), and prevIndent that of the previous line.
+	lineInd    []int
+	prevIndent int
+
+	// Hook, if not nil, is called at key points of the parse (see
+	// ParseEvent). It is meant for operational observability: timing,
+	// tracing or logging of parses.
+	Hook func(ev ParseEvent)
+
+	// Delim is the character that starts variables in templates. It is '$'
+	// if zero.
+	Delim byte
+
+	// Sizes makes unquoted scalars like 2GB, 512kb or 10MiB be stored as a
+	// Size (a number of bytes, plus the original text). Units are B, KB,
+	// MB, GB, TB (powers of 1000), and KiB, MiB, GiB, TiB or Ki, Mi, Gi, Ti
+	// (powers of 1024), in any case.
+	Sizes bool
+
+	// Durations makes unquoted scalars like 250ms or 1h30m be stored as a
+	// Duration (a time.Duration, plus the original text). Units are those
+	// of time.ParseDuration, and are case sensitive: 1m is one minute.
+	// Size units always end in B or i, so they don't collide with these.
+	Durations bool
+
+	// Intern makes scalars that were already seen reuse the value stored
+	// for them, instead of allocating it again. It saves memory and time
+	// when the same strings repeat, as the keys of a configuration, and
+	// more so with a parser that is reused with Reset. At most 4096
+	// different scalars, of up to 64 bytes, are kept.
+	Intern bool
+
+	// buf is the buffer where String, Token and Quoted collect the bytes of
+	// a scalar, reused from one scalar to the next.
+	buf []byte
+
+	// interned holds the values stored for the scalars seen, if Intern is
+	// set: strings already converted to interface{}, so that reusing one
+	// doesn't allocate.
+	interned map[string]interface{}
+}
+
+// maxInterned is the maximum number of scalars kept by Parser.Intern, and
+// maxInternedLen their maximum length.
+const (
+	maxInterned    = 4096
+	maxInternedLen = 64
+)
+
+// Kinds of ParseEvent.
+const (
+	ParseStart = iota
+	ParseLine
+	ParseError
+	ParseEnd
+)
+
+// ParseEvent describes a point in the parse reported to Parser.Hook.
+type ParseEvent struct {
+	// Kind is one of ParseStart, ParseLine, ParseError, ParseEnd.
+	Kind int
+	// Line is the line number in the input.
+	Line int
+	// Indent is the indentation found for a line (ParseLine).
+	Indent int
+	// Level is the nesting level assigned to a line (ParseLine).
+	Level int
+	// Err is the error found (ParseError).
+	Err error
+}
+
+// newParser creates a parser that reads from the given stream.
+func newParser(r io.ByteReader) *Parser {
+	return &Parser{in: r, ev: NewEventHandler(), ind: make([]int, 32), lineInd: make([]int, 32), line: 1, MaxDepth: 1000, TabWidth: 4}
 }
 
 // NewStringParser creates an OGDL parser from a string 
 func NewStringParser(s string) *Parser {
-	return &Parser{strings.NewReader(s), NewEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return newParser(strings.NewReader(s))
 }
 
 // NewParser creates an OGDL parser from a generic io.Reader
 func NewParser(r io.Reader) *Parser {
-	return &Parser{bufio.NewReader(r), NewEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return newParser(bufio.NewReader(r))
 }
 
-// NewFileParser creates an OGDL parser that reads from a file
+// NewFileParser creates an OGDL parser that reads from a file.
+// Gzip compressed files are decompressed transparently.
 func NewFileParser(s string) *Parser {
-	b, err := ioutil.ReadFile(s)
+	b, err := readFile(s)
 	if err != nil || len(b) == 0 {
 		return nil
 	}
 
 	buf := bytes.NewBuffer(b)
-	return &Parser{buf, NewEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return newParser(buf)
+}
+
+// readFile returns the content of a file. If the file starts with the gzip
+// magic number, the decompressed content is returned.
+func readFile(s string) ([]byte, error) {
+	b, err := ioutil.ReadFile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
 }
 
 // NewBytesParser creates an OGDL parser from a []byte source 
 func NewBytesParser(b []byte) *Parser {
 	buf := bytes.NewBuffer(b)
-	return &Parser{buf, NewEventHandler(), make([]int, 32), [2]int{0, 0}, 0, 0, 1, 0}
+	return newParser(buf)
 }
 
 // Parse parses OGDL text contained in a byte array. It returns a *Graph 
@@ -115,6 +267,119 @@ func ParseFile(s string) *Graph {
 	return p.Graph()
 }
 
+// FromString parses OGDL text from a string, like FromReader.
+func FromString(s string) (*Graph, error) {
+	return FromReader(strings.NewReader(s))
+}
+
+// FromFile parses the OGDL text of a file, like FromReader. Gzip
+// compressed files are decompressed transparently.
+func FromFile(file string) (*Graph, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	if b, _ := r.Peek(2); len(b) == 2 && b[0] == 0x1f && b[1] == 0x8b {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		return FromReader(z)
+	}
+	return FromReader(r)
+}
+
+// FromReader parses OGDL text read from r, which is buffered, so that large
+// inputs are not read in memory first. It returns the graph and the first
+// syntax or read error, if any. A UTF-8 byte order mark at the start is
+// skipped. An empty input gives an empty graph, with a nil root.
+func FromReader(r io.Reader) (*Graph, error) {
+
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	if b, _ := br.Peek(3); bytes.Equal(b, []byte("\xef\xbb\xbf")) {
+		br.Discard(3)
+	}
+
+	in := &errByteReader{r: br}
+	p := newParser(in)
+	err := p.Ogdl()
+	if in.err != nil {
+		return nil, in.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	g := p.Graph()
+	if g == nil {
+		g = NilGraph()
+	}
+	return g, nil
+}
+
+// errByteReader keeps the first read error other than io.EOF, which the
+// parser takes as the end of the input.
+type errByteReader struct {
+	r   io.ByteReader
+	err error
+}
+
+func (b *errByteReader) ReadByte() (byte, error) {
+	c, err := b.r.ReadByte()
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return c, err
+}
+
+// Reset discards the state of a previous parse and makes the parser read
+// from s, so that a Parser can be reused (for example from a sync.Pool).
+// Settings (KeepComments, Escapes, MaxDepth, MaxScalarLen, MaxInputBytes,
+// TabWidth, Hook, Delim, Sizes, Durations, Intern) are kept, and so are
+// event recording, statistics collection and the interned scalars. Graphs
+// returned before Reset are not affected.
+func (p *Parser) Reset(s string) {
+	_, counting := p.in.(*countingReader)
+	p.in = strings.NewReader(s)
+	if counting {
+		p.CollectStats()
+	}
+
+	recording := p.ev.rec != nil
+	gl := p.ev.gl
+	for i := range gl {
+		gl[i] = nil
+	}
+	p.ev = EventHandler{gl: gl[:0]}
+	if recording {
+		p.RecordEvents()
+	}
+
+	for i := range p.ind {
+		p.ind[i] = 0
+	}
+	for i := range p.lineInd {
+		p.lineInd[i] = 0
+	}
+	p.prevIndent = 0
+	p.last = [3]int{}
+	p.lastn = 0
+	p.lastnl = 0
+	p.line = 1
+	p.spaces = 0
+	p.err = nil
+	p.depth = 0
+	p.n = 0
+}
+
 // Graph returns the *Graph object associated with this parser (where root
 // where the OGDL tree is build on).
 func (p *Parser) Graph() *Graph {
@@ -128,6 +393,27 @@ func (p *Parser) GraphTop(s string) *Graph {
 	return p.ev.GraphTop(s)
 }
 
+// RecordEvents makes the parser keep a record of all the events sent to its
+// event handler, in order and with their line numbers. The recording can be
+// obtained with Events(), stored, and converted back into the parsed Graph
+// with ReplayEvents().
+func (p *Parser) RecordEvents() {
+	p.ev.rec = NilGraph()
+	p.ev.line = &p.line
+}
+
+// Events returns the events recorded since RecordEvents was called, or nil.
+func (p *Parser) Events() *Graph {
+	return p.ev.rec
+}
+
+// Err returns the first error found while parsing, such as an unterminated
+// quoted string or a limit exceeded. It is useful after productions that
+// don't return errors, as Path() or Expression().
+func (p *Parser) Err() error {
+	return p.err
+}
+
 // NextByteIs tests if the next character in the
 // stream is the one given as parameter, in which
 // case it is consumed.
@@ -150,8 +436,16 @@ func (p *Parser) Read() int {
 		p.lastn--
 		c = p.last[p.lastn]
 	} else {
-		i, _ := p.in.ReadByte()
+		i, err := p.in.ReadByte()
 		c = int(i)
+		if err == nil {
+			p.n++
+			if p.MaxInputBytes > 0 && p.n > p.MaxInputBytes {
+				p.limit(fmt.Sprintf("input longer than %d bytes", p.MaxInputBytes))
+				c = 0
+			}
+		}
+		p.last[2] = p.last[1]
 		p.last[1] = p.last[0]
 		p.last[0] = c
 	}
@@ -167,12 +461,13 @@ func (p *Parser) Read() int {
 }
 
 // Unread puts the last readed character back into the stream.
-// Up to two consecutive Unread()'s can be issued.
-//
-// BUG: line-- if newline
+// Up to three consecutive Unread()'s can be issued.
 func (p *Parser) Unread() {
 	p.lastn++
 	p.lastnl--
+	if p.lastn <= len(p.last) && p.last[p.lastn-1] == 10 {
+		p.line--
+	}
 }
 
 // setLevel sets the nesting level for a given indentation (number of spaces)
@@ -182,6 +477,11 @@ func (p *Parser) Unread() {
 // ind[0..lev-1] has increasing n, adjusting n if necessary.
 func (p *Parser) setLevel(lev, n int) {
 
+	// Keep a zero at the end, see getLevel
+	for lev+1 >= len(p.ind) {
+		p.ind = append(p.ind, 0)
+	}
+
 	// Set ind[level] to the number of spaces + 1 (zero is nil)
 	p.ind[lev] = n + 1
 
@@ -200,13 +500,14 @@ func (p *Parser) setLevel(lev, n int) {
 // getLevel returns the nesting level corresponding to the given indentation.
 // This function is used by the line() production for parsing OGDL text.
 // 
-// getLevel returns the level for which ind[level] is equal or higher than n.
+// getLevel returns the first level for which ind[level] (the number of
+// spaces + 1) is higher than n.
 func (p *Parser) getLevel(n int) int {
 
     l := 0
     
 	for i := 0; i < len(p.ind); i++ {
-		if p.ind[i] >= n {
+		if p.ind[i] > n {
 			return i
 		}
 		if i!=0 && p.ind[i] == 0 {
@@ -220,6 +521,52 @@ func (p *Parser) getLevel(n int) int {
 	return l
 }
 
+// delim returns the character that starts variables in templates.
+func (p *Parser) delim() int {
+	if p.Delim == 0 {
+		return '$'
+	}
+	return int(p.Delim)
+}
+
+// enter increments the nesting depth. If MaxDepth is exceeded, an error is
+// returned (and remembered in p.err).
+func (p *Parser) enter() error {
+	p.depth++
+	if p.MaxDepth > 0 && p.depth > p.MaxDepth {
+		return p.limit(fmt.Sprintf("depth exceeded (max %d)", p.MaxDepth))
+	}
+	return nil
+}
+
+// ErrLimitExceeded is wrapped by the errors returned when the input goes
+// beyond one of the limits set in a Parser or BinParser.
+var ErrLimitExceeded = errors.New("parser limit exceeded")
+
+// limit remembers in p.err, unless there is already an error there, that a
+// limit was exceeded, and returns p.err.
+func (p *Parser) limit(msg string) error {
+	if p.err == nil {
+		p.err = fmt.Errorf("%w: %s at line %d", ErrLimitExceeded, msg, p.line)
+	}
+	return p.err
+}
+
+// tooLong returns true, and sets p.err, if a scalar of n bytes is longer
+// than MaxScalarLen.
+func (p *Parser) tooLong(n int) bool {
+	if p.MaxScalarLen > 0 && n > p.MaxScalarLen {
+		p.limit(fmt.Sprintf("scalar longer than %d bytes", p.MaxScalarLen))
+		return true
+	}
+	return false
+}
+
+// leave decrements the nesting depth.
+func (p *Parser) leave() {
+	p.depth--
+}
+
 /* 
   The following functions are public in order for the Parser to be used
   outside of the current package
@@ -230,6 +577,29 @@ func (p *Parser) Emit(s string) {
     p.ev.Add(s)
 }
 
+// emitText sends the scalar in b to the event handler, as a string. b can be
+// the buffer of the parser: it is not kept.
+func (p *Parser) emitText(b []byte) {
+	if !p.Intern || len(b) > maxInternedLen {
+		p.ev.Add(string(b))
+		return
+	}
+
+	// The conversion in the index doesn't allocate
+	v, ok := p.interned[string(b)]
+	if !ok {
+		s := string(b)
+		v = s
+		if p.interned == nil {
+			p.interned = make(map[string]interface{})
+		}
+		if len(p.interned) < maxInterned {
+			p.interned[s] = v
+		}
+	}
+	p.ev.add(v)
+}
+
 // EmitBytes sends a byte array to the event handler
 func (p *Parser) EmitBytes(b []byte) {
     p.ev.AddBytes(b)
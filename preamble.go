@@ -0,0 +1,188 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// TypePreamble is the root node of a preamble object.
+const TypePreamble = "!preamble"
+
+// ErrUnsupportedFeature is wrapped by the *FeatureError returned when a
+// binary stream uses features that the reader doesn't support.
+var ErrUnsupportedFeature = errors.New("unsupported feature")
+
+// Preamble describes the features used by a binary OGDL stream, so that
+// archives can be decoded correctly long after they were written. It is
+// written as the first object of the stream:
+//
+//     !preamble
+//       typed
+//       compression gzip
+//       encryption key-2014
+//       schema 3
+//
+// The features themselves are applied by the application: the preamble
+// only lets readers check that they can decode the stream before they
+// start.
+type Preamble struct {
+	// TypedScalars tells that scalars carry type information.
+	TypedScalars bool
+	// Compression is the codec used, if any.
+	Compression string
+	// KeyID identifies the encryption key used, if any.
+	KeyID string
+	// SchemaVersion is the version of the application schema, if > 0.
+	SchemaVersion int
+	// Unknown holds the features of the preamble that this package doesn't
+	// know, as written by newer versions. They are never supported.
+	Unknown []string
+}
+
+// Capabilities are the features supported by the reader of a binary OGDL
+// stream.
+type Capabilities struct {
+	// TypedScalars tells that the reader decodes typed scalars.
+	TypedScalars bool
+	// Compression lists the codecs supported.
+	Compression []string
+	// KeyIDs lists the encryption keys available.
+	KeyIDs []string
+	// MaxSchemaVersion is the highest schema version supported. Zero means
+	// any.
+	MaxSchemaVersion int
+}
+
+// FeatureError lists the features of a stream that a reader doesn't
+// support.
+type FeatureError struct {
+	Missing []string
+}
+
+func (e *FeatureError) Error() string {
+	return ErrUnsupportedFeature.Error() + ": " + strings.Join(e.Missing, ", ")
+}
+
+func (e *FeatureError) Unwrap() error {
+	return ErrUnsupportedFeature
+}
+
+// Check returns a *FeatureError if the preamble uses features not in c. A
+// nil c supports everything.
+func (c *Capabilities) Check(p *Preamble) error {
+
+	if c == nil || p == nil {
+		return nil
+	}
+
+	var missing []string
+
+	if p.TypedScalars && !c.TypedScalars {
+		missing = append(missing, "typed scalars")
+	}
+	if p.Compression != "" && !contains(c.Compression, p.Compression) {
+		missing = append(missing, "compression "+p.Compression)
+	}
+	if p.KeyID != "" && !contains(c.KeyIDs, p.KeyID) {
+		missing = append(missing, "encryption key "+p.KeyID)
+	}
+	if c.MaxSchemaVersion > 0 && p.SchemaVersion > c.MaxSchemaVersion {
+		missing = append(missing, "schema version "+strconv.Itoa(p.SchemaVersion))
+	}
+	missing = append(missing, p.Unknown...)
+
+	if missing != nil {
+		return &FeatureError{missing}
+	}
+	return nil
+}
+
+func contains(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Graph returns the preamble as a Graph, rooted at a TypePreamble node.
+func (p *Preamble) Graph() *Graph {
+
+	g := NewGraph(TypePreamble)
+	if p.TypedScalars {
+		g.Add("typed")
+	}
+	if p.Compression != "" {
+		g.Add("compression").Add(p.Compression)
+	}
+	if p.KeyID != "" {
+		g.Add("encryption").Add(p.KeyID)
+	}
+	if p.SchemaVersion > 0 {
+		g.Add("schema").Add(p.SchemaVersion)
+	}
+	for _, s := range p.Unknown {
+		g.Add(s)
+	}
+	return g
+}
+
+// preambleOf returns the preamble held by an object, or nil if it is not
+// one.
+func preambleOf(g *Graph) *Preamble {
+
+	if g.Len() != 1 || g.Out[0].String() != TypePreamble {
+		return nil
+	}
+
+	p := &Preamble{}
+	for _, n := range g.Out[0].Out {
+		var v string
+		if n.Len() != 0 {
+			v = n.Out[0].String()
+		}
+		switch n.String() {
+		case "typed":
+			p.TypedScalars = true
+		case "compression":
+			p.Compression = v
+		case "encryption":
+			p.KeyID = v
+		case "schema":
+			p.SchemaVersion, _ = strconv.Atoi(v)
+		default:
+			p.Unknown = append(p.Unknown, n.String())
+		}
+	}
+	return p
+}
+
+// BinaryOptions control how BinaryTo writes a Graph.
+type BinaryOptions struct {
+	// Preamble, if not nil, is written before the graph.
+	Preamble *Preamble
+}
+
+// BinaryTo writes the graph to w as a binary OGDL stream, as WriteBinary
+// does, preceded by a preamble if opts has one. opts can be nil. It returns
+// the number of bytes written.
+func (g *Graph) BinaryTo(w io.Writer, opts *BinaryOptions) (int, error) {
+
+	n := 0
+	if opts != nil && opts.Preamble != nil {
+		var err error
+		if n, err = opts.Preamble.Graph().WriteBinary(w); err != nil {
+			return n, err
+		}
+	}
+
+	m, err := g.WriteBinary(w)
+	return n + m, err
+}
@@ -7,6 +7,9 @@ package ogdl
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // Ogdl is the main function for parsing OGDL text.
@@ -18,9 +21,19 @@ import (
 //     Graph ::= Line* End
 func (p *Parser) Ogdl() error {
 
+	if p.Hook != nil {
+		p.Hook(ParseEvent{Kind: ParseStart, Line: p.line})
+	}
+
 	for {
 		more, err := p.Line()
+		if err == nil && !more {
+			err = p.err
+		}
 		if err != nil {
+			if p.Hook != nil {
+				p.Hook(ParseEvent{Kind: ParseError, Line: p.line, Err: err})
+			}
 			return err
 		}
 		if !more {
@@ -29,6 +42,10 @@ func (p *Parser) Ogdl() error {
 	}
 	p.End()
 
+	if p.Hook != nil {
+		p.Hook(ParseEvent{Kind: ParseEnd, Line: p.line})
+	}
+
 	return nil
 }
 
@@ -61,12 +78,8 @@ func (p *Parser) Ogdl() error {
 //
 func (p *Parser) Line() (bool, error) {
 
-	sp, n := p.Space()
-
-	// if a line begins with non-uniform space, throw a syntax error.
-	if sp && n == 0 {
-		errors.New("non-uniform space")
-	}
+	_, n := p.Space()
+	line := p.line
 
 	if p.End() {
 		return false, nil
@@ -81,15 +94,22 @@ func (p *Parser) Line() (bool, error) {
 	l := p.getLevel(n)
 	p.ev.SetLevel(l)
 
+	if p.Hook != nil {
+		p.Hook(ParseEvent{Kind: ParseLine, Line: p.line, Indent: n, Level: l})
+	}
+
 	// Now we can expect a sequence of scalars, groups, and finally
 	// a block or comment.
 
+	// empty is true while nothing but comments or spaces are found
+	empty := true
+
 	for {
 
 		gr, err := p.Group()
 
 		if gr {
-
+			empty = false
 		} else if err != nil {
 			return false, err
 		} else if p.Comment() {
@@ -99,16 +119,25 @@ func (p *Parser) Line() (bool, error) {
 		} else {
 			s, ok := p.Block()
 
+			if p.err != nil {
+				return false, p.err
+			}
 			if ok {
 				p.ev.Add(s)
+				empty = false
 				p.Break()
 				break
 			} else {
-				b, ok := p.Scalar()
-				if ok {
-					p.ev.Add(b)
+				if p.scalar() {
+					empty = false
+				} else if p.err != nil {
+					return false, p.err
 				} else {
-					p.Break()
+					if !p.Break() && !p.End() {
+						// Nothing can start here, as a closing ')' without
+						// a group.
+						return false, fmt.Errorf("unexpected %q at line %d", rune(p.Read()), p.line)
+					}
 					break
 				}
 			}
@@ -127,6 +156,29 @@ func (p *Parser) Line() (bool, error) {
 
 	}
 
+	// With KeepComments, empty and comment lines don't define indentation,
+	// so that comment nodes are never parents
+	if empty && p.KeepComments {
+		return true, nil
+	}
+
+	if p.MaxDepth > 0 && p.ev.Level() > p.MaxDepth {
+		return false, p.limit(fmt.Sprintf("depth exceeded (max %d)", p.MaxDepth))
+	}
+
+	// A line that goes back to a previous level must be indented as the
+	// line that opened it. Otherwise the level is ambiguous.
+	if n < p.prevIndent && l > 0 && l < len(p.lineInd) && p.lineInd[l] != n+1 {
+		return false, fmt.Errorf("inconsistent indentation at line %d", line)
+	}
+	p.prevIndent = n
+	if l < len(p.lineInd) {
+		p.lineInd[l] = n + 1
+		for i := l + 1; i < len(p.lineInd); i++ {
+			p.lineInd[i] = 0
+		}
+	}
+
     // Set the indentation to level rules for subsequent lines
 	p.setLevel(l,n)
 	p.setLevel(p.ev.Level(),n+1)
@@ -138,7 +190,7 @@ func (p *Parser) Line() (bool, error) {
 //
 //     path ::= element ('.' element)*
 //
-//     element ::= token | integer | quoted | group | index | selector
+//     element ::= token | integer | quoted | '*' | group | index | selector
 //
 //     (Dot optional before Group, Index, Selector)
 //
@@ -146,6 +198,8 @@ func (p *Parser) Line() (bool, error) {
 //     index := '[' Expression ']'
 //     selector := '{' Expression '}'
 //
+// A '*' element, which matches any node (see Get), is added as TypeAny.
+//
 // The OGDL parser doesn't need to know about Unicode. The character
 // classification relies on values < 127, thus in the ASCII range,
 // which is also part of Unicode.
@@ -158,7 +212,7 @@ func (p *Parser) Path() bool {
 	c := p.Read()
 	p.Unread()
 
-	if !IsLetter(c) {
+	if !IsLetter(c) && c != '"' && c != '\'' && c != '`' && c != '*' {
 		return false
 	}
 
@@ -210,6 +264,12 @@ func (p *Parser) Path() bool {
 			continue
 		}
 
+		if p.NextByteIs('*') {
+			p.ev.Add(TypeAny)
+			anything = true
+			continue
+		}
+
 		if p.Index() {
 			anything = true
 			continue
@@ -265,12 +325,10 @@ func (p *Parser) Sequence() (bool, bool, error) {
 		} else if err != nil {
 			return false, false, err
 		} else {
-			b, ok := p.Scalar()
-			if !ok {
-				return n > 0, wasGroup, nil
+			if !p.scalar() {
+				return n > 0, wasGroup, p.err
 			}
 			wasGroup = false
-			p.ev.Add(b)
 		}
 
 		n++
@@ -297,11 +355,18 @@ func (p *Parser) Group() (bool, error) {
 		return false, nil
 	}
 
+	if err := p.enter(); err != nil {
+		return false, err
+	}
+	defer p.leave()
+
 	i := p.ev.Level()
 
     p.WhiteSpace()
 
-	p.Sequence()
+	if _, _, err := p.Sequence(); err != nil {
+		return false, err
+	}
 
 	p.WhiteSpace()
 
@@ -323,30 +388,71 @@ func (p *Parser) Scalar() (string, bool) {
 	return p.String()
 }
 
-// Comment consumes anything from # up to the end of the line.
+// scalar parses a Scalar and adds it to the graph. Unquoted strings are
+// added as a Size or a Duration if they are one, and p.Sizes or p.Durations
+// is set.
+func (p *Parser) scalar() bool {
+
+	b, ok := p.quoted()
+	if ok {
+		p.emitText(b)
+		return true
+	}
+
+	b, ok = p.text()
+	if !ok {
+		return false
+	}
+
+	if p.Sizes || p.Durations {
+		s := string(b)
+		p.ev.Add(s)
+		if v := p.unit(s); v != nil {
+			p.ev.setValue(v)
+		}
+		return true
+	}
+
+	p.emitText(b)
+	return true
+}
+
+// Comment consumes anything from # up to the end of the line, including the
+// line break unless p.KeepComments is set.
+//
+// If p.KeepComments is set, the comment text (what follows the '#') is added
+// to the graph as the subnode of a TypeComment node, at the current level:
+// a comment on its own line is placed at the level given by its indentation,
+// and a comment after some scalars is placed under the last one of them.
+// Comment nodes never become parents of the nodes that follow.
 //
 // BUG(): Special cases: #?, #{
 //
 func (p *Parser) Comment() bool {
 	c := p.Read()
 
-	if c == '#' {
-		for {
-			c = p.Read()
-			if IsEndChar(c) || IsBreakChar(c) {
-				break
-			}
-			if c == 13 {
-				c := p.Read()
-				if c != 10 {
-					p.Unread()
-				}
+	if c != '#' {
+		p.Unread()
+		return false
+	}
+
+	buf := make([]byte, 0, 16)
+
+	for {
+		c = p.Read()
+		if IsEndChar(c) || IsBreakChar(c) {
+			if p.KeepComments {
+				p.Unread()
 			}
+			break
 		}
-		return true
+		buf = append(buf, byte(c))
 	}
-	p.Unread()
-	return false
+
+	if p.KeepComments {
+		p.ev.AddComment(string(buf))
+	}
+	return true
 }
 
 // String is a concatenation of characters that are > 0x20
@@ -356,20 +462,29 @@ func (p *Parser) Comment() bool {
 // a comment it must be preceeded by break or space, or come
 // after a closing ')'.
 //
+// Backslashes are ordinary text characters here and are never interpreted,
+// so values such as C:\Users\x can be written unquoted.
+//
 // TOTHINK: Many productions return a string and not []byte, which could be
 // more efficient, but has no type information: []byte can be a raw binary or
 // a string.
 func (p *Parser) String() (string, bool) {
+	b, ok := p.text()
+	return string(b), ok
+}
+
+// text is String, returning the bytes in the buffer of the parser, which
+// are valid until the next scalar is read.
+func (p *Parser) text() ([]byte, bool) {
 
 	c := p.Read()
 
 	if !IsTextChar(c) || c == '#' {
 		p.Unread()
-		return "", false
+		return nil, false
 	}
 
-	buf := make([]byte, 1, 16)
-	buf[0] = byte(c)
+	buf := append(p.buf[:0], byte(c))
 
 	for {
 		c = p.Read()
@@ -378,21 +493,67 @@ func (p *Parser) String() (string, bool) {
 			break
 		}
 		buf = append(buf, byte(c))
+		if p.tooLong(len(buf)) {
+			return nil, false
+		}
 	}
 
-	return string(buf), true
+	p.buf = buf
+	return buf, true
 }
 
 // Quoted string. Can have newlines in it.
+//
+// Only \" and \' are treated as escapes; any other backslash is kept as is,
+// so quoted Windows paths are read literally. If p.Escapes is set, the
+// sequences handled by escape() are decoded too.
+//
+// A string between backticks is raw: backslashes are never escapes, and it
+// cannot contain a backtick.
+//
+// A string between triple quotes (""" or ''') is raw too, and can contain
+// single quotes of both kinds, as in shell commands or code. If the text
+// starts on the line after the opening quotes, that line break, and the line
+// of the closing quotes if they are alone on it, are not part of the string,
+// and the indentation common to its lines is removed:
+//
+//     script """
+//       grep -E '^a|"b"$' x.txt
+//         && echo \done
+//       """
+//
+// is the string grep -E '^a|"b"$' x.txt\n  && echo \done. Otherwise the
+// text is taken as is. More than three quotes at the end belong to the
+// string, except the last three.
 func (p *Parser) Quoted() (string, bool) {
+	b, ok := p.quoted()
+	return string(b), ok
+}
+
+// quoted is Quoted, returning the bytes in the buffer of the parser, which
+// are valid until the next scalar is read.
+func (p *Parser) quoted() ([]byte, bool) {
 
 	cs := p.Read()
-	if cs != '"' && cs != '\'' {
+	if cs != '"' && cs != '\'' && cs != '`' {
 		p.Unread()
-		return "", false
+		return nil, false
 	}
 
-	buf := make([]byte, 0, 16)
+	buf := p.buf[:0]
+
+	// Triple quotes, or an empty string
+	if cs != '`' {
+		if c := p.Read(); c != cs {
+			p.Unread()
+		} else if c = p.Read(); c == cs {
+			return p.triple(cs)
+		} else {
+			p.Unread()
+			p.buf = buf
+			return buf, true
+		}
+	}
 
 	// p.lastnl is the indentation of this quoted string
 	lnl := p.lastnl
@@ -403,6 +564,33 @@ func (p *Parser) Quoted() (string, bool) {
 		if c == cs {
 			break
 		}
+		if IsEndChar(c) {
+			if p.err == nil {
+				p.err = fmt.Errorf("unterminated quoted string at line %d", p.line)
+			}
+			return nil, false
+		}
+		if p.tooLong(len(buf)) {
+			return nil, false
+		}
+
+		if c == '\\' && cs != '`' {
+			c = p.Read()
+			if p.Escapes {
+				b, err := p.escape(c)
+				if err != nil {
+					p.err = err
+					return nil, false
+				}
+				if b != nil {
+					buf = append(buf, b...)
+					continue
+				}
+			}
+			if c != '"' && c != '\'' {
+				buf = append(buf, '\\')
+			}
+		}
 
 		buf = append(buf, byte(c))
 
@@ -412,17 +600,207 @@ func (p *Parser) Quoted() (string, bool) {
 			for ; n-lnl > 0; n-- {
 				buf = append(buf, ' ')
 			}
-		} else if c == '\\' {
-			c = p.Read()
-			if c != '"' && c != '\'' {
-				buf = append(buf, '\\')
-			}
-			buf = append(buf, byte(c))
 		}
 	}
 
+	if p.tooLong(len(buf)) {
+		return nil, false
+	}
+
 	// May have zero length
-	return string(buf), true
+	p.buf = buf
+	return buf, true
+}
+
+// triple returns the text of a string between triple quotes, after the
+// opening ones, which are cs.
+func (p *Parser) triple(cs int) ([]byte, bool) {
+
+	buf := p.buf[:0]
+
+	// Quotes at the end of buf
+	n := 0
+
+	for {
+		c := p.Read()
+		if IsEndChar(c) {
+			if p.err == nil {
+				p.err = fmt.Errorf("unterminated quoted string at line %d", p.line)
+			}
+			return nil, false
+		}
+		buf = append(buf, byte(c))
+		if p.tooLong(len(buf)) {
+			return nil, false
+		}
+
+		if c != cs {
+			n = 0
+			continue
+		}
+		if n++; n < 3 {
+			continue
+		}
+
+		// The closing quotes are the last three
+		if c = p.Read(); c != cs {
+			p.Unread()
+			break
+		}
+		p.Unread()
+	}
+
+	buf = buf[:len(buf)-3]
+	if len(buf) > 0 && buf[0] == '\n' {
+		buf = dedent(buf[1:])
+	}
+	p.buf = buf
+	return buf, true
+}
+
+// dedent removes the line of the closing quotes from the text of a string
+// between triple quotes, if it is blank, and the indentation common to the
+// lines that are not. It works in place.
+func dedent(b []byte) []byte {
+
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 && isBlankLine(b[i+1:]) {
+		b = b[:i]
+	} else if i < 0 && isBlankLine(b) {
+		return b[:0]
+	}
+
+	lines := bytes.Split(b, []byte{'\n'})
+
+	var prefix []byte
+	first := true
+	for _, l := range lines {
+		if isBlankLine(l) {
+			continue
+		}
+		k := 0
+		for k < len(l) && IsSpaceChar(int(l[k])) {
+			k++
+		}
+		if first {
+			prefix, first = l[:k], false
+			continue
+		}
+		k = 0
+		for k < len(prefix) && k < len(l) && prefix[k] == l[k] {
+			k++
+		}
+		prefix = prefix[:k]
+	}
+
+	r := b[:0]
+	for i, l := range lines {
+		if i > 0 {
+			r = append(r, '\n')
+		}
+		if isBlankLine(l) {
+			l = bytes.TrimLeft(l, " \t")
+		} else {
+			l = l[len(prefix):]
+		}
+		r = append(r, l...)
+	}
+	return r
+}
+
+// isBlankLine returns true if l only has spaces, tabs or a carriage return.
+func isBlankLine(l []byte) bool {
+	for _, c := range l {
+		if c != ' ' && c != '\t' && c != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// escape decodes the escape sequence found after a backslash in a quoted
+// string, c being the character following the backslash. It returns nil
+// for sequences that are not escapes (they are kept literally), and an error
+// if a \u or \x sequence is not followed by enough hexadecimal digits.
+// Characters outside the BMP are written as UTF-16 surrogate pairs, as in
+// JSON.
+func (p *Parser) escape(c int) ([]byte, error) {
+
+	switch c {
+	case 'n':
+		return []byte{'\n'}, nil
+	case 't':
+		return []byte{'\t'}, nil
+	case 'r':
+		return []byte{'\r'}, nil
+	case '\\', '"', '\'':
+		return []byte{byte(c)}, nil
+	case 'x':
+		r, err := p.hex(2, c)
+		if err != nil {
+			return nil, err
+		}
+		return encodeRune(nil, r), nil
+	case 'u':
+		r, err := p.hex(4, c)
+		if err != nil || !utf16.IsSurrogate(r) || r >= 0xdc00 {
+			return encodeRune(nil, r), err
+		}
+
+		// A high surrogate must be followed by a low one, as in
+		// \ud83d\ude00. Otherwise it is invalid, and replaced by U+FFFD.
+		if p.Read() != '\\' {
+			p.Unread()
+			return encodeRune(nil, utf8.RuneError), nil
+		}
+		if p.Read() != 'u' {
+			p.Unread()
+			p.Unread()
+			return encodeRune(nil, utf8.RuneError), nil
+		}
+		r2, err := p.hex(4, c)
+		if err != nil {
+			return nil, err
+		}
+		if pair := utf16.DecodeRune(r, r2); pair != utf8.RuneError {
+			return encodeRune(nil, pair), nil
+		}
+		return encodeRune(encodeRune(nil, utf8.RuneError), r2), nil
+	}
+
+	return nil, nil
+}
+
+// hex reads the n hexadecimal digits of a \x or \u escape.
+func (p *Parser) hex(n int, c int) (rune, error) {
+	r := 0
+	for i := 0; i < n; i++ {
+		d := hexValue(p.Read())
+		if d < 0 {
+			return 0, fmt.Errorf("invalid \\%c escape at line %d", c, p.line)
+		}
+		r = r<<4 | d
+	}
+	return rune(r), nil
+}
+
+// encodeRune appends the UTF-8 encoding of r to b. Surrogates are encoded
+// as U+FFFD.
+func encodeRune(b []byte, r rune) []byte {
+	var u [utf8.UTFMax]byte
+	return append(b, u[:utf8.EncodeRune(u[:], r)]...)
+}
+
+// hexValue returns the value of an hexadecimal digit, or -1.
+func hexValue(c int) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return -1
 }
 
 // Block ::= '\\' NL LINES_OF_TEXT
@@ -456,7 +834,7 @@ func (p *Parser) Block() (string, bool) {
 		panic("")
 	}
 
-	buffer := &bytes.Buffer{}
+	buf := p.buf[:0]
 
 	j := ns
 
@@ -475,7 +853,10 @@ func (p *Parser) Block() (string, bool) {
 		for {
 			c = p.Read()
 
-			buffer.WriteByte(byte(c))
+			buf = append(buf, byte(c))
+			if p.tooLong(len(buf)) {
+				return "", false
+			}
 			if c == 13 {
 				continue
 			}
@@ -490,12 +871,13 @@ func (p *Parser) Block() (string, bool) {
 
 	// Remove trailing NL
 	if c == 10 {
-		if buffer.Len() > 0 {
-			buffer.Truncate(buffer.Len() - 1)
+		if len(buf) > 0 {
+			buf = buf[:len(buf)-1]
 		}
 	}
 
-	return buffer.String(), true
+	p.buf = buf
+	return string(buf), true
 }
 
 // Break is NL, CR or CR+NL
@@ -534,7 +916,9 @@ func (p *Parser) WhiteSpace() bool {
 
 // Space is (0x20|0x09)+. It returns a boolean indicating
 // if space has been found, and an integer indicating
-// how many spaces, iff uniform (either all 0x20 or 0x09)
+// how many columns it spans: each space counts as one column
+// and each tab as TabWidth columns, so that mixed indentation
+// is measured consistently.
 func (p *Parser) Space() (bool, int) {
 
 	// The Block() production eats to many spaces trying to
@@ -551,22 +935,17 @@ func (p *Parser) Space() (bool, int) {
 		return false, 0
 	}
 
-	n := 1
-
-	// We keep 'c' to tell us what spaces will count as uniform.
+	n := 0
 
-	for {
-		cs := p.Read()
-		if cs != 32 && cs != 9 {
-			p.Unread()
-			break
-		}
-		if n != 0 && cs == c {
-			n++
+	for c == 32 || c == 9 {
+		if c == 9 && p.TabWidth > 1 {
+			n += p.TabWidth
 		} else {
-			n = 0
+			n++
 		}
+		c = p.Read()
 	}
+	p.Unread()
 
 	return true, n
 }
@@ -616,8 +995,7 @@ func (p *Parser) Token() (string, bool) {
 		return "", false
 	}
 
-	buf := make([]byte, 1, 16)
-	buf[0] = byte(c)
+	buf := append(p.buf[:0], byte(c))
 
 	for {
 		c = p.Read()
@@ -626,13 +1004,18 @@ func (p *Parser) Token() (string, bool) {
 			break
 		}
 		buf = append(buf, byte(c))
+		if p.tooLong(len(buf)) {
+			return "", false
+		}
 	}
 
+	p.buf = buf
 	return string(buf), true
 }
 
 // Number returns true if it finds a number at the current parser position
-// It returns also the number found.
+// It returns also the number found. Hexadecimal (0xff) and scientific
+// (6.022e23) notations are accepted.
 func (p *Parser) Number() (string, bool) {
 
 	c := p.Read()
@@ -654,6 +1037,29 @@ func (p *Parser) Number() (string, bool) {
 	buf := make([]byte, 1, 16)
 	buf[0] = byte(c)
 
+	if c == '-' {
+		c = p.Read()
+		buf = append(buf, byte(c))
+	}
+
+	// Hexadecimal: 0x followed by at least one hex digit
+	if c == '0' {
+		x := p.Read()
+		if x == 'x' || x == 'X' {
+			d := p.Read()
+			if hexValue(d) >= 0 {
+				buf = append(buf, byte(x))
+				for ; hexValue(d) >= 0; d = p.Read() {
+					buf = append(buf, byte(d))
+				}
+				p.Unread()
+				return string(buf), true
+			}
+			p.Unread()
+		}
+		p.Unread()
+	}
+
 	for {
 		c = p.Read()
 		if !IsDigit(c) && c != '.' {
@@ -663,6 +1069,28 @@ func (p *Parser) Number() (string, bool) {
 		buf = append(buf, byte(c))
 	}
 
+	// Exponent: e followed by an optional sign and at least one digit
+	c = p.Read()
+	if c == 'e' || c == 'E' {
+		exp := []byte{byte(c)}
+		d := p.Read()
+		if d == '-' || d == '+' {
+			exp = append(exp, byte(d))
+			d = p.Read()
+		}
+		if IsDigit(d) {
+			buf = append(buf, exp...)
+			for ; IsDigit(d); d = p.Read() {
+				buf = append(buf, byte(d))
+			}
+		} else {
+			for range exp {
+				p.Unread()
+			}
+		}
+	}
+	p.Unread()
+
 	return string(buf), true
 }
 
@@ -695,6 +1123,11 @@ func (p *Parser) Operator() (string, bool) {
 // Expression := expr1 (op2 expr1)*
 //
 func (p *Parser) Expression() bool {
+	if p.enter() != nil {
+		return false
+	}
+	defer p.leave()
+
 	if !p.UnaryExpression() {
 		return false
 	}
@@ -742,14 +1175,25 @@ func (p *Parser) UnaryExpression() bool {
 		return true
 	}
 
+	// A unary operator takes the following unary expression as its operand.
+	// Each one is a level of nesting.
 	b, ok = p.Operator()
 	if ok {
+		if p.enter() != nil {
+			return false
+		}
+		defer p.leave()
+
 		p.ev.Add(b)
+		p.ev.Inc()
+		defer p.ev.Dec()
+		p.Space()
+		return p.UnaryExpression()
 	}
 
 	if p.NextByteIs('(') {
 
-		p.ev.Add(TypeGroup)
+		p.ev.Add(TypeExpression)
 		p.ev.Inc()
 		p.Space()
 		p.Expression()
@@ -767,7 +1211,7 @@ func (p *Parser) Text() bool {
 
 	c := p.Read()
 
-	if !IsTemplateTextChar(c) {
+	if !isTemplateTextChar(c, p.delim()) {
 		p.Unread()
 		return false
 	}
@@ -777,7 +1221,7 @@ func (p *Parser) Text() bool {
 
 	for {
 		c := p.Read()
-		if !IsTemplateTextChar(c) {
+		if !isTemplateTextChar(c, p.delim()) {
 
 			p.Unread()
 			break
@@ -789,19 +1233,20 @@ func (p *Parser) Text() bool {
 	return true
 }
 
-// Variable parses variables in a template. They begin with $.
+// Variable parses variables in a template. They begin with $ (or
+// p.Delim).
 func (p *Parser) Variable() bool {
 
 	c := p.Read()
 
-	if c != '$' {
+	if c != p.delim() {
 		p.Unread()
 		return false
 	}
 
 	c = p.Read()
 	if c == '\\' {
-		p.ev.Add("$")
+		p.ev.Add(string(rune(p.delim())))
 		return true
 	} 
 	
@@ -825,6 +1270,10 @@ func (p *Parser) Variable() bool {
 			p.Space()
 		}
 		p.Path()
+		if c == '{' {
+			p.Space()
+		}
+		p.filter(i)
 		if c == '{' {
 			p.Space()
 			p.Read() // Should be '}'
@@ -838,13 +1287,58 @@ func (p *Parser) Variable() bool {
 
 }
 
+// filter parses the output filter that can follow the path of a variable,
+// as in $path|html, and adds it below the path node, which is at level i.
+// A '|' not followed by the name of a filter is text.
+func (p *Parser) filter(i int) {
+
+	if !p.NextByteIs('|') {
+		return
+	}
+
+	var b []byte
+	for {
+		c := p.Read()
+		if c < 'a' || c > 'z' {
+			p.Unread()
+			break
+		}
+		b = append(b, byte(c))
+	}
+
+	name := string(b)
+	if templateFilters[name] == nil {
+		p.ev.SetLevel(i)
+		p.ev.Add("|" + name)
+		return
+	}
+
+	p.ev.SetLevel(i + 1)
+	p.ev.Add(TypeFilter)
+	p.ev.Inc()
+	p.ev.Add(name)
+}
+
 // Index ::= '[' expression ']'
+//
+// An index that is a quoted string, as in ["example.com"], is a key: it is
+// added as a path element, as if written ."example.com".
 func (p *Parser) Index() bool {
 
 	if !p.NextByteIs('[') {
 		return false
 	}
 
+	p.Space()
+	if s, ok := p.Quoted(); ok {
+		p.Space()
+		if !p.NextByteIs(']') {
+			return false // error
+		}
+		p.ev.Add(s)
+		return true
+	}
+
 	i := p.ev.Level()
 
 	p.ev.Add(TypeIndex)
@@ -895,6 +1389,11 @@ func (p *Parser) Args() (bool, error) {
 		return false, nil
 	}
 
+	if err := p.enter(); err != nil {
+		return false, err
+	}
+	defer p.leave()
+
 	i := p.ev.Level()
 
 	p.ev.Add(TypeGroup)
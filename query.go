@@ -0,0 +1,81 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// OutputFormat selects how Query renders its result.
+type OutputFormat int
+
+const (
+	// FormatText renders the result as OGDL text.
+	FormatText OutputFormat = iota
+	// FormatJSON renders the result as JSON.
+	FormatJSON
+	// FormatRaw renders only the scalar value of the result, or one scalar
+	// per line if the path matches several nodes.
+	FormatRaw
+)
+
+// Errors returned by Query. They can be checked with errors.Is.
+var (
+	ErrSyntax   = errors.New("syntax error")
+	ErrNotFound = errors.New("not found")
+)
+
+// Query parses the OGDL text read from src, applies the given path to it
+// and returns the result in the format requested. A path equal to "." selects
+// the complete input.
+//
+// Parse failures are reported as ErrSyntax, and paths that don't resolve
+// as ErrNotFound (both wrapped, use errors.Is).
+func Query(src io.Reader, path string, format OutputFormat) ([]byte, error) {
+
+	p := NewParser(src)
+	if err := p.Ogdl(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSyntax, err)
+	}
+
+	g := p.Graph()
+	r := g
+
+	if path != "." {
+		r = g.Get(path)
+	}
+	if r == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, path)
+	}
+
+	// A transparent root holds a list of results.
+	nodes := []*Graph{r}
+	if r.IsNil() {
+		nodes = r.Out
+	}
+
+	buf := &bytes.Buffer{}
+
+	switch format {
+	case FormatText:
+		buf.WriteString(r.Text())
+	case FormatJSON:
+		writeJSONValue(buf, nodes)
+	case FormatRaw:
+		for i, n := range nodes {
+			if i > 0 {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(n.String())
+		}
+	default:
+		return nil, errors.New("unknown output format")
+	}
+
+	return buf.Bytes(), nil
+}
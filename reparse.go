@@ -0,0 +1,220 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ParseResult holds a parsed OGDL document together with its text and the
+// position of its top-level blocks, so that it can be re-parsed
+// incrementally with Parser.Reparse.
+//
+// A top-level block is a line that starts at column 0 plus all the lines
+// that follow it and are indented, empty or comments.
+type ParseResult struct {
+	// Graph is the parsed document. Its root is a nil node.
+	Graph *Graph
+	// Text is the source the Graph was parsed from.
+	Text []byte
+
+	blocks []parseBlock
+}
+
+// parseBlock is the position of a top-level block in ParseResult.Text, and
+// the number of top-level nodes it produced.
+type parseBlock struct {
+	start, end int
+	line       int
+	nodes      int
+}
+
+// Edit describes a change to a text: Removed bytes at Offset are replaced by
+// Inserted.
+type Edit struct {
+	Offset   int
+	Removed  int
+	Inserted []byte
+}
+
+// ParseText parses a complete OGDL document and returns a ParseResult that
+// can be later passed to Reparse. The parser is only used for its settings
+// (KeepComments, Escapes, MaxDepth, MaxScalarLen, MaxInputBytes, TabWidth);
+// its own input is not read.
+func (p *Parser) ParseText(text []byte) (*ParseResult, error) {
+
+	blocks, nodes, err := p.parseBlocks(text, 0, 1, len(text))
+	if err != nil {
+		return nil, err
+	}
+
+	g := NilGraph()
+	g.Out = nodes
+
+	return &ParseResult{Graph: g, Text: text, blocks: blocks}, nil
+}
+
+// Reparse applies an edit to the text of a previous result and parses only
+// the top-level blocks touched by it, reusing the rest of the previous
+// graph. The result is equal to a full parse of the new text. Unchanged
+// top-level nodes are shared between prev and the new result.
+//
+// If the edit changes where blocks begin beyond the affected region (for
+// example by opening a quoted string that spans the following blocks) the
+// whole text is parsed again.
+func (p *Parser) Reparse(prev *ParseResult, edit Edit) (*ParseResult, error) {
+
+	if edit.Offset < 0 || edit.Removed < 0 || edit.Offset+edit.Removed > len(prev.Text) {
+		return nil, errors.New("edit out of range")
+	}
+
+	text := make([]byte, 0, len(prev.Text)-edit.Removed+len(edit.Inserted))
+	text = append(text, prev.Text[:edit.Offset]...)
+	text = append(text, edit.Inserted...)
+	text = append(text, prev.Text[edit.Offset+edit.Removed:]...)
+
+	blocks := prev.blocks
+	if len(blocks) == 0 {
+		return p.ParseText(text)
+	}
+
+	// First affected block: the one ending at or after the edit, so that an
+	// edit at the start of a block also covers the previous one (an
+	// indented line there would join it).
+	a := len(blocks) - 1
+	for i, b := range blocks {
+		if b.end >= edit.Offset {
+			a = i
+			break
+		}
+	}
+
+	// Last affected block: the one containing the end of the edit.
+	z := len(blocks) - 1
+	for i := a; i < len(blocks); i++ {
+		if blocks[i].end > edit.Offset+edit.Removed {
+			z = i
+			break
+		}
+	}
+
+	delta := len(edit.Inserted) - edit.Removed
+	start := blocks[a].start
+	stop := blocks[z].end + delta
+
+	nb, nodes, err := p.parseBlocks(text, start, blocks[a].line, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	// The region must end where the next unchanged block begins
+	if len(nb) > 0 && nb[len(nb)-1].end != stop {
+		return p.ParseText(text)
+	}
+
+	before, old := 0, 0
+	for _, b := range blocks[:a] {
+		before += b.nodes
+	}
+	for _, b := range blocks[a : z+1] {
+		old += b.nodes
+	}
+
+	out := make([]*Graph, 0, len(prev.Graph.Out)-old+len(nodes))
+	out = append(out, prev.Graph.Out[:before]...)
+	out = append(out, nodes...)
+	out = append(out, prev.Graph.Out[before+old:]...)
+
+	lines := bytes.Count(text[start:stop], []byte{'\n'}) - bytes.Count(prev.Text[start:blocks[z].end], []byte{'\n'})
+
+	all := make([]parseBlock, 0, len(blocks)-(z-a+1)+len(nb))
+	all = append(all, blocks[:a]...)
+	all = append(all, nb...)
+	for _, b := range blocks[z+1:] {
+		b.start += delta
+		b.end += delta
+		b.line += lines
+		all = append(all, b)
+	}
+
+	g := NilGraph()
+	g.Out = out
+
+	return &ParseResult{Graph: g, Text: text, blocks: all}, nil
+}
+
+// parseBlocks parses text[start:] one top-level block at a time, until a
+// block ends at or after stop. A block that fails to parse is joined with
+// the next one, since quoted strings can span lines.
+func (p *Parser) parseBlocks(text []byte, start, line, stop int) ([]parseBlock, []*Graph, error) {
+
+	if p.MaxInputBytes > 0 && len(text) > p.MaxInputBytes {
+		return nil, nil, fmt.Errorf("%w: input longer than %d bytes", ErrLimitExceeded, p.MaxInputBytes)
+	}
+
+	var blocks []parseBlock
+	var nodes []*Graph
+
+	for start < stop {
+		end := nextBlock(text, start)
+
+		var g *Graph
+		for {
+			q := NewBytesParser(text[start:end])
+			q.line = line
+			q.KeepComments = p.KeepComments
+			q.Escapes = p.Escapes
+			q.MaxDepth = p.MaxDepth
+			q.MaxScalarLen = p.MaxScalarLen
+			q.TabWidth = p.TabWidth
+
+			err := q.Ogdl()
+			if err == nil {
+				g = q.Graph()
+				break
+			}
+			if end == len(text) {
+				return nil, nil, err
+			}
+			end = nextBlock(text, end)
+		}
+
+		b := parseBlock{start: start, end: end, line: line}
+		if g != nil {
+			b.nodes = len(g.Out)
+			nodes = append(nodes, g.Out...)
+		}
+		blocks = append(blocks, b)
+
+		line += bytes.Count(text[start:end], []byte{'\n'})
+		start = end
+	}
+
+	return blocks, nodes, nil
+}
+
+// nextBlock returns the offset of the first line after the one at i that
+// starts a top-level block, or len(text).
+func nextBlock(text []byte, i int) int {
+
+	for {
+		n := bytes.IndexByte(text[i:], '\n')
+		if n < 0 {
+			return len(text)
+		}
+		i += n + 1
+		if i == len(text) {
+			return i
+		}
+
+		switch text[i] {
+		case ' ', '\t', '\r', '\n', '#':
+		default:
+			return i
+		}
+	}
+}
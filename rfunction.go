@@ -5,22 +5,52 @@
 package ogdl
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 // RFunction represents a remote function (also known as a remote procedure
-// call). 
+// call).
+//
+// Connections are kept in a small pool, so that concurrent calls don't wait
+// for each other, and are opened again when the server closes them: a call
+// is retried once on a new connection if the idle one it took cannot be
+// written to, or is closed before any response arrives. Other errors, as
+// timeouts, are returned as they are, since the server may have run the
+// request.
 type RFunction struct {
 	cfg  *Graph
 	host string
 	port string
-	conn *net.TCPConn
+	addr string
+
+	// Timeouts, zero if none
+	dial  time.Duration
+	read  time.Duration
+	write time.Duration
+
+	// idle holds the connections not in use
+	idle chan net.Conn
 }
 
 // NewRFunction opens a connection to a TCP/IP server specified in the
 // Graph supplied. It also makes an initialization call, if the Graph has an
-// 'init' section.
+// 'init' section. The Graph can also have these settings:
+//
+//     timeout 5s
+//     pool 4
+//
+// timeout applies to connecting, writing the request and reading the
+// response. It can also be given separately for each of them, with the
+// subnodes dial, write and read. Durations are written as for
+// time.ParseDuration, or as a number of seconds. pool is the number of
+// idle connections kept (1 by default).
 func NewRFunction(g *Graph) (*RFunction, error) {
 	rf := &RFunction{}
 	rf.cfg = g
@@ -31,43 +61,115 @@ func NewRFunction(g *Graph) (*RFunction, error) {
 // Do not want to collide with init()
 func (rf *RFunction) _init() error {
 
-	rf.cfg.This = nil // XXX
-
 	rf.host, _ = rf.cfg.GetString("host")
 	rf.port, _ = rf.cfg.GetString("port")
+	rf.addr = net.JoinHostPort(rf.host, rf.port)
+
+	t := rf.cfg.Node("timeout")
+	if t != nil {
+		d, err := duration(t.GetAt(0))
+		if err != nil {
+			return err
+		}
+		rf.dial, rf.read, rf.write = d, d, d
+		for _, x := range []struct {
+			name string
+			d    *time.Duration
+		}{{"dial", &rf.dial}, {"read", &rf.read}, {"write", &rf.write}} {
+			if n := t.Node(x.name); n != nil {
+				if *x.d, err = duration(n.GetAt(0)); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
-	addr := rf.host + ":" + rf.port
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	size := 1
+	if n := rf.cfg.Node("pool"); n != nil {
+		size, _ = strconv.Atoi(n.GetAt(0).String())
+		if size < 1 {
+			return fmt.Errorf("invalid pool size %q", n.GetAt(0).String())
+		}
+	}
+	rf.idle = make(chan net.Conn, size)
+
+	conn, err := rf.connect()
 	if err != nil {
 		return err
 	}
+	rf.release(conn)
+	return nil
+}
+
+// duration returns the value of a timeout setting.
+func duration(g *Graph) (time.Duration, error) {
+	if g == nil || g.Len() != 0 {
+		return 0, nil
+	}
+	s := g.String()
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return d, nil
+}
 
-    if rf.conn!=nil {
-        rf.conn.Close()
-    }
-    
-	rf.conn, err = net.DialTCP("tcp", nil, tcpAddr)
+// connect opens a new connection and makes the remote initialization call,
+// if any.
+func (rf *RFunction) connect() (net.Conn, error) {
+
+	conn, err := net.DialTimeout("tcp", rf.addr, rf.dial)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Remote initialization
-	r := rf.cfg.Node("init")
-	if r != nil {
-		rf.Call(r)
+	if r := rf.cfg.Node("init"); r != nil {
+		if _, err = rf.roundTrip(conn, r.Binary()); err != nil {
+			conn.Close()
+			return nil, err
+		}
 	}
-	return nil
+	return conn, nil
 }
 
-// Close the connection to the remote server.
-func (rf *RFunction) Close() {
+// acquire returns an idle connection, or a new one. fresh is true if the
+// connection is new.
+func (rf *RFunction) acquire() (conn net.Conn, fresh bool, err error) {
+	select {
+	case conn = <-rf.idle:
+		return conn, false, nil
+	default:
+		conn, err = rf.connect()
+		return conn, true, err
+	}
+}
 
-	// Remote close
-	rf.Call(NewGraph("close"))
+// release returns a connection to the pool, or closes it if the pool is
+// full.
+func (rf *RFunction) release(conn net.Conn) {
+	select {
+	case rf.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
 
-	// Local close
-	if rf.conn != nil {
-		rf.conn.Close()
+// Close the connections to the remote server.
+func (rf *RFunction) Close() {
+	for {
+		select {
+		case conn := <-rf.idle:
+			// Remote close
+			rf.roundTrip(conn, NewGraph("close").Binary())
+			// Local close
+			conn.Close()
+		default:
+			return
+		}
 	}
 }
 
@@ -109,94 +211,83 @@ func (g *Graph) Send(cfg *Graph) (*Graph, error) {
 // Call makes a remote call. It sends the given Graph in binary format to the server
 // and returns the response Graph.
 func (rf *RFunction) Call(g *Graph) (*Graph, error) {
+	return rf.CallBinary(g.Binary())
+}
+
+// CallBinary makes a remote call. It sends the given Graph in binary format
+// to the server and returns the response Graph. An error node in the
+// response (see ServeRFunction) is returned as a *RemoteError.
+//
+// TODO: Return []byte
+func (rf *RFunction) CallBinary(b []byte) (*Graph, error) {
 
-	b := g.Binary()
 	if b == nil {
 		return nil, nil
 	}
 
-	n, err := rf.conn.Write(b)
-
-	if err != nil || n!=len(b) {
-        rf._init()
-		return rf.call(b)
+	r, err := rf.call(b)
+	if err == nil {
+		err = remoteError(r)
 	}
-
-	p := NewBinParser(rf.conn)
-	
-    c := p.read()
-    if c==-1 {
-        rf._init()
-        return rf.call(b)
-    } 
-    
-    p.unread()
-	
-	r := p.Parse()
-	
-	if r==nil || r.Len()==0 {
-	    return nil, errors.New("nil response")
+	if err != nil {
+		return nil, fmt.Errorf("remote function at %s: %w", rf.addr, err)
 	}
-	return r,nil
+	if r == nil || r.Len() == 0 {
+		return nil, errors.New("nil response")
+	}
+	return r, nil
 }
 
-// CallBinary makes a remote call. It sends the given Graph in binary format 
-// to the server and returns the response Graph.
-//
-// TODO: Return []byte
-func (rf *RFunction) CallBinary(b []byte) (*Graph, error) {
+// call sends b and reads the response, retrying once with a new connection
+// if the idle one used was closed before the request reached the server.
+func (rf *RFunction) call(b []byte) (*Graph, error) {
 
-	if b == nil {
-		return nil, nil
+	for retry := false; ; retry = true {
+		conn, fresh, err := rf.acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		r, again, err := rf.exchange(conn, b)
+		if err == nil {
+			rf.release(conn)
+			return r, nil
+		}
+		conn.Close()
+
+		// A new connection that fails is not retried
+		if retry || fresh || !again {
+			return nil, err
+		}
 	}
+}
+
+// roundTrip writes a request to conn and reads the response.
+func (rf *RFunction) roundTrip(conn net.Conn, b []byte) (*Graph, error) {
+	r, _, err := rf.exchange(conn, b)
+	return r, err
+}
 
-	n, err := rf.conn.Write(b)
+// exchange is roundTrip, telling also if the request can be sent again
+// after an error: when it could not be written, or the connection was
+// closed or reset before any byte of the response arrived.
+func (rf *RFunction) exchange(conn net.Conn, b []byte) (*Graph, bool, error) {
 
-	if err != nil || n!=len(b) {
-        rf._init()
-		return rf.call(b)
+	if rf.write > 0 {
+		conn.SetWriteDeadline(time.Now().Add(rf.write))
 	}
-
-	p := NewBinParser(rf.conn)
-	
-    c := p.read()
-    if c==-1 {
-        rf._init()
-        return rf.call(b)
-    } 
-    p.unread()
-	
-	r := p.Parse()
-	
-	if r==nil || r.Len()==0 {
-	    return nil, errors.New("nil response")
+	if _, err := conn.Write(b); err != nil {
+		return nil, true, err
 	}
-	return r,nil
-}
 
-func (rf *RFunction) call(b []byte) (*Graph, error) {
+	if rf.read > 0 {
+		conn.SetReadDeadline(time.Now().Add(rf.read))
+	}
 
-	n, err := rf.conn.Write(b)
-	if err!=nil {
-	    return nil, err
-	}
-	if n<len(b) {
-	    return nil, errors.New("could not write all bytes")
-	}
-
-	p := NewBinParser(rf.conn)
-	
-    c := p.read()
-    if c==-1 {
-        return nil, errors.New("unexpected EOS")
-    } 
-    
-    p.unread()
-	
-	r := p.Parse()
-	
-	if r==nil || r.Len()==0 {
-	    return nil, errors.New("nil response")
-	}
-	return r,nil
+	r := bufio.NewReader(conn)
+	if _, err := r.Peek(1); err != nil {
+		return nil, err == io.EOF || errors.Is(err, syscall.ECONNRESET), err
+	}
+	g, err := NewBinParser(r).parse()
+	return g, false, err
 }
@@ -0,0 +1,153 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// rfError is the node that a remote function server answers with when a
+// request fails, with the message below it.
+const rfError = "!error"
+
+// RemoteError is returned by RFunction.Call when the server answers with an
+// error node (see ServeRFunction).
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// remoteError returns the error in a response, if it is an error node.
+func remoteError(r *Graph) error {
+	if r.Len() == 1 && r.Out[0].String() == rfError {
+		return &RemoteError{Message: r.Out[0].GetAt(0).String()}
+	}
+	return nil
+}
+
+// ServeRFunction answers the calls of RFunction clients on the connections
+// accepted by l, until l is closed. Each request is decoded and passed to
+// handler, and the Graph returned written back in binary form. Connections
+// stay open for the next request.
+//
+// A request that fails, because it is not valid binary OGDL or handler
+// returns an error (or panics), is answered with an error node, which
+// RFunction.Call returns as a *RemoteError:
+//
+//     !error
+//       message
+//
+// After an invalid request, the rest of the data received with it is
+// discarded, and the connection goes on. The request 'close', sent by
+// RFunction.Close, is answered and the connection closed.
+//
+// When l is closed, the requests being handled are answered, and then the
+// connections are closed. ServeRFunction returns nil then, and the error of
+// Accept if it fails otherwise.
+func ServeRFunction(l net.Listener, handler func(req *Graph) (*Graph, error)) error {
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	conns := map[net.Conn]bool{}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Connections waiting for a request end now, and those in a
+			// call after answering it.
+			mu.Lock()
+			for c := range conns {
+				c.SetReadDeadline(time.Now())
+			}
+			mu.Unlock()
+			wg.Wait()
+
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			serveRFunction(conn, handler)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// serveRFunction answers the requests read from conn, until it is closed or
+// fails.
+func serveRFunction(conn net.Conn, handler func(req *Graph) (*Graph, error)) {
+
+	defer conn.Close()
+
+	p := NewBinParser(conn)
+	p.begun = true
+
+	for {
+		var r *Graph
+
+		req, err := p.parse()
+		switch {
+		case err == nil:
+			if req.Len() == 1 && req.Out[0].String() == "close" && req.Out[0].Len() == 0 {
+				conn.Write(req.Binary())
+				return
+			}
+			r = callHandler(handler, req)
+		case errors.Is(err, ErrInvalidBinary):
+			p.r.Discard(p.r.Buffered())
+			r = errorGraph(err)
+		default:
+			// End of the stream, or the connection failed
+			return
+		}
+
+		if _, err = conn.Write(r.Binary()); err != nil {
+			return
+		}
+	}
+}
+
+// callHandler returns the response of handler to req, or an error node.
+func callHandler(handler func(req *Graph) (*Graph, error), req *Graph) (r *Graph) {
+
+	defer func() {
+		if e := recover(); e != nil {
+			r = errorGraph(fmt.Errorf("panic: %v", e))
+		}
+	}()
+
+	r, err := handler(req)
+	if err != nil {
+		return errorGraph(err)
+	}
+	if r == nil {
+		return NilGraph()
+	}
+	return r
+}
+
+// errorGraph returns the error node sent for err.
+func errorGraph(err error) *Graph {
+	g := NewGraph(rfError)
+	g.Add(err.Error())
+	return g
+}
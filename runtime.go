@@ -0,0 +1,100 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Names of the nodes produced by RuntimeGraph.
+const (
+	RuntimeMem           = "mem"
+	RuntimeAlloc         = "alloc"
+	RuntimeTotalAlloc    = "total_alloc"
+	RuntimeSys           = "sys"
+	RuntimeHeapAlloc     = "heap_alloc"
+	RuntimeHeapSys       = "heap_sys"
+	RuntimeHeapObjects   = "heap_objects"
+	RuntimeNumGC         = "num_gc"
+	RuntimeGoroutines    = "goroutines"
+	RuntimeGoMaxProcs    = "gomaxprocs"
+	RuntimeStartTime     = "start_time"
+	RuntimeUptime        = "uptime"
+	RuntimeBuild         = "build"
+	RuntimeGoVersion     = "go_version"
+	RuntimePath          = "path"
+	RuntimeMain          = "main"
+	RuntimeDeps          = "deps"
+	RuntimeModuleVersion = "version"
+)
+
+// startTime is the time this package was initialized, which is close
+// enough to the process start time.
+var startTime = time.Now()
+
+// RuntimeGraph returns a Graph with information about the running process,
+// suitable as context for status page templates. It is built anew on each
+// call:
+//
+//	mem
+//	  alloc         (bytes)
+//	  total_alloc   (bytes)
+//	  sys           (bytes)
+//	  heap_alloc    (bytes)
+//	  heap_sys      (bytes)
+//	  heap_objects
+//	  num_gc
+//	goroutines
+//	gomaxprocs
+//	start_time      (RFC 3339)
+//	uptime          (seconds)
+//	build
+//	  go_version
+//	  path
+//	  main
+//	    version
+//	  deps
+//	    module_path
+//	      version
+//
+// Numbers are stored as int64, so that they can be used in expressions, as
+// in $if(mem.heap_alloc > 1000000000). The build section is only present if
+// the binary has build information.
+func RuntimeGraph() *Graph {
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	g := NilGraph()
+
+	mem := g.Add(RuntimeMem)
+	mem.Add(RuntimeAlloc).Add(int64(ms.Alloc))
+	mem.Add(RuntimeTotalAlloc).Add(int64(ms.TotalAlloc))
+	mem.Add(RuntimeSys).Add(int64(ms.Sys))
+	mem.Add(RuntimeHeapAlloc).Add(int64(ms.HeapAlloc))
+	mem.Add(RuntimeHeapSys).Add(int64(ms.HeapSys))
+	mem.Add(RuntimeHeapObjects).Add(int64(ms.HeapObjects))
+	mem.Add(RuntimeNumGC).Add(int64(ms.NumGC))
+
+	g.Add(RuntimeGoroutines).Add(int64(runtime.NumGoroutine()))
+	g.Add(RuntimeGoMaxProcs).Add(int64(runtime.GOMAXPROCS(0)))
+	g.Add(RuntimeStartTime).Add(startTime.Format(time.RFC3339))
+	g.Add(RuntimeUptime).Add(int64(time.Since(startTime) / time.Second))
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		b := g.Add(RuntimeBuild)
+		b.Add(RuntimeGoVersion).Add(bi.GoVersion)
+		b.Add(RuntimePath).Add(bi.Path)
+		b.Add(RuntimeMain).Add(RuntimeModuleVersion).Add(bi.Main.Version)
+		deps := b.Add(RuntimeDeps)
+		for _, m := range bi.Deps {
+			deps.Add(m.Path).Add(RuntimeModuleVersion).Add(m.Version)
+		}
+	}
+
+	return g
+}
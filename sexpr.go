@@ -0,0 +1,306 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxSexprDepth limits the nesting of lists read by FromSexpr.
+const maxSexprDepth = 1000
+
+// FromSexpr reads S-expressions and returns them as a Graph: each list
+// becomes a node named after its head atom, with the rest of the elements
+// as subnodes, and each atom a leaf. Several expressions at the top level
+// become several root nodes:
+//
+//	(server (host localhost) (port 8080))
+//
+// is read as the OGDL
+//
+//	server
+//	  host localhost
+//	  port 8080
+//
+// Atoms can be quoted with "", with the escapes \", \\, \n, \t and \r.
+// Numbers are kept as text, as the OGDL parser does. As in EDN, [] can be
+// used instead of (), commas count as spaces and ';' starts a comment.
+// Empty lists, lists that don't start with an atom and dotted pairs are
+// rejected.
+func FromSexpr(r io.Reader) (*Graph, error) {
+
+	s := &sexprReader{r: bufio.NewReader(r), line: 1}
+	g := NilGraph()
+
+	for {
+		tok, err := s.token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok.kind {
+		case 0:
+			return g, nil
+		case '(', '[':
+			if err = s.list(g, closing(tok.kind), 1); err != nil {
+				return nil, err
+			}
+		case ')', ']':
+			return nil, fmt.Errorf("unexpected %c at line %d", tok.kind, s.line)
+		default:
+			g.Add(tok.text)
+		}
+	}
+}
+
+// SexprOptions control how Sexpr writes a Graph.
+type SexprOptions struct {
+	// Indent, if > 0, writes the lists inside a list on lines of their own,
+	// indented by Indent spaces per level. Otherwise each top level
+	// expression is written in one line.
+	Indent int
+}
+
+// Sexpr writes the graph as S-expressions that FromSexpr reads back into an
+// equal graph: nodes with subnodes become lists headed by the node, and
+// leaves atoms. Atoms are quoted when needed. As in Format, nil nodes are
+// transparent: a nil root writes each of its subnodes as a top level
+// expression. opts can be nil.
+func (g *Graph) Sexpr(w io.Writer, opts *SexprOptions) error {
+
+	o := SexprOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	buf := &bytes.Buffer{}
+	for _, n := range sexprNodes(g) {
+		o.write(buf, n, 0)
+		buf.WriteByte('\n')
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sexprNodes returns g, or its subnodes if it is nil (recursively).
+func sexprNodes(g *Graph) []*Graph {
+	if g == nil {
+		return nil
+	}
+	if !g.IsNil() {
+		return []*Graph{g}
+	}
+	var l []*Graph
+	for _, n := range g.Out {
+		l = append(l, sexprNodes(n)...)
+	}
+	return l
+}
+
+func (o *SexprOptions) write(buf *bytes.Buffer, g *Graph, level int) {
+
+	sub := sexprNodes(&Graph{Out: g.Out})
+	if len(sub) == 0 {
+		buf.WriteString(sexprAtom(g.String()))
+		return
+	}
+
+	buf.WriteByte('(')
+	buf.WriteString(sexprAtom(g.String()))
+
+	// With Indent, once a list is found the rest goes on separate lines
+	split := false
+	for _, n := range sub {
+		if o.Indent > 0 && (split || n.Len() != 0) {
+			split = true
+			buf.WriteByte('\n')
+			buf.WriteString(strings.Repeat(" ", (level+1)*o.Indent))
+		} else {
+			buf.WriteByte(' ')
+		}
+		o.write(buf, n, level+1)
+	}
+	buf.WriteByte(')')
+}
+
+// sexprAtom returns s as an atom, quoted if needed.
+func sexprAtom(s string) string {
+
+	if s != "" && s != "." && !strings.ContainsAny(s, " \t\r\n()[]\";,") {
+		return s
+	}
+
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\t", "\\t", "\r", "\\r")
+	return "\"" + r.Replace(s) + "\""
+}
+
+func closing(c int) int {
+	if c == '[' {
+		return ']'
+	}
+	return ')'
+}
+
+// sexprReader splits S-expression text into tokens.
+type sexprReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// sexprToken is a parenthesis or bracket (kind is the character), an atom
+// (kind 'a', or '"' if quoted) or the end of input (kind 0).
+type sexprToken struct {
+	kind int
+	text string
+}
+
+// list reads the rest of a list, up to the closing character, and adds it to
+// g.
+func (s *sexprReader) list(g *Graph, close int, depth int) error {
+
+	if depth > maxSexprDepth {
+		return fmt.Errorf("nesting deeper than %d at line %d", maxSexprDepth, s.line)
+	}
+
+	tok, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	switch tok.kind {
+	case 0:
+		return errors.New("unexpected end of input")
+	case ')', ']':
+		return fmt.Errorf("empty list at line %d", s.line)
+	case '(', '[':
+		return fmt.Errorf("list head must be an atom at line %d", s.line)
+	}
+
+	n := g.Add(tok.text)
+
+	for {
+		tok, err = s.token()
+		if err != nil {
+			return err
+		}
+
+		switch tok.kind {
+		case 0:
+			return errors.New("unexpected end of input")
+		case close:
+			return nil
+		case ')', ']':
+			return fmt.Errorf("unexpected %c at line %d", tok.kind, s.line)
+		case '(', '[':
+			if err = s.list(n, closing(tok.kind), depth+1); err != nil {
+				return err
+			}
+		case 'a':
+			if tok.text == "." {
+				return fmt.Errorf("dotted pairs are not supported (line %d)", s.line)
+			}
+			fallthrough
+		default:
+			n.Add(tok.text)
+		}
+	}
+}
+
+// token returns the next token, skipping spaces, commas and comments.
+func (s *sexprReader) token() (sexprToken, error) {
+
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return sexprToken{}, nil
+		}
+		if err != nil {
+			return sexprToken{}, err
+		}
+
+		switch c {
+		case '\n':
+			s.line++
+		case ' ', '\t', '\r', ',':
+		case ';':
+			if _, err = s.r.ReadString('\n'); err != nil && err != io.EOF {
+				return sexprToken{}, err
+			}
+			s.line++
+		case '(', ')', '[', ']':
+			return sexprToken{kind: int(c)}, nil
+		case '"':
+			return s.quoted()
+		default:
+			s.r.UnreadByte()
+			return s.atom()
+		}
+	}
+}
+
+// atom reads an unquoted atom.
+func (s *sexprReader) atom() (sexprToken, error) {
+
+	var b []byte
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sexprToken{}, err
+		}
+		if strings.IndexByte(" \t\r\n()[]\";,", c) != -1 {
+			s.r.UnreadByte()
+			break
+		}
+		b = append(b, c)
+	}
+	return sexprToken{kind: 'a', text: string(b)}, nil
+}
+
+// quoted reads a quoted atom, after the opening quote.
+func (s *sexprReader) quoted() (sexprToken, error) {
+
+	line := s.line
+	var b []byte
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			return sexprToken{}, fmt.Errorf("unterminated string at line %d", line)
+		}
+		if err != nil {
+			return sexprToken{}, err
+		}
+
+		switch c {
+		case '"':
+			return sexprToken{kind: '"', text: string(b)}, nil
+		case '\n':
+			s.line++
+		case '\\':
+			if c, err = s.r.ReadByte(); err != nil {
+				return sexprToken{}, fmt.Errorf("unterminated string at line %d", line)
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case '\n':
+				s.line++
+			}
+		}
+		b = append(b, c)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import "io"
+
+// ParseStats holds throughput metrics of a parse (see Parser.CollectStats).
+type ParseStats struct {
+	// Bytes is the number of input bytes consumed.
+	Bytes int64
+	// Nodes is the number of nodes produced, not counting the root.
+	Nodes int
+}
+
+// countingReader counts the bytes read from the underlying reader, and the
+// calls made (which include reads at EOF).
+type countingReader struct {
+	r     io.ByteReader
+	n     int64
+	calls int64
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	c.calls++
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// CollectStats makes the parser count the bytes it consumes from now on,
+// so that Stats can report them. Parsers that don't call it pay nothing
+// for statistics.
+func (p *Parser) CollectStats() {
+	if _, ok := p.in.(*countingReader); !ok {
+		p.in = &countingReader{r: p.in}
+	}
+}
+
+// Stats returns the bytes consumed since CollectStats was called (zero if
+// it wasn't) and the number of nodes produced so far.
+func (p *Parser) Stats() ParseStats {
+
+	st := ParseStats{}
+
+	if c, ok := p.in.(*countingReader); ok {
+		// Reads pushed back with Unread are not consumed. EOF reads come
+		// last, so they are the first ones discounted.
+		st.Bytes = c.calls - int64(p.lastn)
+		if st.Bytes > c.n {
+			st.Bytes = c.n
+		}
+	}
+
+	if g := p.Graph(); g != nil {
+		st.Nodes = countNodes(g) - 1
+	}
+
+	return st
+}
+
+// countNodes returns the number of nodes in g, including g.
+func countNodes(g *Graph) int {
+	n := 1
+	for _, c := range g.Out {
+		n += countNodes(c)
+	}
+	return n
+}
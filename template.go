@@ -6,6 +6,15 @@ package ogdl
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 // NewTemplate parses a text template given as a string and converts it to a Graph.
@@ -21,13 +30,16 @@ import (
 //
 //     template ::= ( text | variable )*
 //
-//     variable ::= ('$' path) | ('$' '(' expression ')') | ('$' '{' expression '}')
+//     variable ::= ('$' path filter?) | ('$' '(' expression ')') | ('$' '{' path filter? '}')
+//     filter ::= '|' ('html' | 'url' | 'raw')
 //     path ::= as defined in path.go
 //     expression ::= as defined in expression.go
 //
-// Some variables act as directives: $if, $else, $end, $for, $break.
+// Some variables act as directives: $if, $elseif, $else, $end, $for,
+// $while, $break, $include, $raw (see NewHTMLTemplate).
 //
 //    $if(expression)
+//    $elseif(expression)
 //    $else
 //    $end
 //
@@ -35,8 +47,78 @@ import (
 //      $break
 //    $end
 //
+//    $while(expression)
+//      $break
+//    $end
+//
+// In a chain $if(a) ... $elseif(b) ... $else ... $end, only the first
+// branch whose expression is true is processed, or the $else branch if
+// none is. $else$if(b) is not the same as $elseif(b): it starts a new $if
+// inside the $else branch, which needs its own $end.
+//
+// $for can also take an index (or key) destination path in front, as in
+// $for(i,x,list). The source can be a Graph, or a Go slice, array or map
+// stored in a node. Inside the loop, $x_index holds the 0-based position of
+// the element and $x_len the number of elements. Both are restored when
+// the loop ends. Over the nodes returned by a selector, as in
+// $for(s,servers{port > 1000}), $s_matchindex, $s_matchkey and
+// $s_matchpath tell where each one was found (see Graph.MatchIndex); they
+// are also available as the functions matchindex(s), matchkey(s) and
+// matchpath(s).
+//
+// The built-in function range(start, end[, step]) returns the integers from
+// start up to end (excluded), to loop a number of times, as in
+// $for(i, range(0, n)), or down to end with a negative step, as in
+// range(10, 0, -2). $while repeats its body while the expression is true,
+// which needs the body to change the variables it depends on, as in
+//
+//    $set(i, 0)$while(i < 3)$i $set(i, i+1)$end
+//
+// Expressions can also use, without registering them, the functions
+// len(x), which is 0 for paths that don't exist, contains(s, sub),
+// hasprefix(s, p), hassuffix(s, p), lower(s), upper(s) and trim(s), as in
+// $if(len(items) > 0). Functions added to function sets don't replace them.
+//
+// Loops over a range and $while loops stop the render with
+// ErrIterationLimit after TemplateOptions.MaxIterations iterations, so that
+// a template bug doesn't hang the program.
+//
+// A filter after the path of a variable selects how its value is escaped:
+// $name|html escapes it for HTML text or attributes, $q|url for a URL query
+// parameter, and $body|raw writes it as is. Without a filter, values are
+// written as is, or HTML escaped in templates made with NewHTMLTemplate.
+// A '|' followed by anything else is text, as in $a|$b.
+//
+// $include(name) processes another template against the same context, and
+// writes its output in place. The template is looked up first in the
+// TemplateSet being processed, if any, and then in the context, where
+// name is a path to either template text or a template parsed with
+// NewTemplate.
+//
 func NewTemplate(s string) *Graph {
+	return NewTemplateWithDelim(s, '$')
+}
+
+// NewHTMLTemplate parses a template like NewTemplate, for HTML output: the
+// values written by variables are HTML escaped (<, >, &, ' and "), while the
+// text of the template is written as is. Templates included by it are
+// escaped too. Values that hold trusted HTML can be written without
+// escaping with $raw(expression):
+//
+//     <h1>$title</h1> $raw(footer)
+func NewHTMLTemplate(s string) *Graph {
+	t := NewTemplate(s)
+	t.Out = append([]*Graph{NewGraph(TypeHTML)}, t.Out...)
+	return t
+}
+
+// NewTemplateWithDelim parses a template like NewTemplate, where variables
+// begin with delim instead of '$', as in %name or %if(...). This is useful
+// for text full of dollar signs, as shell scripts, which then need no
+// escaping. delim must not be a space or a line break.
+func NewTemplateWithDelim(s string, delim byte) *Graph {
 	p := NewStringParser(s)
+	p.Delim = delim
 	p.Template()
 
 	t := p.GraphTop(TypeTemplate)
@@ -47,80 +129,432 @@ func NewTemplate(s string) *Graph {
 	return t
 }
 
+// templateFilters are the output filters of variables, as in $path|html.
+var templateFilters = map[string]func(string) string{
+	"html": html.EscapeString,
+	"url":  url.QueryEscape,
+	"raw":  func(s string) string { return s },
+}
+
+// ErrOutputLimit is returned by ProcessTo when the output of a template
+// exceeds TemplateOptions.MaxOutputBytes.
+var ErrOutputLimit = errors.New("template output limit exceeded")
+
+// ErrIncludeDepth is returned by ProcessTo when includes are nested deeper
+// than TemplateOptions.MaxIncludeDepth, as when templates include each
+// other.
+var ErrIncludeDepth = errors.New("template include depth exceeded")
+
+// ErrIterationLimit is returned by ProcessTo and ProcessE when a $while
+// loop, or a $for over a range, runs more than TemplateOptions.MaxIterations
+// times.
+var ErrIterationLimit = errors.New("template loop iteration limit exceeded")
+
+// ErrRenderAborted is returned by ProcessTo when TemplateOptions.Progress
+// asks to stop.
+var ErrRenderAborted = errors.New("template render aborted")
+
+// TemplateOptions control how a template is processed by ProcessTo. The zero
+// value imposes no limits.
+type TemplateOptions struct {
+	// MaxOutputBytes is the maximum number of bytes written. When a render
+	// would exceed it, the output is truncated to exactly MaxOutputBytes and
+	// processing stops with ErrOutputLimit. Zero means unlimited.
+	MaxOutputBytes int64
+
+	// FlushEvery, if > 0, makes ProcessTo flush the writer each time
+	// another FlushEvery bytes have been written, if it has a Flush()
+	// method (as http.ResponseWriter does, through http.Flusher).
+	FlushEvery int
+
+	// Progress, if not nil, is called at the same points as the flushes
+	// (so it needs FlushEvery), with the bytes written and the template
+	// nodes processed so far. Returning false stops the render with
+	// ErrRenderAborted.
+	Progress func(bytesWritten int64, nodesProcessed int) bool
+
+	// MaxIncludeDepth is the maximum nesting of $include directives. It is
+	// 16 if zero.
+	MaxIncludeDepth int
+
+	// MaxIterations is the maximum number of iterations of a $while loop,
+	// or of a $for over a range. It is 100000 if zero.
+	MaxIterations int
+
+	// Dir, if not empty, is the directory where $include looks for
+	// templates not found in the set or the context: the name is then a
+	// file path relative to Dir, as in $include("parts/header.html"). Names
+	// that would lead out of Dir are not found.
+	Dir string
+
+	// MaxFunctionCalls limits the calls to functions (of a FunctionSet,
+	// remote or methods of !type objects) in one render. Once exceeded,
+	// processing stops with a *QuotaExceededError. Zero means unlimited.
+	MaxFunctionCalls int
+
+	// MaxCallsPerFunction limits the calls to each function by name. The
+	// limit for the empty name applies to functions not in the map.
+	MaxCallsPerFunction map[string]int
+
+	// MaxRemoteCalls limits the calls to remote functions (rfunction).
+	MaxRemoteCalls int
+
+	// ModifyContext makes the assignments of the template ($set, $(x = ...)
+	// and the variables of $for) change the context graph given, unless it
+	// is frozen. By default they are made in a private copy, visible only
+	// during the render.
+	ModifyContext bool
+}
+
+// flusher is implemented by writers that can flush buffered output, such as
+// http.Flusher.
+type flusher interface {
+	Flush()
+}
+
 // Process processes the parsed template, returning the resulting text in a byte array.
-// The variable parts are resolved out of the Graph given.
+// The variable parts are resolved out of the Graph given. Variables set by the
+// template, with $set(path, expr), $(path = expr), $(path += expr), etc, or
+// by $for, are visible until the end of the render, but don't change the
+// Graph (see TemplateOptions.ModifyContext).
 func (t *Graph) Process(c *Graph) []byte {
 
 	buffer := &bytes.Buffer{}
+	r := newRender(buffer, nil)
 
-	t.process(c, buffer)
+	r.run(t, c)
 
 	return buffer.Bytes()
 }
 
-func (t *Graph) process(c *Graph, buffer *bytes.Buffer) bool {
+// ProcessE processes the template like Process, and returns also the first
+// problem found: a path that doesn't resolve (an ErrNotFound), an expression
+// that cannot be evaluated, a $for over a value that is not iterable or a
+// template to include that is not found. Processing goes on after errors,
+// so the output is always the one of Process.
+//
+// Note that a path to a node with a single value evaluates to that value,
+// so a $for over a list of one element is not iterable.
+func (t *Graph) ProcessE(c *Graph) ([]byte, error) {
+
+	buffer := &bytes.Buffer{}
+	r := newRender(buffer, nil)
+
+	r.run(t, c)
+
+	if r.err != nil {
+		return buffer.Bytes(), r.err
+	}
+	return buffer.Bytes(), r.ee.err
+}
+
+// ProcessTo processes the parsed template like Process, writing the result
+// to w. opts can be nil. It returns the first error found writing to w,
+// ErrOutputLimit, ErrRenderAborted, ErrIncludeDepth, a *QuotaExceededError
+// or an error about a template to include that is not found.
+func (t *Graph) ProcessTo(c *Graph, w io.Writer, opts *TemplateOptions) error {
+
+	r := newRender(w, opts)
+
+	r.run(t, c)
+	r.failed()
+
+	return r.err
+}
+
+// newRender returns a render writing to w. opts can be nil.
+func newRender(w io.Writer, opts *TemplateOptions) *render {
+
+	r := &render{w: w, maxDepth: 16, maxIter: 100000}
+	if opts == nil {
+		return r
+	}
+
+	r.max = opts.MaxOutputBytes
+	if opts.FlushEvery > 0 {
+		r.every = int64(opts.FlushEvery)
+		r.next = r.every
+		r.progress = opts.Progress
+		r.flusher, _ = w.(flusher)
+	}
+	if opts.MaxIncludeDepth > 0 {
+		r.maxDepth = opts.MaxIncludeDepth
+	}
+	if opts.MaxIterations > 0 {
+		r.maxIter = opts.MaxIterations
+	}
+	r.dir = opts.Dir
+	r.ee.quota = newQuota(opts)
+	r.modify = opts.ModifyContext
+
+	return r
+}
+
+// render holds the state of a template being processed.
+type render struct {
+	w   io.Writer
+	n   int64
+	max int64
+	err error
+
+	// nodes counts the template nodes processed
+	nodes int
+
+	// Flushing and progress reports happen when n reaches next
+	every    int64
+	next     int64
+	flusher  flusher
+	progress func(int64, int) bool
+
+	// Includes: the set being processed, if any, and the nesting depth
+	set      *TemplateSet
+	depth    int
+	maxDepth int
+
+	// maxIter is the maximum number of iterations of a loop (see
+	// TemplateOptions.MaxIterations)
+	maxIter int
+
+	// Directory of template files, and those already read
+	dir   string
+	files map[string]*Graph
+
+	// ee keeps the first evaluation error, for ProcessE
+	ee evalError
+
+	// html makes WriteValue escape its input
+	html bool
+
+	// modify makes assignments change the context given
+	modify bool
+}
+
+// run renders t with the context c, and then closes the remote functions
+// opened by the render.
+func (r *render) run(t, c *Graph) {
+	t.process(r.context(c), r)
+	r.ee.closeObjects()
+}
+
+// context returns the context graph to render c with: a private scope, or c
+// itself with TemplateOptions.ModifyContext (an overlay if c is frozen).
+func (r *render) context(c *Graph) *Graph {
+	r.ee.objects = map[*Graph]interface{}{}
+	if r.modify {
+		return c.overlay()
+	}
+	c, r.ee.owned = c.scope()
+	return c
+}
+
+// WriteString writes s to the output, unless a previous write failed or the
+// output limit was reached.
+func (r *render) WriteString(s string) {
+
+	if r.err != nil {
+		return
+	}
+
+	if r.max > 0 && r.n+int64(len(s)) > r.max {
+		s = s[:r.max-r.n]
+		r.err = ErrOutputLimit
+	}
+
+	n, err := io.WriteString(r.w, s)
+	r.n += int64(n)
+	if err != nil {
+		r.err = err
+	}
+
+	if r.every > 0 && r.n >= r.next {
+		r.checkpoint()
+	}
+}
+
+// failed returns true if processing must stop, because of an error or a
+// function call quota exceeded.
+func (r *render) failed() bool {
+	if r.err == nil && r.ee.quota != nil {
+		r.err = r.ee.quota.err
+	}
+	return r.err != nil
+}
+
+// WriteValue writes the value of a variable, HTML escaped if the template
+// is for HTML.
+func (r *render) WriteValue(s string) {
+	if r.html {
+		s = html.EscapeString(s)
+	}
+	r.WriteString(s)
+}
+
+// checkpoint flushes the output and reports progress.
+func (r *render) checkpoint() {
+
+	r.next = r.n - r.n%r.every + r.every
+
+	if r.flusher != nil {
+		r.flusher.Flush()
+	}
+
+	if r.progress != nil && !r.progress(r.n, r.nodes) && r.err == nil {
+		r.err = ErrRenderAborted
+	}
+}
+
+func (t *Graph) process(c *Graph, buffer *render) bool {
 
 	falseIf := false
 
 	for _, n := range t.Out {
+		// Stop at the first error
+		if buffer.failed() {
+			return true
+		}
+		buffer.nodes++
+
 		s := n.String()
 
 		switch s {
 		case TypePath:
-			i := c.Eval(n)
-
-			// If i is a graph, we want the full graph converted to string,
-			// not just the root node (which is what _string() returns.
-
-			if g, ok := i.(*Graph); ok {
-				buffer.WriteString(g.Text())
-			} else {
-				buffer.WriteString(_string(c.Eval(n)))
-			}
+			buffer.WriteValue(valueText(c.eval(n, &buffer.ee)))
+		case TypeFilter:
+			// The filter replaces the escaping of the template
+			f := templateFilters[n.GetAt(0).String()]
+			buffer.WriteString(f(valueText(c.eval(n.GetAt(1), &buffer.ee))))
 		case TypeExpression:
 			// Silent evaluation
-			c.Eval(n)
+			c.eval(n, &buffer.ee)
 		case TypeIf:
 			// evaluate the expression
-			b := c.EvalBool(n.GetAt(0).GetAt(0))
+			b := buffer.evalBool(c, n.GetAt(0).GetAt(0))
 
+			// A $break in the branch ends the enclosing loop too
 			if b {
-				n.GetAt(1).process(c, buffer)
+				if n.GetAt(1).process(c, buffer) {
+					return true
+				}
 				falseIf = false
 			} else {
 				falseIf = true
 			}
+		case TypeElseIf:
+			// only if the previous branches of the chain were false
+			if falseIf && buffer.evalBool(c, n.GetAt(0).GetAt(0)) {
+				if n.GetAt(1).process(c, buffer) {
+					return true
+				}
+				falseIf = false
+			}
 		case TypeElse:
 			// if there was a previous if evaluating to false:
 			if falseIf {
-				n.process(c, buffer)
+				if n.process(c, buffer) {
+					return true
+				}
 				falseIf = false
 			}
 		case TypeFor:
-			// The first subnode (of !g) is a path
-			// The second is an expression evaluating to a list of elements
-			i := c.Eval(n.GetAt(0).GetAt(1))
-
-			// Check that i is iterable
-
-            gi, ok := i.(*Graph);
-			if !ok || gi==nil {
-				return true
-			}
-						
-			// The third is the subtemplate to travel
-			// println ("for type: ",reflect.TypeOf(i).String(), "ok",ok)
-			// Assing expression value to path
-			// XXX if not Graph
-			for _, ee := range gi.Out {
-				c.assign(n.GetAt(0).GetAt(0).GetAt(0), ee, '=')
-				brk := n.GetAt(1).process(c, buffer)
-				if brk {
+			// The first subnode (!g) holds the arguments: a destination
+			// path and an expression evaluating to a list of elements, with
+			// an optional index path in front: $for(x,list) or
+			// $for(i,x,list).
+			args := n.GetAt(0)
+
+			var ipath *Graph
+			xpath := args.GetAt(0).GetAt(0)
+			src := args.GetAt(1)
+
+			if args.Len() > 2 {
+				ipath = xpath
+				xpath = args.GetAt(1).GetAt(0)
+				src = args.GetAt(2)
+			}
+
+			// The second is the subtemplate to travel
+			body := n.GetAt(1)
+
+			// x_index and x_len are available in the body, and restored
+			// afterwards.
+			list := c.eval(src, &buffer.ee)
+			ix := suffixPath(xpath, "_index")
+			nx := suffixPath(xpath, "_len")
+			var restore []func()
+			if ix != nil {
+				restore = append(restore, c.saveVar(ix), c.saveVar(nx))
+				c.assign(nx, iterLen(list), '=', &buffer.ee)
+			}
+
+			// Over the result of a selector, x_matchindex, x_matchkey and
+			// x_matchpath tell where each element comes from.
+			var mpaths []*Graph
+			if g, ok := list.(*Graph); ok && ix != nil && g.Len() > 0 && g.Out[0].origin() != nil {
+				for _, s := range []string{"_matchindex", "_matchkey", "_matchpath"} {
+					p := suffixPath(xpath, s)
+					mpaths = append(mpaths, p)
+					restore = append(restore, c.saveVar(p))
+				}
+			}
+
+			// Ranges are limited to MaxIterations
+			_, limited := list.(intRange)
+
+			j := 0
+			ok := iterate(list, func(k, v interface{}) bool {
+				if limited && buffer.iteration(j) {
+					return false
+				}
+				if ipath != nil {
+					c.assign(ipath, k, '=', &buffer.ee)
+				}
+				if ix != nil {
+					c.assign(ix, j, '=', &buffer.ee)
+				}
+				j++
+				if mpaths != nil {
+					m := v.(*Graph)
+					c.assign(mpaths[0], m.MatchIndex(), '=', &buffer.ee)
+					c.assign(mpaths[1], m.MatchKey(), '=', &buffer.ee)
+					c.assign(mpaths[2], m.MatchPath(), '=', &buffer.ee)
+				}
+				c.assign(xpath, v, '=', &buffer.ee)
+				return !body.process(c, buffer)
+			})
+			if !ok {
+				buffer.ee.set(fmt.Errorf("$for over a value that is not iterable: %s", exprString(unwrap(src))))
+			}
+
+			for _, f := range restore {
+				f()
+			}
+		case TypeWhile:
+			// The first subnode (!g) holds the condition, and the second
+			// the body.
+			cond := n.GetAt(0).GetAt(0)
+			body := n.GetAt(1)
+			for i := 0; buffer.evalBool(c, cond); i++ {
+				if buffer.iteration(i) || body.process(c, buffer) {
 					break
 				}
 			}
 		case TypeBreak:
 			return true
+		case TypeInclude:
+			buffer.include(c, n.GetAt(0).GetAt(0))
+		case TypeRaw:
+			buffer.WriteString(valueText(c.eval(n.GetAt(0).GetAt(0), &buffer.ee)))
+		case TypeSet:
+			// $set(path, expression), as $(path = expression)
+			args := n.GetAt(0)
+			path := args.GetAt(0).GetAt(0)
+			if args.Len() != 2 || path.String() != TypePath {
+				buffer.ee.set(errors.New("$set needs a path and an expression"))
+				break
+			}
+			c.assign(path, c.eval(args.GetAt(1), &buffer.ee), '=', &buffer.ee)
+		case TypeHTML:
+			buffer.html = true
 
 		default:
 			buffer.WriteString(n.String())
@@ -129,9 +563,311 @@ func (t *Graph) process(c *Graph, buffer *bytes.Buffer) bool {
 	return false
 }
 
-// simplify converts !p TYPE in !TYPE for keywords if, end, else for and break.
+// valueText returns the text written for the value of a variable. A graph is
+// written in full, not just its root node (which is what _string returns).
+func valueText(i interface{}) string {
+	if g, ok := i.(*Graph); ok {
+		return g.Text()
+	}
+	return _string(i)
+}
+
+// iteration returns true, and stops the render with ErrIterationLimit, if
+// the iteration i (0-based) of a loop is beyond the limit.
+func (r *render) iteration(i int) bool {
+	if i < r.maxIter {
+		return false
+	}
+	if r.err == nil {
+		r.err = ErrIterationLimit
+	}
+	return true
+}
+
+// evalBool evaluates e in the context c as EvalBool does, keeping errors.
+func (r *render) evalBool(c, e *Graph) bool {
+	b, _ := _boolf(c.eval(e, &r.ee))
+	return b
+}
+
+// include processes the template named by the expression e, which is a path
+// or evaluates to a string.
+func (r *render) include(c *Graph, e *Graph) {
+
+	if r.depth >= r.maxDepth {
+		r.err = ErrIncludeDepth
+		return
+	}
+
+	var name string
+	path := e.GetAt(0)
+	if path != nil && path.String() == TypePath {
+		name = pathString(path)
+	} else {
+		name = _string(c.eval(e, &r.ee))
+		path = NewPath(name)
+	}
+
+	t := r.lookup(c, name, path)
+	if t == nil {
+		r.err = errTemplateNotFound(name)
+		return
+	}
+
+	r.depth++
+	escape := r.html
+	t.process(c, r)
+	r.html = escape
+	r.depth--
+}
+
+// lookup returns the template with the given name from the set being
+// processed, or else the one found at path in the context, or else the file
+// with that name in the template directory.
+func (r *render) lookup(c *Graph, name string, path *Graph) *Graph {
+
+	if r.set != nil {
+		if t := r.set.template(name); t != nil {
+			return t
+		}
+	}
+
+	var n *Graph
+	if path != nil {
+		n = c.get(path)
+	}
+
+	switch {
+	case n == nil:
+		return r.file(name)
+	case n.String() == TypeTemplate:
+		return n
+	case n.Len() == 0 && !n.IsNil():
+		return NewTemplate(n.String())
+	}
+
+	return r.file(name)
+}
+
+// file returns the template in the file with the given name, relative to
+// the template directory, or nil. Files are read once per render.
+func (r *render) file(name string) *Graph {
+
+	if r.dir == "" || name == "" || filepath.IsAbs(name) {
+		return nil
+	}
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return nil
+	}
+
+	if t, ok := r.files[name]; ok {
+		return t
+	}
+
+	var t *Graph
+	if b, err := readFile(filepath.Join(r.dir, name)); err == nil {
+		t = NewTemplate(string(b))
+	}
+
+	if r.files == nil {
+		r.files = map[string]*Graph{}
+	}
+	r.files[name] = t
+	return t
+}
+
+func errTemplateNotFound(name string) error {
+	return fmt.Errorf("template not found: %s", name)
+}
+
+// iterate calls fn for each element of itf, with its index (or key) and
+// value, until fn returns false. itf can be a *Graph (its subnodes are
+// iterated), or a Go slice, array or map. Map keys are visited in sorted
+// order. It returns false if itf is not iterable.
+func iterate(itf interface{}, fn func(k, v interface{}) bool) bool {
+
+	if g, ok := itf.(*Graph); ok {
+		if g == nil {
+			return false
+		}
+		for i, n := range g.Out {
+			if !fn(i, n) {
+				break
+			}
+		}
+		return true
+	}
+
+	if r, ok := itf.(intRange); ok {
+		for i, k := 0, r.start; r.contains(k); i, k = i+1, k+r.step {
+			if !fn(i, k) {
+				break
+			}
+		}
+		return true
+	}
+
+	v := reflect.ValueOf(itf)
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !fn(i, v.Index(i).Interface()) {
+				break
+			}
+		}
+		return true
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return _string(keys[i].Interface()) < _string(keys[j].Interface())
+		})
+		for _, k := range keys {
+			if !fn(k.Interface(), v.MapIndex(k).Interface()) {
+				break
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// iterLen returns the number of elements that iterate visits in itf.
+func iterLen(itf interface{}) int {
+
+	if g, ok := itf.(*Graph); ok {
+		return g.Len()
+	}
+	if r, ok := itf.(intRange); ok {
+		return r.len()
+	}
+
+	v := reflect.ValueOf(itf)
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len()
+	}
+
+	return 0
+}
+
+// intRange is the sequence of integers returned by range(start, end, step),
+// from start up to end, excluded.
+type intRange struct {
+	start, end, step int64
+}
+
+func (r intRange) contains(k int64) bool {
+	if r.step > 0 {
+		return k < r.end
+	}
+	return k > r.end
+}
+
+func (r intRange) len() int {
+	if !r.contains(r.start) {
+		return 0
+	}
+	if r.step > 0 {
+		return int((r.end - r.start + r.step - 1) / r.step)
+	}
+	return int((r.start - r.end - r.step - 1) / -r.step)
+}
+
+// newRange returns the intRange for the arguments of range(): start, end and
+// an optional step, 1 by default. It returns nil if they are not integers,
+// or the step is zero.
+func newRange(args ...interface{}) interface{} {
+
+	if len(args) < 2 || len(args) > 3 {
+		return nil
+	}
+
+	var n [3]int64
+	n[2] = 1
+	for i, a := range args {
+		v, ok := _int64f(a)
+		if !ok {
+			return nil
+		}
+		n[i] = v
+	}
+	if n[2] == 0 {
+		return nil
+	}
+	return intRange{n[0], n[1], n[2]}
+}
+
+// suffixPath returns a copy of the path p with suffix appended to its last
+// element, or nil if p has elements other than tokens.
+func suffixPath(p *Graph, suffix string) *Graph {
+
+	if p == nil || p.Len() == 0 {
+		return nil
+	}
+
+	r := NewGraph(TypePath)
+	for i, e := range p.Out {
+		if e.Len() != 0 || strings.HasPrefix(e.String(), "!") {
+			return nil
+		}
+		if i == p.Len()-1 {
+			r.Add(e.String() + suffix)
+		} else {
+			r.Add(e.This)
+		}
+	}
+	return r
+}
+
+// saveVar returns a function that restores the variable at the path p (made
+// of tokens) to its current state, removing it if it doesn't exist now.
+func (c *Graph) saveVar(p *Graph) func() {
+
+	if h := c.holder(p); h != nil {
+		old := append([]*Graph(nil), h.Out...)
+		return func() {
+			if h := c.holder(p); h != nil && h.mutable() == nil {
+				h.Out = old
+			}
+		}
+	}
+
+	s := pathString(p)
+	return func() {
+		c.Remove(s)
+	}
+}
+
+// holder returns the node named by the last element of the path p (made of
+// tokens), or nil.
+func (c *Graph) holder(p *Graph) *Graph {
+	n := c
+	for _, e := range p.Out {
+		if n = n.Node(e.String()); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// simplify converts !p TYPE in !TYPE for keywords if, end, elseif, else, for,
+// while, break, include, raw and set.
 func (t *Graph) simplify() {
 	for _, node := range t.Out {
+		// $path|filter: !p (path, !filter name) becomes !filter (name, !p path)
+		if TypePath == node.String() && node.Len() > 1 {
+			if f := node.Out[node.Len()-1]; f.String() == TypeFilter {
+				p := &Graph{This: TypePath, Out: node.Out[:node.Len()-1]}
+				node.This = TypeFilter
+				node.Out = []*Graph{f.GetAt(0), p}
+				continue
+			}
+		}
+
 		if TypePath == node.String() {
 			s := node.GetAt(0).String()
 
@@ -145,19 +881,40 @@ func (t *Graph) simplify() {
 			case "else":
 				node.This = TypeElse
 				node.DeleteAt(0)
+			case "elseif":
+				node.This = TypeElseIf
+				node.DeleteAt(0)
 			case "for":
 				node.This = TypeFor
 				node.DeleteAt(0)
+			case "while":
+				if node.Len() == 2 && node.GetAt(1).String() == TypeGroup {
+					node.This = TypeWhile
+					node.DeleteAt(0)
+				}
+			case "include":
+				node.This = TypeInclude
+				node.DeleteAt(0)
 			case "break":
 				node.This = TypeBreak
 				node.DeleteAt(0)
+			case "raw":
+				if node.Len() == 2 && node.GetAt(1).String() == TypeGroup {
+					node.This = TypeRaw
+					node.DeleteAt(0)
+				}
+			case "set":
+				if node.Len() == 2 && node.GetAt(1).String() == TypeGroup {
+					node.This = TypeSet
+					node.DeleteAt(0)
+				}
 			}
 		}
 	}
 
 }
 
-// flow nests 'if' and 'for' loops.
+// flow nests 'if', 'for' and 'while' loops.
 func (t *Graph) flow() {
 	n := 0
 	var nod *Graph
@@ -167,7 +924,7 @@ func (t *Graph) flow() {
 		node := t.Out[i]
 		s := node.String()
 
-		if s == TypeIf || s == TypeFor {
+		if s == TypeIf || s == TypeFor || s == TypeWhile {
 			n++
 			if n == 1 {
 				nod = node.Add(TypeTemplate)
@@ -183,6 +940,15 @@ func (t *Graph) flow() {
 			}
 		}
 
+		// An elseif is a sibling of its if, with its own body
+		if s == TypeElseIf {
+			if n == 1 {
+				nod.flow()
+				nod = node.Add(TypeTemplate)
+				continue
+			}
+		}
+
 		if s == TypeEnd {
 			n--
 			if n == 0 {
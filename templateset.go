@@ -0,0 +1,65 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// TemplateSet is a collection of named templates that can include each
+// other with $include(name). It is safe for concurrent use.
+type TemplateSet struct {
+	mu        sync.RWMutex
+	templates map[string]*Graph
+}
+
+// NewTemplateSet returns an empty TemplateSet.
+func NewTemplateSet() *TemplateSet {
+	return &TemplateSet{templates: make(map[string]*Graph)}
+}
+
+// Add parses a template and adds it to the set with the given name,
+// replacing any previous one.
+func (ts *TemplateSet) Add(name, text string) {
+	t := NewTemplate(text)
+	ts.mu.Lock()
+	ts.templates[name] = t
+	ts.mu.Unlock()
+}
+
+func (ts *TemplateSet) template(name string) *Graph {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.templates[name]
+}
+
+// Process processes the named template against the context c and returns
+// the result. Errors are those of ProcessTo.
+func (ts *TemplateSet) Process(name string, c *Graph) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := ts.ProcessTo(name, c, buf, nil)
+	return buf.Bytes(), err
+}
+
+// ProcessTo processes the named template against the context c, writing the
+// result to w, as Graph.ProcessTo does. Includes are looked up first in the
+// set.
+func (ts *TemplateSet) ProcessTo(name string, c *Graph, w io.Writer, opts *TemplateOptions) error {
+
+	t := ts.template(name)
+	if t == nil {
+		return errTemplateNotFound(name)
+	}
+
+	r := newRender(w, opts)
+	r.set = ts
+
+	r.run(t, c)
+	r.failed()
+
+	return r.err
+}
@@ -0,0 +1,6 @@
+<h1>$title</h1>
+<ul>
+$for(p,catalog)
+  <li>$p.product.name: $p.product.price$if(p.product.stock.north > 50) (in stock)$end</li>
+$end
+</ul>
@@ -0,0 +1,127 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Size is a number of bytes written with a unit, as in 2GB or 10MiB. The
+// parser produces it for unquoted scalars when Parser.Sizes is set. Text is
+// the original form, kept for writing the graph back.
+type Size struct {
+	Bytes int64
+	Text  string
+}
+
+// String returns the original text, or the number of bytes if there is
+// none.
+func (s Size) String() string {
+	if s.Text == "" {
+		return strconv.FormatInt(s.Bytes, 10)
+	}
+	return s.Text
+}
+
+// Duration is a time.Duration written with a unit, as in 250ms or 1h30m.
+// The parser produces it for unquoted scalars when Parser.Durations is set.
+// Text is the original form, kept for writing the graph back.
+type Duration struct {
+	Duration time.Duration
+	Text     string
+}
+
+// String returns the original text, or the one of time.Duration if there
+// is none.
+func (d Duration) String() string {
+	if d.Text == "" {
+		return d.Duration.String()
+	}
+	return d.Text
+}
+
+// sizeUnits are the multipliers of the units of sizes, in lower case.
+var sizeUnits = map[string]int64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"ki":  1 << 10,
+	"mi":  1 << 20,
+	"gi":  1 << 30,
+	"ti":  1 << 40,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// parseSize parses a size: a non negative decimal number followed by a
+// unit of sizeUnits, in any case. The result is rounded to whole bytes.
+func parseSize(s string) (int64, bool) {
+
+	i := 0
+	for i < len(s) && (IsDigit(int(s[i])) || s[i] == '.') {
+		i++
+	}
+	if i == 0 || i == len(s) {
+		return 0, false
+	}
+
+	m, ok := sizeUnits[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, false
+	}
+
+	if n, err := strconv.ParseInt(s[:i], 10, 64); err == nil {
+		if n > math.MaxInt64/m {
+			return 0, false
+		}
+		return n * m, true
+	}
+
+	f, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || f*float64(m) >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(math.Round(f * float64(m))), true
+}
+
+// parseDuration parses a duration as time.ParseDuration does, but requires
+// a unit, as in 90s (not just 0). Units are case sensitive: 1m is one
+// minute, and 1M is not a duration.
+func parseDuration(s string) (time.Duration, bool) {
+	if s == "" || IsDigit(int(s[len(s)-1])) {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}
+
+// unit returns s as a Size or a Duration, depending on the settings of the
+// parser, or nil. Units of sizes always end in b or i, and those of
+// durations never do, so no string is both.
+func (p *Parser) unit(s string) interface{} {
+
+	if len(s) == 0 || !IsDigit(int(s[0])) && s[0] != '-' && s[0] != '+' && s[0] != '.' {
+		return nil
+	}
+
+	if p.Sizes {
+		if n, ok := parseSize(s); ok {
+			return Size{n, s}
+		}
+	}
+	if p.Durations {
+		if d, ok := parseDuration(s); ok {
+			return Duration{d, s}
+		}
+	}
+	return nil
+}
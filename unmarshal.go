@@ -0,0 +1,460 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnknownField is wrapped by the *UnknownFieldsError returned when keys
+// without a matching struct field are not allowed.
+var ErrUnknownField = errors.New("unknown field")
+
+// UnknownFieldsError lists the paths of the keys of a graph that have no
+// matching field in the value being filled.
+type UnknownFieldsError struct {
+	Paths []string
+}
+
+func (e *UnknownFieldsError) Error() string {
+	return ErrUnknownField.Error() + ": " + strings.Join(e.Paths, ", ")
+}
+
+func (e *UnknownFieldsError) Unwrap() error {
+	return ErrUnknownField
+}
+
+// DecodeOptions control how UnmarshalWith fills a Go value.
+type DecodeOptions struct {
+	// DisallowUnknownFields makes keys without a matching struct field an
+	// error: an *UnknownFieldsError listing all of them.
+	DisallowUnknownFields bool
+	// CollectUnknown, if not nil, receives the paths of the keys without a
+	// matching struct field.
+	CollectUnknown *[]string
+}
+
+var (
+	graphType    = reflect.TypeOf((*Graph)(nil))
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Unmarshal fills the value pointed to by v with the graph, whose subnodes
+// are taken as keys. Keys without a matching struct field are ignored; see
+// UnmarshalStrict and UnmarshalWith.
+//
+// Struct fields match keys by their `ogdl:"name"` tag, or by their name,
+// ignoring case. The fields of embedded structs are matched as if they
+// belonged to the outer struct. A field tagged `ogdl:",rest"`, of type
+// *Graph or Graph, receives the keys that match no other field:
+//
+//     type Server struct {
+//         Host    string
+//         Port    int
+//         Timeout time.Duration
+//         Extra   *Graph `ogdl:",rest"`
+//     }
+//
+// Scalars are taken from the only subnode of a key, as in 'port 8080'.
+// Slices take an element from each subnode, and maps with string keys take
+// the subnodes as keys. *Graph fields receive the node of the key itself,
+// and interface{} fields a scalar or, if the key has several subnodes, the
+// node.
+func (g *Graph) Unmarshal(v interface{}) error {
+	return g.UnmarshalWith(v, nil)
+}
+
+// UnmarshalStrict is as Unmarshal, but keys without a matching field are
+// reported as an *UnknownFieldsError.
+func (g *Graph) UnmarshalStrict(v interface{}) error {
+	return g.UnmarshalWith(v, &DecodeOptions{DisallowUnknownFields: true})
+}
+
+// UnmarshalWith is as Unmarshal, with options. opts can be nil. Paths of
+// unknown keys are written with dots, and with indexes for the elements of
+// slices, as in 'routes[1].handler'.
+func (g *Graph) UnmarshalWith(v interface{}, opts *DecodeOptions) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("Unmarshal needs a non nil pointer")
+	}
+	if g == nil {
+		g = NilGraph()
+	}
+
+	d := &decoder{}
+	if err := d.value(g, rv.Elem(), ""); err != nil {
+		return err
+	}
+
+	if opts != nil {
+		if opts.CollectUnknown != nil {
+			*opts.CollectUnknown = append(*opts.CollectUnknown, d.unknown...)
+		}
+		if opts.DisallowUnknownFields && len(d.unknown) != 0 {
+			return &UnknownFieldsError{d.unknown}
+		}
+	}
+	return nil
+}
+
+// decoder holds the state of an Unmarshal call.
+type decoder struct {
+	unknown []string
+}
+
+// value fills v with the subnodes of c, found at the given path.
+func (d *decoder) value(c *Graph, v reflect.Value, path string) error {
+
+	switch v.Type() {
+	case graphType:
+		v.Set(reflect.ValueOf(c))
+		return nil
+	case graphType.Elem():
+		v.Set(reflect.ValueOf(c).Elem())
+		return nil
+	case durationType:
+		n, err := scalarOf(c, path)
+		if err != nil {
+			return err
+		}
+		switch x := n.This.(type) {
+		case Duration:
+			v.SetInt(int64(x.Duration))
+			return nil
+		case time.Duration:
+			v.SetInt(int64(x))
+			return nil
+		}
+		t, ok := parseDuration(n.String())
+		if !ok {
+			return decodeError(n, v, path)
+		}
+		v.SetInt(int64(t))
+		return nil
+	}
+
+	switch v.Kind() {
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(c, v.Elem(), path)
+
+	case reflect.Struct:
+		return d.object(c, v, path)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%s: cannot decode into %s, keys must be strings", pathOrRoot(path), v.Type())
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, n := range c.Out {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(n, e, joinPath(path, n.String())); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(n.String()).Convert(v.Type().Key()), e)
+		}
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			n, err := scalarOf(c, path)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(n.Bytes())
+			return nil
+		}
+		s := reflect.MakeSlice(v.Type(), 0, c.Len())
+		for i, n := range c.Out {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if isScalarType(e.Type()) {
+				n = &Graph{Out: []*Graph{n}}
+			}
+			if err := d.value(n, e, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return err
+			}
+			s = reflect.Append(s, e)
+		}
+		v.Set(s)
+		return nil
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("%s: cannot decode into %s", pathOrRoot(path), v.Type())
+		}
+		if c.Len() == 1 && c.Out[0].Len() == 0 {
+			v.Set(reflect.ValueOf(c.Out[0].Scalar()))
+		} else {
+			v.Set(reflect.ValueOf(c))
+		}
+		return nil
+	}
+
+	n, err := scalarOf(c, path)
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(n.String())
+		return nil
+	case reflect.Bool:
+		if b, ok := boolValue(n); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := _int64f(n)
+		if !ok {
+			i, ok = parseSize(n.String())
+		}
+		if ok && !v.OverflowInt(i) {
+			v.SetInt(i)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := _int64f(n)
+		if !ok {
+			i, ok = parseSize(n.String())
+		}
+		if ok && i >= 0 && !v.OverflowUint(uint64(i)) {
+			v.SetUint(uint64(i))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := _float64f(n.This); ok && !v.OverflowFloat(f) {
+			v.SetFloat(f)
+			return nil
+		}
+	default:
+		return fmt.Errorf("%s: cannot decode into %s", pathOrRoot(path), v.Type())
+	}
+
+	return decodeError(n, v, path)
+}
+
+// object fills a struct with the subnodes of c. Those not matching a field
+// go to the rest field, if there is one, or are recorded as unknown.
+func (d *decoder) object(c *Graph, v reflect.Value, path string) error {
+
+	fields := structFields(v.Type())
+
+	var rest []*Graph
+
+	for _, n := range c.Out {
+		if isComment(n) {
+			continue
+		}
+		f := fields.lookup(n.String())
+		if f == nil {
+			if fields.rest == nil {
+				d.unknown = append(d.unknown, joinPath(path, n.String()))
+			} else {
+				rest = append(rest, n)
+			}
+			continue
+		}
+		fv, err := fieldByIndex(v, f.index)
+		if err != nil {
+			return fmt.Errorf("%s: %v", joinPath(path, n.String()), err)
+		}
+		if err = d.value(n, fv, joinPath(path, n.String())); err != nil {
+			return err
+		}
+	}
+
+	if fields.rest == nil {
+		return nil
+	}
+
+	r := NilGraph()
+	for _, n := range rest {
+		r.Add(n)
+	}
+	fv, err := fieldByIndex(v, fields.rest)
+	if err != nil {
+		return fmt.Errorf("%s: %v", pathOrRoot(path), err)
+	}
+	if fv.Type() == graphType {
+		fv.Set(reflect.ValueOf(r))
+	} else if fv.Type() == graphType.Elem() {
+		fv.Set(reflect.ValueOf(r).Elem())
+	} else {
+		return fmt.Errorf("%s: rest field must be a *Graph, not %s", pathOrRoot(path), fv.Type())
+	}
+	return nil
+}
+
+// field is a struct field that keys can be decoded into.
+type field struct {
+	name  string
+	index []int
+	// tagged is true if the name comes from a tag
+	tagged bool
+}
+
+// fieldSet holds the fields of a struct, including those of embedded
+// structs, and the index of the rest field, if any.
+type fieldSet struct {
+	list []field
+	rest []int
+}
+
+// structFields returns the fields of t. Fields of t come before those of
+// its embedded structs, so that they take precedence.
+func structFields(t reflect.Type) *fieldSet {
+	fs := &fieldSet{}
+	fs.add(t, nil)
+	return fs
+}
+
+func (fs *fieldSet) add(t reflect.Type, index []int) {
+
+	var embedded []reflect.StructField
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("ogdl")
+		if tag == "-" {
+			continue
+		}
+		name := tag
+		opts := ""
+		if j := strings.IndexByte(tag, ','); j != -1 {
+			name, opts = tag[:j], tag[j+1:]
+		}
+
+		idx := append(append([]int{}, index...), i)
+
+		if opts == "rest" {
+			if fs.rest == nil {
+				fs.rest = idx
+			}
+			continue
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			// Pointers to unexported types cannot be allocated
+			if f.PkgPath == "" || f.Type.Kind() != reflect.Ptr {
+				f.Index = idx
+				embedded = append(embedded, f)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tagged := name != ""
+		if !tagged {
+			name = f.Name
+		}
+		fs.list = append(fs.list, field{name, idx, tagged})
+	}
+
+	for _, f := range embedded {
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		fs.add(ft, f.Index)
+	}
+}
+
+// lookup returns the field for a key: the first one with that exact name,
+// or else the first one whose untagged name matches ignoring case.
+func (fs *fieldSet) lookup(key string) *field {
+	for i := range fs.list {
+		if fs.list[i].name == key {
+			return &fs.list[i]
+		}
+	}
+	for i := range fs.list {
+		if !fs.list[i].tagged && strings.EqualFold(fs.list[i].name, key) {
+			return &fs.list[i]
+		}
+	}
+	return nil
+}
+
+// fieldByIndex returns the field of v with the given index, allocating the
+// embedded structs pointed to on the way.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return v, fmt.Errorf("cannot allocate %s", v.Type())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// isScalarType returns true if values of type t are decoded from a single
+// node.
+func isScalarType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr && t != graphType {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return false
+	case reflect.Ptr:
+		// *Graph
+		return false
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return true
+}
+
+// scalarOf returns the only subnode of c, which must be a leaf.
+func scalarOf(c *Graph, path string) (*Graph, error) {
+	if c.Len() != 1 || c.Out[0].Len() != 0 {
+		return nil, fmt.Errorf("%s: expected a single value", pathOrRoot(path))
+	}
+	return c.Out[0], nil
+}
+
+func decodeError(n *Graph, v reflect.Value, path string) error {
+	return fmt.Errorf("%s: %w: cannot decode %q into %s", pathOrRoot(path), ErrConversion, n.String(), v.Type())
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
@@ -0,0 +1,218 @@
+// Copyright 2012-2014, Rolf Veen and contributors.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ogdl
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// xmlNameless is the element written for nodes whose string is not a valid
+// XML name, which is then kept in the attribute xmlNameAttr.
+const (
+	xmlNameless = "_"
+	xmlNameAttr = "_name"
+)
+
+// XML converts a Graph to XML. Each node is written as an element with the
+// same name, and a node with a single leaf below it, as 'port 80', as an
+// element with text content. Subnodes starting with '@' that have a single
+// leaf below them are written as attributes:
+//
+//     server
+//       @id 1
+//       host example.com
+//       alias
+//         www
+//         web
+//
+// is written as
+//
+//     <server id="1">
+//       <host>example.com</host>
+//       <alias>
+//         <www/>
+//         <web/>
+//       </alias>
+//     </server>
+//
+// Nodes whose string is not a valid XML name are written as <_> elements,
+// with the string in the attribute _name. A transparent root is not written:
+// its subnodes are, and there should be only one for the result to be an XML
+// document.
+func (g *Graph) XML() []byte {
+
+	if g == nil {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	if g.IsNil() {
+		for _, n := range g.Out {
+			writeXML(buf, n, 0)
+		}
+	} else {
+		writeXML(buf, g, 0)
+	}
+	return buf.Bytes()
+}
+
+// writeXML writes g as an element, indented at the given level.
+func writeXML(buf *bytes.Buffer, g *Graph, level int) {
+
+	// Transparent nodes
+	if g.IsNil() {
+		for _, n := range g.Out {
+			writeXML(buf, n, level)
+		}
+		return
+	}
+
+	sp := strings.Repeat("  ", level)
+	s := g.String()
+
+	name := s
+	if !isXMLName(s) {
+		name = xmlNameless
+	}
+
+	buf.WriteString(sp)
+	buf.WriteByte('<')
+	buf.WriteString(name)
+	if name != s {
+		writeXMLAttr(buf, xmlNameAttr, s)
+	}
+
+	var content []*Graph
+	for _, n := range g.Out {
+		if a := n.String(); len(a) > 1 && a[0] == '@' && isXMLName(a[1:]) && isValueNode(n) {
+			writeXMLAttr(buf, a[1:], n.Out[0].String())
+		} else {
+			content = append(content, n)
+		}
+	}
+
+	switch {
+	case len(content) == 0:
+		buf.WriteString("/>\n")
+		return
+	case len(content) == 1 && content[0].Len() == 0 && !content[0].IsNil():
+		buf.WriteByte('>')
+		xml.EscapeText(buf, []byte(content[0].String()))
+	default:
+		buf.WriteString(">\n")
+		for _, n := range content {
+			writeXML(buf, n, level+1)
+		}
+		buf.WriteString(sp)
+	}
+
+	buf.WriteString("</")
+	buf.WriteString(name)
+	buf.WriteString(">\n")
+}
+
+func writeXMLAttr(buf *bytes.Buffer, name, value string) {
+	buf.WriteByte(' ')
+	buf.WriteString(name)
+	buf.WriteString(`="`)
+	xml.EscapeText(buf, []byte(value))
+	buf.WriteByte('"')
+}
+
+// isXMLName returns true if s can be used as an element or attribute name.
+func isXMLName(s string) bool {
+
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case unicode.IsLetter(c) || c == '_' || c == ':':
+		case i > 0 && (unicode.IsDigit(c) || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FromXML converts an XML document into a Graph. Elements become nodes,
+// attributes subnodes whose name starts with '@' and hold the value, and
+// non blank text leaf nodes. Names keep their namespace prefix, as in
+// soap:Body, and namespace declarations are kept as attributes, so that
+// XML returns an equivalent document. Comments and processing instructions
+// are ignored.
+//
+// This is the inverse of XML: <_> elements with a _name attribute become
+// nodes with that name.
+func FromXML(b []byte) (*Graph, error) {
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+
+	g := NilGraph()
+	stack := []*Graph{g}
+	var names []string
+
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		top := stack[len(stack)-1]
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			name := xmlName(t.Name)
+			n := NewGraph(name)
+			for _, a := range t.Attr {
+				if name == xmlNameless && a.Name.Space == "" && a.Name.Local == xmlNameAttr {
+					n.This = a.Value
+					continue
+				}
+				n.Add("@" + xmlName(a.Name)).Add(a.Value)
+			}
+			top.Add(n)
+			stack = append(stack, n)
+			names = append(names, name)
+
+		case xml.EndElement:
+			if len(names) == 0 || names[len(names)-1] != xmlName(t.Name) {
+				return nil, errors.New("xml: unexpected end element </" + xmlName(t.Name) + ">")
+			}
+			stack = stack[:len(stack)-1]
+			names = names[:len(names)-1]
+
+		case xml.CharData:
+			if s := strings.TrimSpace(string(t)); s != "" {
+				if len(stack) == 1 {
+					return nil, errors.New("xml: text outside of elements")
+				}
+				top.Add(s)
+			}
+		}
+	}
+
+	if len(names) != 0 {
+		return nil, errors.New("xml: unclosed element <" + names[len(names)-1] + ">")
+	}
+	return g, nil
+}
+
+// xmlName returns a name with its prefix, if any, as written in the source.
+func xmlName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}